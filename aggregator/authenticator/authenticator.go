@@ -32,25 +32,75 @@ type Authenticator struct {
 	privKey *rsa.PrivateKey
 	pubKey  *rsa.PublicKey
 	signer  *local.Signer
+
+	generation GenerationFunc
+	session    SessionFunc
+	certCheck  CertFunc
 }
 
+// GenerationFunc returns the current token generation of a user. Tokens
+// issued for an older generation are rejected, so bumping it (e.g. when the
+// password changes) invalidates all outstanding tokens of the user
+type GenerationFunc func(uid string) (int64, error)
+
+// SessionFunc returns an error if session sid of a user has been revoked or
+// has ended. Auth tokens carry their session id as the JWT ID
+type SessionFunc func(uid, sid string) error
+
+// CertFunc returns an error if the device certificate with serial (hex) has
+// been revoked, e.g. because the device was removed or the certificate renewed
+type CertFunc func(uid string, did int64, serial string) error
+
+var (
+	ErrInvalidCSR = errors.New("invalid certificate request")
+	// the common name of the request isn't DeviceCommonName of the device
+	ErrCSRSubjectMismatch = errors.New("certificate request is not for this device")
+)
+
 // content of JWT claim
 type Claims struct {
 	Type string
 	Uid  string
 	Did  int64
+	// whether user has passed two-factor authentication
+	MFA bool `json:",omitempty"`
+	// token generation of user when issued
+	Gen int64 `json:",omitempty"`
 	jwt.StandardClaims
 }
 
 const (
 	TokenVerifyType = "verify"
 	TokenAuthType   = "auth"
+	// issued after password is checked, can only be used to finish two-factor authentication
+	TokenChallengeType = "challenge"
+	// emailed to reset a forgotten password
+	TokenResetType = "reset"
+	// given to a reporter once its pairing code is approved, can only be used
+	// to sign in that device
+	TokenPairingType = "pairing"
 )
 
+// how long users have to finish two-factor authentication after password is checked
+const ChallengeTokenDuration = 5 * time.Minute
+
+// how long password reset links are valid
+const ResetTokenDuration = time.Hour
+
+// how long a reporter has to sign in after its pairing code is approved
+const PairingTokenDuration = 5 * time.Minute
+
+// how long device certificates are valid, reporters renew them before they expire
+const DeviceCertDuration = 30 * 24 * time.Hour
+
 var TokenDuration time.Duration
 
+// how long a session can be extended for after login
+var SessionMaxLifetime time.Duration
+
 func init() {
 	flag.DurationVar(&TokenDuration, "token_duration", 3*time.Hour, "validity duration of a token")
+	flag.DurationVar(&SessionMaxLifetime, "session_max_lifetime", 30*24*time.Hour, "how long after login a session ends, however often its token is extended")
 }
 
 // read or create root CA. This populates a.keyPEM and a.certPEM
@@ -128,9 +178,17 @@ func (a *Authenticator) GrpcCreds() (grpc.ServerOption, error) {
 
 }
 
-func (a *Authenticator) SignDeviceCert(uid string, did int64) (cert, key []byte, err error) {
+// common name of the certificate for device did of uid
+func DeviceCommonName(uid string, did int64) string {
+	return fmt.Sprintf("%d@%s.productimon.com", did, uid)
+}
+
+// Create a new key and certificate for device did of uid, serial is its serial
+// number in hex. Only for reporters that can't generate their own key, see
+// SignDeviceCSR
+func (a *Authenticator) SignDeviceCert(uid string, did int64) (cert, key []byte, serial string, err error) {
 	mycsr := &csr.CertificateRequest{
-		CN: fmt.Sprintf("%d@%s.productimon.com", did, uid),
+		CN: DeviceCommonName(uid, did),
 		KeyRequest: &csr.KeyRequest{
 			A: "rsa",
 			S: 2048,
@@ -147,28 +205,140 @@ func (a *Authenticator) SignDeviceCert(uid string, did int64) (cert, key []byte,
 	}
 	csrPEM, key, err := csr.ParseRequest(mycsr)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
+	}
+	if cert, serial, err = a.signDeviceRequest(csrPEM); err != nil {
+		return nil, nil, "", err
 	}
+	return cert, key, serial, nil
+}
+
+// Sign a PEM certificate request generated by device did of uid, its
+// subject must have the device's common name
+func (a *Authenticator) SignDeviceCSR(uid string, did int64, csrPEM []byte) (cert []byte, serial string, err error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, "", ErrInvalidCSR
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, "", ErrInvalidCSR
+	}
+	if err = req.CheckSignature(); err != nil {
+		return nil, "", ErrInvalidCSR
+	}
+	if req.Subject.CommonName != DeviceCommonName(uid, did) {
+		return nil, "", ErrCSRSubjectMismatch
+	}
+	return a.signDeviceRequest(csrPEM)
+}
+
+func (a *Authenticator) signDeviceRequest(csrPEM []byte) (cert []byte, serial string, err error) {
 	req := signer.SignRequest{
 		Hosts:    []string{},
 		Request:  string(csrPEM),
-		NotAfter: time.Now().Add(30 * 24 * time.Hour),
+		NotAfter: time.Now().Add(DeviceCertDuration),
 	}
-	cert, err = a.signer.Sign(req)
-	return
+	if cert, err = a.signer.Sign(req); err != nil {
+		return nil, "", err
+	}
+	block, _ := pem.Decode(cert)
+	if block == nil {
+		return nil, "", errors.New("signer returned invalid certificate")
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	return cert, parsed.SerialNumber.Text(16), nil
 }
 
-// Create a new JWT token for given uid
-func (a *Authenticator) SignToken(uid string) (string, error) {
+// Create a new JWT token for session sid of given uid, valid for TokenDuration
+// but not past sessionEnd. mfa is whether user has passed two-factor authentication
+func (a *Authenticator) SignToken(uid, sid string, mfa bool, sessionEnd time.Time) (string, error) {
 	expirationTime := time.Now().Add(TokenDuration)
+	if expirationTime.After(sessionEnd) {
+		expirationTime = sessionEnd
+	}
 	claims := Claims{
 		Type: TokenAuthType,
 		Uid:  uid,
 		Did:  -1,
+		MFA:  mfa,
 		StandardClaims: jwt.StandardClaims{
+			Id:        sid,
 			ExpiresAt: expirationTime.Unix(),
 		},
 	}
+	return a.signUserToken(claims)
+}
+
+// Create a new two-factor authentication challenge token for given uid
+func (a *Authenticator) SignChallengeToken(uid string) (string, error) {
+	claims := Claims{
+		Type: TokenChallengeType,
+		Uid:  uid,
+		Did:  -1,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(ChallengeTokenDuration).Unix(),
+		},
+	}
+	return a.signUserToken(claims)
+}
+
+// Create a new password reset token for given uid. It's invalidated once the
+// password is reset as that bumps the user's token generation
+func (a *Authenticator) SignResetToken(uid string) (string, error) {
+	claims := Claims{
+		Type: TokenResetType,
+		Uid:  uid,
+		Did:  -1,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(ResetTokenDuration).Unix(),
+		},
+	}
+	return a.signUserToken(claims)
+}
+
+// Create a new pairing token for uid, pairing is the id of the approved pairing
+func (a *Authenticator) SignPairingToken(uid, pairing string) (string, error) {
+	claims := Claims{
+		Type: TokenPairingType,
+		Uid:  uid,
+		Did:  -1,
+		StandardClaims: jwt.StandardClaims{
+			Id:        pairing,
+			ExpiresAt: time.Now().Add(PairingTokenDuration).Unix(),
+		},
+	}
+	return a.signUserToken(claims)
+}
+
+// Set how to look up token generations of users, all generations are 0 if not set
+func (a *Authenticator) SetGenerationFunc(f GenerationFunc) {
+	a.generation = f
+}
+
+// Set how to check sessions of auth tokens, sessions are not checked if not set
+func (a *Authenticator) SetSessionFunc(f SessionFunc) {
+	a.session = f
+}
+
+// Set how to check device certificates for revocation, any certificate
+// signed by us is accepted if not set
+func (a *Authenticator) SetCertFunc(f CertFunc) {
+	a.certCheck = f
+}
+
+// sign claims of a token issued to claims.Uid with their current generation
+func (a *Authenticator) signUserToken(claims Claims) (string, error) {
+	if a.generation != nil {
+		gen, err := a.generation(claims.Uid)
+		if err != nil {
+			return "", err
+		}
+		claims.Gen = gen
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 	return token.SignedString(a.privKey)
 }
@@ -183,8 +353,8 @@ func (a *Authenticator) SignVerificationToken(email string) (string, error) {
 	return token.SignedString(a.privKey)
 }
 
-// Return uid for a given JWT token
-func (a *Authenticator) VerifyToken(token string) (uid string, did int64, err error) {
+// Return claims of a given JWT token of type typ
+func (a *Authenticator) verifyToken(token, typ string) (*Claims, error) {
 	claims := &Claims{}
 
 	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodRS256.Name}}
@@ -193,20 +363,65 @@ func (a *Authenticator) VerifyToken(token string) (uid string, did int64, err er
 	})
 
 	if err != nil {
-		return "", -1, err
+		return nil, err
 	}
 
 	if !tkn.Valid {
-		return "", -1, errors.New("token is invalid")
+		return nil, errors.New("token is invalid")
+	}
+
+	if claims.Type != typ {
+		return nil, errors.New("invalid type")
 	}
 
-	if claims.Type != TokenAuthType {
-		return "", -1, errors.New("invalid type")
+	if a.generation != nil {
+		gen, err := a.generation(claims.Uid)
+		if err != nil {
+			return nil, err
+		}
+		if claims.Gen != gen {
+			return nil, errors.New("token has been revoked")
+		}
+	}
+
+	if typ == TokenAuthType && a.session != nil {
+		if err := a.session(claims.Uid, claims.Id); err != nil {
+			return nil, err
+		}
 	}
 
+	return claims, nil
+}
+
+// Return uid for a given JWT token
+func (a *Authenticator) VerifyToken(token string) (uid string, did int64, err error) {
+	claims, err := a.verifyToken(token, TokenAuthType)
+	if err != nil {
+		return "", -1, err
+	}
 	return claims.Uid, claims.Did, nil
 }
 
+// Return uid for a given two-factor authentication challenge token
+func (a *Authenticator) VerifyChallengeToken(token string) (uid string, err error) {
+	claims, err := a.verifyToken(token, TokenChallengeType)
+	if err != nil {
+		return "", err
+	}
+	return claims.Uid, nil
+}
+
+// Return uid and the token generation it was issued for of a given password
+// reset token. Resetting the password must bump exactly that generation, so
+// the token can only be used once
+func (a *Authenticator) VerifyResetToken(token string) (uid string, gen int64, err error) {
+	claims, err := a.verifyToken(token, TokenResetType)
+	if err != nil {
+		return "", 0, err
+	}
+	return claims.Uid, claims.Gen, nil
+}
+
 // Return email for a given JWT verification token
 func (a *Authenticator) VerifyVerificationToken(token string) (email string, err error) {
 	claims := &Claims{}
@@ -250,11 +465,24 @@ func (a *Authenticator) verifyCert(cert *x509.Certificate) (uid string, did int6
 		return "", -1, errors.New("invalid certificate commonname")
 	}
 	uid = uid[0 : len(uid)-len(".productimon.com")]
+	if a.certCheck != nil {
+		if err = a.certCheck(uid, did, cert.SerialNumber.Text(16)); err != nil {
+			return "", -1, err
+		}
+	}
 	log.Printf("verified %s %d", uid, did)
 	return
 }
 
 func (a *Authenticator) AuthenticateRequest(ctx context.Context) (uid string, did int64, err error) {
+	uid, did, _, err = a.AuthenticateRequestMFA(ctx)
+	return
+}
+
+// Like AuthenticateRequest but also returns whether the user has passed
+// two-factor authentication. Device certificates are only issued to tokens
+// that have, so they always count as passed
+func (a *Authenticator) AuthenticateRequestMFA(ctx context.Context) (uid string, did int64, mfa bool, err error) {
 	peer, ok := peer.FromContext(ctx)
 	if ok {
 		tlsinfo, ok := peer.AuthInfo.(credentials.TLSInfo)
@@ -264,21 +492,76 @@ func (a *Authenticator) AuthenticateRequest(ctx context.Context) (uid string, di
 				uid, did, err = a.verifyCert(certs[0])
 				if err == nil {
 					log.Println(err)
-					return
+					return uid, did, true, nil
 				}
 			}
 		}
 	}
 
+	auth, err := authorizationHeader(ctx)
+	if err != nil {
+		return "", -1, false, err
+	}
+	claims, err := a.verifyToken(auth, TokenAuthType)
+	if err != nil {
+		return "", -1, false, err
+	}
+	return claims.Uid, claims.Did, claims.MFA, nil
+}
+
+// DeviceCertSerial returns the serial (hex) of the client certificate the
+// request was made with, or "" if there is none. This doesn't verify it
+func DeviceCertSerial(ctx context.Context) string {
+	if peer, ok := peer.FromContext(ctx); ok {
+		if tlsinfo, ok := peer.AuthInfo.(credentials.TLSInfo); ok && len(tlsinfo.State.PeerCertificates) > 0 {
+			return tlsinfo.State.PeerCertificates[0].SerialNumber.Text(16)
+		}
+	}
+	return ""
+}
+
+// Return claims of the auth token in request, unlike AuthenticateRequest
+// device certificates are not accepted
+func (a *Authenticator) AuthenticateToken(ctx context.Context) (*Claims, error) {
+	auth, err := authorizationHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return a.verifyToken(auth, TokenAuthType)
+}
+
+// Return uid of the two-factor authentication challenge token in request
+func (a *Authenticator) AuthenticateChallenge(ctx context.Context) (uid string, err error) {
+	auth, err := authorizationHeader(ctx)
+	if err != nil {
+		return "", err
+	}
+	return a.VerifyChallengeToken(auth)
+}
+
+// Return uid and pairing id of the pairing token in request
+func (a *Authenticator) AuthenticatePairing(ctx context.Context) (uid, pairing string, err error) {
+	auth, err := authorizationHeader(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	claims, err := a.verifyToken(auth, TokenPairingType)
+	if err != nil {
+		return "", "", err
+	}
+	return claims.Uid, claims.Id, nil
+}
+
+func authorizationHeader(ctx context.Context) (string, error) {
 	headers, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return "", -1, errors.New("metadata is not available")
+		return "", errors.New("metadata is not available")
 	}
 	auth := headers.Get("Authorization")
 	if len(auth) != 1 {
-		return "", -1, errors.New("authorization is missing")
+		return "", errors.New("authorization is missing")
 	}
-	return a.VerifyToken(auth[0])
+	return auth[0], nil
 }
 
 func (a Authenticator) CertPEM() []byte {
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/storage"
+	"go.uber.org/zap"
+)
+
+// Migration is a single forward-only schema change.
+//
+// schema.sql is the baseline (version 1). Every later change is a file under
+// migrations/ named NNNN_description.sql, where NNNN is the version it brings
+// the database to. Never edit a migration that has been released; add a new one.
+//
+// Migrations should be written in portable SQL (e.g. BIGINT for timestamps).
+// When that's not possible, a backend-specific variant can be provided as
+// NNNN_description.<backend>.sql (or schema.<backend>.sql for the baseline),
+// which is used instead of the portable file for that backend.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+const BaselineVersion = 1
+
+var rxMigration = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)(?:\.([a-z0-9]+))?\.sql$`)
+
+// Return all known migrations for backend ordered by version, including the baseline.
+func Migrations(backend string) ([]Migration, error) {
+	baseline, ok := Data["schema."+backend+".sql"]
+	if !ok {
+		baseline = Data["schema.sql"]
+	}
+	migrations := []Migration{{Version: BaselineVersion, Name: "schema", SQL: string(baseline)}}
+	seen := make(map[int]string)
+	overrides := make(map[int]Migration)
+	for filename, content := range Data {
+		m := rxMigration.FindStringSubmatch(filename)
+		if m == nil {
+			continue
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %v", filename, err)
+		}
+		if version <= BaselineVersion {
+			return nil, fmt.Errorf("migration %s must have a version greater than %d", filename, BaselineVersion)
+		}
+		migration := Migration{Version: version, Name: m[2], SQL: string(content)}
+		switch m[3] {
+		case "":
+		case backend:
+			overrides[version] = migration
+			continue
+		default:
+			continue
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", filename, other)
+		}
+		seen[version] = filename
+		migrations = append(migrations, migration)
+	}
+	for i, m := range migrations {
+		if o, ok := overrides[m.Version]; ok {
+			migrations[i] = o
+			delete(overrides, m.Version)
+		}
+	}
+	for version := range overrides {
+		return nil, fmt.Errorf("migration %d has a %s variant but no portable version", version, backend)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Return the current schema version of the database.
+//
+// Databases created before schema_version existed are reported as the
+// baseline version, and fresh databases as 0.
+func CurrentVersion(db *storage.DB) int {
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err == nil && version > 0 {
+		return version
+	}
+	// no schema_version record, check whether this is a pre-migration database
+	if _, err := db.Exec("SELECT 1 FROM users LIMIT 1"); err == nil {
+		return BaselineVersion
+	}
+	return 0
+}
+
+// Bring the database schema up to date, returning migrations that are (or
+// would be, if dryRun is set) applied. Each migration runs in its own
+// transaction together with its schema_version record.
+func Migrate(db *storage.DB, dryRun bool, logger *zap.Logger) ([]Migration, error) {
+	migrations, err := Migrations(db.Name())
+	if err != nil {
+		return nil, err
+	}
+	return migrate(db, migrations, dryRun, logger)
+}
+
+// current version of db and the migrations it doesn't have yet
+func pendingMigrations(db *storage.DB, migrations []Migration) (int, []Migration, error) {
+	version := CurrentVersion(db)
+	latest := migrations[len(migrations)-1].Version
+	if version > latest {
+		return 0, nil, fmt.Errorf("database schema version %d is newer than the latest known version %d", version, latest)
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return version, pending, nil
+}
+
+func migrate(db *storage.DB, migrations []Migration, dryRun bool, logger *zap.Logger) ([]Migration, error) {
+	_, pending, err := pendingMigrations(db, migrations)
+	if err != nil || dryRun || len(pending) == 0 {
+		return pending, err
+	}
+
+	// another aggregator may be migrating the same database, wait until it's
+	// done and look again at what's left
+	unlock, err := db.LockMigrations()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			logger.Error("can't release migration lock", zap.Error(err))
+		}
+	}()
+	version, pending, err := pendingMigrations(db, migrations)
+	if err != nil || len(pending) == 0 {
+		return pending, err
+	}
+
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at BIGINT NOT NULL)"); err != nil {
+		return nil, err
+	}
+	if version == BaselineVersion {
+		// pre-migration database, record the baseline we detected
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			if _, err := db.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", BaselineVersion, migrations[0].Name, time.Now().UnixNano()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i, m := range pending {
+		logger.Info("applying database migration", zap.Int("version", m.Version), zap.String("name", m.Name))
+		tx, err := db.Begin()
+		if err != nil {
+			return pending[:i], err
+		}
+		if _, err = tx.Exec(m.SQL); err != nil {
+			tx.Rollback()
+			return pending[:i], fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+		if _, err = tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now().UnixNano()); err != nil {
+			tx.Rollback()
+			return pending[:i], err
+		}
+		if err = tx.Commit(); err != nil {
+			return pending[:i], err
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/storage"
+	_ "git.yiad.am/productimon/aggregator/storage/postgres"
+	_ "git.yiad.am/productimon/aggregator/storage/sqlite"
+	"go.uber.org/zap"
+)
+
+// PostgreSQL database to run TestMigrateConcurrentPostgres against, see
+// aggregator/service/backends_test.go
+const postgresDSNEnv = "PRODUCTIMON_TEST_POSTGRES_DSN"
+
+func openTestDB(t *testing.T) *storage.DB {
+	dir, err := ioutil.TempDir("", "migrate_test")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := storage.Open("sqlite3", filepath.Join(dir, "db.sqlite3"))
+	if err != nil {
+		t.Fatalf("can't open database: %v", err)
+	}
+	return db
+}
+
+func testMigrations(t *testing.T) []Migration {
+	migrations, err := Migrations("sqlite3")
+	if err != nil {
+		t.Fatalf("Migrations failed: %v", err)
+	}
+	return append(migrations,
+		Migration{Version: 1000, Name: "add_foo", SQL: "CREATE TABLE foo (id INTEGER PRIMARY KEY);"},
+		Migration{Version: 1001, Name: "add_bar", SQL: "CREATE TABLE bar (id INTEGER PRIMARY KEY); INSERT INTO foo VALUES (1);"},
+	)
+}
+
+func TestMigrationsOrdered(t *testing.T) {
+	for _, backend := range []string{"sqlite3", "postgres"} {
+		migrations, err := Migrations(backend)
+		if err != nil {
+			t.Fatalf("Migrations(%s) failed: %v", backend, err)
+		}
+		if migrations[0].Version != BaselineVersion {
+			t.Errorf("first %s migration should be baseline, got %d", backend, migrations[0].Version)
+		}
+		for i := 1; i < len(migrations); i++ {
+			if migrations[i].Version <= migrations[i-1].Version {
+				t.Errorf("%s migration %d is not after %d", backend, migrations[i].Version, migrations[i-1].Version)
+			}
+		}
+	}
+}
+
+func TestMigrateFresh(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	migrations := testMigrations(t)
+
+	pending, err := migrate(db, migrations, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if len(pending) != len(migrations) {
+		t.Errorf("dry run should report all %d migrations pending, got %d", len(migrations), len(pending))
+	}
+	if v := CurrentVersion(db); v != 0 {
+		t.Errorf("dry run should not touch database, got version %d", v)
+	}
+
+	if _, err = migrate(db, migrations, false, zap.NewNop()); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if v := CurrentVersion(db); v != 1001 {
+		t.Errorf("expected version 1001, got %d", v)
+	}
+	var n int
+	if err = db.QueryRow("SELECT COUNT(*) FROM foo").Scan(&n); err != nil || n != 1 {
+		t.Errorf("migration was not applied: %d %v", n, err)
+	}
+
+	// running again is a no-op
+	pending, err = migrate(db, migrations, false, zap.NewNop())
+	if err != nil || len(pending) != 0 {
+		t.Errorf("second migrate should be a no-op, got %d pending, err %v", len(pending), err)
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	if _, err := db.Exec(string(Data["schema.sql"])); err != nil {
+		t.Fatalf("can't create legacy schema: %v", err)
+	}
+	if v := CurrentVersion(db); v != BaselineVersion {
+		t.Errorf("legacy database should be at baseline, got %d", v)
+	}
+	migrations := testMigrations(t)
+	applied, err := migrate(db, migrations, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if len(applied) != len(migrations)-1 {
+		t.Errorf("baseline should not be re-applied, got %d applied", len(applied))
+	}
+	if v := CurrentVersion(db); v != 1001 {
+		t.Errorf("expected version 1001, got %d", v)
+	}
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	migrations, err := Migrations("sqlite3")
+	if err != nil {
+		t.Fatalf("Migrations failed: %v", err)
+	}
+	latest := migrations[len(migrations)-1].Version
+	migrations = append(migrations, Migration{Version: latest + 1, Name: "broken", SQL: "CREATE TABLE baz (id INTEGER); SELECT * FROM nonexistent;"})
+	if _, err = migrate(db, migrations, false, zap.NewNop()); err == nil {
+		t.Fatalf("broken migration should fail")
+	}
+	if v := CurrentVersion(db); v != latest {
+		t.Errorf("expected version %d after failed migration, got %d", latest, v)
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	migrations := testMigrations(t)
+	if _, err := migrate(db, migrations, false, zap.NewNop()); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if _, err := migrate(db, migrations[:len(migrations)-1], false, zap.NewNop()); err == nil {
+		t.Errorf("should refuse to run against a newer database")
+	}
+}
+
+// dsn with search_path set to name, in either URL or key=value form
+func withSearchPath(dsn, name string) string {
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " search_path=" + name
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&search_path=" + name
+	}
+	return dsn + "?search_path=" + name
+}
+
+// aggregators starting at the same time apply each migration once
+func TestMigrateConcurrentPostgres(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skip(postgresDSNEnv + " is not set")
+	}
+	admin, err := storage.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("can't open database: %v", err)
+	}
+	defer admin.Close()
+	name := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + name); err != nil {
+		t.Fatalf("can't create schema: %v", err)
+	}
+	defer admin.Exec("DROP SCHEMA " + name + " CASCADE")
+
+	const n = 3
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		db, err := storage.Open("postgres", withSearchPath(dsn, name))
+		if err != nil {
+			t.Fatalf("can't open database: %v", err)
+		}
+		defer db.Close()
+		go func() {
+			_, err := Migrate(db, false, zap.NewNop())
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Migrate failed: %v", err)
+		}
+	}
+
+	migrations, err := Migrations("postgres")
+	if err != nil {
+		t.Fatalf("Migrations failed: %v", err)
+	}
+	db, err := storage.Open("postgres", withSearchPath(dsn, name))
+	if err != nil {
+		t.Fatalf("can't open database: %v", err)
+	}
+	defer db.Close()
+	var count, versions int
+	if err = db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT version) FROM schema_version").Scan(&count, &versions); err != nil {
+		t.Fatalf("can't read schema_version: %v", err)
+	}
+	if count != len(migrations) || versions != len(migrations) {
+		t.Errorf("schema_version has %d records of %d versions, want %d of each", count, versions, len(migrations))
+	}
+}
@@ -0,0 +1,9 @@
+-- devices a goal is limited to. a goal without any rows here applies to all devices
+CREATE TABLE goal_devices (
+  uid CHAR(36) NOT NULL,
+  gid BIGINT NOT NULL,
+  did BIGINT NOT NULL,
+  PRIMARY KEY(uid, gid, did),
+  FOREIGN KEY (uid, gid) REFERENCES goals(uid, id) ON DELETE CASCADE,
+  FOREIGN KEY (uid, did) REFERENCES devices(uid, id) ON DELETE CASCADE
+);
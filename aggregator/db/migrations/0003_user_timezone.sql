@@ -0,0 +1,2 @@
+-- IANA time zone name, server default if empty
+ALTER TABLE users ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,14 @@
+-- 0 for one-off goals, otherwise common.Goal.Recurrence
+ALTER TABLE goals ADD COLUMN recurrence INTEGER NOT NULL DEFAULT 0;
+
+-- results of closed periods of recurring goals
+CREATE TABLE goal_periods (
+  uid CHAR(36) NOT NULL,
+  gid BIGINT NOT NULL,
+  starttime BIGINT NOT NULL,
+  endtime BIGINT NOT NULL,
+  progress BIGINT NOT NULL, -- out of 1000
+  succeeded BOOLEAN NOT NULL,
+  PRIMARY KEY(uid, gid, starttime),
+  FOREIGN KEY (uid, gid) REFERENCES goals(uid, id) ON DELETE CASCADE
+);
@@ -0,0 +1,4 @@
+-- notification channel of a goal (email/sms/device/webhook), account email if empty
+ALTER TABLE goals ADD COLUMN notify_kind VARCHAR(16) NOT NULL DEFAULT '';
+-- email address, phone number, device id or URL
+ALTER TABLE goals ADD COLUMN notify_target VARCHAR(2048) NOT NULL DEFAULT '';
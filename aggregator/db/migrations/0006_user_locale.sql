@@ -0,0 +1,2 @@
+-- BCP 47 language tag of notification messages, server default if empty
+ALTER TABLE users ADD COLUMN locale VARCHAR(35) NOT NULL DEFAULT '';
@@ -0,0 +1,47 @@
+-- comma-separated progress percentages goal notifications are sent at, default if empty
+ALTER TABLE users ADD COLUMN notify_thresholds VARCHAR(64) NOT NULL DEFAULT '';
+-- notifications are held back and sent as a digest between these minutes of day (user's timezone), disabled if equal
+ALTER TABLE users ADD COLUMN quiet_hours_start INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN quiet_hours_end INTEGER NOT NULL DEFAULT 0;
+-- maximum notifications sent per day (user's timezone), unlimited if 0
+ALTER TABLE users ADD COLUMN max_daily_notifications INTEGER NOT NULL DEFAULT 0;
+-- overrides users.notify_thresholds if not empty
+ALTER TABLE goals ADD COLUMN notify_thresholds VARCHAR(64) NOT NULL DEFAULT '';
+
+-- thresholds already notified for each goal period
+CREATE TABLE goal_notifications (
+  uid CHAR(36) NOT NULL,
+  gid BIGINT NOT NULL,
+  period_start BIGINT NOT NULL, -- goals.starttime of the period
+  threshold INTEGER NOT NULL, -- percent
+  fired_at BIGINT NOT NULL,
+  PRIMARY KEY(uid, gid, period_start, threshold),
+  FOREIGN KEY (uid, gid) REFERENCES goals(uid, id) ON DELETE CASCADE
+);
+
+-- notifications held back during quiet hours, to be sent as a digest
+CREATE TABLE pending_notifications (
+  uid CHAR(36) NOT NULL,
+  kind VARCHAR(16) NOT NULL,
+  recipient VARCHAR(2048) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  body TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  FOREIGN KEY (uid) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX pending_notifications_uid ON pending_notifications(uid);
+
+-- notifications sent recently, used for the daily cap
+CREATE TABLE notification_log (
+  uid CHAR(36) NOT NULL,
+  kind VARCHAR(16) NOT NULL,
+  sent_at BIGINT NOT NULL,
+  FOREIGN KEY (uid) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX notification_log_uid_sent_at ON notification_log(uid, sent_at);
+
+-- goals notified before thresholds were recorded used to fire at 85% and 100%
+INSERT INTO goal_notifications (uid, gid, period_start, threshold, fired_at)
+  SELECT uid, id, starttime, 85, 0 FROM goals WHERE progress >= 850;
+INSERT INTO goal_notifications (uid, gid, period_start, threshold, fired_at)
+  SELECT uid, id, starttime, 100, 0 FROM goals WHERE progress >= 1000;
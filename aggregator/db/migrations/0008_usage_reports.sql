@@ -0,0 +1,8 @@
+-- usage summary reports, 0: never, 1: daily, 2: weekly
+ALTER TABLE users ADD COLUMN report_frequency INTEGER NOT NULL DEFAULT 0;
+-- minute of day (user's timezone) reports are sent at
+ALTER TABLE users ADD COLUMN report_time INTEGER NOT NULL DEFAULT 0;
+-- day of week weekly reports are sent on, 0 is Sunday
+ALTER TABLE users ADD COLUMN report_weekday INTEGER NOT NULL DEFAULT 1;
+-- end of the last period a report was sent for
+ALTER TABLE users ADD COLUMN last_report_at BIGINT NOT NULL DEFAULT 0;
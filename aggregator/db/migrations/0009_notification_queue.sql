@@ -0,0 +1,18 @@
+-- html version of held back notifications, empty if there isn't one
+ALTER TABLE pending_notifications ADD COLUMN html TEXT NOT NULL DEFAULT '';
+
+-- notifications that failed to send, retried with exponential backoff
+CREATE TABLE notification_queue (
+  uid CHAR(36) NOT NULL,
+  kind VARCHAR(16) NOT NULL,
+  recipient VARCHAR(2048) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  body TEXT NOT NULL,
+  html TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  attempts INTEGER NOT NULL,
+  next_attempt_at BIGINT NOT NULL,
+  last_error TEXT NOT NULL,
+  FOREIGN KEY (uid) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX notification_queue_next_attempt_at ON notification_queue(next_attempt_at);
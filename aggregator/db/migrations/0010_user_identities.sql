@@ -0,0 +1,9 @@
+-- accounts at OpenID Connect providers users sign in with
+CREATE TABLE user_identities (
+  issuer VARCHAR(255) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  uid CHAR(36) NOT NULL,
+  PRIMARY KEY(issuer, subject),
+  FOREIGN KEY (uid) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX user_identities_uid ON user_identities(uid);
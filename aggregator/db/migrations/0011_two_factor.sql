@@ -0,0 +1,19 @@
+-- base32 TOTP secret, set but not enabled while enrollment is pending
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+-- time step of the last accepted code, older codes are rejected to prevent replays
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- unused two-factor recovery codes
+CREATE TABLE recovery_codes (
+  uid CHAR(36) NOT NULL,
+  code_hash CHAR(64) NOT NULL, -- hex sha256
+  PRIMARY KEY(uid, code_hash),
+  FOREIGN KEY (uid) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- settings admins can change at runtime
+CREATE TABLE server_settings (
+  name VARCHAR(64) PRIMARY KEY,
+  value VARCHAR(255) NOT NULL
+);
@@ -0,0 +1,2 @@
+-- bumped to invalidate all outstanding tokens of a user, e.g. when the password changes
+ALTER TABLE users ADD COLUMN token_generation BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,13 @@
+-- logins, auth tokens carry the session id and are rejected once it's deleted
+CREATE TABLE sessions (
+  id CHAR(36) PRIMARY KEY,
+  uid CHAR(36) NOT NULL,
+  user_agent VARCHAR(255) NOT NULL DEFAULT '',
+  created_at BIGINT NOT NULL, -- nanoseconds
+  -- when a token was last issued for it
+  refreshed_at BIGINT NOT NULL,
+  -- tokens can't be extended past this
+  expires_at BIGINT NOT NULL,
+  FOREIGN KEY (uid) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX sessions_uid ON sessions(uid);
@@ -0,0 +1,5 @@
+-- serial (hex) of the device's current certificate, any other is revoked.
+-- empty for devices signed in before this was recorded
+ALTER TABLE devices ADD COLUMN cert_serial VARCHAR(64) NOT NULL DEFAULT '';
+-- removed devices can't report anymore, their history is kept
+ALTER TABLE devices ADD COLUMN removed BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,16 @@
+-- reporters waiting for a user to approve their pairing code, see service/pairing.go
+CREATE TABLE device_pairings (
+  -- sha256 (hex) of the secret the reporter polls with
+  id CHAR(64) PRIMARY KEY,
+  -- shown by the reporter and entered by the user, without the dash
+  code VARCHAR(16) NOT NULL UNIQUE,
+  device_name VARCHAR(255) NOT NULL,
+  device_kind INTEGER NOT NULL,
+  -- ip address that requested the code, for rate limiting
+  remote_addr VARCHAR(64) NOT NULL,
+  -- user who approved the pairing, empty until then
+  uid VARCHAR(36) NOT NULL DEFAULT '',
+  created_at BIGINT NOT NULL, -- nanoseconds
+  expires_at BIGINT NOT NULL,
+  polled_at BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,13 @@
+-- state of each device's open interval, see analyzer/deviceState. Events after
+-- last_eid haven't been applied yet and are replayed on startup
+CREATE TABLE device_states (
+  uid CHAR(36) NOT NULL,
+  did INTEGER NOT NULL,
+  last_eid BIGINT NOT NULL,
+  app VARCHAR(255) NOT NULL,
+  starttime BIGINT NOT NULL,
+  activetime BIGINT NOT NULL,
+  running BOOLEAN NOT NULL,
+  PRIMARY KEY (uid, did),
+  FOREIGN KEY (uid, did) REFERENCES devices(uid, id) ON DELETE CASCADE
+);
@@ -0,0 +1,11 @@
+-- events a device's queue stopped waiting for, see analyzer/deviceState
+CREATE TABLE event_gaps (
+  uid CHAR(36) NOT NULL,
+  did INTEGER NOT NULL,
+  first_eid BIGINT NOT NULL,
+  last_eid BIGINT NOT NULL,
+  skipped_at BIGINT NOT NULL,
+  reason VARCHAR(32) NOT NULL,
+  FOREIGN KEY (uid, did) REFERENCES devices(uid, id) ON DELETE CASCADE
+);
+CREATE INDEX event_gaps_device ON event_gaps (uid, did, skipped_at);
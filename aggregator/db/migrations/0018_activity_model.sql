@@ -0,0 +1,5 @@
+-- activity events count as active time with at least this many keystrokes or mouse clicks per minute, server default if 0
+ALTER TABLE users ADD COLUMN min_keystrokes_per_minute INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN min_clicks_per_minute INTEGER NOT NULL DEFAULT 0;
+-- nanoseconds each input keeps the user active for, server default if 0
+ALTER TABLE users ADD COLUMN idle_gap BIGINT NOT NULL DEFAULT 0;
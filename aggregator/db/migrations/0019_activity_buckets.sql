@@ -0,0 +1,10 @@
+-- active time of each interval per minute, so intervals cut by a time range get the active time in it
+CREATE TABLE activity_buckets (
+  uid CHAR(36) NOT NULL,
+  did INTEGER NOT NULL,
+  starttime BIGINT NOT NULL, -- intervals.starttime
+  minute BIGINT NOT NULL, -- unix nanoseconds at the start of the minute
+  activetime BIGINT NOT NULL,
+  PRIMARY KEY (uid, did, starttime, minute),
+  FOREIGN KEY (uid, did) REFERENCES devices(uid, id) ON DELETE CASCADE
+);
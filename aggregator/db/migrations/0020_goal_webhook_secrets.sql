@@ -0,0 +1,3 @@
+-- key webhook notifications of the goal are signed with, generated when its webhook URL is set.
+-- Webhooks set before this have none and aren't sent until the goal is edited
+ALTER TABLE goals ADD COLUMN notify_secret VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,94 @@
+CREATE TABLE users (
+  id CHAR(36) PRIMARY KEY,
+  email VARCHAR(255) NOT NULL UNIQUE,
+  password VARCHAR(255) NOT NULL,
+  verified BOOLEAN NOT NULL DEFAULT FALSE,
+  admin BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE devices (
+  uid CHAR(36) NOT NULL,
+  id BIGINT NOT NULL,
+  name VARCHAR(255) NOT NULL,
+  kind BIGINT NOT NULL,
+  PRIMARY KEY(uid, id),
+  FOREIGN KEY(uid) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE events (
+  uid CHAR(36) NOT NULL,
+  did BIGINT NOT NULL,
+  id BIGINT NOT NULL,
+  kind BIGINT NOT NULL,
+  starttime BIGINT NOT NULL,
+  endtime BIGINT NOT NULL,
+  PRIMARY KEY(uid, did, id),
+  FOREIGN KEY (uid, did) REFERENCES devices(uid, id) ON DELETE CASCADE
+);
+
+CREATE TABLE intervals (
+  uid CHAR(36) NOT NULL,
+  did BIGINT NOT NULL,
+  starttime BIGINT NOT NULL,
+  endtime BIGINT NOT NULL,
+  activetime BIGINT NOT NULL,
+  app VARCHAR(255) NOT NULL,
+  PRIMARY KEY(uid, did, starttime),
+  FOREIGN KEY (uid, did) REFERENCES devices(uid, id) ON DELETE CASCADE
+);
+
+CREATE TABLE default_apps (
+  name VARCHAR(255) PRIMARY KEY,
+  label VARCHAR(255)
+);
+
+CREATE TABLE user_apps (
+  name VARCHAR(255),
+  uid CHAR(36) NOT NULL,
+  label VARCHAR(255),
+  PRIMARY KEY(name, uid),
+  FOREIGN KEY (uid) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE app_switch_events (
+  uid CHAR(36) NOT NULL,
+  did BIGINT NOT NULL,
+  id BIGINT NOT NULL,
+  app VARCHAR(255) NOT NULL,
+  PRIMARY KEY(uid, did, id),
+  FOREIGN KEY (uid, did, id) REFERENCES events(uid, did, id) ON DELETE CASCADE
+);
+
+CREATE TABLE activity_events (
+  uid CHAR(36) NOT NULL,
+  did BIGINT NOT NULL,
+  id BIGINT NOT NULL,
+  keystrokes BIGINT NOT NULL,
+  mouseclicks BIGINT NOT NULL,
+  PRIMARY KEY(uid, did, id),
+  FOREIGN KEY (uid, did, id) REFERENCES events(uid, did, id) ON DELETE CASCADE
+);
+
+CREATE TABLE goals (
+  uid CHAR(36) NOT NULL,
+  id BIGINT NOT NULL,
+  title VARCHAR(255) NOT NULL,
+  is_label BOOLEAN NOT NULL,
+  item VARCHAR(255) NOT NULL,
+  is_percent BOOLEAN NOT NULL,
+  goal_duration BIGINT NOT NULL, -- raw goal duration by user. if percent, out of 1000
+  target_duration BIGINT NOT NULL, -- target duration (100% completion line)
+  base_duration BIGINT NOT NULL, -- base duration (i am dumb, we should use 0 as baseline completion instead)
+  starttime BIGINT NOT NULL,
+  endtime BIGINT NOT NULL,
+  compare_starttime BIGINT,
+  compare_endtime BIGINT,
+  days_of_week BIGINT,
+  equalized BOOLEAN NOT NULL,
+  progress BIGINT NOT NULL, -- out of 1000
+  goaltype VARCHAR(8) CHECK(goaltype IN ('aspiring', 'limiting')) NOT NULL,
+  -- TODO: different notification methods
+  PRIMARY KEY(uid, id),
+  FOREIGN KEY (uid) REFERENCES users(id) ON DELETE CASCADE
+);
+
@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"os"
 	"strings"
+	"time"
 
 	"git.yiad.am/productimon/aggregator/authenticator"
+	"git.yiad.am/productimon/aggregator/oidc"
 	"git.yiad.am/productimon/aggregator/service"
 	"git.yiad.am/productimon/internal"
 	"git.yiad.am/productimon/viewer/webfe"
@@ -26,6 +30,7 @@ var (
 	flagHTTPSListenAddress string
 	flagCertDir            string
 	flagTOSAccepted        bool
+	flagOIDCConfig         string
 )
 
 var (
@@ -38,6 +43,44 @@ func init() {
 	flag.StringVar(&flagHTTPSListenAddress, "https_listen_address", "0.0.0.0:443", "HTTPS listen address")
 	flag.StringVar(&flagCertDir, "cert_cache_dir", ".certs", "Path to directory to store HTTPS certificates. Concatenate your key and cert to a single file and put it in this directory with your domain name as filename without any extra file extension (e.g., .certs/my.productimon.com). If you don't provide a certificate, one will be provisioned automatically for you via Let's Encrypt")
 	flag.BoolVar(&flagTOSAccepted, "accept_acme_tos", false, "Accept Let's Encrypt Terms of Service (you don't have to pass this if you provided your own certificate)")
+	flag.StringVar(&flagOIDCConfig, "oidc_config", "", "Path to JSON config of OpenID Connect providers users can sign in with (leave empty to disable single sign-on)")
+}
+
+// read OpenID Connect providers users can sign in with from -oidc_config
+func newOIDCHandler(s *service.Service) *oidc.Handler {
+	f, err := os.Open(flagOIDCConfig)
+	if err != nil {
+		logger.Fatal("can't open oidc config", zap.Error(err))
+	}
+	defer f.Close()
+	var config struct {
+		Providers []oidc.ProviderConfig `json:"providers"`
+	}
+	if err = json.NewDecoder(f).Decode(&config); err != nil {
+		logger.Fatal("can't parse oidc config", zap.Error(err))
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	var providers []*oidc.Provider
+	for _, pc := range config.Providers {
+		p, err := oidc.NewProvider(pc, fmt.Sprintf("https://%s/oidc/callback", flagDomain), client)
+		if err != nil {
+			logger.Error("can't set up oidc provider, skipping", zap.Error(err), zap.String("provider", pc.Name))
+			continue
+		}
+		providers = append(providers, p)
+	}
+	return oidc.NewHandler(providers, func(r *http.Request, p *oidc.Provider, claims *oidc.Claims) (*oidc.Login, error) {
+		token, challenge, err := s.OIDCLogin(claims.Issuer, claims.Subject, claims.Email, r.UserAgent(), p.LinkExistingAccounts)
+		if err == service.ErrIdentityNotLinked {
+			return nil, oidc.ErrAccountExists
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &oidc.Login{Token: token, MFAChallenge: challenge}, nil
+	}, func(msg string, err error) {
+		logger.Error(msg, zap.Error(err))
+	})
 }
 
 func webfeServeStaticFile(contentType, filename string) func(w http.ResponseWriter, r *http.Request) {
@@ -94,6 +137,10 @@ func buildHandlers(ctx context.Context, s *service.Service, auther *authenticato
 		w.Write([]byte("Account verified! You may login now"))
 	})
 
+	if flagOIDCConfig != "" {
+		mux.Handle("/oidc/", newOIDCHandler(s))
+	}
+
 	mux.HandleFunc("/rpc.json", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -126,6 +173,7 @@ func buildHandlers(ctx context.Context, s *service.Service, auther *authenticato
 		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
 	}
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,54 @@
+package messages
+
+// built-in templates, locale -> message name -> template
+var defaults = map[string]map[string]string{
+	DefaultLocale: {
+		GoalAchieved: `{{define "subject"}}Goal achieved: {{.Goal.Title}}{{end}}
+{{define "body"}}Congrats! You've achieved your goal in using {{.Goal.Item}} ({{.Goal.Title}}) from {{template "interval" .}}. Check {{.Domain}} for more details.{{end}}
+{{define "interval"}}{{.Goal.Start.Format "Mon Jan 2 15:04"}} to {{.Goal.End.Format "Mon Jan 2 15:04 MST"}}{{end}}`,
+
+		GoalAlmostAchieved: `{{define "subject"}}Almost there: {{.Goal.Title}}{{end}}
+{{define "body"}}You're almost there! You've finished {{printf "%.1f" .Goal.Progress}}% of your goal in using {{.Goal.Item}} ({{.Goal.Title}}) from {{template "interval" .}}. Check {{.Domain}} for more details.{{end}}
+{{define "interval"}}{{.Goal.Start.Format "Mon Jan 2 15:04"}} to {{.Goal.End.Format "Mon Jan 2 15:04 MST"}}{{end}}`,
+
+		GoalFailed: `{{define "subject"}}Goal failed: {{.Goal.Title}}{{end}}
+{{define "body"}}Unfortunately, you've failed your goal ({{.Goal.Title}}) by using {{.Goal.Item}} too much from {{template "interval" .}}. Check {{.Domain}} for more details.{{end}}
+{{define "interval"}}{{.Goal.Start.Format "Mon Jan 2 15:04"}} to {{.Goal.End.Format "Mon Jan 2 15:04 MST"}}{{end}}`,
+
+		GoalAlmostFailed: `{{define "subject"}}Be careful: {{.Goal.Title}}{{end}}
+{{define "body"}}Be careful! You've used {{printf "%.1f" .Goal.Progress}}% of all allowed time to use {{.Goal.Item}} in your goal ({{.Goal.Title}}) from {{template "interval" .}}. Check {{.Domain}} for more details.{{end}}
+{{define "interval"}}{{.Goal.Start.Format "Mon Jan 2 15:04"}} to {{.Goal.End.Format "Mon Jan 2 15:04 MST"}}{{end}}`,
+
+		VerifyEmail: `{{define "subject"}}Verify your Productimon account{{end}}
+{{define "body"}}Hi there! Verify your productimon email here: {{.Link}}{{end}}`,
+
+		PasswordReset: `{{define "subject"}}Reset your Productimon password{{end}}
+{{define "body"}}Hi there! Someone (hopefully you) asked to reset the password of your Productimon account. Choose a new password here within an hour: {{.Link}}
+
+If it wasn't you, you can ignore this email.{{end}}`,
+
+		Digest: `{{define "subject"}}{{len .Messages}} Productimon notifications{{end}}
+{{define "body"}}Here's what happened during your quiet hours:
+{{range .Messages}}
+- {{.Body}}{{end}}
+
+Check {{.Domain}} for more details.{{end}}`,
+
+		Report: `{{define "subject"}}Your {{.Report.Frequency}} Productimon report{{end}}
+{{define "body"}}Here's your {{.Report.Frequency}} usage summary for {{template "period" .Report}}.
+
+Total time: {{duration .Report.TotalTime}} ({{duration .Report.ActiveTime}} active){{if .Report.PreviousTotalTime}}, {{printf "%+.0f" .Report.Change}}% compared to the period before{{end}}.
+{{with .Report.Apps}}
+Top applications:
+{{range .}}- {{.Name}}: {{duration .Time}}
+{{end}}{{end}}{{with .Report.Labels}}
+Top labels:
+{{range .}}- {{.Name}}: {{duration .Time}}
+{{end}}{{end}}{{with .Report.Goals}}
+Goals:
+{{range .}}- {{.Title}}: {{printf "%.1f" .Progress}}%{{if .Ended}}, {{if .Succeeded}}achieved{{else}}failed{{end}}{{end}}
+{{end}}{{end}}
+Check {{.Domain}} for more details.{{end}}
+{{define "period"}}{{if eq .Frequency "weekly"}}{{.Start.Format "Mon Jan 2"}} to {{(.End.AddDate 0 0 -1).Format "Mon Jan 2"}}{{else}}{{.Start.Format "Mon Jan 2"}}{{end}}{{end}}`,
+	},
+}
@@ -0,0 +1,278 @@
+// Package messages renders notification messages from text/template
+// catalogues.
+//
+// A catalogue directory has a subdirectory per locale containing one
+// <name>.tmpl file per message, e.g. en/goal_achieved.tmpl or
+// pt-br/goal_achieved.tmpl. Each file defines a "body" template and optionally
+// a "subject" template and an "html" template (used by notifiers that support
+// them, e.g. email). html is executed with html/template so data is escaped:
+//
+//	{{define "subject"}}Goal achieved: {{.Goal.Title}}{{end}}
+//	{{define "body"}}Congrats! ...{{end}}
+//	{{define "html"}}<p>Congrats! ...</p>{{end}}
+//
+// Messages missing from the directory fall back to built-in defaults.
+package messages
+
+import (
+	"bytes"
+	"fmt"
+	htemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// message names
+const (
+	GoalAchieved       = "goal_achieved"
+	GoalAlmostAchieved = "goal_almost_achieved"
+	GoalFailed         = "goal_failed"
+	GoalAlmostFailed   = "goal_almost_failed"
+	VerifyEmail        = "verify_email"
+	PasswordReset      = "password_reset"
+	// notifications held back during quiet hours
+	Digest = "digest"
+	// daily/weekly usage summary
+	Report = "report"
+)
+
+// locale built-in defaults are written in
+const DefaultLocale = "en"
+
+// Message is a rendered notification
+type Message struct {
+	Subject string
+	Body    string
+	// optional HTML version of Body
+	HTML string
+}
+
+// Data is passed to templates
+type Data struct {
+	// public-facing server domain
+	Domain string
+	User   User
+	// only set for goal notifications
+	Goal *Goal
+	// verification or password reset link, only set for verify_email and
+	// password_reset
+	Link string
+	// only set for digest
+	Messages []*Message
+	// only set for report
+	Report *UsageReport
+}
+
+type User struct {
+	Email string
+}
+
+type Goal struct {
+	Title string
+	// application or label name
+	Item    string
+	IsLabel bool
+	// aspiring/limiting
+	Type string
+	// in user's timezone
+	Start time.Time
+	End   time.Time
+	// percentage of goal finished, from 0 to 100
+	Progress float64
+	// progress percentage this notification is sent for
+	Threshold int32
+	// only set in reports, whether the goal (period) has ended and succeeded
+	Ended     bool
+	Succeeded bool
+}
+
+type UsageReport struct {
+	// daily or weekly
+	Frequency string
+	// in user's timezone, End is exclusive
+	Start      time.Time
+	End        time.Time
+	TotalTime  time.Duration
+	ActiveTime time.Duration
+	// total time in the period before, 0 if there was no usage
+	PreviousTotalTime time.Duration
+	// percentage change of total time from previous period
+	Change float64
+	// most used applications and labels, most used first
+	Apps   []Usage
+	Labels []Usage
+	Goals  []*Goal
+}
+
+type Usage struct {
+	// application or label name
+	Name       string
+	Time       time.Duration
+	ActiveTime time.Duration
+}
+
+// Catalogue holds templates of all messages in all locales
+type Catalogue struct {
+	// locale -> message name -> template
+	templates     map[string]map[string]*catalogueEntry
+	defaultLocale string
+}
+
+// Load creates a catalogue from built-in defaults, overridden by templates in
+// dir if it's not empty. defaultLocale is used when a message isn't
+// available in user's locale.
+func Load(dir, defaultLocale string) (*Catalogue, error) {
+	c := &Catalogue{
+		templates:     make(map[string]map[string]*catalogueEntry),
+		defaultLocale: NormalizeLocale(defaultLocale),
+	}
+	for locale, msgs := range defaults {
+		for name, text := range msgs {
+			if err := c.add(locale, name, text); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if dir == "" {
+		return c, nil
+	}
+	locales, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range locales {
+		if !l.IsDir() {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(dir, l.Name(), "*.tmpl"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			text, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if err = c.add(l.Name(), strings.TrimSuffix(filepath.Base(f), ".tmpl"), string(text)); err != nil {
+				return nil, fmt.Errorf("messages: %s: %v", f, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// functions available to templates
+var funcs = template.FuncMap{
+	"duration": FormatDuration,
+}
+
+// FormatDuration formats d rounded to minutes, e.g. 1h 5m
+func FormatDuration(d time.Duration) string {
+	m := int64(d.Round(time.Minute) / time.Minute)
+	if m < 60 {
+		return fmt.Sprintf("%dm", m)
+	}
+	return fmt.Sprintf("%dh %dm", m/60, m%60)
+}
+
+type catalogueEntry struct {
+	text *template.Template
+	// nil if message doesn't define html
+	html *htemplate.Template
+}
+
+func (c *Catalogue) add(locale, name, text string) error {
+	e := &catalogueEntry{}
+	var err error
+	if e.text, err = template.New(name).Funcs(funcs).Parse(text); err != nil {
+		return err
+	}
+	if e.text.Lookup("body") == nil {
+		return fmt.Errorf("messages: %s/%s doesn't define body", locale, name)
+	}
+	if e.text.Lookup("html") != nil {
+		if e.html, err = htemplate.New(name).Funcs(htemplate.FuncMap(funcs)).Parse(text); err != nil {
+			return err
+		}
+	}
+	locale = NormalizeLocale(locale)
+	if c.templates[locale] == nil {
+		c.templates[locale] = make(map[string]*catalogueEntry)
+	}
+	c.templates[locale][name] = e
+	return nil
+}
+
+// find template in locale, then its base language, then default locale and
+// finally the locale built-in defaults are in
+func (c *Catalogue) lookup(name, locale string) *catalogueEntry {
+	locale = NormalizeLocale(locale)
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	candidates = append(candidates, c.defaultLocale, DefaultLocale)
+	for _, l := range candidates {
+		if t := c.templates[l][name]; t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// Render renders message name in locale (server default if empty)
+func (c *Catalogue) Render(name, locale string, data *Data) (*Message, error) {
+	e := c.lookup(name, locale)
+	if e == nil {
+		return nil, fmt.Errorf("messages: unknown message %q", name)
+	}
+	t := e.text
+	msg := &Message{}
+	var buf bytes.Buffer
+	if t.Lookup("subject") != nil {
+		if err := t.ExecuteTemplate(&buf, "subject", data); err != nil {
+			return nil, err
+		}
+		msg.Subject = strings.TrimSpace(buf.String())
+		buf.Reset()
+	}
+	if err := t.ExecuteTemplate(&buf, "body", data); err != nil {
+		return nil, err
+	}
+	msg.Body = strings.TrimSpace(buf.String())
+	if e.html != nil {
+		buf.Reset()
+		if err := e.html.ExecuteTemplate(&buf, "html", data); err != nil {
+			return nil, err
+		}
+		msg.HTML = strings.TrimSpace(buf.String())
+	}
+	return msg, nil
+}
+
+// NormalizeLocale lowercases locale and uses - as separator, e.g. pt_BR -> pt-br
+func NormalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(locale, "_", "-", -1))
+}
+
+// ValidLocale reports whether locale looks like a BCP 47 language tag
+func ValidLocale(locale string) bool {
+	parts := strings.Split(NormalizeLocale(locale), "-")
+	if len(parts[0]) < 2 || len(parts[0]) > 3 {
+		return false
+	}
+	for _, p := range parts {
+		if len(p) == 0 || len(p) > 8 {
+			return false
+		}
+		for _, r := range p {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
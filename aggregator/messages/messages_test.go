@@ -0,0 +1,174 @@
+package messages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testData = &Data{
+	Domain: "my.productimon.com",
+	User:   User{Email: "user@productimon.com"},
+	Goal: &Goal{
+		Title:    "less games",
+		Item:     "Games",
+		IsLabel:  true,
+		Type:     "limiting",
+		Start:    time.Date(2020, time.August, 3, 0, 0, 0, 0, time.UTC),
+		End:      time.Date(2020, time.August, 10, 0, 0, 0, 0, time.UTC),
+		Progress: 85.5,
+	},
+	Link:     "https://my.productimon.com/verify?token=abc",
+	Messages: []*Message{{Body: "one"}, {Body: "two"}},
+	Report: &UsageReport{
+		Frequency:         "weekly",
+		Start:             time.Date(2020, time.August, 3, 0, 0, 0, 0, time.UTC),
+		End:               time.Date(2020, time.August, 10, 0, 0, 0, 0, time.UTC),
+		TotalTime:         10 * time.Hour,
+		ActiveTime:        8*time.Hour + 30*time.Minute,
+		PreviousTotalTime: 8 * time.Hour,
+		Change:            25,
+		Apps:              []Usage{{Name: "Firefox", Time: 6 * time.Hour}, {Name: "Steam", Time: 4 * time.Hour}},
+		Labels:            []Usage{{Name: "Games", Time: 4 * time.Hour}},
+		Goals:             []*Goal{{Title: "less games", Progress: 120, Ended: true}},
+	},
+}
+
+func TestDefaults(t *testing.T) {
+	c, err := Load("", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{GoalAchieved, GoalAlmostAchieved, GoalFailed, GoalAlmostFailed, VerifyEmail, PasswordReset, Digest, Report} {
+		msg, err := c.Render(name, "", testData)
+		if err != nil {
+			t.Errorf("Render(%q) = %v", name, err)
+			continue
+		}
+		if msg.Subject == "" || msg.Body == "" {
+			t.Errorf("Render(%q) = %+v, want subject and body", name, msg)
+		}
+	}
+	msg, _ := c.Render(GoalAlmostFailed, "", testData)
+	if want := "Be careful! You've used 85.5% of all allowed time to use Games in your goal (less games) from Mon Aug 3 00:00 to Mon Aug 10 00:00 UTC. Check my.productimon.com for more details."; msg.Body != want {
+		t.Errorf("got body %q, want %q", msg.Body, want)
+	}
+	msg, _ = c.Render(Report, "", testData)
+	if want := `Here's your weekly usage summary for Mon Aug 3 to Sun Aug 9.
+
+Total time: 10h 0m (8h 30m active), +25% compared to the period before.
+
+Top applications:
+- Firefox: 6h 0m
+- Steam: 4h 0m
+
+Top labels:
+- Games: 4h 0m
+
+Goals:
+- less games: 120.0%, failed
+
+Check my.productimon.com for more details.`; msg.Body != want {
+		t.Errorf("got report body %q, want %q", msg.Body, want)
+	}
+	if _, err = c.Render("nope", "", testData); err == nil {
+		t.Error("Render() of unknown message = nil error")
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(locale, name, text string) {
+		if err := os.MkdirAll(filepath.Join(dir, locale), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, locale, name+".tmpl"), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("en", VerifyEmail, `{{define "body"}}verify: {{.Link}}{{end}}`)
+	write("pt", VerifyEmail, `{{define "subject"}}Verifique{{end}}{{define "body"}}verifique: {{.Link}}{{end}}`)
+	write("fr_CA", VerifyEmail, `{{define "body"}}vérifiez: {{.Link}}{{end}}`)
+
+	c, err := Load(dir, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, locale, subject, body string
+	}{
+		{VerifyEmail, "", "", "verify: " + testData.Link},
+		{VerifyEmail, "pt-BR", "Verifique", "verifique: " + testData.Link},
+		{VerifyEmail, "fr-ca", "", "vérifiez: " + testData.Link},
+		{VerifyEmail, "de", "", "verify: " + testData.Link},
+		// not overridden, falls back to built-in default
+		{GoalFailed, "pt", "Goal failed: less games", ""},
+	}
+	for _, tt := range tests {
+		msg, err := c.Render(tt.name, tt.locale, testData)
+		if err != nil {
+			t.Errorf("Render(%q, %q) = %v", tt.name, tt.locale, err)
+			continue
+		}
+		if msg.Subject != tt.subject || (tt.body != "" && msg.Body != tt.body) {
+			t.Errorf("Render(%q, %q) = %+v, want subject %q body %q", tt.name, tt.locale, msg, tt.subject, tt.body)
+		}
+	}
+
+	write("de", VerifyEmail, `{{define "body"}}{{.Link}}{{end}}{{define "html"}}<a href="{{.Link}}">{{.User.Email}}</a>{{end}}`)
+	if c, err = Load(dir, "en"); err != nil {
+		t.Fatal(err)
+	}
+	data := &Data{User: User{Email: "<script>@productimon.com"}, Link: testData.Link}
+	msg, err := c.Render(VerifyEmail, "de", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<a href="https://my.productimon.com/verify?token=abc">&lt;script&gt;@productimon.com</a>`; msg.HTML != want {
+		t.Errorf("got html %q, want %q", msg.HTML, want)
+	}
+	if msg.Body != testData.Link {
+		t.Errorf("got body %q, want %q", msg.Body, testData.Link)
+	}
+
+	write("en", GoalFailed, `{{define "subject"}}no body{{end}}`)
+	if _, err = Load(dir, "en"); err == nil {
+		t.Error("Load() with template missing body = nil error")
+	}
+}
+
+func TestValidLocale(t *testing.T) {
+	for _, l := range []string{"en", "pt-BR", "zh_Hant_TW", "es-419"} {
+		if !ValidLocale(l) {
+			t.Errorf("ValidLocale(%q) = false", l)
+		}
+	}
+	for _, l := range []string{"", "e", "english-", "../en", "en/us"} {
+		if ValidLocale(l) {
+			t.Errorf("ValidLocale(%q) = true", l)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0m"},
+		{29 * time.Second, "0m"},
+		{59*time.Minute + 40*time.Second, "1h 0m"},
+		{25*time.Hour + 5*time.Minute, "25h 5m"},
+	}
+	for _, tt := range tests {
+		if got := FormatDuration(tt.d); got != tt.want {
+			t.Errorf("FormatDuration(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrDeviceNotConnected = errors.New("notifications: device is not connected")
+
+// notifications buffered per connection before we start dropping them
+const deviceBufferSize = 16
+
+// DeviceNotifier fans notifications out to devices connected via Subscribe.
+// A connection that has deviceBufferSize messages unread misses the next ones.
+// Recipients are formatted with DeviceRecipient.
+// It also tracks the open streams of devices, so they can be disconnected
+type DeviceNotifier struct {
+	mu      sync.Mutex
+	subs    map[string]map[chan string]struct{}
+	streams map[string]map[*context.CancelFunc]struct{}
+}
+
+func NewDeviceNotifier() *DeviceNotifier {
+	return &DeviceNotifier{
+		subs:    make(map[string]map[chan string]struct{}),
+		streams: make(map[string]map[*context.CancelFunc]struct{}),
+	}
+}
+
+func (n *DeviceNotifier) Name() string {
+	return "device"
+}
+
+// Notify sends message to all connections of the device.
+// Messages are not queued for devices that are offline
+func (n *DeviceNotifier) Notify(recipient, message string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	subs := n.subs[recipient]
+	if len(subs) == 0 {
+		return ErrDeviceNotConnected
+	}
+	for c := range subs {
+		select {
+		case c <- message:
+		default:
+			// this connection isn't keeping up, drop the message rather than blocking other notifiers
+		}
+	}
+	return nil
+}
+
+// Subscribe returns a channel receiving notifications for device,
+// cancel must be called once caller stops reading from it
+func (n *DeviceNotifier) Subscribe(uid string, did int64) (messages <-chan string, cancel func()) {
+	recipient := DeviceRecipient(uid, did)
+	c := make(chan string, deviceBufferSize)
+	n.mu.Lock()
+	if n.subs[recipient] == nil {
+		n.subs[recipient] = make(map[chan string]struct{})
+	}
+	n.subs[recipient][c] = struct{}{}
+	n.mu.Unlock()
+	return c, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subs[recipient], c)
+		if len(n.subs[recipient]) == 0 {
+			delete(n.subs, recipient)
+		}
+	}
+}
+
+// Track returns a context derived from ctx of a stream of device, which is
+// cancelled by Disconnect. done must be called once the stream ends
+func (n *DeviceNotifier) Track(ctx context.Context, uid string, did int64) (streamCtx context.Context, done func()) {
+	recipient := DeviceRecipient(uid, did)
+	streamCtx, cancel := context.WithCancel(ctx)
+	key := &cancel
+	n.mu.Lock()
+	if n.streams[recipient] == nil {
+		n.streams[recipient] = make(map[*context.CancelFunc]struct{})
+	}
+	n.streams[recipient][key] = struct{}{}
+	n.mu.Unlock()
+	return streamCtx, func() {
+		n.mu.Lock()
+		delete(n.streams[recipient], key)
+		if len(n.streams[recipient]) == 0 {
+			delete(n.streams, recipient)
+		}
+		n.mu.Unlock()
+		cancel()
+	}
+}
+
+// Disconnect cancels the contexts of all tracked streams of device,
+// e.g. once its certificate has been revoked
+func (n *DeviceNotifier) Disconnect(uid string, did int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for cancel := range n.streams[DeviceRecipient(uid, did)] {
+		(*cancel)()
+	}
+}
@@ -0,0 +1,61 @@
+package notifications
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDeviceNotifier(t *testing.T) {
+	n := NewDeviceNotifier()
+	if err := n.Notify(DeviceRecipient("uid", 1), "hello"); err != ErrDeviceNotConnected {
+		t.Errorf("Notify() to offline device = %v, want %v", err, ErrDeviceNotConnected)
+	}
+
+	c1, cancel1 := n.Subscribe("uid", 1)
+	c2, cancel2 := n.Subscribe("uid", 1)
+	other, cancelOther := n.Subscribe("uid", 2)
+	defer cancelOther()
+	if err := n.Notify(DeviceRecipient("uid", 1), "hello"); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	for _, c := range []<-chan string{c1, c2} {
+		if msg := <-c; msg != "hello" {
+			t.Errorf("got %q, want %q", msg, "hello")
+		}
+	}
+	select {
+	case msg := <-other:
+		t.Errorf("other device got %q", msg)
+	default:
+	}
+
+	cancel1()
+	cancel2()
+	if err := n.Notify(DeviceRecipient("uid", 1), "hello"); err != ErrDeviceNotConnected {
+		t.Errorf("Notify() after cancel = %v, want %v", err, ErrDeviceNotConnected)
+	}
+}
+
+func TestDeviceNotifierDisconnect(t *testing.T) {
+	n := NewDeviceNotifier()
+	ctx1, done1 := n.Track(context.Background(), "uid", 1)
+	defer done1()
+	ctx2, done2 := n.Track(context.Background(), "uid", 1)
+	other, doneOther := n.Track(context.Background(), "uid", 2)
+	defer doneOther()
+
+	done2()
+	if ctx2.Err() == nil {
+		t.Error("stream context isn't cancelled once it's done")
+	}
+	n.Disconnect("uid", 1)
+	if ctx1.Err() == nil {
+		t.Error("stream context isn't cancelled by Disconnect")
+	}
+	if other.Err() != nil {
+		t.Error("Disconnect cancelled the stream of another device")
+	}
+	if len(n.streams[DeviceRecipient("uid", 2)]) != 1 || len(n.streams[DeviceRecipient("uid", 1)]) != 1 {
+		t.Errorf("tracking %v, want one stream of each device", n.streams)
+	}
+}
@@ -1,17 +1,75 @@
 package notifications
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/smtp"
+	"net/textproto"
 	"strings"
+	"time"
 
 	"git.yiad.am/productimon/third_party/smtp_login_auth"
 )
 
+// EmailSecurity is how the connection to the SMTP server is secured
+type EmailSecurity string
+
+const (
+	// use STARTTLS if the server supports it
+	EmailSecurityAuto EmailSecurity = "auto"
+	// fail if the server doesn't support STARTTLS
+	EmailSecurityStartTLS EmailSecurity = "starttls"
+	// implicit TLS, usually on port 465
+	EmailSecurityTLS EmailSecurity = "tls"
+	// never use TLS
+	EmailSecurityPlain EmailSecurity = "plain"
+)
+
+func ParseEmailSecurity(s string) (EmailSecurity, error) {
+	switch sec := EmailSecurity(strings.ToLower(s)); sec {
+	case EmailSecurityAuto, EmailSecurityStartTLS, EmailSecurityTLS, EmailSecurityPlain:
+		return sec, nil
+	}
+	return "", fmt.Errorf("notifications: unknown email security %q, must be one of auto, starttls, tls or plain", s)
+}
+
+// HTMLNotifier is implemented by notifiers that can send an HTML version of messages
+type HTMLNotifier interface {
+	SubjectNotifier
+	NotifyWithHTML(recipient, subject, text, html string) error
+}
+
+const smtpTimeout = 30 * time.Second
+
+// EmailConfig configures an email notifier
+type EmailConfig struct {
+	// host[:port], port defaults to 465 for implicit TLS and 25 otherwise
+	Server string
+	// authentication is disabled if empty
+	Username string
+	Password string
+	Sender   string
+	Security EmailSecurity
+	// used for messages without a subject
+	DefaultSubject string
+}
+
 type emailNotifier struct {
-	serverAddr string
-	auth       smtp.Auth
-	sender     string
+	serverAddr     string
+	serverName     string
+	auth           smtp.Auth
+	sender         string
+	security       EmailSecurity
+	defaultSubject string
 }
 
 func (n emailNotifier) Name() string {
@@ -19,33 +77,172 @@ func (n emailNotifier) Name() string {
 }
 
 func (n emailNotifier) Notify(recipient, message string) error {
-	to := []string{recipient}
-	msg := []byte(fmt.Sprintf("From: Productimon <%s>\r\n"+
+	return n.NotifyWithSubject(recipient, "", message)
+}
+
+func (n emailNotifier) NotifyWithSubject(recipient, subject, message string) error {
+	return n.NotifyWithHTML(recipient, subject, message, textToHTML(message))
+}
+
+// send a multipart/alternative email with text and html version of message
+func (n emailNotifier) NotifyWithHTML(recipient, subject, text, html string) error {
+	if subject == "" {
+		subject = n.defaultSubject
+	}
+	msg, err := buildEmail(n.sender, recipient, subject, text, html, time.Now(), newMessageID(n.sender))
+	if err != nil {
+		return err
+	}
+	return n.send(recipient, msg)
+}
+
+func (n emailNotifier) send(recipient string, msg []byte) error {
+	tlsConfig := &tls.Config{ServerName: n.serverName}
+	var conn net.Conn
+	var err error
+	if n.security == EmailSecurityTLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpTimeout}, "tcp", n.serverAddr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", n.serverAddr, smtpTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, n.serverName)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if n.security == EmailSecurityAuto || n.security == EmailSecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if n.security == EmailSecurityStartTLS {
+			return errors.New("notifications: smtp server doesn't support STARTTLS")
+		}
+	}
+	if n.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("notifications: smtp server doesn't support AUTH")
+		}
+		if err = c.Auth(n.auth); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(n.sender); err != nil {
+		return err
+	}
+	if err = c.Rcpt(recipient); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// build a MIME multipart/alternative email
+func buildEmail(sender, recipient, subject, text, html string, date time.Time, messageID string) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err = qw.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err = qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: Productimon <%s>\r\n"+
 		"To: %s\r\n"+
-		"Subject: Productimon notification\r\n"+
-		"\r\n%s\r\n", n.sender, recipient, message))
-	return smtp.SendMail(n.serverAddr, n.auth, n.sender, to, msg)
+		"Subject: %s\r\n"+
+		"Date: %s\r\n"+
+		"Message-ID: %s\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: %s\r\n"+
+		"\r\n", sender, recipient, mime.QEncoding.Encode("utf-8", subject), date.Format(time.RFC1123Z), messageID,
+		mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}))
+	body.WriteTo(&msg)
+	return msg.Bytes(), nil
 }
 
-func ensurePort(serverName string) string {
-	if !strings.Contains(serverName, ":") {
-		serverName += ":25"
+// random Message-ID in sender's domain
+func newMessageID(sender string) string {
+	domain := "productimon"
+	if i := strings.LastIndex(sender, "@"); i >= 0 && i < len(sender)-1 {
+		domain = sender[i+1:]
 	}
-	return serverName
+	var b [12]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b[:]), domain)
 }
 
-func NewEmailNotifier(serverName, authUsername, authPassword, sender string) Notifier {
-	return &emailNotifier{
-		serverAddr: ensurePort(serverName),
-		auth:       smtp_login_auth.LoginAuth(authUsername, authPassword),
-		sender:     sender,
+// escape text and turn paragraphs and line breaks into html
+func textToHTML(text string) string {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html><body>\n")
+	for _, p := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n\n") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		b.WriteString("<p>")
+		b.WriteString(strings.Replace(html.EscapeString(p), "\n", "<br>\n", -1))
+		b.WriteString("</p>\n")
 	}
+	b.WriteString("</body></html>")
+	return b.String()
 }
 
-func NewEmailNoAuthNotifier(serverName, sender string) Notifier {
-	return &emailNotifier{
-		serverAddr: ensurePort(serverName),
-		auth:       nil,
-		sender:     sender,
+func NewEmailNotifier(config EmailConfig) Notifier {
+	addr := config.Server
+	if !strings.Contains(addr, ":") {
+		if config.Security == EmailSecurityTLS {
+			addr += ":465"
+		} else {
+			addr += ":25"
+		}
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	n := &emailNotifier{
+		serverAddr:     addr,
+		serverName:     host,
+		sender:         config.Sender,
+		security:       config.Security,
+		defaultSubject: config.DefaultSubject,
+	}
+	if n.security == "" {
+		n.security = EmailSecurityAuto
+	}
+	if n.defaultSubject == "" {
+		n.defaultSubject = "Productimon notification"
+	}
+	if len(config.Username) > 0 {
+		n.auth = smtp_login_auth.LoginAuth(config.Username, config.Password)
 	}
+	return n
 }
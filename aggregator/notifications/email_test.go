@@ -0,0 +1,136 @@
+package notifications
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildEmail(t *testing.T) {
+	date := time.Date(2020, time.August, 3, 9, 0, 0, 0, time.UTC)
+	raw, err := buildEmail("noreply@productimon.com", "user@productimon.com", "Goal achieved: ✓", "hi\nthere", "<p>hi</p>", date, "<1@productimon.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := new(mime.WordDecoder)
+	if subject, _ := dec.DecodeHeader(msg.Header.Get("Subject")); subject != "Goal achieved: ✓" {
+		t.Errorf("got subject %q", subject)
+	}
+	if d, err := msg.Header.Date(); err != nil || !d.Equal(date) {
+		t.Errorf("got date %v, %v", d, err)
+	}
+	if id := msg.Header.Get("Message-ID"); id != "<1@productimon.com>" {
+		t.Errorf("got Message-ID %q", id)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got Content-Type %q, %v", msg.Header.Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", "hi\r\nthere"},
+		{"text/html; charset=utf-8", "<p>hi</p>"},
+	} {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// multipart reader decodes quoted-printable
+		body, _ := ioutil.ReadAll(p)
+		if ct := p.Header.Get("Content-Type"); ct != want.contentType || string(body) != want.body {
+			t.Errorf("got part %q %q, want %q %q", ct, body, want.contentType, want.body)
+		}
+	}
+	if _, err = mr.NextPart(); err == nil {
+		t.Error("got more than 2 parts")
+	}
+}
+
+func TestTextToHTML(t *testing.T) {
+	want := "<!DOCTYPE html>\n<html><body>\n<p>a &lt;b&gt;<br>\nc</p>\n<p>d</p>\n</body></html>"
+	if got := textToHTML("a <b>\nc\n\n\n\nd\n"); got != want {
+		t.Errorf("textToHTML() = %q, want %q", got, want)
+	}
+}
+
+// minimal SMTP server accepting one message, reports DATA received on the channel
+func fakeSMTPServer(t *testing.T, extensions []string) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 fake")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO":
+				reply("250-fake")
+				for _, ext := range extensions {
+					reply("250-" + ext)
+				}
+				reply("250 8BITMIME")
+			case "DATA":
+				reply("354 go ahead")
+				var msg strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					msg.WriteString(l)
+				}
+				data <- msg.String()
+				reply("250 ok")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), data
+}
+
+func TestEmailNotifierPlain(t *testing.T) {
+	addr, data := fakeSMTPServer(t, nil)
+	n := NewEmailNotifier(EmailConfig{Server: addr, Sender: "noreply@productimon.com", Security: EmailSecurityPlain})
+	if err := n.Notify("user@productimon.com", "hello"); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	msg := <-data
+	if !strings.Contains(msg, "Subject: Productimon notification\r\n") || !strings.Contains(msg, "hello") {
+		t.Errorf("got message %q", msg)
+	}
+}
+
+func TestEmailNotifierRequireStartTLS(t *testing.T) {
+	addr, _ := fakeSMTPServer(t, nil)
+	n := NewEmailNotifier(EmailConfig{Server: addr, Sender: "noreply@productimon.com", Security: EmailSecurityStartTLS})
+	if err := n.Notify("user@productimon.com", "hello"); err == nil {
+		t.Error("Notify() without STARTTLS support = nil error")
+	}
+}
@@ -1,6 +1,9 @@
 package notifications
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var ErrNotRegistered = errors.New("notifications: notifier is not registered")
 
@@ -8,3 +11,14 @@ type Notifier interface {
 	Name() string
 	Notify(receipient, message string) error
 }
+
+// SubjectNotifier is implemented by notifiers that support a subject line
+type SubjectNotifier interface {
+	Notifier
+	NotifyWithSubject(recipient, subject, message string) error
+}
+
+// DeviceRecipient formats recipient for notifiers that push to a device
+func DeviceRecipient(uid string, did int64) string {
+	return fmt.Sprintf("%s/%d", uid, did)
+}
@@ -0,0 +1,79 @@
+package notifications
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SMSGateway sends text messages through an SMS provider
+type SMSGateway interface {
+	Send(to, message string) error
+}
+
+type smsNotifier struct {
+	gateway SMSGateway
+}
+
+func (n smsNotifier) Name() string {
+	return "sms"
+}
+
+func (n smsNotifier) Notify(recipient, message string) error {
+	return n.gateway.Send(recipient, message)
+}
+
+func NewSMSNotifier(gateway SMSGateway) Notifier {
+	return &smsNotifier{gateway: gateway}
+}
+
+type httpSMSGateway struct {
+	endpoint string
+	username string
+	password string
+	sender   string
+	client   *http.Client
+}
+
+// POST To/From/Body as a form, this is compatible with Twilio's Messages API
+// and most other providers can be adapted to it with a small proxy
+func (g httpSMSGateway) Send(to, message string) error {
+	v := url.Values{}
+	v.Set("To", to)
+	v.Set("From", g.sender)
+	v.Set("Body", message)
+	req, err := http.NewRequest("POST", g.endpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(g.username) > 0 {
+		req.SetBasicAuth(g.username, g.password)
+	}
+	rsp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 512))
+		return fmt.Errorf("notifications: sms gateway returned %s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// NewHTTPSMSGateway creates a gateway that POSTs messages to endpoint,
+// authenticating with HTTP basic auth if username is not empty
+func NewHTTPSMSGateway(endpoint, username, password, sender string) SMSGateway {
+	return &httpSMSGateway{
+		endpoint: endpoint,
+		username: username,
+		password: password,
+		sender:   sender,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
@@ -0,0 +1,33 @@
+package notifications
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSMSGateway(t *testing.T) {
+	var to, from, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		to, from, body = r.PostFormValue("To"), r.PostFormValue("From"), r.PostFormValue("Body")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	n := NewSMSNotifier(NewHTTPSMSGateway(srv.URL, "user", "pass", "+61400000000"))
+	if err := n.Notify("+61412345678", "hello"); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	if to != "+61412345678" || from != "+61400000000" || body != "hello" {
+		t.Errorf("gateway got To=%q From=%q Body=%q", to, from, body)
+	}
+
+	n = NewSMSNotifier(NewHTTPSMSGateway(srv.URL, "user", "wrong", "+61400000000"))
+	if err := n.Notify("+61412345678", "hello"); err == nil {
+		t.Error("Notify() with bad credentials = nil, want error")
+	}
+}
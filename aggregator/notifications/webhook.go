@@ -0,0 +1,159 @@
+package notifications
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// unix timestamp (seconds) of when the webhook was sent
+	WebhookTimestampHeader = "X-Productimon-Timestamp"
+	// "sha256=" + hex HMAC-SHA256 of timestamp + "." + body, keyed by the webhook secret
+	WebhookSignatureHeader = "X-Productimon-Signature"
+)
+
+var ErrWebhookAddress = errors.New("notifications: webhook address is not public")
+
+// addresses webhooks must not be sent to, so users can't make the aggregator
+// reach hosts on its own network
+var nonPublicNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // RFC1918
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local
+		"172.16.0.0/12",  // RFC1918
+		"192.0.0.0/24",   // IETF protocol assignments
+		"192.168.0.0/16", // RFC1918
+		"198.18.0.0/15",  // benchmarking
+		"224.0.0.0/4",    // multicast
+		"240.0.0.0/4",    // reserved and broadcast
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"64:ff9b::/96",   // NAT64
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+		"ff00::/8",       // multicast
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nonPublicNetworks = append(nonPublicNetworks, n)
+	}
+}
+
+// IsPublicIP returns whether ip is a public internet address webhooks can be sent to
+func IsPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checks the address a webhook connection is about to be made to, after the
+// host has been resolved, so DNS can't point an accepted URL to a private host
+func checkWebhookAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+		return ErrWebhookAddress
+	}
+	return nil
+}
+
+// WebhookRecipient formats recipient for the webhook notifier, which signs
+// requests to url with secret
+func WebhookRecipient(url, secret string) string {
+	return secret + " " + url
+}
+
+type webhookPayload struct {
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type webhookNotifier struct {
+	client *http.Client
+}
+
+func (n webhookNotifier) Name() string {
+	return "webhook"
+}
+
+// POST message as JSON to recipient URL
+func (n webhookNotifier) Notify(recipient, message string) error {
+	i := strings.IndexByte(recipient, ' ')
+	if i <= 0 {
+		return errors.New("notifications: webhook has no secret")
+	}
+	secret, url := recipient[:i], recipient[i+1:]
+	ts := time.Now().Unix()
+	body, err := json.Marshal(webhookPayload{Message: message, Timestamp: ts})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Productimon-Webhook")
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook([]byte(secret), ts, body))
+	rsp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("notifications: webhook returned %s", rsp.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns hex HMAC-SHA256 signature of a webhook request,
+// receivers can use this to verify WebhookSignatureHeader
+func SignWebhook(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewWebhookNotifier creates a notifier that POSTs to the recipient URL
+// (see WebhookRecipient), signed with the recipient's secret.
+// Only public addresses are connected to, and proxies aren't used
+func NewWebhookNotifier() Notifier {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: checkWebhookAddress,
+	}
+	return &webhookNotifier{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+	}
+}
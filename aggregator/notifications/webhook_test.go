@@ -0,0 +1,102 @@
+package notifications
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var got webhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := strconv.ParseInt(r.Header.Get(WebhookTimestampHeader), 10, 64)
+		if err != nil {
+			t.Errorf("bad timestamp header: %v", err)
+		}
+		if sig := r.Header.Get(WebhookSignatureHeader); sig != "sha256="+SignWebhook([]byte("secret"), ts, body) {
+			t.Errorf("bad signature %q", sig)
+		}
+		if err = json.Unmarshal(body, &got); err != nil {
+			t.Errorf("bad body %q: %v", body, err)
+		}
+	}))
+	defer srv.Close()
+
+	// the test server is on loopback, which NewWebhookNotifier refuses
+	n := &webhookNotifier{client: srv.Client()}
+	if err := n.Notify(WebhookRecipient(srv.URL, "secret"), "hello"); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	if got.Message != "hello" {
+		t.Errorf("got message %q, want %q", got.Message, "hello")
+	}
+}
+
+func TestWebhookNotifierError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	n := &webhookNotifier{client: srv.Client()}
+	if err := n.Notify(WebhookRecipient(srv.URL, "secret"), "hello"); err == nil {
+		t.Error("Notify() = nil, want error")
+	}
+	if err := n.Notify(WebhookRecipient(srv.URL, ""), "hello"); err == nil {
+		t.Error("Notify() without secret = nil, want error")
+	}
+}
+
+func TestWebhookNotifierPrivateAddress(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	if err := NewWebhookNotifier().Notify(WebhookRecipient(srv.URL, "secret"), "hello"); err == nil {
+		t.Error("Notify() to loopback = nil, want error")
+	}
+	if called {
+		t.Error("webhook was sent to loopback")
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+	} {
+		if got := IsPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("IsPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
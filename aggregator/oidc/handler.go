@@ -0,0 +1,191 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// Login is what LoginFunc signs the user in with: an auth token, or if they
+// still have to pass two-factor authentication, a challenge for the sign in page
+type Login struct {
+	Token        string
+	MFAChallenge string
+}
+
+// LoginFunc signs in (or signs up) the user identified by verified claims
+// from provider. r is the callback request
+type LoginFunc func(r *http.Request, p *Provider, claims *Claims) (*Login, error)
+
+var (
+	// ErrForbidden can be returned by LoginFunc to reject a user
+	ErrForbidden = errors.New("oidc: user is not allowed to sign in")
+	// ErrAccountExists can be returned by LoginFunc when the email belongs to
+	// a user the provider account may not be linked to
+	ErrAccountExists = errors.New("oidc: an account with this email already exists")
+)
+
+const stateCookie = "productimon_oidc"
+
+// Handler serves the login flow under a prefix:
+//
+//	providers          JSON list of providers for the sign in page
+//	login?provider=x   redirects to provider x
+//	callback           provider redirects back here
+type Handler struct {
+	providers map[string]*Provider
+	// in configured order
+	names []string
+	login LoginFunc
+	// called with errors we don't show to users
+	logError func(msg string, err error)
+}
+
+func NewHandler(providers []*Provider, login LoginFunc, logError func(msg string, err error)) *Handler {
+	h := &Handler{
+		providers: make(map[string]*Provider),
+		login:     login,
+		logError:  logError,
+	}
+	for _, p := range providers {
+		h.providers[p.Name] = p
+		h.names = append(h.names, p.Name)
+	}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:] {
+	case "providers":
+		h.serveProviders(w, r)
+	case "login":
+		h.serveLogin(w, r)
+	case "callback":
+		h.serveCallback(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) serveProviders(w http.ResponseWriter, r *http.Request) {
+	type provider struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+	}
+	providers := []provider{}
+	for _, name := range h.names {
+		providers = append(providers, provider{name, h.providers[name].DisplayName})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
+
+func randomString() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func (h *Handler) serveLogin(w http.ResponseWriter, r *http.Request) {
+	p := h.providers[r.FormValue("provider")]
+	if p == nil {
+		http.Error(w, "unknown provider", http.StatusNotFound)
+		return
+	}
+	state, nonce := randomString(), randomString()
+	// the provider redirects back with state, which must match the cookie only
+	// this browser has
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    strings.Join([]string{p.Name, state, nonce}, "."),
+		Path:     strings.TrimSuffix(r.URL.Path, "login"),
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, p.AuthCodeURL(state, nonce), http.StatusFound)
+}
+
+// stores the token where the web frontend expects it, or the challenge for
+// the sign in page to ask for the second factor
+var callbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
+<html><body><script>
+{{if .MFAChallenge}}
+window.sessionStorage.setItem("mfa_challenge", {{.MFAChallenge}});
+window.location.replace("/");
+{{else}}
+window.localStorage.setItem("token", {{.Token}});
+window.location.replace("/dashboard");
+{{end}}
+</script></body></html>`))
+
+func (h *Handler) serveCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil {
+		http.Error(w, "sign in session expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   stateCookie,
+		Path:   strings.TrimSuffix(r.URL.Path, "callback"),
+		MaxAge: -1,
+	})
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || parts[1] != r.FormValue("state") {
+		http.Error(w, "invalid sign in state, please try again", http.StatusBadRequest)
+		return
+	}
+	p := h.providers[parts[0]]
+	if p == nil {
+		http.Error(w, "unknown provider", http.StatusBadRequest)
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "sign in failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, err := p.Exchange(r.FormValue("code"))
+	if err != nil {
+		h.logError("oidc code exchange failed", err)
+		http.Error(w, "sign in failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := p.Verify(rawIDToken, parts[2])
+	if err != nil {
+		h.logError("oidc id token verification failed", err)
+		http.Error(w, "sign in failed", http.StatusUnauthorized)
+		return
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		http.Error(w, "your account doesn't have a verified email", http.StatusForbidden)
+		return
+	}
+	if !p.EmailAllowed(claims.Email) {
+		http.Error(w, "your email domain is not allowed to sign in", http.StatusForbidden)
+		return
+	}
+	login, err := h.login(r, p, claims)
+	if err == ErrForbidden {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err == ErrAccountExists {
+		http.Error(w, "an account with your email already exists, please sign in with your password", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.logError("oidc login failed", err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	callbackPage.Execute(w, login)
+}
@@ -0,0 +1,335 @@
+// Package oidc implements the OpenID Connect authorization code flow for
+// signing in to the aggregator with an external identity provider.
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// ProviderConfig is an identity provider configured by the server admin
+type ProviderConfig struct {
+	// short name used in URLs, e.g. google
+	Name string `json:"name"`
+	// shown on the sign in page, defaults to Name
+	DisplayName  string `json:"display_name"`
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// only users with email in these domains can sign in, any if empty
+	AllowedEmailDomains []string `json:"allowed_email_domains"`
+	// whether the first sign in may link the provider account to an existing
+	// user with the same email, instead of refusing it. Only for providers
+	// trusted with the email addresses of the domains they can sign in
+	LinkExistingAccounts bool `json:"link_existing_accounts"`
+}
+
+// Claims are the claims of a verified ID token we care about
+type Claims struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// Provider is an OpenID Connect identity provider
+type Provider struct {
+	ProviderConfig
+	redirectURL string
+	client      *http.Client
+
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+
+	mu   sync.Mutex
+	keys map[string]interface{}
+	// when keys were last fetched
+	keysFetched time.Time
+}
+
+// how often we refetch keys at most when we see an unknown key id
+const minKeysRefreshInterval = time.Minute
+
+var validMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// NewProvider fetches the provider's discovery document. redirectURL is the
+// callback URL registered with the provider
+func NewProvider(config ProviderConfig, redirectURL string, client *http.Client) (*Provider, error) {
+	if config.Name == "" || config.Issuer == "" || config.ClientID == "" {
+		return nil, errors.New("oidc: provider needs name, issuer and client_id")
+	}
+	if config.DisplayName == "" {
+		config.DisplayName = config.Name
+	}
+	p := &Provider{
+		ProviderConfig: config,
+		redirectURL:    redirectURL,
+		client:         client,
+	}
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(strings.TrimSuffix(config.Issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, err
+	}
+	if doc.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc: discovery document issuer %q doesn't match %q", doc.Issuer, config.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc: incomplete discovery document")
+	}
+	p.authEndpoint, p.tokenEndpoint, p.jwksURI = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI
+	return p, nil
+}
+
+func (p *Provider) getJSON(u string, v interface{}) error {
+	rsp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s returned %s", u, rsp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(v)
+}
+
+// AuthCodeURL is where users are redirected to sign in
+func (p *Provider) AuthCodeURL(state, nonce string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.redirectURL)
+	v.Set("scope", "openid email")
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(p.authEndpoint, "?") {
+		sep = "&"
+	}
+	return p.authEndpoint + sep + v.Encode()
+}
+
+// Exchange exchanges an authorization code for a raw ID token
+func (p *Provider) Exchange(code string) (string, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.redirectURL)
+	req, err := http.NewRequest("POST", p.tokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	rsp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: token endpoint returned %s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.Unmarshal(body, &tok); err != nil {
+		return "", err
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("oidc: token response has no id_token")
+	}
+	return tok.IDToken, nil
+}
+
+// Verify checks the signature, issuer, audience, expiry and nonce of an ID token
+func (p *Provider) Verify(rawIDToken, nonce string) (*Claims, error) {
+	mc := jwt.MapClaims{}
+	parser := jwt.Parser{ValidMethods: validMethods}
+	tkn, err := parser.ParseWithClaims(rawIDToken, mc, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !tkn.Valid {
+		return nil, errors.New("oidc: invalid id token")
+	}
+	if _, ok := mc["exp"]; !ok {
+		return nil, errors.New("oidc: id token has no expiry")
+	}
+	claims := &Claims{}
+	claims.Issuer, _ = mc["iss"].(string)
+	claims.Subject, _ = mc["sub"].(string)
+	claims.Email, _ = mc["email"].(string)
+	// some providers send this as a string
+	switch v := mc["email_verified"].(type) {
+	case bool:
+		claims.EmailVerified = v
+	case string:
+		claims.EmailVerified = v == "true"
+	}
+	if claims.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: id token issued by %q, expected %q", claims.Issuer, p.Issuer)
+	}
+	if !hasAudience(mc["aud"], p.ClientID) {
+		return nil, errors.New("oidc: id token not issued for this client")
+	}
+	if n, _ := mc["nonce"].(string); nonce == "" || n != nonce {
+		return nil, errors.New("oidc: id token nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("oidc: id token has no subject")
+	}
+	return claims, nil
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if s, _ := a.(string); s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EmailAllowed reports whether users with email can sign in with this provider
+func (p *Provider) EmailAllowed(email string) bool {
+	if len(p.AllowedEmailDomains) == 0 {
+		return true
+	}
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[i+1:])
+	for _, d := range p.AllowedEmailDomains {
+		if strings.ToLower(d) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// get signing key kid, refetching provider's keys if we don't know it
+func (p *Provider) key(kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < minKeysRefreshInterval {
+		return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keysFetched = time.Now()
+	p.keys = make(map[string]interface{})
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = pub
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+}
+
+// JSON web key, RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("oidc: unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("oidc: invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("oidc: unsupported key type %q", k.Kty)
+}
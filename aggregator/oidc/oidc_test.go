@@ -0,0 +1,188 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// mockProvider is a minimal OpenID Connect provider issuing ID tokens with
+// whatever claims the test sets for the next code exchange
+type mockProvider struct {
+	srv    *httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.srv.URL,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"jwks_uri":               m.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "secret" || r.FormValue("code") != "code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, m.claims)
+		tkn.Header["kid"] = "test"
+		signed, err := tkn.SignedString(key)
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "x", "token_type": "Bearer", "id_token": signed})
+	})
+	m.srv = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockProvider) validClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            m.srv.URL,
+		"sub":            "1234",
+		"aud":            []string{"client", "other"},
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "user@productimon.com",
+		"email_verified": true,
+	}
+}
+
+func TestLoginFlow(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.srv.Close()
+	p, err := NewProvider(ProviderConfig{
+		Name:                "mock",
+		Issuer:              m.srv.URL,
+		ClientID:            "client",
+		ClientSecret:        "secret",
+		AllowedEmailDomains: []string{"Productimon.com"},
+	}, "https://my.productimon.com/oidc/callback", m.srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loggedIn *Claims
+	var result *Login
+	h := NewHandler([]*Provider{p}, func(r *http.Request, p *Provider, claims *Claims) (*Login, error) {
+		loggedIn = claims
+		return result, nil
+	}, func(msg string, err error) { t.Log(msg, err) })
+
+	// start login, returns state cookie and nonce sent to provider
+	login := func() (*http.Cookie, string, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/oidc/login?provider=mock", nil))
+		if rec.Code != http.StatusFound {
+			t.Fatalf("login returned %d", rec.Code)
+		}
+		loc, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(loc.String(), m.srv.URL+"/authorize?") {
+			t.Fatalf("login redirected to %q", rec.Header().Get("Location"))
+		}
+		if loc.Query().Get("client_id") != "client" || loc.Query().Get("redirect_uri") != "https://my.productimon.com/oidc/callback" {
+			t.Errorf("bad authorize request %q", loc)
+		}
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("login set %d cookies", len(cookies))
+		}
+		return cookies[0], loc.Query().Get("state"), loc.Query().Get("nonce")
+	}
+	callback := func(cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oidc/callback?code=code&state="+url.QueryEscape(state), nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	result = &Login{Token: "our-token"}
+	cookie, state, nonce := login()
+	m.claims = m.validClaims(nonce)
+	rec := callback(cookie, state)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"our-token"`) {
+		t.Fatalf("callback returned %d %q", rec.Code, rec.Body.String())
+	}
+	if loggedIn == nil || loggedIn.Subject != "1234" || loggedIn.Email != "user@productimon.com" || loggedIn.Issuer != m.srv.URL {
+		t.Errorf("logged in with %+v", loggedIn)
+	}
+
+	// the sign in page asks for the second factor
+	result = &Login{MFAChallenge: "our-challenge"}
+	cookie, state, nonce = login()
+	m.claims = m.validClaims(nonce)
+	rec = callback(cookie, state)
+	if body := rec.Body.String(); rec.Code != http.StatusOK || !strings.Contains(body, `"our-challenge"`) || strings.Contains(body, `"token"`) {
+		t.Errorf("callback with challenge returned %d %q", rec.Code, body)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(c jwt.MapClaims)
+		state  string
+		want   int
+	}{
+		{"wrong state", nil, "nope", http.StatusBadRequest},
+		{"wrong nonce", func(c jwt.MapClaims) { c["nonce"] = "nope" }, "", http.StatusUnauthorized},
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "other" }, "", http.StatusUnauthorized},
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.com" }, "", http.StatusUnauthorized},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, "", http.StatusUnauthorized},
+		{"unverified email", func(c jwt.MapClaims) { c["email_verified"] = false }, "", http.StatusForbidden},
+		{"domain not allowed", func(c jwt.MapClaims) { c["email"] = "user@gmail.com" }, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		loggedIn = nil
+		cookie, state, nonce := login()
+		m.claims = m.validClaims(nonce)
+		if tt.mutate != nil {
+			tt.mutate(m.claims)
+		}
+		if tt.state != "" {
+			state = tt.state
+		}
+		if rec := callback(cookie, state); rec.Code != tt.want || loggedIn != nil {
+			t.Errorf("%s: callback returned %d, want %d (logged in: %v)", tt.name, rec.Code, tt.want, loggedIn != nil)
+		}
+	}
+}
+
+func TestProviders(t *testing.T) {
+	h := NewHandler([]*Provider{{ProviderConfig: ProviderConfig{Name: "corp", DisplayName: "Corp SSO"}}}, nil, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/oidc/providers", nil))
+	if want := `[{"name":"corp","display_name":"Corp SSO"}]`; strings.TrimSpace(rec.Body.String()) != want {
+		t.Errorf("got %q, want %q", rec.Body.String(), want)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/service"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+)
+
+// run -reprocess_intervals and print the intervals that changed
+func reprocessIntervals(s *service.Service) {
+	req := &spb.DataAggregatorReprocessIntervalsRequest{DryRun: flagReprocessDryRun}
+	if flagReprocess != "all" {
+		parts := strings.SplitN(flagReprocess, "/", 2)
+		req.User = &cpb.User{Id: parts[0]}
+		if len(parts) == 2 {
+			did, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				logger.Fatal("invalid device id in -reprocess_intervals", zap.Error(err), zap.String("reprocess_intervals", flagReprocess))
+			}
+			req.Device = &cpb.Device{User: req.User, Id: did}
+		}
+	}
+	rsp, err := s.Reprocess(req)
+	if err != nil {
+		logger.Fatal("can't reprocess intervals", zap.Error(err))
+	}
+	printInterval := func(prefix string, i *spb.DataAggregatorReprocessIntervalsResponse_Interval) {
+		fmt.Printf("%s %s - %s %v active %s\n", prefix,
+			time.Unix(0, i.Starttime).Format(time.RFC3339), time.Unix(0, i.Endtime).Format(time.RFC3339),
+			time.Duration(i.Activetime), i.App)
+	}
+	for _, d := range rsp.Devices {
+		fmt.Printf("%s/%d: %d unchanged, %d removed, %d added\n", d.Device.User.Id, d.Device.Id, d.Unchanged, len(d.Removed), len(d.Added))
+		for _, i := range d.Removed {
+			printInterval("-", i)
+		}
+		for _, i := range d.Added {
+			printInterval("+", i)
+		}
+	}
+	if flagReprocessDryRun {
+		fmt.Println("Dry run, nothing was changed")
+	}
+}
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"time"
 
+	"git.yiad.am/productimon/aggregator/authenticator"
+	"git.yiad.am/productimon/aggregator/messages"
 	"git.yiad.am/productimon/aggregator/notifications"
 	cpb "git.yiad.am/productimon/proto/common"
 	spb "git.yiad.am/productimon/proto/svc"
@@ -40,34 +43,152 @@ func (s *Service) Login(ctx context.Context, req *spb.DataAggregatorLoginRequest
 		return nil, status.Error(codes.Unauthenticated, "account not verified, please check your email")
 	}
 	s.log.Info("logged in", zap.String("uid", uid))
-	return s.returnToken(ctx, uid)
+	return s.loginResponse(ctx, uid)
+}
+
+// ErrIdentityNotLinked is returned by OIDCLogin when a user with the email
+// exists but the provider account may not be linked to them
+var ErrIdentityNotLinked = errors.New("a user with this email exists and isn't linked to the provider account")
+
+// OIDCLogin signs in the user with an account at an OpenID Connect provider,
+// linking it to the user with the same (provider verified) email if
+// linkExisting or creating a new user. the provider is trusted to have done
+// any two-factor authentication, so the auth token counts as having passed
+// it, unless the user has enabled TOTP: they get a challenge for
+// CompleteLogin instead
+func (s *Service) OIDCLogin(issuer, subject, email, userAgent string, linkExisting bool) (token, challenge string, err error) {
+	uid, err := s.linkOIDCIdentity(issuer, subject, email, linkExisting)
+	if err != nil {
+		return "", "", err
+	}
+	var totpEnabled bool
+	if err = s.db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", uid).Scan(&totpEnabled); err != nil {
+		return "", "", err
+	}
+	if totpEnabled {
+		s.log.Info("oidc login needs second factor", zap.String("uid", uid), zap.String("issuer", issuer))
+		challenge, err = s.auther.SignChallengeToken(uid)
+		return "", challenge, err
+	}
+	s.log.Info("logged in with oidc", zap.String("uid", uid), zap.String("issuer", issuer))
+	sid, end, err := s.createSession(uid, userAgent)
+	if err != nil {
+		return "", "", err
+	}
+	token, err = s.auther.SignToken(uid, sid, true, end)
+	return token, "", err
+}
+
+// returns the user linked to the provider account, see OIDCLogin
+func (s *Service) linkOIDCIdentity(issuer, subject, email string, linkExisting bool) (string, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	var uid string
+	err := s.db.QueryRow("SELECT uid FROM user_identities WHERE issuer = ? AND subject = ?", issuer, subject).Scan(&uid)
+	switch {
+	case err == sql.ErrNoRows:
+		tx, err := s.db.Begin()
+		if err != nil {
+			return "", err
+		}
+		defer tx.Rollback()
+		err = tx.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&uid)
+		switch {
+		case err == sql.ErrNoRows:
+			uid = uuid.New().String()
+			// empty password hash never matches, user can only sign in with the provider
+			if _, err = tx.Exec("INSERT INTO users (id, email, password, verified) VALUES (?, ?, ?, ?)", uid, email, "", true); err != nil {
+				return "", err
+			}
+			s.log.Info("created user from oidc login", zap.String("uid", uid), zap.String("issuer", issuer))
+		case err != nil:
+			return "", err
+		case !linkExisting:
+			return "", ErrIdentityNotLinked
+		default:
+			// provider has verified the email, no need for our verification link
+			if _, err = tx.Exec("UPDATE users SET verified = ? WHERE id = ?", true, uid); err != nil {
+				return "", err
+			}
+		}
+		if _, err = tx.Exec("INSERT INTO user_identities (issuer, subject, uid) VALUES (?, ?, ?)", issuer, subject, uid); err != nil {
+			return "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return "", err
+		}
+		s.log.Info("linked oidc identity", zap.String("uid", uid), zap.String("issuer", issuer))
+	case err != nil:
+		return "", err
+	}
+	return uid, nil
 }
 
 func (s *Service) DeviceSignin(ctx context.Context, req *spb.DataAggregatorDeviceSigninRequest) (*spb.DataAggregatorDeviceSigninResponse, error) {
-	uid, did, err := s.auther.AuthenticateRequest(ctx)
-	if err != nil || did != -1 {
-		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	uid, pairing, err := s.authenticateDeviceSignin(ctx)
+	if err != nil {
+		return nil, err
 	}
-	err = s.db.QueryRow("SELECT MAX(id) FROM devices WHERE uid=?", uid).Scan(&did)
+	s.db.Lock()
+	defer s.db.Unlock()
+	tx, err := s.db.Begin()
 	if err != nil {
-		s.log.Debug("DeviceSignin: MAX(id) FROM devices failed", zap.Error(err))
-		did = 0
-	} else {
-		did += 1
+		s.log.Error("can't begin transaction", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
 	}
-	s.log.Info("DeviceSignin: signing cert", zap.String("uid", uid), zap.Int64("did", did))
-	s.dbWLock.Lock()
-	defer s.dbWLock.Unlock()
-	_, err = s.db.Exec("INSERT INTO devices(uid, id, name, kind) VALUES(?, ?, ?, ?)", uid, did, req.Device.Name, req.Device.DeviceType)
+	// the device is inserted first, so no other signin gets its id before its certificate is issued
+	did, err := s.insertNextId(tx, "devices", uid, 0, func(did int64) error {
+		_, err := tx.Exec("INSERT INTO devices(uid, id, name, kind) VALUES(?, ?, ?, ?)", uid, did, req.Device.Name, req.Device.DeviceType)
+		return err
+	})
 	if err != nil {
-		s.log.Error("can't insert device", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did), zap.String("device_name", req.Device.Name))
+		tx.Rollback()
+		s.log.Error("can't insert device", zap.Error(err), zap.String("uid", uid), zap.String("device_name", req.Device.Name))
 		return nil, status.Error(codes.Internal, "something went wrong")
 	}
-	cert, key, err := s.auther.SignDeviceCert(uid, did)
+	var cert, key []byte
+	var serial string
+	if len(req.Csr) > 0 {
+		s.log.Info("DeviceSignin: signing csr", zap.String("uid", uid), zap.Int64("did", did))
+		cert, serial, err = s.auther.SignDeviceCSR(uid, did, req.Csr)
+	} else {
+		s.log.Info("DeviceSignin: signing cert", zap.String("uid", uid), zap.Int64("did", did))
+		cert, key, serial, err = s.auther.SignDeviceCert(uid, did)
+	}
 	if err != nil {
+		tx.Rollback()
+	}
+	switch {
+	case err == authenticator.ErrInvalidCSR:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case err == authenticator.ErrCSRSubjectMismatch:
+		// another device signed in since the reporter got the subject
+		return nil, status.Error(codes.Aborted, err.Error())
+	case err != nil:
 		s.log.Error("can't sign device cert", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did), zap.String("device_name", req.Device.Name))
 		return nil, status.Error(codes.Internal, "something went wrong")
 	}
+	if pairing != "" {
+		ok, err := s.consumePairing(tx, uid, pairing)
+		if err != nil {
+			tx.Rollback()
+			s.log.Error("can't consume pairing", zap.Error(err), zap.String("uid", uid))
+			return nil, status.Error(codes.Internal, "something went wrong")
+		}
+		if !ok {
+			tx.Rollback()
+			return nil, status.Error(codes.Unauthenticated, "pairing has already been used")
+		}
+	}
+	if _, err = tx.Exec("UPDATE devices SET cert_serial = ? WHERE uid = ? AND id = ?", serial, uid, did); err != nil {
+		tx.Rollback()
+		s.log.Error("can't set device cert", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if err = tx.Commit(); err != nil {
+		s.log.Error("commit device failed", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
 	return &spb.DataAggregatorDeviceSigninResponse{
 		Cert: cert,
 		Key:  key,
@@ -93,16 +214,22 @@ func (s *Service) Signup(ctx context.Context, req *spb.DataAggregatorSignupReque
 		return nil, status.Error(codes.Internal, "something went wrong")
 	}
 	uid := uuid.New().String()
-	s.dbWLock.Lock()
-	defer s.dbWLock.Unlock()
 	verified := false
 	vtoken, err := s.auther.SignVerificationToken(req.User.Email)
 	if err != nil {
 		s.log.Error("can't sign verification token", zap.Error(err), zap.String("email", req.User.Email))
 		return nil, status.Error(codes.Internal, "something went wrong with signing token")
 	}
-	if err = s.Notify("email", req.User.Email, fmt.Sprintf(
-		"Hi there! Verify your productimon email here: https://%s/verify?token=%s", s.domain, url.QueryEscape(vtoken))); err != nil {
+	msg, err := s.messages.Render(messages.VerifyEmail, "", &messages.Data{
+		Domain: s.domain,
+		User:   messages.User{Email: req.User.Email},
+		Link:   fmt.Sprintf("https://%s/verify?token=%s", s.domain, url.QueryEscape(vtoken)),
+	})
+	if err != nil {
+		s.log.Error("can't render verification email", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if err = s.Notify("email", req.User.Email, msg); err != nil {
 		switch err {
 		case notifications.ErrNotRegistered:
 			verified = true
@@ -111,7 +238,9 @@ func (s *Service) Signup(ctx context.Context, req *spb.DataAggregatorSignupReque
 			return nil, status.Error(codes.Internal, "something went wrong")
 		}
 	}
-	_, err = s.db.Exec("INSERT INTO users (id, email, password, verified) VALUES (?, ?, ?, ?)", uid, req.User.Email, pwd, verified)
+	s.db.Lock()
+	_, err = s.db.Exec("INSERT INTO users (id, email, password, verified) VALUES (?, ?, ?, ?)", uid, req.User.Email, string(pwd), verified)
+	s.db.Unlock()
 	if err != nil {
 		s.log.Error("error inserting user for signup", zap.Error(err), zap.String("uid", uid), zap.String("email", req.User.Email))
 		return nil, status.Error(codes.Internal, "something went wrong")
@@ -120,15 +249,34 @@ func (s *Service) Signup(ctx context.Context, req *spb.DataAggregatorSignupReque
 		// TODO: instead of using an error, have proper proto types for this
 		return nil, status.Error(codes.Internal, "Please check your email and click the verification link!")
 	}
-	return s.returnToken(ctx, uid)
+	return s.loginResponse(ctx, uid)
 }
 
 func (s *Service) ExtendToken(ctx context.Context, req *cpb.Empty) (*spb.DataAggregatorLoginResponse, error) {
-	uid, did, err := s.auther.AuthenticateRequest(ctx)
-	if err != nil || did != -1 {
+	claims, err := s.auther.AuthenticateToken(ctx)
+	if err != nil {
 		return nil, status.Error(codes.Unauthenticated, "Invalid token")
 	}
-	return s.returnToken(ctx, uid)
+	if !claims.MFA {
+		// user has enabled 2fa (or it's been enforced) since logging in
+		required, err := s.mfaRequired(claims.Uid)
+		if err != nil {
+			s.log.Error("failed to get 2fa status", zap.Error(err), zap.String("uid", claims.Uid))
+			return nil, status.Error(codes.Internal, "something went wrong")
+		}
+		if required {
+			return nil, status.Error(codes.Unauthenticated, "two-factor authentication is required, please log in again")
+		}
+	}
+	end, err := s.refreshSession(claims.Uid, claims.Id)
+	if err == errSessionEnded {
+		return nil, status.Error(codes.Unauthenticated, "session has ended, please log in again")
+	}
+	if err != nil {
+		s.log.Error("failed to refresh session", zap.Error(err), zap.String("uid", claims.Uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	return s.sessionToken(claims.Uid, claims.Id, claims.MFA, end)
 }
 
 func (s *Service) UserDetails(ctx context.Context, req *cpb.Empty) (*spb.DataAggregatorUserDetailsResponse, error) {
@@ -137,8 +285,8 @@ func (s *Service) UserDetails(ctx context.Context, req *cpb.Empty) (*spb.DataAgg
 		return nil, status.Error(codes.Unauthenticated, "Invalid token")
 	}
 	var email string
-	var admin bool
-	err = s.db.QueryRow("SELECT email, admin FROM users WHERE id = ? LIMIT 1", uid).Scan(&email, &admin)
+	var admin, totpEnabled bool
+	err = s.db.QueryRow("SELECT email, admin, totp_enabled FROM users WHERE id = ? LIMIT 1", uid).Scan(&email, &admin, &totpEnabled)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "User missing from db")
 	}
@@ -158,12 +306,24 @@ func (s *Service) UserDetails(ctx context.Context, req *cpb.Empty) (*spb.DataAgg
 		Device: &cpb.Device{
 			Id: did,
 		},
+		TotpEnabled: totpEnabled,
 	}
 	return ret, nil
 }
 
-func (s *Service) returnToken(ctx context.Context, uid string) (*spb.DataAggregatorLoginResponse, error) {
-	token, err := s.auther.SignToken(uid)
+// log uid in with a new session
+func (s *Service) returnToken(ctx context.Context, uid string, mfa bool) (*spb.DataAggregatorLoginResponse, error) {
+	sid, end, err := s.createSession(uid, userAgent(ctx))
+	if err != nil {
+		s.log.Error("can't create session", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	return s.sessionToken(uid, sid, mfa, end)
+}
+
+// token for existing session sid of uid
+func (s *Service) sessionToken(uid, sid string, mfa bool, end time.Time) (*spb.DataAggregatorLoginResponse, error) {
+	token, err := s.auther.SignToken(uid, sid, mfa, end)
 	if err != nil {
 		s.log.Error("can't sign token", zap.Error(err), zap.String("uid", uid))
 		return nil, status.Error(codes.Internal, "something went wrong with signing token")
@@ -204,8 +364,8 @@ func (s *Service) DeleteAccount(ctx context.Context, req *cpb.Empty) (*cpb.Empty
 		return nil, status.Error(codes.Unauthenticated, "Invalid token")
 	}
 
-	s.dbWLock.Lock()
-	defer s.dbWLock.Unlock()
+	s.db.Lock()
+	defer s.db.Unlock()
 
 	var email string
 	err = s.db.QueryRow("SELECT email FROM users WHERE id = ?", uid).Scan(&email)
@@ -233,7 +393,7 @@ func (s *Service) GetDevices(ctx context.Context, req *cpb.Empty) (*spb.DataAggr
 		return nil, status.Error(codes.Unauthenticated, "Invalid token")
 	}
 
-	rows, err := s.db.Query("SELECT id, name FROM devices WHERE uid = ?", uid)
+	rows, err := s.db.Query("SELECT id, name FROM devices WHERE uid = ? AND removed = ?", uid, false)
 
 	rsp := &spb.DataAggregatorGetDevicesResponse{}
 	switch {
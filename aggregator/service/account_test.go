@@ -0,0 +1,53 @@
+package service
+
+import (
+	"testing"
+
+	spb "git.yiad.am/productimon/proto/svc"
+)
+
+const testIssuer = "https://sso.productimon.com"
+
+func TestOIDCLogin(t *testing.T) {
+	s := startRPCService(t)
+	token, challenge, err := s.OIDCLogin(testIssuer, "new", "new@productimon.com", "test", false)
+	if err != nil || token == "" || challenge != "" {
+		t.Fatalf("OIDCLogin of new user returned token %q and challenge %q (error %v), want a token", token, challenge, err)
+	}
+	newUid, _, err := s.auther.VerifyToken(token)
+	if err != nil {
+		t.Fatalf("OIDCLogin returned invalid token: %v", err)
+	}
+	if token, _, err = s.OIDCLogin(testIssuer, "new", "new@productimon.com", "test", false); err != nil {
+		t.Fatalf("second OIDCLogin failed: %v", err)
+	}
+	if uid, _, _ := s.auther.VerifyToken(token); uid != newUid {
+		t.Errorf("second OIDCLogin signed in %s, want %s", uid, newUid)
+	}
+
+	// existing users are only linked if the provider allows it
+	uid := addUser(t, s, "user@productimon.com", "password")
+	if _, _, err = s.OIDCLogin(testIssuer, "user", "user@productimon.com", "test", false); err != ErrIdentityNotLinked {
+		t.Errorf("OIDCLogin of existing user = %v, want %v", err, ErrIdentityNotLinked)
+	}
+	if token, _, err = s.OIDCLogin(testIssuer, "user", "user@productimon.com", "test", true); err != nil {
+		t.Fatalf("OIDCLogin linking existing user failed: %v", err)
+	}
+	if got, _, _ := s.auther.VerifyToken(token); got != uid {
+		t.Errorf("OIDCLogin linking existing user signed in %s, want %s", got, uid)
+	}
+}
+
+func TestOIDCLoginRequiresTOTP(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "mfa@productimon.com", "password")
+	secret := enableTOTP(t, s, uid, "7kq2m-x4fzt")
+	token, challenge, err := s.OIDCLogin(testIssuer, "mfa", "mfa@productimon.com", "test", true)
+	if err != nil || token != "" || challenge == "" {
+		t.Fatalf("OIDCLogin returned token %q and challenge %q (error %v), want only a challenge", token, challenge, err)
+	}
+	rsp, err := completeLogin(s, challenge, currentCode(t, secret))
+	if err != nil || rsp.Token == "" || rsp.MfaState != spb.DataAggregatorLoginResponse_NONE {
+		t.Errorf("CompleteLogin returned %v (error %v), want a token", rsp, err)
+	}
+}
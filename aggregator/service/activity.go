@@ -0,0 +1,81 @@
+package service
+
+import (
+	"flag"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	flagMinKeystrokesPerMinute int64
+	flagMinClicksPerMinute     int64
+	flagIdleGap                time.Duration
+)
+
+func init() {
+	flag.Int64Var(&flagMinKeystrokesPerMinute, "min_keystrokes_per_minute", 0, "Default minimum keystrokes per minute for time to count as active, unless there are enough mouse clicks")
+	flag.Int64Var(&flagMinClicksPerMinute, "min_clicks_per_minute", 0, "Default minimum mouse clicks per minute for time to count as active, unless there are enough keystrokes")
+	flag.DurationVar(&flagIdleGap, "idle_gap", time.Minute, "Default time each keystroke or mouse click keeps a user active without further input (0 for the whole activity event)")
+}
+
+// decides how much of the time covered by activity events users were active
+type activityModel struct {
+	minKeystrokesPerMinute int64
+	minClicksPerMinute     int64
+	// nanoseconds
+	idleGap int64
+}
+
+func defaultActivityModel() activityModel {
+	return activityModel{
+		minKeystrokesPerMinute: flagMinKeystrokesPerMinute,
+		minClicksPerMinute:     flagMinClicksPerMinute,
+		idleGap:                int64(flagIdleGap),
+	}
+}
+
+// the server defaults with the user's overrides
+func (s *Service) getActivityModel(uid string) activityModel {
+	m := defaultActivityModel()
+	var keystrokes, clicks, idleGap int64
+	if err := s.db.QueryRow("SELECT min_keystrokes_per_minute, min_clicks_per_minute, idle_gap FROM users WHERE id = ?", uid).Scan(&keystrokes, &clicks, &idleGap); err != nil {
+		s.log.Error("failed to get user activity settings", zap.Error(err), zap.String("uid", uid))
+		return m
+	}
+	if keystrokes > 0 {
+		m.minKeystrokesPerMinute = keystrokes
+	}
+	if clicks > 0 {
+		m.minClicksPerMinute = clicks
+	}
+	if idleGap > 0 {
+		m.idleGap = idleGap
+	}
+	return m
+}
+
+// whether an activity event has any input and enough keystrokes or clicks per minute
+func (m activityModel) isActive(keystrokes, mouseclicks, starttime, endtime int64) bool {
+	d := endtime - starttime
+	if keystrokes+mouseclicks <= 0 {
+		return false
+	}
+	if d <= 0 {
+		return true
+	}
+	return keystrokes*int64(time.Minute) >= m.minKeystrokesPerMinute*d || mouseclicks*int64(time.Minute) >= m.minClicksPerMinute*d
+}
+
+// nanoseconds of an activity event the user was active for: none if it isn't
+// active, otherwise idleGap for each input, up to the whole event
+func (m activityModel) activeTime(keystrokes, mouseclicks, starttime, endtime int64) int64 {
+	if !m.isActive(keystrokes, mouseclicks, starttime, endtime) {
+		return 0
+	}
+	d := endtime - starttime
+	if m.idleGap > 0 && (keystrokes+mouseclicks)*m.idleGap < d {
+		return (keystrokes + mouseclicks) * m.idleGap
+	}
+	return d
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	cpb "git.yiad.am/productimon/proto/common"
+)
+
+const minute = int64(time.Minute)
+
+func inputs(eid, start, end, keystrokes, clicks int64) *cpb.Event {
+	return &cpb.Event{
+		Id:           eid,
+		Timeinterval: &cpb.Interval{Start: &cpb.Timestamp{Nanos: start}, End: &cpb.Timestamp{Nanos: end}},
+		Kind:         &cpb.Event_ActivityEvent{ActivityEvent: &cpb.ActivityEvent{Keystrokes: keystrokes, Mouseclicks: clicks}},
+	}
+}
+
+func TestActivityModel(t *testing.T) {
+	m := activityModel{minKeystrokesPerMinute: 10, minClicksPerMinute: 4, idleGap: 10 * int64(time.Second)}
+	for _, tc := range []struct {
+		name                string
+		keystrokes, clicks  int64
+		start, end, wantAct int64
+	}{
+		{"typing", 60, 0, 0, minute, minute},
+		{"clicking", 0, 4, 0, minute, 40 * int64(time.Second)},
+		{"too few inputs", 9, 3, 0, minute, 0},
+		{"short burst", 2, 0, 0, 5 * int64(time.Second), 5 * int64(time.Second)},
+		{"rate over long event", 20, 0, 0, 2 * minute, 2 * minute},
+		{"sparse over long event", 19, 0, 0, 2 * minute, 0},
+		{"input limited by idle gap", 0, 10, 0, 2 * minute, 100 * int64(time.Second)},
+		{"instant", 1, 0, 5, 5, 0},
+	} {
+		if got := m.activeTime(tc.keystrokes, tc.clicks, tc.start, tc.end); got != tc.wantAct {
+			t.Errorf("%s: activeTime(%d, %d, %d, %d) = %v, want %v", tc.name, tc.keystrokes, tc.clicks, tc.start, tc.end, time.Duration(got), time.Duration(tc.wantAct))
+		}
+	}
+}
+
+func TestActivityModelNoInput(t *testing.T) {
+	// no minimum rates, so only the lack of input makes these inactive
+	for _, m := range []activityModel{{idleGap: minute}, {idleGap: 0}} {
+		if m.isActive(0, 0, 0, minute) {
+			t.Errorf("event without input is active with idle gap %v", time.Duration(m.idleGap))
+		}
+		if got := m.activeTime(0, 0, 0, 5*minute); got != 0 {
+			t.Errorf("activeTime of event without input with idle gap %v = %v, want 0", time.Duration(m.idleGap), time.Duration(got))
+		}
+		if got := m.activeTime(0, 1, 0, 5*minute); got == 0 {
+			t.Errorf("activeTime of event with a click with idle gap %v = 0", time.Duration(m.idleGap))
+		}
+	}
+}
+
+func TestActiveTime(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	defer db.Close()
+
+	// server defaults: any input keeps the user active for a minute
+	addEvents(t, s,
+		appSwitch(1, 0, "vim"),
+		inputs(2, 0, minute, 30, 2),
+		inputs(3, minute, 2*minute, 1, 0),
+		// idle for a minute, then reading with the odd click
+		inputs(4, 3*minute, 5*minute, 0, 2),
+		// one click over two minutes is only a minute
+		inputs(5, 5*minute, 7*minute, 0, 1),
+		appSwitch(6, 7*minute, "firefox"),
+	)
+	checkIntervals(t, s, []testInterval{{0, 7 * minute, 5 * minute, "vim"}})
+
+	// user only counts time with at least 20 keystrokes a minute, kept active
+	// for 2 seconds by each
+	if _, err := s.db.Exec("UPDATE users SET min_keystrokes_per_minute = ?, min_clicks_per_minute = ?, idle_gap = ? WHERE id = ?",
+		20, 1000, int64(2*time.Second), testUid); err != nil {
+		t.Fatalf("can't update activity settings: %v", err)
+	}
+	addEvents(t, s,
+		inputs(7, 7*minute, 8*minute, 20, 0),
+		inputs(8, 8*minute, 9*minute, 10, 50),
+		inputs(9, 9*minute, 10*minute, 60, 0),
+		stopTracking(10, 10*minute),
+	)
+	checkIntervals(t, s, []testInterval{{0, 7 * minute, 5 * minute, "vim"}, {7 * minute, 10 * minute, 40*int64(time.Second) + minute, "firefox"}})
+}
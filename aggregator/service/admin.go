@@ -42,8 +42,8 @@ func (s *Service) PromoteAccount(ctx context.Context, user *cpb.User) (*cpb.Empt
 	if !s.isRootAdmin(ctx) {
 		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
 	}
-	s.dbWLock.Lock()
-	defer s.dbWLock.Unlock()
+	s.db.Lock()
+	defer s.db.Unlock()
 	// if user is already an admin, we just return success
 	if user.Id != "" {
 		res, err := s.db.Exec("UPDATE users SET admin = TRUE WHERE id = ?", user.Id)
@@ -73,8 +73,8 @@ func (s *Service) DemoteAccount(ctx context.Context, user *cpb.User) (*cpb.Empty
 	if !s.isRootAdmin(ctx) {
 		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
 	}
-	s.dbWLock.Lock()
-	defer s.dbWLock.Unlock()
+	s.db.Lock()
+	defer s.db.Unlock()
 	// if user doesn't exist or isn't an admin, we just don't do anything without returning an error
 	if user.Id != "" {
 		if _, err := s.db.Exec("UPDATE users SET admin = FALSE WHERE id = ?", user.Id); err != nil {
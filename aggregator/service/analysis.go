@@ -2,40 +2,61 @@ package service
 
 import (
 	"context"
-	"database/sql"
 
-	cpb "git.yiad.am/productimon/proto/common"
+	"git.yiad.am/productimon/aggregator/storage"
+	"git.yiad.am/productimon/analyzer/deviceState"
 	spb "git.yiad.am/productimon/proto/svc"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-func (s *Service) findActiveTime(uid, dFilter string, stime, etime int64, tx *sql.Tx) int64 {
-	rows, err := tx.Query("SELECT I.starttime, I.endtime, A.keystrokes, A.mouseclicks FROM intervals I JOIN activity_events A ON I.id=A.id WHERE I.uid = ? AND I.endtime >= ? AND I.starttime <= ? AND I.kind=?"+dFilter, uid, stime, etime, cpb.EventType_ACTIVITY_EVENT)
-	var ret int64
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var st, et, ks, mc int64
-			rows.Scan(&st, &et, &ks, &mc)
-			if s.isActive(ks, mc, st, et) {
-				if st < stime {
-					st = stime
-				}
-				if et > etime {
-					et = etime
-				}
-				ret += et - st
-			}
+// active time of the part of an interval from st to et with active time at
+// between start and end. Active time in its activity buckets is counted where
+// it is, the rest (e.g. from before buckets were stored) in proportion to how
+// much of the interval is between start and end
+func clippedActiveTime(tx *storage.Tx, uid string, did, st, et, at, start, end int64) (int64, error) {
+	rows, err := tx.Query("SELECT minute, activetime FROM activity_buckets WHERE uid = ? AND did = ? AND starttime = ?", uid, did, st)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var ret float64
+	var bucketed int64
+	for rows.Next() {
+		var minute, active int64
+		if err = rows.Scan(&minute, &active); err != nil {
+			return 0, err
+		}
+		bucketed += active
+		// the part of the interval in this minute, and of that between start and end
+		bs, be := minute, minute+deviceState.BucketSize
+		if bs < st {
+			bs = st
+		}
+		if be > et {
+			be = et
+		}
+		cs, ce := bs, be
+		if cs < start {
+			cs = start
 		}
+		if ce > end {
+			ce = end
+		}
+		if be <= bs || ce <= cs {
+			continue
+		}
+		ret += float64(active) * float64(ce-cs) / float64(be-bs)
 	}
-	return ret
-}
-
-// TODO
-func (s *Service) isActive(keystrokes, mouseclicks, starttime, endtime int64) bool {
-	return true
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if bucketed < at {
+		_, rest := clipUsage(st, et, at-bucketed, start, end)
+		ret += float64(rest)
+	}
+	return int64(ret), nil
 }
 
 func (s *Service) GetTime(ctx context.Context, req *spb.DataAggregatorGetTimeRequest) (*spb.DataAggregatorGetTimeResponse, error) {
@@ -46,11 +67,11 @@ func (s *Service) GetTime(ctx context.Context, req *spb.DataAggregatorGetTimeReq
 
 	intervals := req.GetIntervals()
 
-	var merge func(app string, tottime, acttime int64, result map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint, tx *sql.Tx)
+	var merge timeMerger
 
 	switch req.GroupBy {
 	case spb.DataAggregatorGetTimeRequest_APPLICATION:
-		merge = func(app string, tottime, acttime int64, result map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint, tx *sql.Tx) {
+		merge = func(app string, tottime, acttime int64, result map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint, tx *storage.Tx) {
 			dp, ok := result[app]
 			if !ok {
 				dp = &spb.DataAggregatorGetTimeResponse_RangeData_DataPoint{
@@ -63,7 +84,7 @@ func (s *Service) GetTime(ctx context.Context, req *spb.DataAggregatorGetTimeReq
 			dp.Activetime += acttime
 		}
 	case spb.DataAggregatorGetTimeRequest_LABEL:
-		merge = func(app string, tottime, acttime int64, result map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint, tx *sql.Tx) {
+		merge = func(app string, tottime, acttime int64, result map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint, tx *storage.Tx) {
 			label := s.getLabel(uid, app, tx)
 			dp, ok := result[label]
 			if !ok {
@@ -83,12 +104,11 @@ func (s *Service) GetTime(ctx context.Context, req *spb.DataAggregatorGetTimeReq
 
 	devices := req.GetDevices()
 	dFilter := deviceFilters("did", devices)
-	idFilter := deviceFilters("intervals.did", devices)
 	s.log.Debug("using device filter", zap.String("dFilter", dFilter))
 
 	for _, in := range intervals {
 		rd := &spb.DataAggregatorGetTimeResponse_RangeData{Interval: in}
-		s.dbWLock.Lock()
+		s.db.Lock()
 		func() {
 			tx, err := s.db.Begin()
 			if err != nil {
@@ -96,31 +116,56 @@ func (s *Service) GetTime(ctx context.Context, req *spb.DataAggregatorGetTimeReq
 				return
 			}
 			defer tx.Commit()
-			rows, err := tx.Query("SELECT MAX(starttime, ?), MIN(endtime, ?), activetime, app FROM intervals WHERE uid = ? AND endtime >= ? AND starttime <= ?"+dFilter, in.Start.Nanos, in.End.Nanos, uid, in.Start.Nanos, in.End.Nanos)
-
+			result, err := s.getTime(uid, dFilter, in.Start.Nanos, in.End.Nanos, merge, tx)
 			if err != nil {
 				s.log.Error("error querying for GetTime", zap.Error(err))
 				return
 			}
-			result := make(map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint)
-			for rows.Next() {
-				var stime, etime, atime int64
-				var appname string
-				rows.Scan(&stime, &etime, &atime, &appname)
-				if stime == in.Start.Nanos || etime == in.End.Nanos {
-					atime = s.findActiveTime(uid, idFilter, in.Start.Nanos, in.End.Nanos, tx)
-				}
-				merge(appname, etime-stime, atime, result, tx)
-			}
-			rows.Close()
 			for _, v := range result {
 				rd.Data = append(rd.Data, v)
 			}
 		}()
-		s.dbWLock.Unlock()
+		s.db.Unlock()
 
 		rsp.Data = append(rsp.Data, rd)
 	}
 
 	return rsp, nil
 }
+
+// adds time spent in app to result
+type timeMerger func(app string, tottime, acttime int64, result map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint, tx *storage.Tx)
+
+// time in apps of the user's devices in dFilter between start and end, grouped
+// by merge
+func (s *Service) getTime(uid, dFilter string, start, end int64, merge timeMerger, tx *storage.Tx) (map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint, error) {
+	rows, err := tx.Query("SELECT did, starttime, endtime, activetime, app FROM intervals WHERE uid = ? AND endtime > ? AND starttime < ?"+dFilter, uid, start, end)
+	if err != nil {
+		return nil, err
+	}
+	type interval struct {
+		did, st, et, at int64
+		app             string
+	}
+	var intervals []interval
+	for rows.Next() {
+		var i interval
+		if err = rows.Scan(&i.did, &i.st, &i.et, &i.at, &i.app); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		intervals = append(intervals, i)
+	}
+	rows.Close()
+	result := make(map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint)
+	for _, i := range intervals {
+		tottime, acttime := clipUsage(i.st, i.et, i.at, start, end)
+		if i.st < start || i.et > end {
+			if acttime, err = clippedActiveTime(tx, uid, i.did, i.st, i.et, i.at, start, end); err != nil {
+				return nil, err
+			}
+		}
+		merge(i.app, tottime, acttime, result, tx)
+	}
+	return result, nil
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/storage"
+	spb "git.yiad.am/productimon/proto/svc"
+)
+
+type testTime struct {
+	total, active time.Duration
+}
+
+func getTestTime(t *testing.T, s *Service, start, end int64) map[string]testTime {
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatalf("can't begin transaction: %v", err)
+	}
+	defer tx.Commit()
+	merge := func(app string, tottime, acttime int64, result map[string]*spb.DataAggregatorGetTimeResponse_RangeData_DataPoint, tx *storage.Tx) {
+		dp, ok := result[app]
+		if !ok {
+			dp = &spb.DataAggregatorGetTimeResponse_RangeData_DataPoint{App: app}
+			result[app] = dp
+		}
+		dp.Time += tottime
+		dp.Activetime += acttime
+	}
+	result, err := s.getTime(testUid, "", start, end, merge, tx)
+	if err != nil {
+		t.Fatalf("getTime failed: %v", err)
+	}
+	ret := make(map[string]testTime)
+	for app, dp := range result {
+		ret[app] = testTime{time.Duration(dp.Time), time.Duration(dp.Activetime)}
+	}
+	return ret
+}
+
+func TestGetTimeClipping(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	defer db.Close()
+	sec := int64(time.Second)
+	// vim for 3.5 minutes, active in the first, third and half of the fourth
+	addEvents(t, s,
+		appSwitch(1, 0, "vim"),
+		inputs(2, 0, minute, 60, 0),
+		inputs(3, 2*minute, 3*minute, 1, 0),
+		inputs(4, 3*minute, 3*minute+30*sec, 1, 0),
+		appSwitch(5, 3*minute+30*sec, "firefox"),
+		inputs(6, 3*minute+30*sec, 4*minute, 0, 5),
+		stopTracking(7, 4*minute),
+	)
+	// from before activity buckets were stored
+	if _, err := s.db.Exec("INSERT INTO intervals (uid, did, starttime, endtime, activetime, app) VALUES (?, ?, ?, ?, ?, ?)",
+		testUid, testDid, 5*minute, 7*minute, minute, "legacy"); err != nil {
+		t.Fatalf("can't insert interval: %v", err)
+	}
+	// 2 of 4 minutes active, but only the third minute's active time is in
+	// buckets, like an interval that was open when buckets were added
+	if _, err := s.db.Exec("INSERT INTO intervals (uid, did, starttime, endtime, activetime, app) VALUES (?, ?, ?, ?, ?, ?)",
+		testUid, testDid, 20*minute, 24*minute, 2*minute, "upgraded"); err != nil {
+		t.Fatalf("can't insert interval: %v", err)
+	}
+	if _, err := s.db.Exec("INSERT INTO activity_buckets (uid, did, starttime, minute, activetime) VALUES (?, ?, ?, ?, ?)",
+		testUid, testDid, 20*minute, 22*minute, minute); err != nil {
+		t.Fatalf("can't insert activity bucket: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		start, end int64
+		want       map[string]testTime
+	}{
+		{"whole intervals", 0, 8 * minute, map[string]testTime{
+			"vim":     {3*time.Minute + 30*time.Second, 150 * time.Second},
+			"firefox": {30 * time.Second, 30 * time.Second},
+			"legacy":  {2 * time.Minute, time.Minute},
+		}},
+		{"clipped start", minute, 4 * minute, map[string]testTime{
+			"vim":     {2*time.Minute + 30*time.Second, 90 * time.Second},
+			"firefox": {30 * time.Second, 30 * time.Second},
+		}},
+		{"clipped start in a minute", 30 * sec, 3 * minute, map[string]testTime{
+			"vim": {2*time.Minute + 30*time.Second, 90 * time.Second},
+		}},
+		{"clipped end", 0, 2*minute + 30*sec, map[string]testTime{
+			"vim": {2*time.Minute + 30*time.Second, 90 * time.Second},
+		}},
+		{"clipped both ends", 30 * sec, 2*minute + 30*sec, map[string]testTime{
+			"vim": {2 * time.Minute, 60 * time.Second},
+		}},
+		{"clipped in a minute cut by the interval end", 3*minute + 15*sec, 3*minute + 45*sec, map[string]testTime{
+			"vim":     {15 * time.Second, 15 * time.Second},
+			"firefox": {15 * time.Second, 15 * time.Second},
+		}},
+		{"idle part", minute, 2 * minute, map[string]testTime{
+			"vim": {time.Minute, 0},
+		}},
+		{"clipped without buckets", 6 * minute, 8 * minute, map[string]testTime{
+			"legacy": {time.Minute, 30 * time.Second},
+		}},
+		{"partly bucketed", 20 * minute, 24 * minute, map[string]testTime{
+			"upgraded": {4 * time.Minute, 2 * time.Minute},
+		}},
+		{"partly bucketed, clipped to the bucket", 22 * minute, 23 * minute, map[string]testTime{
+			"upgraded": {time.Minute, 75 * time.Second},
+		}},
+		{"partly bucketed, clipped without the bucket", 19 * minute, 21 * minute, map[string]testTime{
+			"upgraded": {time.Minute, 15 * time.Second},
+		}},
+		{"nothing", 10 * minute, 11 * minute, map[string]testTime{}},
+	} {
+		got := getTestTime(t, s, tc.start, tc.end)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for app, want := range tc.want {
+			if got[app] != want {
+				t.Errorf("%s: %s got %v, want %v", tc.name, app, got[app], want)
+			}
+		}
+	}
+}
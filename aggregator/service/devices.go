@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"git.yiad.am/productimon/aggregator/authenticator"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// see authenticator.CertFunc
+func (s *Service) checkDeviceCert(uid string, did int64, serial string) error {
+	var current string
+	var removed bool
+	err := s.db.QueryRow("SELECT cert_serial, removed FROM devices WHERE uid = ? AND id = ?", uid, did).Scan(&current, &removed)
+	switch {
+	case err == sql.ErrNoRows:
+		return errors.New("device not found")
+	case err != nil:
+		return err
+	case removed:
+		return errors.New("device has been removed")
+	case current != "" && current != serial:
+		return errors.New("certificate has been revoked")
+	}
+	return nil
+}
+
+// id the next device of uid will get, unless another one signs in first
+func (s *Service) nextDeviceId(uid string) int64 {
+	var did int64
+	err := s.db.QueryRow("SELECT MAX(id) FROM devices WHERE uid=?", uid).Scan(&did)
+	if err != nil {
+		s.log.Debug("MAX(id) FROM devices failed", zap.Error(err))
+		return 0
+	}
+	return did + 1
+}
+
+// uid of the logged in user in request, if they may sign in new devices
+func (s *Service) authenticateNewDevice(ctx context.Context) (string, error) {
+	uid, did, mfa, err := s.auther.AuthenticateRequestMFA(ctx)
+	if err != nil || did != -1 {
+		return "", status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	if !mfa {
+		required, err := s.mfaRequired(uid)
+		if err != nil {
+			s.log.Error("failed to get 2fa status", zap.Error(err), zap.String("uid", uid))
+			return "", status.Error(codes.Internal, "something went wrong")
+		}
+		if required {
+			return "", status.Error(codes.PermissionDenied, "two-factor authentication is required")
+		}
+	}
+	return uid, nil
+}
+
+// like authenticateNewDevice but also accepts pairing tokens, pairing is the
+// id of the pairing if the request has one
+func (s *Service) authenticateDeviceSignin(ctx context.Context) (uid, pairing string, err error) {
+	if uid, pairing, err = s.auther.AuthenticatePairing(ctx); err == nil {
+		return uid, pairing, nil
+	}
+	uid, err = s.authenticateNewDevice(ctx)
+	return uid, "", err
+}
+
+// GetDeviceSigninSubject tells reporters what common name to put in the
+// certificate request for DeviceSignin
+func (s *Service) GetDeviceSigninSubject(ctx context.Context, req *cpb.Empty) (*spb.DataAggregatorDeviceSigninSubject, error) {
+	uid, _, err := s.authenticateDeviceSignin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &spb.DataAggregatorDeviceSigninSubject{
+		CommonName: authenticator.DeviceCommonName(uid, s.nextDeviceId(uid)),
+	}, nil
+}
+
+// RenewDeviceCert issues a new certificate to the device making the request
+// and revokes the one it used
+func (s *Service) RenewDeviceCert(ctx context.Context, req *spb.DataAggregatorRenewDeviceCertRequest) (*spb.DataAggregatorDeviceSigninResponse, error) {
+	uid, did, err := s.auther.AuthenticateRequest(ctx)
+	if err != nil || did == -1 {
+		return nil, status.Error(codes.Unauthenticated, "Invalid certificate")
+	}
+	var cert, key []byte
+	var serial string
+	if len(req.Csr) > 0 {
+		cert, serial, err = s.auther.SignDeviceCSR(uid, did, req.Csr)
+	} else {
+		cert, key, serial, err = s.auther.SignDeviceCert(uid, did)
+	}
+	switch {
+	case err == authenticator.ErrInvalidCSR || err == authenticator.ErrCSRSubjectMismatch:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		s.log.Error("can't sign device cert", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	if _, err = s.db.Exec("UPDATE devices SET cert_serial = ? WHERE uid = ? AND id = ?", serial, uid, did); err != nil {
+		s.log.Error("can't update device cert", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	s.deviceNotifier.Disconnect(uid, did)
+	s.log.Info("renewed device cert", zap.String("uid", uid), zap.Int64("did", did))
+	return &spb.DataAggregatorDeviceSigninResponse{
+		Cert: cert,
+		Key:  key,
+	}, nil
+}
+
+func (s *Service) RenameDevice(ctx context.Context, req *cpb.Device) (*cpb.Empty, error) {
+	uid, did, err := s.auther.AuthenticateRequest(ctx)
+	if err != nil || did != -1 {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	if req.Name == "" || len(req.Name) > 255 {
+		return nil, status.Error(codes.InvalidArgument, "device name must be 1 to 255 characters")
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	res, err := s.db.Exec("UPDATE devices SET name = ? WHERE uid = ? AND id = ? AND removed = ?", req.Name, uid, req.Id, false)
+	if err != nil {
+		s.log.Error("can't rename device", zap.Error(err), zap.String("uid", uid), zap.Int64("did", req.Id))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, status.Error(codes.NotFound, "device not found")
+	}
+	return &cpb.Empty{}, nil
+}
+
+// RemoveDevice revokes the device's certificate and hides it from the device
+// list. Its history stays in the user's data
+func (s *Service) RemoveDevice(ctx context.Context, req *cpb.Device) (*cpb.Empty, error) {
+	uid, did, err := s.auther.AuthenticateRequest(ctx)
+	if err != nil || did != -1 {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	res, err := s.db.Exec("UPDATE devices SET removed = ? WHERE uid = ? AND id = ? AND removed = ?", true, uid, req.Id, false)
+	if err != nil {
+		s.log.Error("can't remove device", zap.Error(err), zap.String("uid", uid), zap.Int64("did", req.Id))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, status.Error(codes.NotFound, "device not found")
+	}
+	s.deviceNotifier.Disconnect(uid, req.Id)
+	s.log.Info("removed device", zap.String("uid", uid), zap.Int64("did", req.Id))
+	return &cpb.Empty{}, nil
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"testing"
+	"time"
+
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// context of a request made with device certificate certPEM
+func certContext(t *testing.T, certPEM []byte) context.Context {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("can't decode device cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("can't parse device cert: %v", err)
+	}
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+	}})
+}
+
+// a PushEvent stream whose client never sends anything
+type pushStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	// closed once PushEvent starts receiving
+	receiving chan struct{}
+}
+
+func (s *pushStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *pushStream) Recv() (*cpb.Event, error) {
+	close(s.receiving)
+	<-s.ctx.Done()
+	return nil, io.EOF
+}
+
+func (s *pushStream) SendAndClose(*spb.DataAggregatorPushEventResponse) error {
+	return nil
+}
+
+// start PushEvent with certificate certPEM, the returned channel gets its result
+func startPushEvent(t *testing.T, s *Service, certPEM []byte) (<-chan error, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(certContext(t, certPEM))
+	stream := &pushStream{ctx: ctx, receiving: make(chan struct{})}
+	result := make(chan error, 1)
+	go func() { result <- s.PushEvent(stream) }()
+	select {
+	case <-stream.receiving:
+	case err := <-result:
+		t.Fatalf("PushEvent failed: %v", err)
+	}
+	return result, cancel
+}
+
+func checkStreamEnded(t *testing.T, what string, result <-chan error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		checkCode(t, what, err, codes.Unauthenticated)
+	case <-time.After(5 * time.Second):
+		t.Errorf("%s: stream is still open", what)
+	}
+}
+
+func TestRevokedDeviceDisconnected(t *testing.T) {
+	s := startRPCService(t)
+	addUser(t, s, "user@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	device, err := s.DeviceSignin(tokenContext(token), &spb.DataAggregatorDeviceSigninRequest{Device: &cpb.Device{Name: "laptop"}})
+	if err != nil {
+		t.Fatalf("DeviceSignin failed: %v", err)
+	}
+
+	result, cancel := startPushEvent(t, s, device.Cert)
+	defer cancel()
+	renewed, err := s.RenewDeviceCert(certContext(t, device.Cert), &spb.DataAggregatorRenewDeviceCertRequest{})
+	if err != nil {
+		t.Fatalf("RenewDeviceCert failed: %v", err)
+	}
+	checkStreamEnded(t, "PushEvent after RenewDeviceCert", result)
+
+	result, cancel = startPushEvent(t, s, renewed.Cert)
+	defer cancel()
+	if _, err = s.RemoveDevice(tokenContext(token), &cpb.Device{Id: 0}); err != nil {
+		t.Fatalf("RemoveDevice failed: %v", err)
+	}
+	checkStreamEnded(t, "PushEvent after RemoveDevice", result)
+}
+
+func TestAddEventRevokedDevice(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	addDevice(t, s, uid, 0)
+	if _, err := s.db.Exec("UPDATE devices SET cert_serial = ? WHERE uid = ? AND id = ?", "2a", uid, 0); err != nil {
+		t.Fatalf("can't set device cert: %v", err)
+	}
+	if err := s.AddEvent(uid, 0, "1a", appSwitch(1, 100, "vim")); err != errDeviceRevoked {
+		t.Errorf("AddEvent with old cert = %v, want %v", err, errDeviceRevoked)
+	}
+	if err := s.AddEvent(uid, 0, "2a", appSwitch(1, 100, "vim")); err != nil {
+		t.Errorf("AddEvent with current cert = %v", err)
+	}
+	if _, err := s.db.Exec("UPDATE devices SET removed = ? WHERE uid = ? AND id = ?", true, uid, 0); err != nil {
+		t.Fatalf("can't remove device: %v", err)
+	}
+	if err := s.AddEvent(uid, 0, "2a", appSwitch(2, 200, "bash")); err != errDeviceRevoked {
+		t.Errorf("AddEvent of removed device = %v, want %v", err, errDeviceRevoked)
+	}
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"git.yiad.am/productimon/analyzer/deviceState"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// how often to look for gaps older than -event_gap_timeout
+	eventGapSweepInterval = time.Minute
+	// skipped gaps returned by GetEventQueue
+	maxEventGaps = 20
+)
+
+var (
+	flagEventGapTimeout       time.Duration
+	flagEventQueueMaxBuffered int
+)
+
+func init() {
+	flag.DurationVar(&flagEventGapTimeout, "event_gap_timeout", 10*time.Minute, "How long to wait for a missing event of a device before skipping it and applying the later ones (0 to wait forever)")
+	flag.IntVar(&flagEventQueueMaxBuffered, "event_queue_max_buffered", 1000, "How many later events of a device may wait for a missing one before skipping it (0 for no limit)")
+}
+
+// skip missing events that have been waited on for too long periodically
+// to be run in its own goroutine
+func (s *Service) RunEventQueueRoutine() {
+	if flagEventGapTimeout <= 0 {
+		return
+	}
+	timer := time.NewTicker(eventGapSweepInterval)
+	for range timer.C {
+		s.ds.SkipStaleGaps(s)
+	}
+}
+
+func (s *Service) eventQueueResponse(device *cpb.Device, info deviceState.QueueInfo) (*spb.DataAggregatorEventQueue, error) {
+	metrics := deviceState.GetMetrics()
+	rsp := &spb.DataAggregatorEventQueue{
+		Device:              device,
+		LastEid:             info.LastEid,
+		BufferedEids:        info.BufferedEids,
+		TotalGapsSkipped:    metrics.GapsSkipped,
+		TotalEventsSkipped:  metrics.EventsSkipped,
+		TotalBufferedEvents: metrics.BufferedEvents,
+	}
+	if !info.WaitingSince.IsZero() {
+		rsp.WaitingSince = info.WaitingSince.UnixNano()
+	}
+	rows, err := s.db.Query("SELECT first_eid, last_eid, skipped_at, reason FROM event_gaps WHERE uid = ? AND did = ? ORDER BY skipped_at DESC LIMIT ?",
+		device.User.Id, device.Id, maxEventGaps)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		gap := &spb.DataAggregatorEventGap{}
+		if err = rows.Scan(&gap.FirstEid, &gap.LastEid, &gap.SkippedAt, &gap.Reason); err != nil {
+			return nil, err
+		}
+		rsp.Gaps = append(rsp.Gaps, gap)
+	}
+	return rsp, rows.Err()
+}
+
+func (s *Service) GetEventQueue(ctx context.Context, req *cpb.Device) (*spb.DataAggregatorEventQueue, error) {
+	if !s.isAdmin(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	if req.User == nil {
+		return nil, status.Error(codes.InvalidArgument, "device user not specified")
+	}
+	info, ok := s.ds.Queue(req.User.Id, req.Id)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "device has no event queue")
+	}
+	rsp, err := s.eventQueueResponse(req, info)
+	if err != nil {
+		s.log.Error("failed to get event gaps", zap.Error(err), zap.String("uid", req.User.Id), zap.Int64("did", req.Id))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	return rsp, nil
+}
+
+func (s *Service) FlushEventQueue(ctx context.Context, req *cpb.Device) (*spb.DataAggregatorEventQueue, error) {
+	if !s.isAdmin(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	if req.User == nil {
+		return nil, status.Error(codes.InvalidArgument, "device user not specified")
+	}
+	info, ok := s.ds.FlushQueue(s, req.User.Id, req.Id)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "device has no event queue")
+	}
+	s.log.Info("flushed event queue", zap.String("uid", req.User.Id), zap.Int64("did", req.Id), zap.Int64("lastEid", info.LastEid))
+	rsp, err := s.eventQueueResponse(req, info)
+	if err != nil {
+		s.log.Error("failed to get event gaps", zap.Error(err), zap.String("uid", req.User.Id), zap.Int64("did", req.Id))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	return rsp, nil
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"testing"
+
+	"git.yiad.am/productimon/analyzer/deviceState"
+)
+
+func eventGaps(t *testing.T, s *Service) [][2]int64 {
+	rows, err := s.db.Query("SELECT first_eid, last_eid FROM event_gaps WHERE uid = ? AND did = ? ORDER BY first_eid", testUid, testDid)
+	if err != nil {
+		t.Fatalf("can't get event gaps: %v", err)
+	}
+	defer rows.Close()
+	var ret [][2]int64
+	for rows.Next() {
+		var gap [2]int64
+		if err = rows.Scan(&gap[0], &gap[1]); err != nil {
+			t.Fatalf("can't scan event gap: %v", err)
+		}
+		ret = append(ret, gap)
+	}
+	return ret
+}
+
+func TestSkipEventGap(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	s.ds.SetGapLimits(0, 2)
+	// 2 never arrives
+	addEvents(t, s, appSwitch(1, 100, "vim"), appSwitch(3, 300, "firefox"))
+	checkIntervals(t, s, nil)
+	addEvents(t, s, stopTracking(4, 400))
+	checkIntervals(t, s, []testInterval{{100, 300, 0, "vim"}, {300, 400, 0, "firefox"}})
+	if gaps := eventGaps(t, s); len(gaps) != 1 || gaps[0] != [2]int64{2, 2} {
+		t.Errorf("event gaps = %v, want [[2 2]]", gaps)
+	}
+	db.Close()
+
+	// the skip is saved, so 2 isn't waited for again
+	s, db = startAggregator(t, path)
+	defer db.Close()
+	addEvents(t, s, appSwitch(5, 500, "bash"), stopTracking(6, 600))
+	checkIntervals(t, s, []testInterval{{100, 300, 0, "vim"}, {300, 400, 0, "firefox"}, {500, 600, 0, "bash"}})
+}
+
+func TestFlushEventQueue(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	defer db.Close()
+	addEvents(t, s, appSwitch(1, 100, "vim"), appSwitch(3, 300, "firefox"), appSwitch(6, 600, "bash"))
+	info, ok := s.ds.Queue(testUid, testDid)
+	if !ok || info.LastEid != 1 || len(info.BufferedEids) != 2 || info.WaitingSince.IsZero() {
+		t.Errorf("Queue() = %+v, %v, want eid 1 with 3 and 6 waiting", info, ok)
+	}
+	before := deviceState.GetMetrics()
+	if info, ok = s.ds.FlushQueue(s, testUid, testDid); !ok || info.LastEid != 6 || len(info.BufferedEids) != 0 {
+		t.Errorf("FlushQueue() = %+v, %v, want eid 6 with none waiting", info, ok)
+	}
+	after := deviceState.GetMetrics()
+	if after.GapsSkipped-before.GapsSkipped != 2 || after.EventsSkipped-before.EventsSkipped != 3 {
+		t.Errorf("metrics went from %+v to %+v, want 2 more gaps and 3 more events skipped", before, after)
+	}
+	checkIntervals(t, s, []testInterval{{100, 300, 0, "vim"}, {300, 600, 0, "firefox"}})
+	if gaps := eventGaps(t, s); len(gaps) != 2 || gaps[0] != [2]int64{2, 2} || gaps[1] != [2]int64{4, 5} {
+		t.Errorf("event gaps = %v, want [[2 2] [4 5]]", gaps)
+	}
+}
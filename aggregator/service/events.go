@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 
+	"git.yiad.am/productimon/aggregator/authenticator"
+	"git.yiad.am/productimon/aggregator/storage"
 	"git.yiad.am/productimon/analyzer/deviceState"
 	cpb "git.yiad.am/productimon/proto/common"
 	spb "git.yiad.am/productimon/proto/svc"
@@ -14,100 +16,162 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-// TODO: what if we recoreded out-of-order events in db and are waiting for an old event when we shutdown server
-func (s *Service) lazyInitEidHandler(uid string, did int64) (int64, error) {
-	var eid int64
-	if err := s.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM events WHERE uid=? AND did=?", uid, did).Scan(&eid); err != nil {
+// devices without saved state (e.g. from before device_states existed) are
+// rebuilt from the event that closed their last interval, as it also started
+// the interval that was still open
+func (s *Service) lazyInitEidHandler(uid string, did, eid int64) (int64, error) {
+	var first sql.NullInt64
+	err := s.db.QueryRow("SELECT MIN(id) FROM events WHERE uid = ? AND did = ? AND starttime >= "+
+		"COALESCE((SELECT MAX(endtime) FROM intervals WHERE uid = ? AND did = ?), 0)", uid, did, uid, did).Scan(&first)
+	switch {
+	case err != nil:
 		return -1, err
+	case first.Valid:
+		return first.Int64 - 1, nil
+	default:
+		return eid - 1, nil
+	}
+}
+
+// stored events of a device after eid, for rebuilding its state
+func (s *Service) replayEvents(uid string, did, after int64) ([]deviceState.PendingEvent, error) {
+	rows, err := s.db.Query("SELECT e.did, e.id, e.kind, e.starttime, e.endtime, a.app, ac.keystrokes, ac.mouseclicks FROM events e "+
+		"LEFT JOIN app_switch_events a ON (a.uid = e.uid AND a.did = e.did AND a.id = e.id) "+
+		"LEFT JOIN activity_events ac ON (ac.uid = e.uid AND ac.did = e.did AND ac.id = e.id) "+
+		"WHERE e.uid = ? AND e.did = ? AND e.id > ? ORDER BY e.id", uid, did, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := s.getActivityModel(uid)
+	var pending []deviceState.PendingEvent
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, deviceState.PendingEvent{Eid: e.Id, Handler: s.eventHandler(m, e)})
+	}
+	return pending, rows.Err()
+}
+
+// Rebuild device states and run events left pending when the aggregator
+// stopped, must be called before accepting events
+func (s *Service) RestoreDeviceStates() error {
+	return s.ds.Restore(s)
+}
+
+// how e changes the state of its device, whose user has activity model m
+func (s *Service) eventHandler(m activityModel, e *cpb.Event) deviceState.EventHandler {
+	switch k := e.Kind.(type) {
+	case *cpb.Event_AppSwitchEvent:
+		return deviceState.SwitchApp(e)
+	case *cpb.Event_StartTrackingEvent, *cpb.Event_StopTrackingEvent:
+		return deviceState.ClearState(e)
+	case *cpb.Event_ActivityEvent:
+		if active := m.activeTime(k.ActivityEvent.Keystrokes, k.ActivityEvent.Mouseclicks, e.Timeinterval.Start.Nanos, e.Timeinterval.End.Nanos); active > 0 {
+			return deviceState.SetActive(e, active)
+		}
 	}
-	return eid, nil
+	return deviceState.Nop(e)
 }
 
 // add a event to events table in a new transaction and return that transaction
 // no need to rollback tx if err != nil
-func (s *Service) addGeneralEvent(uid string, did int64, e *cpb.Event, kind cpb.EventType) (tx *sql.Tx, err error) {
+// events of a device that was removed, or sent with a certificate that was
+// revoked, since the stream they came in started
+var errDeviceRevoked = errors.New("device has been removed or its certificate revoked")
+
+// serial is the device certificate the event came with, "" if none
+func (s *Service) addGeneralEvent(uid string, did int64, serial string, e *cpb.Event, kind cpb.EventType) (tx *storage.Tx, err error) {
 	tx, err = s.db.Begin()
 	if err != nil {
 		return
 	}
-	_, err = tx.Exec("INSERT INTO events (uid, did, id, kind, starttime, endtime) VALUES(?, ?, ?, ?, ?, ?)",
-		uid, did, e.Id, kind, e.Timeinterval.Start.Nanos, e.Timeinterval.End.Nanos)
+	var current string
+	var removed bool
+	err = tx.QueryRow("SELECT cert_serial, removed FROM devices WHERE uid = ? AND id = ?", uid, did).Scan(&current, &removed)
+	if err == nil && (removed || serial != "" && current != "" && current != serial) {
+		err = errDeviceRevoked
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO events (uid, did, id, kind, starttime, endtime) VALUES(?, ?, ?, ?, ?, ?)",
+			uid, did, e.Id, kind, e.Timeinterval.Start.Nanos, e.Timeinterval.End.Nanos)
+	}
 	if err != nil {
 		tx.Rollback()
 	}
 	return
 }
 
-func (s *Service) eventUpdateState(uid string, did int64, e *cpb.Event, eg func(e *cpb.Event) func(*deviceState.DeviceState, deviceState.Operator, *zap.Logger)) error {
-	err := s.ds.RunEvent(s, uid, did, e.Id, eg(e))
+func (s *Service) eventUpdateState(uid string, did int64, e *cpb.Event) error {
+	err := s.ds.RunEvent(s, uid, did, e.Id, s.eventHandler(s.getActivityModel(uid), e))
 	if err != nil {
 		s.log.Error("RunEvent error", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did), zap.Int64("eid", e.Id))
 	}
 	return err // this is currently ignored by AddEvent
 }
 
-func (s *Service) AddEvent(uid string, did int64, e *cpb.Event) error {
+// AddEvent stores e and runs it on the device's state. serial is the device
+// certificate it came with, events are refused once it has been revoked
+func (s *Service) AddEvent(uid string, did int64, serial string, e *cpb.Event) error {
 	switch k := e.Kind.(type) {
 	case *cpb.Event_AppSwitchEvent:
-		s.dbWLock.Lock()
-		tx, err := s.addGeneralEvent(uid, did, e, cpb.EventType_APP_SWITCH_EVENT)
+		s.db.Lock()
+		tx, err := s.addGeneralEvent(uid, did, serial, e, cpb.EventType_APP_SWITCH_EVENT)
 		if err != nil {
-			s.dbWLock.Unlock()
+			s.db.Unlock()
 			return err
 		}
 		if _, err := tx.Exec("INSERT INTO app_switch_events(uid, did, id, app) VALUES(?, ?, ?, ?)",
 			uid, did, e.Id, k.AppSwitchEvent.AppName); err != nil {
 			tx.Rollback()
-			s.dbWLock.Unlock()
+			s.db.Unlock()
 			return err
 		}
 		s.getDefaultLabel(k.AppSwitchEvent.AppName, tx) // either it exists or we add it to queue
 		tx.Commit()
-		s.dbWLock.Unlock()
-		s.eventUpdateState(uid, did, e, deviceState.SwitchApp)
+		s.db.Unlock()
+		s.eventUpdateState(uid, did, e)
 
 	case *cpb.Event_StartTrackingEvent:
-		s.dbWLock.Lock()
-		tx, err := s.addGeneralEvent(uid, did, e, cpb.EventType_START_TRACKING_EVENT)
+		s.db.Lock()
+		tx, err := s.addGeneralEvent(uid, did, serial, e, cpb.EventType_START_TRACKING_EVENT)
 		if err != nil {
-			s.dbWLock.Unlock()
+			s.db.Unlock()
 			return err
 		}
 		tx.Commit()
-		s.dbWLock.Unlock()
-		s.eventUpdateState(uid, did, e, deviceState.ClearState)
+		s.db.Unlock()
+		s.eventUpdateState(uid, did, e)
 
 	case *cpb.Event_StopTrackingEvent:
-		s.dbWLock.Lock()
-		tx, err := s.addGeneralEvent(uid, did, e, cpb.EventType_STOP_TRACKING_EVENT)
+		s.db.Lock()
+		tx, err := s.addGeneralEvent(uid, did, serial, e, cpb.EventType_STOP_TRACKING_EVENT)
 		if err != nil {
-			s.dbWLock.Unlock()
+			s.db.Unlock()
 			return err
 		}
 		tx.Commit()
-		s.dbWLock.Unlock()
-		s.eventUpdateState(uid, did, e, deviceState.ClearState)
+		s.db.Unlock()
+		s.eventUpdateState(uid, did, e)
 
 	case *cpb.Event_ActivityEvent:
-		s.dbWLock.Lock()
-		tx, err := s.addGeneralEvent(uid, did, e, cpb.EventType_ACTIVITY_EVENT)
+		s.db.Lock()
+		tx, err := s.addGeneralEvent(uid, did, serial, e, cpb.EventType_ACTIVITY_EVENT)
 		if err != nil {
-			s.dbWLock.Unlock()
+			s.db.Unlock()
 			return err
 		}
 		if _, err := tx.Exec("INSERT INTO activity_events(uid, did, id, keystrokes, mouseclicks) VALUES(?, ?, ?, ?, ?)",
 			uid, did, e.Id, k.ActivityEvent.Keystrokes, k.ActivityEvent.Mouseclicks); err != nil {
 			tx.Rollback()
-			s.dbWLock.Unlock()
+			s.db.Unlock()
 			return err
 		}
 		tx.Commit()
-		s.dbWLock.Unlock()
-		if s.isActive(k.ActivityEvent.Keystrokes, k.ActivityEvent.Mouseclicks, e.Timeinterval.Start.Nanos, e.Timeinterval.End.Nanos) {
-			s.eventUpdateState(uid, did, e, deviceState.SetActive)
-		} else {
-			s.eventUpdateState(uid, did, e, deviceState.Nop)
-		}
+		s.db.Unlock()
+		s.eventUpdateState(uid, did, e)
 
 	case nil:
 		return errors.New("event not set")
@@ -121,39 +185,190 @@ func (s *Service) AddEvent(uid string, did int64, e *cpb.Event) error {
 
 func (s *Service) PushEvent(server spb.DataAggregator_PushEventServer) error {
 	s.log.Info("Started pushEvent stream")
-	ctx := server.Context()
-	uid, did, err := s.auther.AuthenticateRequest(ctx)
+	uid, did, err := s.auther.AuthenticateRequest(server.Context())
 	if err != nil || did == -1 {
 		s.log.Error("Failed to authenticate pushEvent", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did))
 		return status.Error(codes.Unauthenticated, "Invalid token")
 	}
+	serial := authenticator.DeviceCertSerial(server.Context())
+	// cancelled once the device is removed or renews its certificate
+	ctx, done := s.deviceNotifier.Track(server.Context(), uid, did)
+	defer done()
+
+	// Recv doesn't return when ctx is cancelled, so it's called in its own goroutine
+	events := make(chan *cpb.Event)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			event, err := server.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
 	for {
+		var event *cpb.Event
 		select {
 		case <-ctx.Done():
+			if server.Context().Err() == nil {
+				s.log.Info("device disconnected", zap.String("uid", uid), zap.Int64("did", did))
+				return status.Error(codes.Unauthenticated, "Invalid certificate")
+			}
 			s.log.Warn("context cancelled", zap.Error(ctx.Err()))
 			return ctx.Err()
-		default:
-		}
-
-		event, err := server.Recv()
-		switch {
-		case err == io.EOF:
-			s.log.Info("Client closed the stream, we're closing too")
-			return nil
-		case err != nil:
+		case err = <-errs:
+			if err == io.EOF {
+				s.log.Info("Client closed the stream, we're closing too")
+				return nil
+			}
 			s.log.Error("receive error", zap.Error(err))
-			continue
+			return err
+		case event = <-events:
 		}
 		s.log.Sugar().Info("received event ", event)
 
-		if err = s.AddEvent(uid, did, event); err != nil {
+		switch err = s.AddEvent(uid, did, serial, event); {
+		case err == errDeviceRevoked:
+			return status.Error(codes.Unauthenticated, "Invalid certificate")
+		case err != nil:
 			s.log.Error("Failed to add event", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did), zap.Int64("eid", event.Id))
 		}
 	}
-	return nil
+}
+
+const (
+	getEventDefaultLimit = 1000
+	getEventMaxLimit     = 10000
+)
+
+// reconstruct an event from a row of the events/app_switch_events/activity_events join
+func scanEvent(rows *sql.Rows) (*cpb.Event, error) {
+	var did, eid, starttime, endtime int64
+	var kind cpb.EventType
+	var app sql.NullString
+	var keystrokes, mouseclicks sql.NullInt64
+	if err := rows.Scan(&did, &eid, &kind, &starttime, &endtime, &app, &keystrokes, &mouseclicks); err != nil {
+		return nil, err
+	}
+	e := &cpb.Event{
+		Device: &cpb.Device{Id: did},
+		Id:     eid,
+		Timeinterval: &cpb.Interval{
+			Start: &cpb.Timestamp{Nanos: starttime},
+			End:   &cpb.Timestamp{Nanos: endtime},
+		},
+	}
+	switch kind {
+	case cpb.EventType_APP_SWITCH_EVENT:
+		e.Kind = &cpb.Event_AppSwitchEvent{AppSwitchEvent: &cpb.AppSwitchEvent{AppName: app.String}}
+	case cpb.EventType_ACTIVITY_EVENT:
+		e.Kind = &cpb.Event_ActivityEvent{ActivityEvent: &cpb.ActivityEvent{Keystrokes: keystrokes.Int64, Mouseclicks: mouseclicks.Int64}}
+	case cpb.EventType_START_TRACKING_EVENT:
+		e.Kind = &cpb.Event_StartTrackingEvent{StartTrackingEvent: &cpb.StartTrackingEvent{}}
+	case cpb.EventType_STOP_TRACKING_EVENT:
+		e.Kind = &cpb.Event_StopTrackingEvent{StopTrackingEvent: &cpb.StopTrackingEvent{}}
+	default:
+		return nil, fmt.Errorf("unknown event kind %d", kind)
+	}
+	return e, nil
 }
 
 func (s *Service) GetEvent(req *spb.DataAggregatorGetEventRequest, server spb.DataAggregator_GetEventServer) error {
-	return status.Error(codes.Unimplemented, "not implemented")
+	uid, did, err := s.auther.AuthenticateRequest(server.Context())
+	if err != nil || did != -1 {
+		return status.Error(codes.Unauthenticated, "Invalid token")
+	}
+
+	st := "SELECT e.did, e.id, e.kind, e.starttime, e.endtime, a.app, ac.keystrokes, ac.mouseclicks FROM events e " +
+		"LEFT JOIN app_switch_events a ON (a.uid = e.uid AND a.did = e.did AND a.id = e.id) " +
+		"LEFT JOIN activity_events ac ON (ac.uid = e.uid AND ac.did = e.did AND ac.id = e.id) " +
+		"WHERE e.uid = ? "
+	args := []interface{}{uid}
+
+	switch q := req.Query.(type) {
+	case *spb.DataAggregatorGetEventRequest_ByDevice_:
+		if q.ByDevice.GetDevice() == nil {
+			return status.Error(codes.InvalidArgument, "device missing")
+		}
+		st += "AND e.did = ? "
+		args = append(args, q.ByDevice.Device.Id)
+	case *spb.DataAggregatorGetEventRequest_ById_:
+		if q.ById.GetDevice() == nil {
+			return status.Error(codes.InvalidArgument, "device missing")
+		}
+		st += "AND e.did = ? AND e.id = ? "
+		args = append(args, q.ById.Device.Id, q.ById.Id)
+	case *spb.DataAggregatorGetEventRequest_ByType_:
+		if q.ByType.Type == cpb.EventType_UNKNOWN {
+			return status.Error(codes.InvalidArgument, "event type missing")
+		}
+		st += "AND e.kind = ? "
+		args = append(args, q.ByType.Type)
+	case nil:
+		return status.Error(codes.InvalidArgument, "query not set")
+	default:
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("unknown query type %T", q))
+	}
+
+	// a bound that isn't set leaves that side of the interval open
+	if start := req.GetInterval().GetStart(); start != nil {
+		st += "AND e.endtime >= ? "
+		args = append(args, start.Nanos)
+	}
+	if end := req.GetInterval().GetEnd(); end != nil {
+		st += "AND e.starttime <= ? "
+		args = append(args, end.Nanos)
+	}
+
+	if req.AfterDevice != 0 || req.AfterId != 0 {
+		st += "AND (e.did > ? OR (e.did = ? AND e.id > ?)) "
+		args = append(args, req.AfterDevice, req.AfterDevice, req.AfterId)
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = getEventDefaultLimit
+	}
+	if limit > getEventMaxLimit {
+		limit = getEventMaxLimit
+	}
+	st += "ORDER BY e.did, e.id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.db.Query(st, args...)
+	if err != nil {
+		s.log.Error("error querying events", zap.Error(err), zap.String("uid", uid))
+		return status.Error(codes.Internal, "something went wrong")
+	}
+	defer rows.Close()
+
+	var count int64
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			s.log.Error("failed to scan event", zap.Error(err), zap.String("uid", uid))
+			return status.Error(codes.Internal, "something went wrong")
+		}
+		if err = server.Send(e); err != nil {
+			s.log.Warn("failed to send event", zap.Error(err), zap.String("uid", uid))
+			return err
+		}
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		s.log.Error("error iterating events", zap.Error(err), zap.String("uid", uid))
+		return status.Error(codes.Internal, "something went wrong")
+	}
+
+	if _, ok := req.Query.(*spb.DataAggregatorGetEventRequest_ById_); ok && count == 0 {
+		return status.Error(codes.NotFound, "event not found")
+	}
+	return nil
 }
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// collects the events sent by GetEvent
+type eventStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events []*cpb.Event
+}
+
+func (s *eventStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *eventStream) Send(e *cpb.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+// GetEvent as "did/eid" of the returned events
+func getEvents(s *Service, token string, req *spb.DataAggregatorGetEventRequest) ([]string, error) {
+	stream := &eventStream{ctx: tokenContext(token)}
+	err := s.GetEvent(req, stream)
+	var got []string
+	for _, e := range stream.events {
+		got = append(got, fmt.Sprintf("%d/%d", e.Device.Id, e.Id))
+	}
+	return got, err
+}
+
+func addDevice(t *testing.T, s *Service, uid string, did int64) {
+	if _, err := s.db.Exec("INSERT INTO devices (uid, id, name, kind) VALUES (?, ?, ?, ?)", uid, did, fmt.Sprintf("device %d", did), 0); err != nil {
+		t.Fatalf("can't insert device: %v", err)
+	}
+}
+
+func addUserEvents(t *testing.T, s *Service, uid string, did int64, events ...*cpb.Event) {
+	for _, e := range events {
+		if err := s.AddEvent(uid, did, "", e); err != nil {
+			t.Fatalf("AddEvent(%d) failed: %v", e.Id, err)
+		}
+	}
+}
+
+func TestGetEvent(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	other := addUser(t, s, "other@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	addDevice(t, s, uid, 1)
+	addDevice(t, s, uid, 2)
+	addDevice(t, s, other, 1)
+	addDevice(t, s, other, 3)
+	addUserEvents(t, s, uid, 1, appSwitch(1, 100, "a"), activity(2, 100, 200), stopTracking(3, 300))
+	addUserEvents(t, s, uid, 2, appSwitch(1, 1000, "b"), activity(2, 1000, 1100), stopTracking(3, 2000))
+	// the other user has the same device and event ids, and a device id the user doesn't have
+	addUserEvents(t, s, other, 1, appSwitch(1, 100, "x"), activity(2, 100, 200), appSwitch(3, 300, "y"), appSwitch(4, 400, "z"))
+	addUserEvents(t, s, other, 3, appSwitch(1, 100, "x"))
+
+	byDevice := func(did int64) *spb.DataAggregatorGetEventRequest {
+		return &spb.DataAggregatorGetEventRequest{Query: &spb.DataAggregatorGetEventRequest_ByDevice_{
+			ByDevice: &spb.DataAggregatorGetEventRequest_ByDevice{Device: &cpb.Device{Id: did}}}}
+	}
+	byId := func(did, eid int64) *spb.DataAggregatorGetEventRequest {
+		return &spb.DataAggregatorGetEventRequest{Query: &spb.DataAggregatorGetEventRequest_ById_{
+			ById: &spb.DataAggregatorGetEventRequest_ById{Device: &cpb.Device{Id: did}, Id: eid}}}
+	}
+	byType := func(kind cpb.EventType) *spb.DataAggregatorGetEventRequest {
+		return &spb.DataAggregatorGetEventRequest{Query: &spb.DataAggregatorGetEventRequest_ByType_{
+			ByType: &spb.DataAggregatorGetEventRequest_ByType{Type: kind}}}
+	}
+	between := func(req *spb.DataAggregatorGetEventRequest, start, end int64) *spb.DataAggregatorGetEventRequest {
+		req.Interval = &cpb.Interval{Start: &cpb.Timestamp{Nanos: start}, End: &cpb.Timestamp{Nanos: end}}
+		return req
+	}
+	from := func(req *spb.DataAggregatorGetEventRequest, start int64) *spb.DataAggregatorGetEventRequest {
+		req.Interval = &cpb.Interval{Start: &cpb.Timestamp{Nanos: start}}
+		return req
+	}
+	until := func(req *spb.DataAggregatorGetEventRequest, end int64) *spb.DataAggregatorGetEventRequest {
+		req.Interval = &cpb.Interval{End: &cpb.Timestamp{Nanos: end}}
+		return req
+	}
+	open := func(req *spb.DataAggregatorGetEventRequest) *spb.DataAggregatorGetEventRequest {
+		req.Interval = &cpb.Interval{}
+		return req
+	}
+
+	for _, test := range []struct {
+		name string
+		req  *spb.DataAggregatorGetEventRequest
+		want []string
+		code codes.Code
+	}{
+		{"by device", byDevice(1), []string{"1/1", "1/2", "1/3"}, codes.OK},
+		{"by other user's device", byDevice(3), nil, codes.OK},
+		{"by id", byId(2, 2), []string{"2/2"}, codes.OK},
+		{"by id of other user's event", byId(1, 4), nil, codes.NotFound},
+		{"by id of other user's device", byId(3, 1), nil, codes.NotFound},
+		{"by type", byType(cpb.EventType_APP_SWITCH_EVENT), []string{"1/1", "2/1"}, codes.OK},
+		{"by type in range", between(byType(cpb.EventType_ACTIVITY_EVENT), 150, 1000), []string{"1/2", "2/2"}, codes.OK},
+		{"by device in range", between(byDevice(1), 201, 300), []string{"1/3"}, codes.OK},
+		{"by device before events", between(byDevice(2), 0, 999), nil, codes.OK},
+		{"by device after events", between(byDevice(1), 301, 1000), nil, codes.OK},
+		{"by type from start", from(byType(cpb.EventType_APP_SWITCH_EVENT), 101), []string{"2/1"}, codes.OK},
+		{"by type until end", until(byType(cpb.EventType_APP_SWITCH_EVENT), 999), []string{"1/1"}, codes.OK},
+		{"by device in empty interval", open(byDevice(1)), []string{"1/1", "1/2", "1/3"}, codes.OK},
+		{"without query", &spb.DataAggregatorGetEventRequest{}, nil, codes.InvalidArgument},
+		{"by device without device", &spb.DataAggregatorGetEventRequest{Query: &spb.DataAggregatorGetEventRequest_ByDevice_{
+			ByDevice: &spb.DataAggregatorGetEventRequest_ByDevice{}}}, nil, codes.InvalidArgument},
+		{"by unknown type", byType(cpb.EventType_UNKNOWN), nil, codes.InvalidArgument},
+	} {
+		got, err := getEvents(s, token, test.req)
+		checkCode(t, test.name, err, test.code)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got events %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	stream := &eventStream{ctx: tokenContext(token)}
+	if err := s.GetEvent(byId(1, 1), stream); err != nil {
+		t.Fatalf("GetEvent by id failed: %v", err)
+	}
+	want := appSwitch(1, 100, "a")
+	want.Device = &cpb.Device{Id: 1}
+	if len(stream.events) != 1 || !reflect.DeepEqual(stream.events[0], want) {
+		t.Errorf("GetEvent by id got %v, want %v", stream.events, want)
+	}
+
+	_, err := getEvents(s, "", byDevice(1))
+	checkCode(t, "GetEvent without token", err, codes.Unauthenticated)
+}
+
+func TestGetEventPaging(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	other := addUser(t, s, "other@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	addDevice(t, s, uid, 1)
+	addDevice(t, s, uid, 2)
+	addDevice(t, s, other, 1)
+	addUserEvents(t, s, uid, 1, appSwitch(1, 100, "a"), appSwitch(2, 200, "b"), appSwitch(3, 300, "c"))
+	addUserEvents(t, s, uid, 2, appSwitch(1, 100, "a"), appSwitch(2, 200, "b"))
+	addUserEvents(t, s, other, 1, appSwitch(1, 100, "x"), appSwitch(2, 200, "y"), appSwitch(3, 300, "z"), appSwitch(4, 400, "w"))
+
+	req := &spb.DataAggregatorGetEventRequest{
+		Query: &spb.DataAggregatorGetEventRequest_ByType_{ByType: &spb.DataAggregatorGetEventRequest_ByType{Type: cpb.EventType_APP_SWITCH_EVENT}},
+		Limit: 2,
+	}
+	var pages [][]string
+	for {
+		stream := &eventStream{ctx: tokenContext(token)}
+		if err := s.GetEvent(req, stream); err != nil {
+			t.Fatalf("GetEvent after %d/%d failed: %v", req.AfterDevice, req.AfterId, err)
+		}
+		if len(stream.events) == 0 {
+			break
+		}
+		var page []string
+		for _, e := range stream.events {
+			page = append(page, fmt.Sprintf("%d/%d", e.Device.Id, e.Id))
+		}
+		pages = append(pages, page)
+		last := stream.events[len(stream.events)-1]
+		req.AfterDevice, req.AfterId = last.Device.Id, last.Id
+		if len(pages) > 5 {
+			t.Fatalf("GetEvent keeps returning events: %v", pages)
+		}
+	}
+	want := [][]string{{"1/1", "1/2"}, {"1/3", "2/1"}, {"2/2"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+}
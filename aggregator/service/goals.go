@@ -2,11 +2,20 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
-	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"git.yiad.am/productimon/aggregator/messages"
+	"git.yiad.am/productimon/aggregator/notifications"
+	"git.yiad.am/productimon/aggregator/storage"
 	cpb "git.yiad.am/productimon/proto/common"
 	spb "git.yiad.am/productimon/proto/svc"
 	"go.uber.org/zap"
@@ -14,29 +23,195 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-// get total time for user in interval for a given label/app
-func (s *Service) getGoalDuration(uid string, isLabel bool, item, dFilter string, startTime, endTime int64) (duration int64, err error) {
-	st := "SELECT COALESCE(SUM(MIN(endtime, ?)-MAX(starttime, ?)), 0) FROM intervals "
+// get total time for user in given time ranges for a given label/app.
+// ranges mustn't overlap, they're summed in a single query
+func (s *Service) getGoalDuration(uid string, isLabel bool, item, dFilter string, ranges [][2]int64) (duration int64, err error) {
+	if len(ranges) == 0 {
+		return 0, nil
+	}
+	var selects []string
+	var args []interface{}
+	for _, r := range ranges {
+		selects = append(selects, "SELECT CAST(? AS BIGINT) AS rstart, CAST(? AS BIGINT) AS rend")
+		args = append(args, r[0], r[1])
+	}
+	st := "SELECT COALESCE(SUM(" + s.db.Least("intervals.endtime", "r.rend") + "-" + s.db.Greatest("intervals.starttime", "r.rstart") + "), 0) FROM intervals "
 	defer func() {
 		s.log.Debug("getGoalDuration", zap.String("sql", st), zap.Int64("duration", duration), zap.Error(err))
 	}()
+	st += "JOIN (" + strings.Join(selects, " UNION ALL ") + ") r ON (intervals.endtime >= r.rstart AND intervals.starttime <= r.rend) "
 	if isLabel {
 		st += "LEFT JOIN user_apps ON (user_apps.name = intervals.app AND user_apps.uid = intervals.uid) "
 		st += "LEFT JOIN default_apps ON (user_apps.name IS NULL AND default_apps.name = intervals.app) "
 	}
-	st += "WHERE intervals.uid = ? AND endtime >= ? AND starttime <= ? "
+	st += "WHERE intervals.uid = ? "
 	if isLabel {
 		st += "AND COALESCE(user_apps.label, default_apps.label, '" + LABEL_UNCATEGORIZED + "') = ? "
 	} else {
-		st += "AND app = ? "
+		st += "AND intervals.app = ? "
 	}
 	st += dFilter
-	if err = s.db.QueryRow(st, endTime, startTime, uid, startTime, endTime, item).Scan(&duration); err != nil {
-		return 0, err
-	}
+	args = append(args, uid, item)
+	err = s.db.QueryRow(st, args...).Scan(&duration)
 	return
 }
 
+// get devices a goal is limited to, empty if it applies to all devices
+func (s *Service) getGoalDevices(uid string, gid int64) ([]*cpb.Device, error) {
+	rows, err := s.db.Query("SELECT gd.did, d.name FROM goal_devices gd JOIN devices d ON (d.uid = gd.uid AND d.id = gd.did) WHERE gd.uid = ? AND gd.gid = ? ORDER BY gd.did", uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var devices []*cpb.Device
+	for rows.Next() {
+		dev := &cpb.Device{}
+		if err = rows.Scan(&dev.Id, &dev.Name); err != nil {
+			return nil, err
+		}
+		devices = append(devices, dev)
+	}
+	return devices, rows.Err()
+}
+
+// check that all devices belong to user
+func (s *Service) validateGoalDevices(uid string, devices []*cpb.Device) error {
+	if len(devices) == 0 {
+		return nil
+	}
+	ids := make(map[int64]bool)
+	for _, dev := range devices {
+		ids[dev.Id] = true
+	}
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM devices WHERE uid = ?"+deviceFilters("id", devices), uid).Scan(&n); err != nil {
+		return err
+	}
+	if n != len(ids) {
+		return errors.New("invalid device")
+	}
+	return nil
+}
+
+// replace devices a goal is limited to
+func (s *Service) setGoalDevices(tx *storage.Tx, uid string, gid int64, devices []*cpb.Device) error {
+	if _, err := tx.Exec("DELETE FROM goal_devices WHERE uid = ? AND gid = ?", uid, gid); err != nil {
+		return err
+	}
+	added := make(map[int64]bool)
+	for _, dev := range devices {
+		if added[dev.Id] {
+			continue
+		}
+		added[dev.Id] = true
+		if _, err := tx.Exec("INSERT INTO goal_devices (uid, gid, did) VALUES (?, ?, ?)", uid, gid, dev.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var phoneNumberRegex = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// convert goal notification channel to notify_kind and notify_target
+func goalNotification(goal *cpb.Goal) (kind, target string) {
+	switch n := goal.Notification.(type) {
+	case *cpb.Goal_Email:
+		return "email", n.Email
+	case *cpb.Goal_Sms:
+		return "sms", n.Sms
+	case *cpb.Goal_Device:
+		return "device", strconv.FormatInt(n.Device, 10)
+	case *cpb.Goal_Webhook:
+		return "webhook", n.Webhook
+	}
+	return "", ""
+}
+
+// convert notify_kind and notify_target back to goal notification channel
+func setGoalNotification(goal *cpb.Goal, kind, target string) {
+	switch kind {
+	case "email":
+		goal.Notification = &cpb.Goal_Email{Email: target}
+	case "sms":
+		goal.Notification = &cpb.Goal_Sms{Sms: target}
+	case "device":
+		did, _ := strconv.ParseInt(target, 10, 64)
+		goal.Notification = &cpb.Goal_Device{Device: did}
+	case "webhook":
+		goal.Notification = &cpb.Goal_Webhook{Webhook: target}
+	}
+}
+
+// check goal notification channel is valid and supported by this server
+func (s *Service) validateGoalNotification(goal *cpb.Goal) error {
+	kind, _ := goalNotification(goal)
+	if kind == "" {
+		return nil
+	}
+	if _, ok := s.notifiers[kind]; !ok {
+		return status.Error(codes.FailedPrecondition, kind+" notifications are not enabled on this server")
+	}
+	switch n := goal.Notification.(type) {
+	case *cpb.Goal_Email:
+		if n.Email == "" {
+			return nil
+		}
+		if !rxEmail.MatchString(n.Email) {
+			return status.Error(codes.InvalidArgument, "Invalid notification email address")
+		}
+	case *cpb.Goal_Sms:
+		if !phoneNumberRegex.MatchString(n.Sms) {
+			return status.Error(codes.InvalidArgument, "Invalid notification phone number")
+		}
+	case *cpb.Goal_Device:
+		if err := s.validateGoalDevices(goal.Uid, []*cpb.Device{{Id: n.Device}}); err != nil {
+			return status.Error(codes.InvalidArgument, "Invalid notification device")
+		}
+	case *cpb.Goal_Webhook:
+		u, err := url.Parse(n.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return status.Error(codes.InvalidArgument, "Invalid notification webhook URL")
+		}
+		// hostnames are checked again when connecting, see notifications.NewWebhookNotifier
+		host := strings.ToLower(u.Hostname())
+		if ip := net.ParseIP(host); (ip != nil && !notifications.IsPublicIP(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return status.Error(codes.InvalidArgument, "Notification webhook URL must be a public address")
+		}
+	}
+	return nil
+}
+
+// resolve notifier and recipient for goal notifications
+func (s *Service) goalRecipient(uid, kind, target, secret string) (string, string, error) {
+	switch kind {
+	case "", "email":
+		if target != "" {
+			return "email", target, nil
+		}
+		var email string
+		err := s.db.QueryRow("SELECT email FROM users WHERE id = ? LIMIT 1", uid).Scan(&email)
+		return "email", email, err
+	case "device":
+		did, err := strconv.ParseInt(target, 10, 64)
+		return kind, notifications.DeviceRecipient(uid, did), err
+	case "webhook":
+		if secret == "" {
+			return "", "", errors.New("goal webhook has no secret")
+		}
+		return kind, notifications.WebhookRecipient(target, secret), nil
+	}
+	return kind, target, nil
+}
+
+func generateWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
 // precompute goal
 func (s *Service) initGoal(g *cpb.Goal) (isLabel bool, item string, isPercent bool, goalDuration, targetDuration, baseDuration int64, err error) {
 	switch i := g.Item.(type) {
@@ -72,11 +247,19 @@ func (s *Service) initGoal(g *cpb.Goal) (isLabel bool, item string, isPercent bo
 		err = errors.New("invalid compare interval")
 		return
 	}
-	if baseDuration, err = s.getGoalDuration(g.Uid, isLabel, item, deviceFilters("intervals.did", g.GetDevices()), g.CompareInterval.Start.Nanos, g.CompareInterval.End.Nanos); err != nil {
+	loc := s.getUserLocation(g.Uid)
+	compareRanges := dayRanges(g.CompareInterval.Start.Nanos, g.CompareInterval.End.Nanos, g.DaysOfWeek, loc)
+	if baseDuration, err = s.getGoalDuration(g.Uid, isLabel, item, deviceFilters("intervals.did", g.GetDevices()), compareRanges); err != nil {
 		return
 	}
 	if g.CompareEqualized {
-		ratio := float64(g.GoalInterval.End.Nanos-g.GoalInterval.Start.Nanos) / float64(g.CompareInterval.End.Nanos-g.CompareInterval.Start.Nanos)
+		// only compare the selected days of week in both intervals
+		compareLength := dayRangesDuration(compareRanges)
+		if compareLength == 0 {
+			err = errors.New("compare interval doesn't contain any selected days of week")
+			return
+		}
+		ratio := float64(dayRangesDuration(dayRanges(g.GoalInterval.Start.Nanos, g.GoalInterval.End.Nanos, g.DaysOfWeek, loc))) / float64(compareLength)
 		baseDuration = int64(float64(baseDuration) * ratio)
 	}
 	if isPercent {
@@ -89,11 +272,11 @@ func (s *Service) initGoal(g *cpb.Goal) (isLabel bool, item string, isPercent bo
 	return
 }
 
-func (s *Service) getGoalProgress(uid, dFilter string, isLabel bool, item string, baseDuration, targetDuration, startTime, endTime int64) (int64, error) {
+func (s *Service) getGoalProgress(uid, dFilter string, isLabel bool, item string, baseDuration, targetDuration int64, ranges [][2]int64) (int64, error) {
 	// i am dumb and think too much - it makes more sense to use 0 as baseDuration
 	// TODO: remove all references to baseDuration if we won't be using it for other stuff
 	baseDuration = 0
-	actualDuration, err := s.getGoalDuration(uid, isLabel, item, dFilter, startTime, endTime)
+	actualDuration, err := s.getGoalDuration(uid, isLabel, item, dFilter, ranges)
 	if err != nil {
 		return 0, err
 	}
@@ -107,56 +290,190 @@ func (s *Service) getGoalProgress(uid, dFilter string, isLabel bool, item string
 	return int64(result * 1000), nil
 }
 
-// calculate and update goal progress
+// calculate and update goal progress, and notify user of thresholds it has reached
 func (s *Service) UpdateGoal(uid string, gid int64) {
+	s.db.Lock()
+	kind, recipient, msg := s.updateGoalProgress(uid, gid)
+	s.db.Unlock()
+	// sending may take a while, so it's done without holding the write lock
+	if msg == nil {
+		return
+	}
+	if err := s.deliverNotification(uid, kind, recipient, msg); err != nil {
+		s.log.Error("error sending goal notification", zap.Error(err), zap.String("kind", kind), zap.String("recipient", recipient))
+	}
+}
+
+// update goal progress and record the thresholds it has reached, returning
+// the notification to send if any. Caller must hold the write lock
+func (s *Service) updateGoalProgress(uid string, gid int64) (kind, recipient string, msg *messages.Message) {
 	var isLabel bool
-	var item, title, goaltype string
-	var baseDuration, targetDuration, startTime, endTime, oldProgress, progress int64
+	var item, title, goaltype, notifyKind, notifyTarget, notifySecret, notifyThresholds string
+	var baseDuration, targetDuration, startTime, endTime, progress int64
+	var daysOfWeek int32
 	var err error
-	s.dbWLock.Lock()
-	defer s.dbWLock.Unlock()
-	if err = s.db.QueryRow("SELECT title, goaltype, is_label, item, base_duration, target_duration, starttime, endtime, progress FROM goals WHERE uid = ? AND id = ?", uid, gid).Scan(&title, &goaltype, &isLabel, &item, &baseDuration, &targetDuration, &startTime, &endTime, &oldProgress); err != nil {
+	if err = s.db.QueryRow("SELECT title, goaltype, is_label, item, base_duration, target_duration, starttime, endtime, COALESCE(days_of_week, 0), notify_kind, notify_target, notify_secret, notify_thresholds FROM goals WHERE uid = ? AND id = ?", uid, gid).Scan(&title, &goaltype, &isLabel, &item, &baseDuration, &targetDuration, &startTime, &endTime, &daysOfWeek, &notifyKind, &notifyTarget, &notifySecret, &notifyThresholds); err != nil {
 		s.log.Error("Error updating goal", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
-		return
+		return "", "", nil
 	}
-	if progress, err = s.getGoalProgress(uid, "" /* TODO: get device filter */, isLabel, item, baseDuration, targetDuration, startTime, endTime); err != nil {
+	devices, err := s.getGoalDevices(uid, gid)
+	if err != nil {
+		s.log.Error("error getting goal devices", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+		return "", "", nil
+	}
+	loc := s.getUserLocation(uid)
+	ranges := dayRanges(startTime, endTime, daysOfWeek, loc)
+	if progress, err = s.getGoalProgress(uid, deviceFilters("intervals.did", devices), isLabel, item, baseDuration, targetDuration, ranges); err != nil {
 		s.log.Error("error getting goal progress", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
-		return
+		return "", "", nil
 	}
 	if _, err = s.db.Exec("UPDATE goals SET progress = ? WHERE uid = ? AND id = ?", progress, uid, gid); err != nil {
 		s.log.Error("error setting goal progress", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
-		return
+		return "", "", nil
 	}
-	var msg string
-	// TODO: this looks like a nice place to allow configuration/templating. If not on a user-level, at least on a server-level
-	switch goaltype {
-	case "aspiring":
-		switch {
-		case oldProgress < 1000 && progress >= 1000:
-			msg = fmt.Sprintf("Congrats! You've achieved your goal in using %s (%s) from %s to %s. Check %s for more details.", item, title, time.Unix(0, startTime).String(), time.Unix(0, endTime).String(), s.domain)
-		case oldProgress < 850 && progress >= 850:
-			msg = fmt.Sprintf("You're almost there! You've finished %.1f%% of your goal in using %s (%s) from %s to %s. Check %s for more details.", float32(progress)/10, item, title, time.Unix(0, startTime).String(), time.Unix(0, endTime).String(), s.domain)
+	threshold, err := s.fireGoalThresholds(uid, gid, startTime, progress, parseThresholds(notifyThresholds))
+	if err != nil {
+		s.log.Error("error checking goal notification thresholds", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+		return "", "", nil
+	}
+	if threshold == 0 {
+		return "", "", nil
+	}
+	var name string
+	switch {
+	case goaltype == "aspiring" && threshold >= 100:
+		name = messages.GoalAchieved
+	case goaltype == "aspiring":
+		name = messages.GoalAlmostAchieved
+	case threshold >= 100:
+		name = messages.GoalFailed
+	default:
+		name = messages.GoalAlmostFailed
+	}
+	data, locale, err := s.userMessageData(uid)
+	if err != nil {
+		s.log.Error("error getting user for goal notification", zap.Error(err), zap.String("uid", uid))
+		return "", "", nil
+	}
+	data.Goal = &messages.Goal{
+		Title:     title,
+		Item:      item,
+		IsLabel:   isLabel,
+		Type:      goaltype,
+		Start:     time.Unix(0, startTime).In(loc),
+		End:       time.Unix(0, endTime).In(loc),
+		Progress:  float64(progress) / 10,
+		Threshold: threshold,
+	}
+	if msg, err = s.messages.Render(name, locale, data); err != nil {
+		s.log.Error("error rendering goal notification", zap.Error(err), zap.String("message", name))
+		return "", "", nil
+	}
+	if kind, recipient, err = s.goalRecipient(uid, notifyKind, notifyTarget, notifySecret); err != nil {
+		s.log.Error("error getting goal notification recipient", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+		return "", "", nil
+	}
+	return kind, recipient, msg
+}
+
+// record thresholds (percent) progress has reached in goal period for the first time,
+// returning the highest one or 0 if there isn't any.
+// user's thresholds are used if goal doesn't have any
+func (s *Service) fireGoalThresholds(uid string, gid, periodStart, progress int64, thresholds []int32) (int32, error) {
+	if len(thresholds) == 0 {
+		ns, err := s.getNotificationSettings(uid)
+		if err != nil {
+			return 0, err
 		}
-	case "limiting":
-		switch {
-		case oldProgress < 1000 && progress >= 1000:
-			msg = fmt.Sprintf("Unfortunately, you've failed your goal (%s) by using %s too much from %s to %s. Check %s for more details.", title, item, time.Unix(0, startTime).String(), time.Unix(0, endTime).String(), s.domain)
-		case oldProgress < 850 && progress >= 850:
-			msg = fmt.Sprintf("Be careful! You've used %.1f%% of all allowed time to use %s in your goal (%s) from %s to %s. Check %s for more details.", float32(progress)/10, item, title, time.Unix(0, startTime).String(), time.Unix(0, endTime).String(), s.domain)
+		thresholds = ns.thresholds
+	}
+	fired := make(map[int32]bool)
+	rows, err := s.db.Query("SELECT threshold FROM goal_notifications WHERE uid = ? AND gid = ? AND period_start = ?", uid, gid, periodStart)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var t int32
+		if err = rows.Scan(&t); err != nil {
+			rows.Close()
+			return 0, err
 		}
+		fired[t] = true
 	}
-	// TODO: add non-email notifiers
-	if len(msg) > 0 {
-		var email string
-		if err = s.db.QueryRow("SELECT email FROM users WHERE id = ? LIMIT 1", uid).Scan(&email); err != nil {
-			s.log.Error("error getting email", zap.Error(err), zap.String("uid", uid))
-			return
+	rows.Close()
+	var highest int32
+	now := time.Now().UnixNano()
+	for _, t := range thresholds {
+		if fired[t] || progress < int64(t)*10 {
+			continue
 		}
-		if err = s.Notify("email", email, msg); err != nil {
-			s.log.Error("error sending goal notification email", zap.Error(err), zap.String("email", email))
-			return
+		fired[t] = true
+		if _, err = s.db.Exec("INSERT INTO goal_notifications (uid, gid, period_start, threshold, fired_at) VALUES (?, ?, ?, ?, ?)", uid, gid, periodStart, t, now); err != nil {
+			return 0, err
+		}
+		if t > highest {
+			highest = t
+		}
+	}
+	return highest, nil
+}
+
+// validate user-provided goal, returning a grpc status error
+// end of goal interval is filled in for recurring goals
+func (s *Service) validateGoal(goal *cpb.Goal) error {
+	switch goal.Type {
+	case "aspiring":
+	case "limiting":
+	default:
+		return status.Error(codes.InvalidArgument, "Invalid goal type")
+	}
+	if _, ok := cpb.Goal_Recurrence_name[int32(goal.Recurrence)]; !ok {
+		return status.Error(codes.InvalidArgument, "Invalid goal recurrence")
+	}
+	switch i := goal.Item.(type) {
+	case *cpb.Goal_Label:
+		if i.Label == "" {
+			return status.Error(codes.InvalidArgument, "Goal label missing")
+		}
+	case *cpb.Goal_Application:
+		if i.Application == "" {
+			return status.Error(codes.InvalidArgument, "Goal application missing")
 		}
+	default:
+		return status.Error(codes.InvalidArgument, "Goal item missing")
+	}
+	if goal.Amount == nil {
+		return status.Error(codes.InvalidArgument, "Goal amount missing")
 	}
+	if goal.GetGoalInterval().GetStart() == nil {
+		return status.Error(codes.InvalidArgument, "Goal interval missing")
+	}
+	if goal.Recurrence != cpb.Goal_NONE {
+		goal.GoalInterval.End = &cpb.Timestamp{Nanos: periodEnd(goal.GoalInterval.Start.Nanos, goal.Recurrence, s.getUserLocation(goal.Uid))}
+	}
+	if goal.GoalInterval.End == nil {
+		return status.Error(codes.InvalidArgument, "Goal interval missing")
+	}
+	if goal.GoalInterval.End.Nanos <= goal.GoalInterval.Start.Nanos {
+		return status.Error(codes.InvalidArgument, "Goal interval ends before it starts")
+	}
+	if in := goal.CompareInterval; in != nil && (in.Start == nil || in.End == nil || in.End.Nanos <= in.Start.Nanos) {
+		return status.Error(codes.InvalidArgument, "Invalid compare interval")
+	}
+	if _, ok := goal.Amount.(*cpb.Goal_PercentAmount); ok && goal.CompareInterval == nil {
+		return status.Error(codes.InvalidArgument, "Percent goal needs a compare interval")
+	}
+	if in := goal.CompareInterval; in != nil && goal.CompareEqualized &&
+		dayRangesDuration(dayRanges(in.Start.Nanos, in.End.Nanos, goal.DaysOfWeek, s.getUserLocation(goal.Uid))) == 0 {
+		return status.Error(codes.InvalidArgument, "Compare interval doesn't contain any selected days of week")
+	}
+	if err := s.validateGoalDevices(goal.Uid, goal.Devices); err != nil {
+		return status.Error(codes.InvalidArgument, "Invalid goal device")
+	}
+	if err := validateThresholds(goal.NotificationThresholds); err != nil {
+		return err
+	}
+	return s.validateGoalNotification(goal)
 }
 
 func (s *Service) AddGoal(ctx context.Context, goal *cpb.Goal) (*cpb.Goal, error) {
@@ -165,35 +482,52 @@ func (s *Service) AddGoal(ctx context.Context, goal *cpb.Goal) (*cpb.Goal, error
 		return nil, status.Error(codes.Unauthenticated, "Invalid token")
 	}
 	goal.Uid = uid
-	switch goal.Type {
-	case "aspiring":
-	case "limiting":
-	default:
-		return nil, status.Error(codes.InvalidArgument, "Invalid goal type")
-	}
-	s.dbWLock.Lock()
-	defer s.dbWLock.Unlock()
-	if err = s.db.QueryRow("SELECT COALESCE(MAX(id), -1) FROM goals WHERE uid=?", uid).Scan(&goal.Id); err != nil {
-		s.log.Error("error getting goal id", zap.String("uid", uid), zap.Error(err))
-		return nil, status.Error(codes.Internal, "error adding goal")
+	goal.WebhookSecret = ""
+	if err = s.validateGoal(goal); err != nil {
+		return nil, err
 	}
-	goal.Id = goal.Id + 1
+	s.db.Lock()
+	defer s.db.Unlock()
 	isLabel, item, isPercent, goalDuration, targetDuration, baseDuration, err := s.initGoal(goal)
 	if err != nil {
 		s.log.Error("init goal error", zap.Error(err))
 		return nil, status.Error(codes.Internal, "error adding goal")
 	}
-	progress, err := s.getGoalProgress(uid, deviceFilters("did", goal.GetDevices()), isLabel, item, baseDuration, targetDuration, goal.GoalInterval.Start.Nanos, goal.GoalInterval.End.Nanos)
+	progress, err := s.getGoalProgress(uid, deviceFilters("intervals.did", goal.GetDevices()), isLabel, item, baseDuration, targetDuration, dayRanges(goal.GoalInterval.Start.Nanos, goal.GoalInterval.End.Nanos, goal.DaysOfWeek, s.getUserLocation(uid)))
 	if err != nil {
 		s.log.Error("error getting goal progress", zap.Error(err))
 		return nil, status.Error(codes.Internal, "error adding goal")
 	}
-	// TODO: store devices to db
-	if _, err = s.db.Exec("INSERT INTO goals VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) ",
-		goal.Uid, goal.Id, goal.Title, isLabel, item, isPercent, goalDuration, targetDuration, baseDuration, goal.GoalInterval.Start.Nanos, goal.GoalInterval.End.Nanos, goal.GetCompareInterval().GetStart().GetNanos(), goal.GetCompareInterval().GetEnd().GetNanos(), goal.DaysOfWeek, goal.CompareEqualized, progress, goal.Type); err != nil {
+	notifyKind, notifyTarget := goalNotification(goal)
+	if notifyKind == "webhook" {
+		if goal.WebhookSecret, err = generateWebhookSecret(); err != nil {
+			s.log.Error("failed to generate webhook secret", zap.Error(err))
+			return nil, status.Error(codes.Internal, "error adding goal")
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		s.log.Error("can't begin transaction", zap.Error(err))
+		return nil, status.Error(codes.Internal, "error adding goal")
+	}
+	if goal.Id, err = s.insertNextId(tx, "goals", uid, 0, func(gid int64) error {
+		_, err := tx.Exec("INSERT INTO goals (uid, id, title, is_label, item, is_percent, goal_duration, target_duration, base_duration, starttime, endtime, compare_starttime, compare_endtime, days_of_week, equalized, progress, goaltype, recurrence, notify_kind, notify_target, notify_secret, notify_thresholds) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+			goal.Uid, gid, goal.Title, isLabel, item, isPercent, goalDuration, targetDuration, baseDuration, goal.GoalInterval.Start.Nanos, goal.GoalInterval.End.Nanos, goal.GetCompareInterval().GetStart().GetNanos(), goal.GetCompareInterval().GetEnd().GetNanos(), goal.DaysOfWeek, goal.CompareEqualized, progress, goal.Type, goal.Recurrence, notifyKind, notifyTarget, goal.WebhookSecret, formatThresholds(goal.NotificationThresholds))
+		return err
+	}); err != nil {
+		tx.Rollback()
 		s.log.Error("insert goal failed", zap.Error(err))
 		return nil, status.Error(codes.Internal, "error adding goal")
 	}
+	if err = s.setGoalDevices(tx, uid, goal.Id, goal.Devices); err != nil {
+		tx.Rollback()
+		s.log.Error("insert goal devices failed", zap.Error(err))
+		return nil, status.Error(codes.Internal, "error adding goal")
+	}
+	if err = tx.Commit(); err != nil {
+		s.log.Error("commit goal failed", zap.Error(err))
+		return nil, status.Error(codes.Internal, "error adding goal")
+	}
 	return goal, nil
 }
 
@@ -211,8 +545,75 @@ func (s *Service) DeleteGoal(ctx context.Context, goal *cpb.Goal) (*cpb.Empty, e
 	return &cpb.Empty{}, nil
 }
 
-func (s *Service) EditGoal(ctx context.Context, goal *cpb.Goal) (*cpb.Empty, error) {
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+func (s *Service) EditGoal(ctx context.Context, goal *cpb.Goal) (*cpb.Goal, error) {
+	uid, did, err := s.auther.AuthenticateRequest(ctx)
+	if err != nil || did != -1 {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	goal.Uid = uid
+	goal.WebhookSecret = ""
+	if err = s.validateGoal(goal); err != nil {
+		return nil, err
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	var endTime int64
+	var recurrence int32
+	var oldKind, oldTarget, notifySecret string
+	switch err = s.db.QueryRow("SELECT endtime, recurrence, notify_kind, notify_target, notify_secret FROM goals WHERE uid = ? AND id = ?", uid, goal.Id).Scan(&endTime, &recurrence, &oldKind, &oldTarget, &notifySecret); {
+	case err == sql.ErrNoRows:
+		return nil, status.Error(codes.NotFound, "goal doesn't exist")
+	case err != nil:
+		s.log.Error("error getting goal", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", goal.Id))
+		return nil, status.Error(codes.Internal, "error editing goal")
+	}
+	if recurrence == int32(cpb.Goal_NONE) && endTime < time.Now().UnixNano() {
+		return nil, status.Error(codes.FailedPrecondition, "cannot edit a completed goal")
+	}
+	isLabel, item, isPercent, goalDuration, targetDuration, baseDuration, err := s.initGoal(goal)
+	if err != nil {
+		s.log.Error("init goal error", zap.Error(err))
+		return nil, status.Error(codes.Internal, "error editing goal")
+	}
+	progress, err := s.getGoalProgress(uid, deviceFilters("intervals.did", goal.GetDevices()), isLabel, item, baseDuration, targetDuration, dayRanges(goal.GoalInterval.Start.Nanos, goal.GoalInterval.End.Nanos, goal.DaysOfWeek, s.getUserLocation(uid)))
+	if err != nil {
+		s.log.Error("error getting goal progress", zap.Error(err))
+		return nil, status.Error(codes.Internal, "error editing goal")
+	}
+	notifyKind, notifyTarget := goalNotification(goal)
+	switch {
+	case notifyKind != "webhook":
+		notifySecret = ""
+	case oldKind != "webhook" || oldTarget != notifyTarget || notifySecret == "":
+		// a new webhook gets a new secret, so a secret is never sent to another URL
+		if notifySecret, err = generateWebhookSecret(); err != nil {
+			s.log.Error("failed to generate webhook secret", zap.Error(err))
+			return nil, status.Error(codes.Internal, "error editing goal")
+		}
+		goal.WebhookSecret = notifySecret
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		s.log.Error("can't begin transaction", zap.Error(err))
+		return nil, status.Error(codes.Internal, "error editing goal")
+	}
+	if _, err = tx.Exec("UPDATE goals SET title = ?, is_label = ?, item = ?, is_percent = ?, goal_duration = ?, target_duration = ?, base_duration = ?, "+
+		"starttime = ?, endtime = ?, compare_starttime = ?, compare_endtime = ?, days_of_week = ?, equalized = ?, progress = ?, goaltype = ?, recurrence = ?, notify_kind = ?, notify_target = ?, notify_secret = ?, notify_thresholds = ? WHERE uid = ? AND id = ?",
+		goal.Title, isLabel, item, isPercent, goalDuration, targetDuration, baseDuration, goal.GoalInterval.Start.Nanos, goal.GoalInterval.End.Nanos, goal.GetCompareInterval().GetStart().GetNanos(), goal.GetCompareInterval().GetEnd().GetNanos(), goal.DaysOfWeek, goal.CompareEqualized, progress, goal.Type, goal.Recurrence, notifyKind, notifyTarget, notifySecret, formatThresholds(goal.NotificationThresholds), uid, goal.Id); err != nil {
+		tx.Rollback()
+		s.log.Error("update goal failed", zap.Error(err))
+		return nil, status.Error(codes.Internal, "error editing goal")
+	}
+	if err = s.setGoalDevices(tx, uid, goal.Id, goal.Devices); err != nil {
+		tx.Rollback()
+		s.log.Error("update goal devices failed", zap.Error(err))
+		return nil, status.Error(codes.Internal, "error editing goal")
+	}
+	if err = tx.Commit(); err != nil {
+		s.log.Error("commit goal failed", zap.Error(err))
+		return nil, status.Error(codes.Internal, "error editing goal")
+	}
+	return goal, nil
 }
 
 func (s *Service) GetGoals(ctx context.Context, req *cpb.Empty) (*spb.DataAggregatorGetGoalsResponse, error) {
@@ -221,7 +622,30 @@ func (s *Service) GetGoals(ctx context.Context, req *cpb.Empty) (*spb.DataAggreg
 		return nil, status.Error(codes.Unauthenticated, "Invalid token")
 	}
 
-	rows, err := s.db.Query("SELECT id, title, is_label, item, is_percent, goal_duration, starttime, endtime, compare_starttime, compare_endtime, equalized, progress, goaltype FROM goals WHERE uid = ? ORDER BY starttime", uid)
+	goalDevices := make(map[int64][]*cpb.Device)
+	drows, err := s.db.Query("SELECT gd.gid, gd.did, d.name FROM goal_devices gd JOIN devices d ON (d.uid = gd.uid AND d.id = gd.did) WHERE gd.uid = ? ORDER BY gd.did", uid)
+	if err != nil {
+		s.log.Error("Failed to get goal devices", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	for drows.Next() {
+		var gid int64
+		dev := &cpb.Device{}
+		if err = drows.Scan(&gid, &dev.Id, &dev.Name); err != nil {
+			s.log.Error("failed to scan goal device", zap.Error(err))
+			continue
+		}
+		goalDevices[gid] = append(goalDevices[gid], dev)
+	}
+	drows.Close()
+
+	goalHistory, err := s.getGoalHistory(uid)
+	if err != nil {
+		s.log.Error("Failed to get goal history", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+
+	rows, err := s.db.Query("SELECT id, title, is_label, item, is_percent, goal_duration, starttime, endtime, compare_starttime, compare_endtime, COALESCE(days_of_week, 0), equalized, progress, goaltype, recurrence, notify_kind, notify_target, notify_thresholds FROM goals WHERE uid = ? ORDER BY starttime", uid)
 
 	rsp := &spb.DataAggregatorGetGoalsResponse{}
 	switch {
@@ -229,16 +653,18 @@ func (s *Service) GetGoals(ctx context.Context, req *cpb.Empty) (*spb.DataAggreg
 		defer rows.Close()
 		for rows.Next() {
 			var id, goalDuration, starttime, endtime, compareStarttime, compareEndtime, progress int64
+			var daysOfWeek, recurrence int32
 			var isLabel, isPercent, equalized bool
-			var item, title, goaltype string
-			if err = rows.Scan(&id, &title, &isLabel, &item, &isPercent, &goalDuration, &starttime, &endtime, &compareStarttime, &compareEndtime, &equalized, &progress, &goaltype); err != nil {
+			var item, title, goaltype, notifyKind, notifyTarget, notifyThresholds string
+			if err = rows.Scan(&id, &title, &isLabel, &item, &isPercent, &goalDuration, &starttime, &endtime, &compareStarttime, &compareEndtime, &daysOfWeek, &equalized, &progress, &goaltype, &recurrence, &notifyKind, &notifyTarget, &notifyThresholds); err != nil {
 				s.log.Error("failed to scan goal", zap.Error(err))
 				continue
 			}
 			goal := &cpb.Goal{
-				Uid:   uid,
-				Id:    id,
-				Title: title,
+				Uid:     uid,
+				Id:      id,
+				Title:   title,
+				Devices: goalDevices[id],
 				GoalInterval: &cpb.Interval{
 					Start: &cpb.Timestamp{Nanos: starttime},
 					End:   &cpb.Timestamp{Nanos: endtime},
@@ -247,11 +673,17 @@ func (s *Service) GetGoals(ctx context.Context, req *cpb.Empty) (*spb.DataAggreg
 					Start: &cpb.Timestamp{Nanos: compareStarttime},
 					End:   &cpb.Timestamp{Nanos: compareEndtime},
 				},
-				CompareEqualized: equalized,
-				Completed:        endtime < time.Now().UnixNano(),
-				Progress:         float32(progress) / 1000,
-				Type:             goaltype,
+				DaysOfWeek:             daysOfWeek,
+				CompareEqualized:       equalized,
+				Completed:              recurrence == int32(cpb.Goal_NONE) && endtime < time.Now().UnixNano(),
+				Progress:               float32(progress) / 1000,
+				Type:                   goaltype,
+				Recurrence:             cpb.Goal_Recurrence(recurrence),
+				History:                goalHistory[id],
+				NotificationThresholds: parseThresholds(notifyThresholds),
 			}
+			goal.CurrentStreak, goal.BestStreak = goalStreaks(goal.History)
+			setGoalNotification(goal, notifyKind, notifyTarget)
 			if isPercent {
 				goal.Amount = &cpb.Goal_PercentAmount{PercentAmount: float32(goalDuration) / 1000}
 			} else {
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/notifications"
+	cpb "git.yiad.am/productimon/proto/common"
+	"google.golang.org/grpc/codes"
+)
+
+func goalProgress(t *testing.T, s *Service, token string, gid int64) float32 {
+	t.Helper()
+	rsp, err := s.GetGoals(tokenContext(token), &cpb.Empty{})
+	if err != nil {
+		t.Fatalf("GetGoals failed: %v", err)
+	}
+	for _, g := range rsp.Goals {
+		if g.Id == gid {
+			return g.Progress
+		}
+	}
+	t.Fatalf("goal %d not found", gid)
+	return 0
+}
+
+func TestEditGoal(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	addUser(t, s, "other@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	otherToken := login(t, s, "other@productimon.com", "password").Token
+	addDevice(t, s, uid, 1)
+	now := time.Now()
+	start := now.Add(-30 * time.Minute).UnixNano()
+	addUserEvents(t, s, uid, 1, appSwitch(1, start, "a"), activity(2, start, start+int64(time.Minute)), stopTracking(3, start+int64(10*time.Minute)))
+
+	goal := func(app string, amount time.Duration) *cpb.Goal {
+		return &cpb.Goal{
+			Title:        "less " + app,
+			Type:         "limiting",
+			Item:         &cpb.Goal_Application{Application: app},
+			Amount:       &cpb.Goal_FixedAmount{FixedAmount: int64(amount)},
+			GoalInterval: &cpb.Interval{Start: &cpb.Timestamp{Nanos: now.Add(-time.Hour).UnixNano()}, End: &cpb.Timestamp{Nanos: now.Add(time.Hour).UnixNano()}},
+		}
+	}
+	added, err := s.AddGoal(tokenContext(token), goal("b", time.Hour))
+	if err != nil {
+		t.Fatalf("AddGoal failed: %v", err)
+	}
+	if p := goalProgress(t, s, token, added.Id); p != 0 {
+		t.Errorf("progress of goal for unused app is %v, want 0", p)
+	}
+
+	edited := goal("a", time.Hour)
+	edited.Id = added.Id
+	if _, err = s.EditGoal(tokenContext(token), edited); err != nil {
+		t.Fatalf("EditGoal failed: %v", err)
+	}
+	used := goalProgress(t, s, token, added.Id)
+	if used <= 0 {
+		t.Errorf("progress after editing goal to used app is %v, want > 0", used)
+	}
+	edited = goal("a", 2*time.Hour)
+	edited.Id = added.Id
+	if _, err = s.EditGoal(tokenContext(token), edited); err != nil {
+		t.Fatalf("EditGoal failed: %v", err)
+	}
+	if p := goalProgress(t, s, token, added.Id); p*2 < used-0.01 || p*2 > used+0.01 {
+		t.Errorf("progress after doubling the goal's amount is %v, want %v", p, used/2)
+	}
+
+	// the other user can't see or change the goal
+	edited = goal("b", time.Minute)
+	edited.Id = added.Id
+	_, err = s.EditGoal(tokenContext(otherToken), edited)
+	checkCode(t, "EditGoal of other user's goal", err, codes.NotFound)
+	if rsp, err := s.GetGoals(tokenContext(otherToken), &cpb.Empty{}); err != nil || len(rsp.Goals) != 0 {
+		t.Errorf("other user got goals %v (error %v), want none", rsp.GetGoals(), err)
+	}
+	if p := goalProgress(t, s, token, added.Id); p*2 < used-0.01 || p*2 > used+0.01 {
+		t.Errorf("progress after other user's edit is %v, want %v", p, used/2)
+	}
+
+	missing := goal("a", time.Hour)
+	missing.Id = added.Id + 1
+	_, err = s.EditGoal(tokenContext(token), missing)
+	checkCode(t, "EditGoal of missing goal", err, codes.NotFound)
+	_, err = s.EditGoal(context.Background(), edited)
+	checkCode(t, "EditGoal without token", err, codes.Unauthenticated)
+}
+
+func TestEditGoalInvalid(t *testing.T) {
+	s := startRPCService(t)
+	addUser(t, s, "user@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	now := time.Now().UnixNano()
+	hour := int64(time.Hour)
+	interval := func(start, end int64) *cpb.Interval {
+		return &cpb.Interval{Start: &cpb.Timestamp{Nanos: start}, End: &cpb.Timestamp{Nanos: end}}
+	}
+	goal := &cpb.Goal{
+		Title:        "less a",
+		Type:         "limiting",
+		Item:         &cpb.Goal_Application{Application: "a"},
+		Amount:       &cpb.Goal_FixedAmount{FixedAmount: hour},
+		GoalInterval: interval(now-hour, now+hour),
+	}
+	added, err := s.AddGoal(tokenContext(token), goal)
+	if err != nil {
+		t.Fatalf("AddGoal failed: %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		edit func(g *cpb.Goal)
+	}{
+		{"goal interval ends before start", func(g *cpb.Goal) { g.GoalInterval = interval(now+hour, now-hour) }},
+		{"empty goal interval", func(g *cpb.Goal) { g.GoalInterval = interval(now, now) }},
+		{"goal interval without end", func(g *cpb.Goal) { g.GoalInterval.End = nil }},
+		{"goal interval without start", func(g *cpb.Goal) { g.GoalInterval.Start = nil }},
+		{"compare interval ends before start", func(g *cpb.Goal) { g.CompareInterval = interval(now-hour, now-2*hour) }},
+		{"compare interval without end", func(g *cpb.Goal) { g.CompareInterval = &cpb.Interval{Start: &cpb.Timestamp{Nanos: now - 2*hour}} }},
+		{"compare interval without start", func(g *cpb.Goal) { g.CompareInterval = &cpb.Interval{End: &cpb.Timestamp{Nanos: now - hour}} }},
+		{"percent without compare interval", func(g *cpb.Goal) { g.Amount = &cpb.Goal_PercentAmount{PercentAmount: -0.5} }},
+		{"unknown type", func(g *cpb.Goal) { g.Type = "other" }},
+		{"without item", func(g *cpb.Goal) { g.Item = nil }},
+		{"empty application", func(g *cpb.Goal) { g.Item = &cpb.Goal_Application{} }},
+		{"empty label", func(g *cpb.Goal) { g.Item = &cpb.Goal_Label{} }},
+		{"without amount", func(g *cpb.Goal) { g.Amount = nil }},
+		{"equalized compare interval without selected days", func(g *cpb.Goal) {
+			// a Saturday to Sunday, with only Mondays selected
+			saturday := time.Date(2020, time.August, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+			g.CompareInterval = interval(saturday, saturday+2*24*hour)
+			g.CompareEqualized = true
+			g.DaysOfWeek = 1 << uint(time.Monday)
+		}},
+	} {
+		g := &cpb.Goal{
+			Id:           added.Id,
+			Title:        goal.Title,
+			Type:         goal.Type,
+			Item:         goal.Item,
+			Amount:       goal.Amount,
+			GoalInterval: interval(now-hour, now+hour),
+		}
+		test.edit(g)
+		_, err = s.EditGoal(tokenContext(token), g)
+		checkCode(t, test.name, err, codes.InvalidArgument)
+	}
+}
+
+// records notifications instead of sending them
+type recordingNotifier struct {
+	name       string
+	recipients []string
+}
+
+func (n *recordingNotifier) Name() string {
+	return n.name
+}
+
+func (n *recordingNotifier) Notify(recipient, message string) error {
+	n.recipients = append(n.recipients, recipient)
+	return nil
+}
+
+func TestGoalWebhookSecret(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	addDevice(t, s, uid, 1)
+	webhooks := &recordingNotifier{name: "webhook"}
+	s.RegisterNotifier(webhooks)
+	now := time.Now()
+	goal := func(webhook string) *cpb.Goal {
+		return &cpb.Goal{
+			Title:                  "less a",
+			Type:                   "limiting",
+			Item:                   &cpb.Goal_Application{Application: "a"},
+			Amount:                 &cpb.Goal_FixedAmount{FixedAmount: int64(time.Minute)},
+			GoalInterval:           &cpb.Interval{Start: &cpb.Timestamp{Nanos: now.Add(-time.Hour).UnixNano()}, End: &cpb.Timestamp{Nanos: now.Add(time.Hour).UnixNano()}},
+			Notification:           &cpb.Goal_Webhook{Webhook: webhook},
+			NotificationThresholds: []int32{100},
+			WebhookSecret:          "chosen by the user",
+		}
+	}
+
+	added, err := s.AddGoal(tokenContext(token), goal("https://example.com/hook"))
+	if err != nil {
+		t.Fatalf("AddGoal failed: %v", err)
+	}
+	secret := added.WebhookSecret
+	if len(secret) != 64 {
+		t.Fatalf("AddGoal returned webhook secret %q, want a generated one", secret)
+	}
+	rsp, err := s.GetGoals(tokenContext(token), &cpb.Empty{})
+	if err != nil || len(rsp.Goals) != 1 || rsp.Goals[0].WebhookSecret != "" {
+		t.Errorf("GetGoals returned %v (error %v), want the goal without its secret", rsp.GetGoals(), err)
+	}
+
+	// the secret stays while the URL does, and is only returned when it's new
+	edited := goal("https://example.com/hook")
+	edited.Id = added.Id
+	rspGoal, err := s.EditGoal(tokenContext(token), edited)
+	if err != nil || rspGoal.WebhookSecret != "" {
+		t.Errorf("EditGoal without changing webhook returned secret %q (error %v), want none", rspGoal.GetWebhookSecret(), err)
+	}
+
+	start := now.Add(-30 * time.Minute).UnixNano()
+	addUserEvents(t, s, uid, 1, appSwitch(1, start, "a"), activity(2, start, start+int64(time.Minute)), stopTracking(3, start+int64(10*time.Minute)))
+	s.UpdateGoal(uid, added.Id)
+	if want := []string{notifications.WebhookRecipient("https://example.com/hook", secret)}; !reflect.DeepEqual(webhooks.recipients, want) {
+		t.Errorf("webhook sent to %q, want %q", webhooks.recipients, want)
+	}
+
+	edited = goal("https://example.org/hook")
+	edited.Id = added.Id
+	if rspGoal, err = s.EditGoal(tokenContext(token), edited); err != nil {
+		t.Fatalf("EditGoal failed: %v", err)
+	}
+	if len(rspGoal.WebhookSecret) != 64 || rspGoal.WebhookSecret == secret {
+		t.Errorf("EditGoal changing webhook returned secret %q, want a new one", rspGoal.WebhookSecret)
+	}
+
+	edited = goal("")
+	edited.Id = added.Id
+	edited.Notification = nil
+	if rspGoal, err = s.EditGoal(tokenContext(token), edited); err != nil || rspGoal.WebhookSecret != "" {
+		t.Errorf("EditGoal removing webhook returned secret %q (error %v), want none", rspGoal.GetWebhookSecret(), err)
+	}
+	var stored string
+	if err = s.db.QueryRow("SELECT notify_secret FROM goals WHERE uid = ? AND id = ?", uid, added.Id).Scan(&stored); err != nil || stored != "" {
+		t.Errorf("goal without webhook has secret %q (error %v), want none", stored, err)
+	}
+}
+
+func TestGoalWebhookAddress(t *testing.T) {
+	s := startRPCService(t)
+	addUser(t, s, "user@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	now := time.Now()
+	goal := func(webhook string) *cpb.Goal {
+		return &cpb.Goal{
+			Title:        "less a",
+			Type:         "limiting",
+			Item:         &cpb.Goal_Application{Application: "a"},
+			Amount:       &cpb.Goal_FixedAmount{FixedAmount: int64(time.Minute)},
+			GoalInterval: &cpb.Interval{Start: &cpb.Timestamp{Nanos: now.Add(-time.Hour).UnixNano()}, End: &cpb.Timestamp{Nanos: now.Add(time.Hour).UnixNano()}},
+			Notification: &cpb.Goal_Webhook{Webhook: webhook},
+		}
+	}
+
+	_, err := s.AddGoal(tokenContext(token), goal("https://example.com/hook"))
+	checkCode(t, "AddGoal with webhooks disabled", err, codes.FailedPrecondition)
+
+	s.RegisterNotifier(notifications.NewWebhookNotifier())
+	for _, webhook := range []string{
+		"http://127.0.0.1:8080/",
+		"http://localhost/hook",
+		"http://api.localhost/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[fd00::1]/hook",
+		"http://0.0.0.0/hook",
+		"ftp://example.com/hook",
+		"example.com/hook",
+	} {
+		_, err = s.AddGoal(tokenContext(token), goal(webhook))
+		checkCode(t, "AddGoal with webhook "+webhook, err, codes.InvalidArgument)
+	}
+	if _, err = s.AddGoal(tokenContext(token), goal("https://203.0.113.7/hook")); err != nil {
+		t.Errorf("AddGoal with public webhook failed: %v", err)
+	}
+}
+
+func TestGoalDuration(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	addDevice(t, s, uid, 1)
+	addDevice(t, s, uid, 2)
+	for _, in := range []struct {
+		did        int64
+		start, end int64
+		app        string
+	}{
+		{1, 0, 100, "a"},
+		{1, 100, 150, "b"},
+		{1, 200, 300, "a"},
+		{2, 250, 400, "a"},
+	} {
+		if _, err := s.db.Exec("INSERT INTO intervals (uid, did, starttime, endtime, activetime, app) VALUES (?, ?, ?, ?, ?, ?)", uid, in.did, in.start, in.end, 0, in.app); err != nil {
+			t.Fatalf("can't insert interval: %v", err)
+		}
+	}
+	for _, tt := range []struct {
+		name    string
+		app     string
+		dFilter string
+		ranges  [][2]int64
+		want    int64
+	}{
+		{"no ranges", "a", "", nil, 0},
+		{"one range", "a", "", [][2]int64{{0, 1000}}, 100 + 100 + 150},
+		{"ranges cutting intervals", "a", "", [][2]int64{{50, 120}, {180, 260}}, 50 + 60 + 10},
+		{"other app", "b", "", [][2]int64{{50, 120}, {180, 260}}, 20},
+		{"device filter", "a", deviceFilters("intervals.did", []*cpb.Device{{Id: 2}}), [][2]int64{{50, 120}, {180, 260}}, 10},
+	} {
+		got, err := s.getGoalDuration(uid, false, tt.app, tt.dFilter, tt.ranges)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: getGoalDuration() = %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+	}
+	// neither app has a label
+	if got, err := s.getGoalDuration(uid, true, LABEL_UNCATEGORIZED, "", [][2]int64{{50, 120}, {180, 260}}); err != nil || got != 140 {
+		t.Errorf("label: getGoalDuration() = %d, %v, want 140", got, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"time"
 
+	"git.yiad.am/productimon/aggregator/storage"
 	"git.yiad.am/productimon/analyzer/nlp"
 	cpb "git.yiad.am/productimon/proto/common"
 	spb "git.yiad.am/productimon/proto/svc"
@@ -41,7 +42,7 @@ func (s *Service) addLabelToQueue(app string) {
 
 // get system-wide label for app
 // return LABEL_UNCATEGORIZED if it's not yet ready
-func (s *Service) getDefaultLabel(app string, tx *sql.Tx) string {
+func (s *Service) getDefaultLabel(app string, tx *storage.Tx) string {
 	if label, ok := labelCache.Get(app); ok {
 		return label.(string)
 	}
@@ -54,7 +55,7 @@ func (s *Service) getDefaultLabel(app string, tx *sql.Tx) string {
 	return LABEL_UNCATEGORIZED
 }
 
-func (s *Service) getLabel(uid, appname string, tx *sql.Tx) (label string) {
+func (s *Service) getLabel(uid, appname string, tx *storage.Tx) (label string) {
 	if err := tx.QueryRow("SELECT label FROM user_apps WHERE uid=? AND name=? LIMIT 1", uid, appname).Scan(&label); err == nil {
 		return
 	}
@@ -88,11 +89,11 @@ func (s *Service) ensureLabel(app string) {
 	}
 	label = nlp.GuessLabel(app)
 	s.log.Info("guessed label", zap.String("app", app), zap.String("label", label))
-	s.dbWLock.Lock()
+	s.db.Lock()
 	if _, err := s.db.Exec("INSERT INTO default_apps (name, label) VALUES (?, ?)", app, label); err != nil {
 		s.log.Error("cannot insert label into default_apps", zap.Error(err), zap.String("app", app), zap.String("label", label))
 	}
-	s.dbWLock.Unlock()
+	s.db.Unlock()
 }
 
 // scan db for any remaining uncatogorized apps and add them to queue on best effort
@@ -138,9 +139,9 @@ func (s *Service) GetLabels(ctx context.Context, req *spb.DataAggregatorGetLabel
 		if !s.isAdmin(ctx) {
 			return nil, status.Error(codes.Unauthenticated, "You must be an admin to change system-level labels")
 		}
-		rows, err = s.db.Query("SELECT a.name, a.label, COUNT(DISTINCT i.uid) FROM default_apps a, intervals i WHERE a.name = i.app GROUP BY a.name ORDER BY a.name COLLATE NOCASE ASC")
+		rows, err = s.db.Query("SELECT a.name, a.label, COUNT(DISTINCT i.uid) FROM default_apps a, intervals i WHERE a.name = i.app GROUP BY a.name ORDER BY " + s.db.NoCase("a.name") + " ASC")
 	} else {
-		rows, err = s.db.Query("SELECT i.app, COALESCE(u.label, d.label, ?), 0 FROM (SELECT DISTINCT app FROM intervals WHERE uid = ?) i LEFT JOIN user_apps u ON i.app = u.name AND u.uid = ? LEFT JOIN default_apps d ON i.app = d.name ORDER BY i.app COLLATE NOCASE ASC", LABEL_UNCATEGORIZED, uid, uid)
+		rows, err = s.db.Query("SELECT i.app, COALESCE(u.label, d.label, ?), 0 FROM (SELECT DISTINCT app FROM intervals WHERE uid = ?) i LEFT JOIN user_apps u ON i.app = u.name AND u.uid = ? LEFT JOIN default_apps d ON i.app = d.name ORDER BY "+s.db.NoCase("i.app")+" ASC", LABEL_UNCATEGORIZED, uid, uid)
 	}
 	rsp := &spb.DataAggregatorGetLabelsResponse{}
 
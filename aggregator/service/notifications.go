@@ -0,0 +1,356 @@
+package service
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/messages"
+	"git.yiad.am/productimon/aggregator/notifications"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Service) SubscribeNotifications(req *cpb.Empty, server spb.DataAggregator_SubscribeNotificationsServer) error {
+	uid, did, err := s.auther.AuthenticateRequest(server.Context())
+	if err != nil || did == -1 {
+		return status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	// cancelled once the device is removed or renews its certificate
+	ctx, done := s.deviceNotifier.Track(server.Context(), uid, did)
+	defer done()
+	messages, cancel := s.deviceNotifier.Subscribe(uid, did)
+	defer cancel()
+	s.log.Info("device subscribed to notifications", zap.String("uid", uid), zap.Int64("did", did))
+	for {
+		select {
+		case <-ctx.Done():
+			if server.Context().Err() == nil {
+				s.log.Info("device disconnected", zap.String("uid", uid), zap.Int64("did", did))
+				return status.Error(codes.Unauthenticated, "Invalid certificate")
+			}
+			s.log.Info("device unsubscribed from notifications", zap.String("uid", uid), zap.Int64("did", did))
+			return nil
+		case msg := <-messages:
+			if err = server.Send(&spb.DataAggregatorNotification{
+				Message: msg,
+				Time:    &cpb.Timestamp{Nanos: time.Now().UnixNano()},
+			}); err != nil {
+				s.log.Error("failed to push notification", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did))
+				return err
+			}
+		}
+	}
+}
+
+// goal progress percentages notifications are sent at if user hasn't set any
+var defaultNotificationThresholds = []int32{85, 100}
+
+const maxNotificationThresholds = 10
+
+// how often we check for digests to send once quiet hours end and for
+// failed notifications to retry
+const notificationDigestInterval = time.Minute
+
+// failed notifications are retried with exponential backoff up to this interval,
+// and dropped after maxNotificationAttempts
+const (
+	maxNotificationRetryInterval = 6 * time.Hour
+	maxNotificationAttempts      = 12
+)
+
+// parse comma-separated thresholds stored in db
+func parseThresholds(s string) []int32 {
+	var thresholds []int32
+	for _, t := range strings.Split(s, ",") {
+		if n, err := strconv.ParseInt(strings.TrimSpace(t), 10, 32); err == nil {
+			thresholds = append(thresholds, int32(n))
+		}
+	}
+	return thresholds
+}
+
+// sort and dedup thresholds and format them to be stored in db
+func formatThresholds(thresholds []int32) string {
+	sorted := append([]int32(nil), thresholds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var parts []string
+	for i, t := range sorted {
+		if i > 0 && t == sorted[i-1] {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(t)))
+	}
+	return strings.Join(parts, ",")
+}
+
+func validateThresholds(thresholds []int32) error {
+	if len(thresholds) > maxNotificationThresholds {
+		return status.Errorf(codes.InvalidArgument, "at most %d notification thresholds are allowed", maxNotificationThresholds)
+	}
+	for _, t := range thresholds {
+		if t < 1 || t > 100 {
+			return status.Error(codes.InvalidArgument, "notification thresholds must be between 1 and 100")
+		}
+	}
+	return nil
+}
+
+// whether t is in quiet hours between minutes of day start and end, which may wrap around midnight
+func inQuietHours(t time.Time, start, end int32) bool {
+	if start == end {
+		return false
+	}
+	m := int32(t.Hour()*60 + t.Minute())
+	if start < end {
+		return m >= start && m < end
+	}
+	return m >= start || m < end
+}
+
+type notificationSettings struct {
+	thresholds []int32
+	quietStart int32
+	quietEnd   int32
+	maxDaily   int32
+}
+
+func (s *Service) getNotificationSettings(uid string) (*notificationSettings, error) {
+	ns := &notificationSettings{}
+	var thresholds string
+	if err := s.db.QueryRow("SELECT notify_thresholds, quiet_hours_start, quiet_hours_end, max_daily_notifications FROM users WHERE id = ?", uid).Scan(&thresholds, &ns.quietStart, &ns.quietEnd, &ns.maxDaily); err != nil {
+		return nil, err
+	}
+	if ns.thresholds = parseThresholds(thresholds); len(ns.thresholds) == 0 {
+		ns.thresholds = defaultNotificationThresholds
+	}
+	return ns, nil
+}
+
+// send msg to user now, or hold it back for the digest if it's in user's quiet hours.
+// messages over user's daily cap are dropped. Caller must not hold the write lock
+func (s *Service) deliverNotification(uid, kind, recipient string, msg *messages.Message) error {
+	ns, err := s.getNotificationSettings(uid)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(s.getUserLocation(uid))
+	if inQuietHours(now, ns.quietStart, ns.quietEnd) {
+		s.db.Lock()
+		defer s.db.Unlock()
+		_, err = s.db.Exec("INSERT INTO pending_notifications (uid, kind, recipient, subject, body, html, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			uid, kind, recipient, msg.Subject, msg.Body, msg.HTML, now.UnixNano())
+		return err
+	}
+	if ns.maxDaily > 0 {
+		var sent int32
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		if err = s.db.QueryRow("SELECT COUNT(*) FROM notification_log WHERE uid = ? AND sent_at >= ?", uid, today.UnixNano()).Scan(&sent); err != nil {
+			return err
+		}
+		if sent >= ns.maxDaily {
+			s.log.Info("daily notification cap reached, dropping notification", zap.String("uid", uid), zap.String("kind", kind))
+			return nil
+		}
+	}
+	return s.sendNotification(uid, kind, recipient, msg)
+}
+
+// send msg now, queueing it for retry if the notifier fails.
+// Caller must not hold the write lock
+func (s *Service) sendNotification(uid, kind, recipient string, msg *messages.Message) error {
+	if err := s.Notify(kind, recipient, msg); err != nil {
+		if err == notifications.ErrNotRegistered {
+			return err
+		}
+		s.log.Warn("failed to send notification, queueing for retry", zap.Error(err), zap.String("uid", uid), zap.String("kind", kind))
+		now := time.Now()
+		s.db.Lock()
+		defer s.db.Unlock()
+		_, err = s.db.Exec("INSERT INTO notification_queue (uid, kind, recipient, subject, body, html, created_at, attempts, next_attempt_at, last_error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			uid, kind, recipient, msg.Subject, msg.Body, msg.HTML, now.UnixNano(), 1, now.Add(retryBackoff(1)).UnixNano(), err.Error())
+		return err
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	_, err := s.db.Exec("INSERT INTO notification_log (uid, kind, sent_at) VALUES (?, ?, ?)", uid, kind, time.Now().UnixNano())
+	return err
+}
+
+// how long to wait before retrying a notification that failed attempts times
+func retryBackoff(attempts int32) time.Duration {
+	if attempts > 10 {
+		return maxNotificationRetryInterval
+	}
+	d := time.Minute << uint(attempts-1)
+	if d > maxNotificationRetryInterval {
+		d = maxNotificationRetryInterval
+	}
+	return d
+}
+
+// retry queued notifications that are due
+func (s *Service) retryNotifications(now time.Time) {
+	type queued struct {
+		uid, kind, recipient string
+		msg                  *messages.Message
+		createdAt            int64
+		attempts             int32
+	}
+	rows, err := s.db.Query("SELECT uid, kind, recipient, subject, body, html, created_at, attempts FROM notification_queue WHERE next_attempt_at <= ? ORDER BY next_attempt_at", now.UnixNano())
+	if err != nil {
+		s.log.Error("error getting queued notifications", zap.Error(err))
+		return
+	}
+	var due []queued
+	for rows.Next() {
+		q := queued{msg: &messages.Message{}}
+		if err = rows.Scan(&q.uid, &q.kind, &q.recipient, &q.msg.Subject, &q.msg.Body, &q.msg.HTML, &q.createdAt, &q.attempts); err != nil {
+			s.log.Error("failed to scan queued notification", zap.Error(err))
+			continue
+		}
+		due = append(due, q)
+	}
+	rows.Close()
+	for _, q := range due {
+		err := s.Notify(q.kind, q.recipient, q.msg)
+		// only the writes are done with the write lock held, not sending
+		s.db.Lock()
+		func() {
+			defer s.db.Unlock()
+			switch {
+			case err == nil:
+				_, err = s.db.Exec("INSERT INTO notification_log (uid, kind, sent_at) VALUES (?, ?, ?)", q.uid, q.kind, now.UnixNano())
+			case q.attempts+1 >= maxNotificationAttempts:
+				s.log.Error("giving up on notification", zap.Error(err), zap.String("uid", q.uid), zap.String("kind", q.kind), zap.Int32("attempts", q.attempts+1))
+				err = nil
+			default:
+				s.log.Warn("failed to retry notification", zap.Error(err), zap.String("uid", q.uid), zap.String("kind", q.kind), zap.Int32("attempts", q.attempts+1))
+				if _, err = s.db.Exec("UPDATE notification_queue SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE uid = ? AND kind = ? AND recipient = ? AND created_at = ?",
+					q.attempts+1, now.Add(retryBackoff(q.attempts+1)).UnixNano(), err.Error(), q.uid, q.kind, q.recipient, q.createdAt); err != nil {
+					s.log.Error("error updating queued notification", zap.Error(err), zap.String("uid", q.uid))
+				}
+				return
+			}
+			if err != nil {
+				s.log.Error("error logging notification", zap.Error(err), zap.String("uid", q.uid))
+			}
+			if _, err = s.db.Exec("DELETE FROM notification_queue WHERE uid = ? AND kind = ? AND recipient = ? AND created_at = ?", q.uid, q.kind, q.recipient, q.createdAt); err != nil {
+				s.log.Error("error deleting queued notification", zap.Error(err), zap.String("uid", q.uid))
+			}
+		}()
+	}
+}
+
+// send digests of notifications held back during quiet hours and retry failed
+// notifications periodically
+// to be run in its own goroutine
+func (s *Service) RunNotificationRoutine() {
+	timer := time.NewTicker(notificationDigestInterval)
+	for range timer.C {
+		s.sendDigests()
+		s.retryNotifications(time.Now())
+		// we only need today's log for the daily cap
+		s.db.Lock()
+		if _, err := s.db.Exec("DELETE FROM notification_log WHERE sent_at < ?", time.Now().Add(-48*time.Hour).UnixNano()); err != nil {
+			s.log.Error("error cleaning up notification log", zap.Error(err))
+		}
+		s.db.Unlock()
+	}
+}
+
+func (s *Service) sendDigests() {
+	rows, err := s.db.Query("SELECT DISTINCT uid FROM pending_notifications")
+	if err != nil {
+		s.log.Error("error getting pending notifications", zap.Error(err))
+		return
+	}
+	var uids []string
+	for rows.Next() {
+		var uid string
+		if err = rows.Scan(&uid); err != nil {
+			s.log.Error("failed to scan pending notification", zap.Error(err))
+			continue
+		}
+		uids = append(uids, uid)
+	}
+	rows.Close()
+	for _, uid := range uids {
+		if err = s.sendDigest(uid); err != nil {
+			s.log.Error("error sending notification digest", zap.Error(err), zap.String("uid", uid))
+		}
+	}
+}
+
+// send one digest per channel of all notifications held back for user, if quiet hours are over
+func (s *Service) sendDigest(uid string) error {
+	ns, err := s.getNotificationSettings(uid)
+	if err != nil {
+		return err
+	}
+	if inQuietHours(time.Now().In(s.getUserLocation(uid)), ns.quietStart, ns.quietEnd) {
+		return nil
+	}
+	type channel struct {
+		kind, recipient string
+	}
+	var channels []channel
+	pending := make(map[channel][]*messages.Message)
+	// created_at of the last notification of each channel, the ones up to it are
+	// only removed from pending_notifications once their digest is sent or queued
+	last := make(map[channel]int64)
+	rows, err := s.db.Query("SELECT kind, recipient, subject, body, html, created_at FROM pending_notifications WHERE uid = ? ORDER BY created_at", uid)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c channel
+		var createdAt int64
+		msg := &messages.Message{}
+		if err = rows.Scan(&c.kind, &c.recipient, &msg.Subject, &msg.Body, &msg.HTML, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		if pending[c] == nil {
+			channels = append(channels, c)
+		}
+		pending[c] = append(pending[c], msg)
+		last[c] = createdAt
+	}
+	rows.Close()
+	if len(channels) == 0 {
+		return nil
+	}
+	data, locale, err := s.userMessageData(uid)
+	if err != nil {
+		return err
+	}
+	digests := make(map[channel]*messages.Message)
+	for _, c := range channels {
+		digests[c] = pending[c][0]
+		if len(pending[c]) > 1 {
+			data.Messages = pending[c]
+			if digests[c], err = s.messages.Render(messages.Digest, locale, data); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range channels {
+		// digests aren't subject to daily cap since they were already held back for a while.
+		// A digest that fails to send is queued for retry, so it's done with either way
+		if err = s.sendNotification(uid, c.kind, c.recipient, digests[c]); err != nil {
+			s.log.Error("error sending notification digest", zap.Error(err), zap.String("uid", uid), zap.String("kind", c.kind))
+		}
+		s.db.Lock()
+		_, err = s.db.Exec("DELETE FROM pending_notifications WHERE uid = ? AND kind = ? AND recipient = ? AND created_at <= ?", uid, c.kind, c.recipient, last[c])
+		s.db.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
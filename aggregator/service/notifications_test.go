@@ -0,0 +1,127 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/messages"
+)
+
+func TestThresholds(t *testing.T) {
+	if got := formatThresholds([]int32{100, 50, 75, 50}); got != "50,75,100" {
+		t.Errorf("formatThresholds() = %q, want %q", got, "50,75,100")
+	}
+	if got := parseThresholds("50,75,100"); !reflect.DeepEqual(got, []int32{50, 75, 100}) {
+		t.Errorf("parseThresholds() = %v", got)
+	}
+	if got := parseThresholds(""); got != nil {
+		t.Errorf("parseThresholds(\"\") = %v, want nil", got)
+	}
+	if err := validateThresholds([]int32{1, 100}); err != nil {
+		t.Errorf("validateThresholds() = %v", err)
+	}
+	if err := validateThresholds([]int32{0}); err == nil {
+		t.Error("validateThresholds([0]) = nil")
+	}
+	if err := validateThresholds([]int32{101}); err == nil {
+		t.Error("validateThresholds([101]) = nil")
+	}
+}
+
+func TestInQuietHours(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2020, time.August, 3, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		t          time.Time
+		start, end int32
+		want       bool
+	}{
+		{at(3, 0), 0, 0, false},
+		{at(12, 0), 9 * 60, 17 * 60, true},
+		{at(17, 0), 9 * 60, 17 * 60, false},
+		{at(8, 59), 9 * 60, 17 * 60, false},
+		// 22:00 - 07:30
+		{at(23, 0), 22 * 60, 7*60 + 30, true},
+		{at(7, 29), 22 * 60, 7*60 + 30, true},
+		{at(7, 30), 22 * 60, 7*60 + 30, false},
+		{at(12, 0), 22 * 60, 7*60 + 30, false},
+	}
+	for _, tt := range tests {
+		if got := inQuietHours(tt.t, tt.start, tt.end); got != tt.want {
+			t.Errorf("inQuietHours(%s, %d, %d) = %v, want %v", tt.t.Format("15:04"), tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int32
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{10, maxNotificationRetryInterval},
+		{100, maxNotificationRetryInterval},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.attempts); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func pendingNotifications(t *testing.T, s *Service, uid string) int {
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM pending_notifications WHERE uid = ?", uid).Scan(&n); err != nil {
+		t.Fatalf("can't count pending notifications: %v", err)
+	}
+	return n
+}
+
+func TestSendDigestKeepsPendingOnError(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	emails := &recordingNotifier{name: "email"}
+	s.RegisterNotifier(emails)
+	for i := 0; i < 2; i++ {
+		if _, err := s.db.Exec("INSERT INTO pending_notifications (uid, kind, recipient, subject, body, html, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			uid, "email", "user@productimon.com", "goal", "you did it", "", int64(i)); err != nil {
+			t.Fatalf("can't insert pending notification: %v", err)
+		}
+	}
+
+	// a digest template that fails to render
+	dir := tempDir(t)
+	if err := os.Mkdir(filepath.Join(dir, "en"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "en", "digest.tmpl"), []byte(`{{define "body"}}{{template "missing"}}{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	working := s.messages
+	broken, err := messages.Load(dir, "en")
+	if err != nil {
+		t.Fatalf("can't load templates: %v", err)
+	}
+	s.messages = broken
+	if err = s.sendDigest(uid); err == nil {
+		t.Error("sendDigest with broken template succeeded")
+	}
+	if n := pendingNotifications(t, s, uid); n != 2 || len(emails.recipients) != 0 {
+		t.Errorf("after failed digest %d notifications are pending and %d sent, want 2 and 0", n, len(emails.recipients))
+	}
+
+	s.messages = working
+	if err = s.sendDigest(uid); err != nil {
+		t.Errorf("sendDigest failed: %v", err)
+	}
+	if n := pendingNotifications(t, s, uid); n != 0 || len(emails.recipients) != 1 {
+		t.Errorf("after digest %d notifications are pending and %d sent, want 0 and 1", n, len(emails.recipients))
+	}
+}
@@ -0,0 +1,256 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/storage"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// how long reporters wait for their pairing code to be approved
+	pairingCodeDuration = 10 * time.Minute
+	// how often reporters may poll for approval
+	pairingPollInterval = 5 * time.Second
+	// pending pairing codes per ip address
+	maxPairingCodesPerAddr = 5
+	// wrong codes a user may enter per pairingCodeDuration
+	maxPairingFailures = 10
+)
+
+// no 0/O or 1/I so codes can be read out
+const pairingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// counts recent attempts per key, e.g. wrong pairing codes per user
+type attemptLimiter struct {
+	window   time.Duration
+	max      int
+	attempts map[string][]time.Time
+	mutex    sync.Mutex
+}
+
+func newAttemptLimiter(window time.Duration, max int) *attemptLimiter {
+	return &attemptLimiter{
+		window:   window,
+		max:      max,
+		attempts: make(map[string][]time.Time),
+	}
+}
+
+// whether key has made less than max attempts in the window
+func (l *attemptLimiter) allowed(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	cutoff := time.Now().Add(-l.window)
+	recent := l.attempts[key][:0]
+	for _, t := range l.attempts[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(l.attempts, key)
+	} else {
+		l.attempts[key] = recent
+	}
+	return len(recent) < l.max
+}
+
+func (l *attemptLimiter) add(key string) {
+	l.mutex.Lock()
+	l.attempts[key] = append(l.attempts[key], time.Now())
+	l.mutex.Unlock()
+}
+
+func generatePairingCode() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = pairingCodeAlphabet[int(b)%len(pairingCodeAlphabet)]
+	}
+	return string(buf), nil
+}
+
+// strip what users may type around a code, e.g. "abcd-efgh" to "ABCDEFGH"
+func normalizePairingCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+func formatPairingCode(code string) string {
+	return code[:4] + "-" + code[4:]
+}
+
+// id of the pairing a reporter polls for with secret
+func pairingId(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ip address of the client making the request
+func remoteAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// RequestPairingCode starts pairing a new device without its user's password,
+// the user approves the returned code with ApprovePairing while the reporter
+// polls PollPairing with the secret
+func (s *Service) RequestPairingCode(ctx context.Context, req *spb.DataAggregatorDeviceSigninRequest) (*spb.DataAggregatorPairingCode, error) {
+	if req.Device == nil || req.Device.Name == "" || len(req.Device.Name) > 255 {
+		return nil, status.Error(codes.InvalidArgument, "device name must be 1 to 255 characters")
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		s.log.Error("failed to generate pairing secret", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	addr := remoteAddr(ctx)
+	now := time.Now()
+	expires := now.Add(pairingCodeDuration)
+
+	s.db.Lock()
+	defer s.db.Unlock()
+	if _, err := s.db.Exec("DELETE FROM device_pairings WHERE expires_at < ?", now.UnixNano()); err != nil {
+		s.log.Error("failed to delete expired pairings", zap.Error(err))
+	}
+	var pending int64
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM device_pairings WHERE remote_addr = ?", addr).Scan(&pending); err != nil {
+		s.log.Error("failed to count pairings", zap.Error(err), zap.String("remote_addr", addr))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if pending >= maxPairingCodesPerAddr {
+		return nil, status.Error(codes.ResourceExhausted, "too many pairing codes requested, try again later")
+	}
+	for {
+		code, err := generatePairingCode()
+		if err != nil {
+			s.log.Error("failed to generate pairing code", zap.Error(err))
+			return nil, status.Error(codes.Internal, "something went wrong")
+		}
+		var tmp int64
+		err = s.db.QueryRow("SELECT 1 FROM device_pairings WHERE code = ?", code).Scan(&tmp)
+		if err == nil {
+			continue
+		} else if err != sql.ErrNoRows {
+			s.log.Error("failed to check pairing code", zap.Error(err))
+			return nil, status.Error(codes.Internal, "something went wrong")
+		}
+		_, err = s.db.Exec("INSERT INTO device_pairings (id, code, device_name, device_kind, remote_addr, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			pairingId(secret), code, req.Device.Name, req.Device.DeviceType, addr, now.UnixNano(), expires.UnixNano())
+		if err != nil {
+			s.log.Error("failed to insert pairing", zap.Error(err))
+			return nil, status.Error(codes.Internal, "something went wrong")
+		}
+		s.log.Info("requested pairing code", zap.String("remote_addr", addr), zap.String("device_name", req.Device.Name))
+		return &spb.DataAggregatorPairingCode{
+			Code:         formatPairingCode(code),
+			Secret:       secret,
+			ExpiresAt:    expires.UnixNano(),
+			PollInterval: int64(pairingPollInterval),
+		}, nil
+	}
+}
+
+// ApprovePairing lets the reporter showing the code sign in as the user
+func (s *Service) ApprovePairing(ctx context.Context, req *spb.DataAggregatorApprovePairingRequest) (*cpb.Device, error) {
+	uid, err := s.authenticateNewDevice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !s.pairingFailures.allowed(uid) {
+		return nil, status.Error(codes.ResourceExhausted, "too many wrong codes, try again later")
+	}
+	code := normalizePairingCode(req.Code)
+	s.db.Lock()
+	defer s.db.Unlock()
+	device := &cpb.Device{}
+	err = s.db.QueryRow("SELECT device_name, device_kind FROM device_pairings WHERE code = ? AND uid = ? AND expires_at > ?", code, "", time.Now().UnixNano()).
+		Scan(&device.Name, &device.DeviceType)
+	switch {
+	case err == sql.ErrNoRows:
+		s.pairingFailures.add(uid)
+		return nil, status.Error(codes.NotFound, "invalid or expired code")
+	case err != nil:
+		s.log.Error("failed to get pairing", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if _, err = s.db.Exec("UPDATE device_pairings SET uid = ? WHERE code = ?", uid, code); err != nil {
+		s.log.Error("failed to approve pairing", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	s.log.Info("approved pairing", zap.String("uid", uid), zap.String("device_name", device.Name))
+	return device, nil
+}
+
+// PollPairing returns a token for DeviceSignin once the pairing is approved
+func (s *Service) PollPairing(ctx context.Context, req *spb.DataAggregatorPollPairingRequest) (*spb.DataAggregatorLoginResponse, error) {
+	id := pairingId(req.Secret)
+	now := time.Now()
+	s.db.Lock()
+	defer s.db.Unlock()
+	var uid string
+	var expires, polled int64
+	err := s.db.QueryRow("SELECT uid, expires_at, polled_at FROM device_pairings WHERE id = ?", id).Scan(&uid, &expires, &polled)
+	switch {
+	case err == sql.ErrNoRows || err == nil && expires <= now.UnixNano():
+		return nil, status.Error(codes.NotFound, "pairing code expired")
+	case err != nil:
+		s.log.Error("failed to get pairing", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	// allow some jitter in the reporter's timer
+	if now.UnixNano()-polled < int64(pairingPollInterval*4/5) {
+		return nil, status.Error(codes.ResourceExhausted, "polling too often")
+	}
+	if _, err = s.db.Exec("UPDATE device_pairings SET polled_at = ? WHERE id = ?", now.UnixNano(), id); err != nil {
+		s.log.Error("failed to update pairing", zap.Error(err))
+	}
+	if uid == "" {
+		return nil, status.Error(codes.FailedPrecondition, "pairing not approved yet")
+	}
+	token, err := s.auther.SignPairingToken(uid, id)
+	if err != nil {
+		s.log.Error("failed to sign pairing token", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	return &spb.DataAggregatorLoginResponse{Token: token}, nil
+}
+
+// mark the pairing as used in tx. Returns false if it has been already
+func (s *Service) consumePairing(tx *storage.Tx, uid, pairing string) (bool, error) {
+	res, err := tx.Exec("DELETE FROM device_pairings WHERE id = ? AND uid = ?", pairing, uid)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
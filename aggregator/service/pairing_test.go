@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+)
+
+func TestPairingCode(t *testing.T) {
+	code, err := generatePairingCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 8 {
+		t.Fatalf("code %q has wrong length", code)
+	}
+	for _, c := range code {
+		if !strings.ContainsRune(pairingCodeAlphabet, c) {
+			t.Errorf("code %q has character %q not in alphabet", code, c)
+		}
+	}
+	for _, typed := range []string{formatPairingCode(code), strings.ToLower(formatPairingCode(code)), " " + code + " "} {
+		if got := normalizePairingCode(typed); got != code {
+			t.Errorf("normalizePairingCode(%q) = %q, want %q", typed, got, code)
+		}
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	l := newAttemptLimiter(time.Hour, 2)
+	for i := 0; i < 2; i++ {
+		if !l.allowed("a") {
+			t.Fatalf("attempt %d not allowed", i)
+		}
+		l.add("a")
+	}
+	if l.allowed("a") {
+		t.Error("attempt over limit allowed")
+	}
+	if !l.allowed("b") {
+		t.Error("limit shared between keys")
+	}
+	l.attempts["a"][0] = time.Now().Add(-2 * time.Hour)
+	if !l.allowed("a") {
+		t.Error("attempts outside window counted")
+	}
+}
+
+// context of a request from ip
+func addrContext(ip string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}})
+}
+
+func requestPairingCode(t *testing.T, s *Service, ctx context.Context) *spb.DataAggregatorPairingCode {
+	t.Helper()
+	code, err := s.RequestPairingCode(ctx, &spb.DataAggregatorDeviceSigninRequest{Device: &cpb.Device{Name: "laptop"}})
+	if err != nil {
+		t.Fatalf("RequestPairingCode failed: %v", err)
+	}
+	return code
+}
+
+func approvePairing(s *Service, token, code string) error {
+	_, err := s.ApprovePairing(tokenContext(token), &spb.DataAggregatorApprovePairingRequest{Code: code})
+	return err
+}
+
+// poll like a reporter that has waited the poll interval
+func pollPairing(t *testing.T, s *Service, secret string) (*spb.DataAggregatorLoginResponse, error) {
+	if _, err := s.db.Exec("UPDATE device_pairings SET polled_at = 0"); err != nil {
+		t.Fatalf("can't reset poll time: %v", err)
+	}
+	return s.PollPairing(context.Background(), &spb.DataAggregatorPollPairingRequest{Secret: secret})
+}
+
+func TestPairing(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	code := requestPairingCode(t, s, addrContext("192.0.2.1"))
+
+	_, err := pollPairing(t, s, code.Secret)
+	checkCode(t, "PollPairing before approval", err, codes.FailedPrecondition)
+	_, err = s.PollPairing(context.Background(), &spb.DataAggregatorPollPairingRequest{Secret: code.Secret})
+	checkCode(t, "PollPairing too often", err, codes.ResourceExhausted)
+
+	if err = approvePairing(s, token, strings.ToLower(code.Code)); err != nil {
+		t.Fatalf("ApprovePairing failed: %v", err)
+	}
+	checkCode(t, "ApprovePairing of approved code", approvePairing(s, token, code.Code), codes.NotFound)
+	paired, err := pollPairing(t, s, code.Secret)
+	if err != nil {
+		t.Fatalf("PollPairing after approval failed: %v", err)
+	}
+	_, err = s.UserDetails(tokenContext(paired.Token), &cpb.Empty{})
+	checkCode(t, "UserDetails with pairing token", err, codes.Unauthenticated)
+
+	req := &spb.DataAggregatorDeviceSigninRequest{Device: &cpb.Device{Name: "laptop"}}
+	rsp, err := s.DeviceSignin(tokenContext(paired.Token), req)
+	if err != nil {
+		t.Fatalf("DeviceSignin with pairing token failed: %v", err)
+	}
+	if len(rsp.Cert) == 0 {
+		t.Error("DeviceSignin returned no certificate")
+	}
+	var devices int
+	if err = s.db.QueryRow("SELECT COUNT(*) FROM devices WHERE uid = ? AND name = ?", uid, "laptop").Scan(&devices); err != nil || devices != 1 {
+		t.Errorf("user has %d paired devices (error %v), want 1", devices, err)
+	}
+
+	// the pairing is used up
+	_, err = s.DeviceSignin(tokenContext(paired.Token), req)
+	checkCode(t, "DeviceSignin with used pairing token", err, codes.Unauthenticated)
+	_, err = pollPairing(t, s, code.Secret)
+	checkCode(t, "PollPairing of used pairing", err, codes.NotFound)
+}
+
+func TestPairingExpired(t *testing.T) {
+	s := startRPCService(t)
+	addUser(t, s, "user@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	code := requestPairingCode(t, s, addrContext("192.0.2.1"))
+	if _, err := s.db.Exec("UPDATE device_pairings SET expires_at = ?", time.Now().Add(-time.Second).UnixNano()); err != nil {
+		t.Fatalf("can't expire pairing: %v", err)
+	}
+	checkCode(t, "ApprovePairing of expired code", approvePairing(s, token, code.Code), codes.NotFound)
+	_, err := pollPairing(t, s, code.Secret)
+	checkCode(t, "PollPairing of expired code", err, codes.NotFound)
+}
+
+func TestPairingRateLimits(t *testing.T) {
+	s := startRPCService(t)
+	addUser(t, s, "user@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+
+	var code *spb.DataAggregatorPairingCode
+	for i := 0; i < maxPairingCodesPerAddr; i++ {
+		code = requestPairingCode(t, s, addrContext("192.0.2.1"))
+	}
+	_, err := s.RequestPairingCode(addrContext("192.0.2.1"), &spb.DataAggregatorDeviceSigninRequest{Device: &cpb.Device{Name: "laptop"}})
+	checkCode(t, "RequestPairingCode over limit", err, codes.ResourceExhausted)
+	requestPairingCode(t, s, addrContext("192.0.2.2"))
+
+	for i := 0; i < maxPairingFailures; i++ {
+		checkCode(t, "ApprovePairing with wrong code", approvePairing(s, token, "AAAA-AAAA"), codes.NotFound)
+	}
+	checkCode(t, "ApprovePairing with right code after too many wrong ones", approvePairing(s, token, code.Code), codes.ResourceExhausted)
+	_, err = pollPairing(t, s, code.Secret)
+	checkCode(t, "PollPairing of code that wasn't approved", err, codes.FailedPrecondition)
+}
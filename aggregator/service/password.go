@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"git.yiad.am/productimon/aggregator/messages"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// current token generation of user, see authenticator.GenerationFunc
+func (s *Service) tokenGeneration(uid string) (int64, error) {
+	var gen int64
+	err := s.db.QueryRow("SELECT token_generation FROM users WHERE id = ?", uid).Scan(&gen)
+	return gen, err
+}
+
+func (s *Service) RequestPasswordReset(ctx context.Context, req *spb.DataAggregatorRequestPasswordResetRequest) (*cpb.Empty, error) {
+	if s.notifiers["email"] == nil {
+		return nil, status.Error(codes.FailedPrecondition, "email is not enabled on this server, please ask your admin to reset your password")
+	}
+	var uid string
+	err := s.db.QueryRow("SELECT id FROM users WHERE email = ?", req.Email).Scan(&uid)
+	if err == sql.ErrNoRows {
+		s.log.Debug("password reset requested for unknown email", zap.String("email", req.Email))
+		return &cpb.Empty{}, nil
+	}
+	if err != nil {
+		s.log.Error("failed to get user for password reset", zap.Error(err), zap.String("email", req.Email))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	token, err := s.auther.SignResetToken(uid)
+	if err != nil {
+		s.log.Error("can't sign reset token", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong with signing token")
+	}
+	data, locale, err := s.userMessageData(uid)
+	if err != nil {
+		s.log.Error("failed to get user for message", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	data.Link = fmt.Sprintf("https://%s/reset-password?token=%s", s.domain, url.QueryEscape(token))
+	msg, err := s.messages.Render(messages.PasswordReset, locale, data)
+	if err != nil {
+		s.log.Error("can't render password reset email", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if err = s.Notify("email", data.User.Email, msg); err != nil {
+		s.log.Error("error sending password reset email", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	s.log.Info("sent password reset email", zap.String("uid", uid))
+	return &cpb.Empty{}, nil
+}
+
+func (s *Service) ResetPassword(ctx context.Context, req *spb.DataAggregatorResetPasswordRequest) (*cpb.Empty, error) {
+	uid, gen, err := s.auther.VerifyResetToken(req.Token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "this link is invalid or has expired, please request a new one")
+	}
+	if req.NewPassword == "" {
+		return nil, status.Error(codes.InvalidArgument, "password can't be empty")
+	}
+	pwd, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcryptStrength)
+	if err != nil {
+		s.log.Error("error encrypting password", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	// the user has proved they own the email, so also verify the account
+	res, err := s.db.Exec("UPDATE users SET password = ?, verified = ?, token_generation = token_generation + 1 WHERE id = ? AND token_generation = ?", string(pwd), true, uid, gen)
+	if err != nil {
+		s.log.Error("failed to reset password", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		// another request used the token first
+		return nil, status.Error(codes.Unauthenticated, "this link is invalid or has expired, please request a new one")
+	}
+	if _, err = s.db.Exec("DELETE FROM sessions WHERE uid = ?", uid); err != nil {
+		s.log.Error("failed to delete sessions", zap.Error(err), zap.String("uid", uid))
+	}
+	s.log.Info("reset password", zap.String("uid", uid))
+	return &cpb.Empty{}, nil
+}
+
+func (s *Service) ChangePassword(ctx context.Context, req *spb.DataAggregatorChangePasswordRequest) (*spb.DataAggregatorLoginResponse, error) {
+	uid, did, mfa, err := s.auther.AuthenticateRequestMFA(ctx)
+	if err != nil || did != -1 {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	if req.NewPassword == "" {
+		return nil, status.Error(codes.InvalidArgument, "password can't be empty")
+	}
+	var storedPassword string
+	if err = s.db.QueryRow("SELECT password FROM users WHERE id = ?", uid).Scan(&storedPassword); err != nil {
+		s.log.Error("failed to get password", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(req.OldPassword)); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "wrong password")
+	}
+	pwd, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcryptStrength)
+	if err != nil {
+		s.log.Error("error encrypting password", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	s.db.Lock()
+	_, err = s.db.Exec("UPDATE users SET password = ?, token_generation = token_generation + 1 WHERE id = ?", string(pwd), uid)
+	if err == nil {
+		_, err = s.db.Exec("DELETE FROM sessions WHERE uid = ?", uid)
+	}
+	s.db.Unlock()
+	if err != nil {
+		s.log.Error("failed to change password", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	s.log.Info("changed password", zap.String("uid", uid))
+	return s.returnToken(ctx, uid, mfa)
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	spb "git.yiad.am/productimon/proto/svc"
+	"google.golang.org/grpc/codes"
+)
+
+func resetPassword(s *Service, token, password string) error {
+	_, err := s.ResetPassword(context.Background(), &spb.DataAggregatorResetPasswordRequest{Token: token, NewPassword: password})
+	return err
+}
+
+func checkLogin(t *testing.T, s *Service, email, password string, want codes.Code) {
+	t.Helper()
+	_, err := s.Login(context.Background(), &spb.DataAggregatorLoginRequest{Email: email, Password: password})
+	checkCode(t, "Login with password "+password, err, want)
+}
+
+func TestResetPasswordOnce(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	session := login(t, s, "user@productimon.com", "password").Token
+	first, err := s.auther.SignResetToken(uid)
+	if err != nil {
+		t.Fatalf("SignResetToken failed: %v", err)
+	}
+	second, err := s.auther.SignResetToken(uid)
+	if err != nil {
+		t.Fatalf("SignResetToken failed: %v", err)
+	}
+
+	if err = resetPassword(s, first, "new password"); err != nil {
+		t.Fatalf("ResetPassword failed: %v", err)
+	}
+	checkLogin(t, s, "user@productimon.com", "new password", codes.OK)
+	checkLogin(t, s, "user@productimon.com", "password", codes.Unauthenticated)
+	if _, _, err = s.auther.VerifyToken(session); err == nil {
+		t.Error("token from before the reset accepted")
+	}
+
+	checkCode(t, "ResetPassword with used token", resetPassword(s, first, "another password"), codes.Unauthenticated)
+	checkCode(t, "ResetPassword with token issued before the reset", resetPassword(s, second, "another password"), codes.Unauthenticated)
+	checkLogin(t, s, "user@productimon.com", "new password", codes.OK)
+}
+
+func TestChangePasswordInvalidatesTokens(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	session := login(t, s, "user@productimon.com", "password").Token
+	other := login(t, s, "user@productimon.com", "password").Token
+	reset, err := s.auther.SignResetToken(uid)
+	if err != nil {
+		t.Fatalf("SignResetToken failed: %v", err)
+	}
+
+	_, err = s.ChangePassword(tokenContext(session), &spb.DataAggregatorChangePasswordRequest{OldPassword: "wrong", NewPassword: "new password"})
+	checkCode(t, "ChangePassword with wrong password", err, codes.PermissionDenied)
+	rsp, err := s.ChangePassword(tokenContext(session), &spb.DataAggregatorChangePasswordRequest{OldPassword: "password", NewPassword: "new password"})
+	if err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+	if _, _, err = s.auther.VerifyToken(rsp.Token); err != nil {
+		t.Errorf("token from ChangePassword rejected: %v", err)
+	}
+	for _, token := range []string{session, other} {
+		if _, _, err = s.auther.VerifyToken(token); err == nil {
+			t.Error("token from before the change accepted")
+		}
+	}
+	checkCode(t, "ResetPassword with token issued before the change", resetPassword(s, reset, "another password"), codes.Unauthenticated)
+	checkLogin(t, s, "user@productimon.com", "new password", codes.OK)
+	checkLogin(t, s, "user@productimon.com", "another password", codes.Unauthenticated)
+}
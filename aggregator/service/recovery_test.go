@@ -0,0 +1,219 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"git.yiad.am/productimon/aggregator/storage"
+	_ "git.yiad.am/productimon/aggregator/storage/sqlite"
+	cpb "git.yiad.am/productimon/proto/common"
+	lru "github.com/hashicorp/golang-lru"
+	"go.uber.org/zap"
+)
+
+const (
+	testUid = "00000000-0000-0000-0000-000000000001"
+	testDid = 1
+)
+
+// a database with one user and device, whose path can be opened again by
+// startAggregator after a "crash"
+func openRecoveryDB(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "recovery_test")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "db.sqlite3")
+	s, db := startAggregator(t, path)
+	defer db.Close()
+	if _, err = s.db.Exec("INSERT INTO users (id, email, password) VALUES (?, ?, ?)", testUid, "test@productimon.com", ""); err != nil {
+		t.Fatalf("can't insert user: %v", err)
+	}
+	if _, err = s.db.Exec("INSERT INTO devices (uid, id, name, kind) VALUES (?, ?, ?, ?)", testUid, testDid, "test", 0); err != nil {
+		t.Fatalf("can't insert device: %v", err)
+	}
+	return path
+}
+
+// start a fresh aggregator on the database at path, like after a restart
+func startAggregator(t *testing.T, path string) (*Service, *storage.DB) {
+	db, err := storage.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("can't open database: %v", err)
+	}
+	s, err := NewService("productimon.com", nil, db, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+	// normally made by RunLabelRoutine
+	if labelCache == nil {
+		if labelCache, err = lru.New2Q(labelcachesize); err != nil {
+			t.Fatalf("can't create label cache: %v", err)
+		}
+	}
+	if err = s.RestoreDeviceStates(); err != nil {
+		t.Fatalf("RestoreDeviceStates failed: %v", err)
+	}
+	return s, db
+}
+
+func appSwitch(eid, t int64, app string) *cpb.Event {
+	return &cpb.Event{
+		Id:           eid,
+		Timeinterval: &cpb.Interval{Start: &cpb.Timestamp{Nanos: t}, End: &cpb.Timestamp{Nanos: t}},
+		Kind:         &cpb.Event_AppSwitchEvent{AppSwitchEvent: &cpb.AppSwitchEvent{AppName: app}},
+	}
+}
+
+func activity(eid, start, end int64) *cpb.Event {
+	return &cpb.Event{
+		Id:           eid,
+		Timeinterval: &cpb.Interval{Start: &cpb.Timestamp{Nanos: start}, End: &cpb.Timestamp{Nanos: end}},
+		Kind:         &cpb.Event_ActivityEvent{ActivityEvent: &cpb.ActivityEvent{Keystrokes: 10, Mouseclicks: 10}},
+	}
+}
+
+func stopTracking(eid, t int64) *cpb.Event {
+	return &cpb.Event{
+		Id:           eid,
+		Timeinterval: &cpb.Interval{Start: &cpb.Timestamp{Nanos: t}, End: &cpb.Timestamp{Nanos: t}},
+		Kind:         &cpb.Event_StopTrackingEvent{StopTrackingEvent: &cpb.StopTrackingEvent{}},
+	}
+}
+
+func addEvents(t *testing.T, s *Service, events ...*cpb.Event) {
+	for _, e := range events {
+		if err := s.AddEvent(testUid, testDid, "", e); err != nil {
+			t.Fatalf("AddEvent(%d) failed: %v", e.Id, err)
+		}
+	}
+}
+
+type testInterval struct {
+	start, end, active int64
+	app                string
+}
+
+func intervals(t *testing.T, s *Service) []testInterval {
+	rows, err := s.db.Query("SELECT starttime, endtime, activetime, app FROM intervals WHERE uid = ? AND did = ? ORDER BY starttime", testUid, testDid)
+	if err != nil {
+		t.Fatalf("can't get intervals: %v", err)
+	}
+	defer rows.Close()
+	var ret []testInterval
+	for rows.Next() {
+		var i testInterval
+		if err = rows.Scan(&i.start, &i.end, &i.active, &i.app); err != nil {
+			t.Fatalf("can't scan interval: %v", err)
+		}
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+func checkIntervals(t *testing.T, s *Service, want []testInterval) {
+	t.Helper()
+	if got := intervals(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("intervals = %v, want %v", got, want)
+	}
+}
+
+func TestRecoverOpenInterval(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	addEvents(t, s, appSwitch(1, 100, "vim"), activity(2, 100, 150))
+	db.Close()
+
+	s, db = startAggregator(t, path)
+	defer db.Close()
+	addEvents(t, s, activity(3, 150, 180), appSwitch(4, 200, "firefox"))
+	checkIntervals(t, s, []testInterval{{100, 200, 80, "vim"}})
+}
+
+func TestRecoverQueuedEvents(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	// 2 is delayed, so 3 and 4 wait for it when the aggregator stops
+	addEvents(t, s, appSwitch(1, 100, "vim"), appSwitch(3, 300, "firefox"), stopTracking(4, 400))
+	checkIntervals(t, s, nil)
+	db.Close()
+
+	s, db = startAggregator(t, path)
+	defer db.Close()
+	addEvents(t, s, appSwitch(2, 200, "bash"))
+	checkIntervals(t, s, []testInterval{
+		{100, 200, 0, "vim"},
+		{200, 300, 0, "bash"},
+		{300, 400, 0, "firefox"},
+	})
+}
+
+func TestRecoverUnappliedEvents(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	addEvents(t, s, appSwitch(1, 100, "vim"))
+	// stored, but the aggregator stopped before applying it
+	tx, err := s.addGeneralEvent(testUid, testDid, "", stopTracking(2, 200), cpb.EventType_STOP_TRACKING_EVENT)
+	if err != nil {
+		t.Fatalf("addGeneralEvent failed: %v", err)
+	}
+	tx.Commit()
+	db.Close()
+
+	s, db = startAggregator(t, path)
+	defer db.Close()
+	checkIntervals(t, s, []testInterval{{100, 200, 0, "vim"}})
+	addEvents(t, s, appSwitch(3, 300, "firefox"), stopTracking(4, 400))
+	checkIntervals(t, s, []testInterval{{100, 200, 0, "vim"}, {300, 400, 0, "firefox"}})
+}
+
+func TestRecoverWithoutSavedState(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	addEvents(t, s, appSwitch(1, 100, "vim"), appSwitch(2, 200, "bash"), activity(3, 200, 250))
+	// like devices that were tracking when device_states was added
+	if _, err := s.db.Exec("DELETE FROM device_states"); err != nil {
+		t.Fatalf("can't delete device states: %v", err)
+	}
+	db.Close()
+
+	s, db = startAggregator(t, path)
+	defer db.Close()
+	addEvents(t, s, appSwitch(4, 300, "firefox"))
+	checkIntervals(t, s, []testInterval{{100, 200, 0, "vim"}, {200, 300, 50, "bash"}})
+}
+
+func bucketedActiveTime(t *testing.T, s *Service) int64 {
+	var active int64
+	if err := s.db.QueryRow("SELECT COALESCE(SUM(activetime), 0) FROM activity_buckets WHERE uid = ? AND did = ?", testUid, testDid).Scan(&active); err != nil {
+		t.Fatalf("can't get activity buckets: %v", err)
+	}
+	return active
+}
+
+func TestRecoverAfterFailedSave(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	addEvents(t, s, appSwitch(1, 100, "vim"), activity(2, 100, 150))
+	// the device state can't be saved after 3 runs, like a crash before it's saved
+	if _, err := s.db.Exec("ALTER TABLE device_states RENAME TO device_states_broken"); err != nil {
+		t.Fatalf("can't rename device states: %v", err)
+	}
+	addEvents(t, s, activity(3, 150, 180), appSwitch(4, 200, "firefox"))
+	if _, err := s.db.Exec("ALTER TABLE device_states_broken RENAME TO device_states"); err != nil {
+		t.Fatalf("can't rename device states: %v", err)
+	}
+	db.Close()
+
+	// 3 and 4 are replayed, and only counted once
+	s, db = startAggregator(t, path)
+	defer db.Close()
+	checkIntervals(t, s, []testInterval{{100, 200, 80, "vim"}})
+	if active := bucketedActiveTime(t, s); active != 80 {
+		t.Errorf("active time in buckets = %d, want 80", active)
+	}
+}
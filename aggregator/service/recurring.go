@@ -0,0 +1,247 @@
+package service
+
+import (
+	"time"
+
+	cpb "git.yiad.am/productimon/proto/common"
+	"go.uber.org/zap"
+)
+
+// how often we check for recurring goals whose current period has ended
+const goalRolloverInterval = time.Minute
+
+// end of the recurring goal period starting at start, in user's timezone
+func periodEnd(start int64, recurrence cpb.Goal_Recurrence, loc *time.Location) int64 {
+	t := time.Unix(0, start).In(loc)
+	switch recurrence {
+	case cpb.Goal_DAILY:
+		t = t.AddDate(0, 0, 1)
+	case cpb.Goal_WEEKLY:
+		t = t.AddDate(0, 0, 7)
+	case cpb.Goal_MONTHLY:
+		t = t.AddDate(0, 1, 0)
+	}
+	return t.UnixNano()
+}
+
+// whether a goal with given final progress (out of 1000) has succeeded
+func goalSucceeded(goaltype string, progress int64) bool {
+	if goaltype == "limiting" {
+		return progress < 1000
+	}
+	return progress >= 1000
+}
+
+// current and best streak of succeeded periods, history is most recent first
+func goalStreaks(history []*cpb.GoalPeriod) (current, best int32) {
+	var run int32
+	counting := true
+	for _, p := range history {
+		if !p.Succeeded {
+			counting = false
+			run = 0
+			continue
+		}
+		run++
+		if counting {
+			current = run
+		}
+		if run > best {
+			best = run
+		}
+	}
+	return
+}
+
+// close ended periods of recurring goals and open new ones periodically
+// to be run in its own goroutine
+func (s *Service) RunGoalRoutine() {
+	s.rolloverGoals(time.Now().UnixNano())
+	timer := time.NewTicker(goalRolloverInterval)
+	for range timer.C {
+		s.rolloverGoals(time.Now().UnixNano())
+	}
+}
+
+func (s *Service) rolloverGoals(now int64) {
+	type goalKey struct {
+		uid string
+		gid int64
+	}
+	rows, err := s.db.Query("SELECT uid, id FROM goals WHERE recurrence != 0 AND endtime <= ?", now)
+	if err != nil {
+		s.log.Error("error getting ended recurring goals", zap.Error(err))
+		return
+	}
+	var goals []goalKey
+	for rows.Next() {
+		var g goalKey
+		if err = rows.Scan(&g.uid, &g.gid); err != nil {
+			s.log.Error("failed to scan recurring goal", zap.Error(err))
+			continue
+		}
+		goals = append(goals, g)
+	}
+	rows.Close()
+	for _, g := range goals {
+		s.rolloverGoal(g.uid, g.gid, now)
+	}
+}
+
+// record results of all periods of goal that ended before now and move it to the current period
+func (s *Service) rolloverGoal(uid string, gid int64, now int64) {
+	var isLabel bool
+	var item, goaltype string
+	var baseDuration, targetDuration, startTime, endTime int64
+	var daysOfWeek, recurrence int32
+	s.db.Lock()
+	defer s.db.Unlock()
+	if err := s.db.QueryRow("SELECT goaltype, is_label, item, base_duration, target_duration, starttime, endtime, COALESCE(days_of_week, 0), recurrence FROM goals WHERE uid = ? AND id = ?", uid, gid).Scan(&goaltype, &isLabel, &item, &baseDuration, &targetDuration, &startTime, &endTime, &daysOfWeek, &recurrence); err != nil {
+		s.log.Error("error getting recurring goal", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+		return
+	}
+	if recurrence == int32(cpb.Goal_NONE) || endTime > now {
+		// edited or rolled over since we looked
+		return
+	}
+	devices, err := s.getGoalDevices(uid, gid)
+	if err != nil {
+		s.log.Error("error getting goal devices", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+		return
+	}
+	dFilter := deviceFilters("intervals.did", devices)
+	loc := s.getUserLocation(uid)
+
+	type period struct {
+		start, end, progress int64
+	}
+	var periods []period
+	var progress int64
+	for {
+		if progress, err = s.getGoalProgress(uid, dFilter, isLabel, item, baseDuration, targetDuration, dayRanges(startTime, endTime, daysOfWeek, loc)); err != nil {
+			s.log.Error("error getting goal progress", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+			return
+		}
+		if endTime > now {
+			break
+		}
+		periods = append(periods, period{startTime, endTime, progress})
+		startTime, endTime = endTime, periodEnd(endTime, cpb.Goal_Recurrence(recurrence), loc)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		s.log.Error("can't begin transaction", zap.Error(err))
+		return
+	}
+	for _, p := range periods {
+		// goal might have been moved back to a period we've already recorded
+		if _, err = tx.Exec("DELETE FROM goal_periods WHERE uid = ? AND gid = ? AND starttime = ?", uid, gid, p.start); err != nil {
+			tx.Rollback()
+			s.log.Error("error deleting goal period", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+			return
+		}
+		if _, err = tx.Exec("INSERT INTO goal_periods (uid, gid, starttime, endtime, progress, succeeded) VALUES (?, ?, ?, ?, ?, ?)",
+			uid, gid, p.start, p.end, p.progress, goalSucceeded(goaltype, p.progress)); err != nil {
+			tx.Rollback()
+			s.log.Error("error inserting goal period", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+			return
+		}
+	}
+	if _, err = tx.Exec("UPDATE goals SET starttime = ?, endtime = ?, progress = ? WHERE uid = ? AND id = ?", startTime, endTime, progress, uid, gid); err != nil {
+		tx.Rollback()
+		s.log.Error("error moving goal to new period", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		s.log.Error("commit goal rollover failed", zap.Error(err), zap.String("uid", uid), zap.Int64("gid", gid))
+		return
+	}
+	s.log.Debug("rolled over recurring goal", zap.String("uid", uid), zap.Int64("gid", gid), zap.Int("periods", len(periods)))
+}
+
+// recompute progress of the closed periods of goal from its current intervals,
+// e.g. after they were reprocessed. This uses the goal's current settings
+func (s *Service) recomputeGoalPeriods(uid string, gid int64) error {
+	var isLabel bool
+	var item, goaltype string
+	var baseDuration, targetDuration int64
+	var daysOfWeek int32
+	s.db.Lock()
+	defer s.db.Unlock()
+	if err := s.db.QueryRow("SELECT goaltype, is_label, item, base_duration, target_duration, COALESCE(days_of_week, 0) FROM goals WHERE uid = ? AND id = ?", uid, gid).Scan(&goaltype, &isLabel, &item, &baseDuration, &targetDuration, &daysOfWeek); err != nil {
+		return err
+	}
+	devices, err := s.getGoalDevices(uid, gid)
+	if err != nil {
+		return err
+	}
+	dFilter := deviceFilters("intervals.did", devices)
+	loc := s.getUserLocation(uid)
+
+	rows, err := s.db.Query("SELECT starttime, endtime FROM goal_periods WHERE uid = ? AND gid = ?", uid, gid)
+	if err != nil {
+		return err
+	}
+	type period struct {
+		start, end, progress int64
+	}
+	var periods []period
+	for rows.Next() {
+		var p period
+		if err = rows.Scan(&p.start, &p.end); err != nil {
+			rows.Close()
+			return err
+		}
+		periods = append(periods, p)
+	}
+	rows.Close()
+	if len(periods) == 0 {
+		return nil
+	}
+	for i := range periods {
+		p := &periods[i]
+		if p.progress, err = s.getGoalProgress(uid, dFilter, isLabel, item, baseDuration, targetDuration, dayRanges(p.start, p.end, daysOfWeek, loc)); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, p := range periods {
+		if _, err = tx.Exec("UPDATE goal_periods SET progress = ?, succeeded = ? WHERE uid = ? AND gid = ? AND starttime = ?",
+			p.progress, goalSucceeded(goaltype, p.progress), uid, gid, p.start); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// get history of closed periods of all recurring goals of user, most recent first
+func (s *Service) getGoalHistory(uid string) (map[int64][]*cpb.GoalPeriod, error) {
+	rows, err := s.db.Query("SELECT gid, starttime, endtime, progress, succeeded FROM goal_periods WHERE uid = ? ORDER BY gid, starttime DESC", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := make(map[int64][]*cpb.GoalPeriod)
+	for rows.Next() {
+		var gid, start, end, progress int64
+		var succeeded bool
+		if err = rows.Scan(&gid, &start, &end, &progress, &succeeded); err != nil {
+			return nil, err
+		}
+		history[gid] = append(history[gid], &cpb.GoalPeriod{
+			Interval: &cpb.Interval{
+				Start: &cpb.Timestamp{Nanos: start},
+				End:   &cpb.Timestamp{Nanos: end},
+			},
+			Progress:  float32(progress) / 1000,
+			Succeeded: succeeded,
+		})
+	}
+	return history, rows.Err()
+}
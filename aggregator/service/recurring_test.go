@@ -0,0 +1,75 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	cpb "git.yiad.am/productimon/proto/common"
+)
+
+func TestPeriodEnd(t *testing.T) {
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	tests := []struct {
+		name       string
+		start      time.Time
+		recurrence cpb.Goal_Recurrence
+		want       time.Time
+	}{
+		{"daily", time.Date(2020, time.August, 2, 0, 0, 0, 0, time.UTC), cpb.Goal_DAILY, time.Date(2020, time.August, 3, 0, 0, 0, 0, time.UTC)},
+		{"weekly", time.Date(2020, time.August, 2, 9, 0, 0, 0, time.UTC), cpb.Goal_WEEKLY, time.Date(2020, time.August, 9, 9, 0, 0, 0, time.UTC)},
+		{"monthly", time.Date(2020, time.August, 1, 0, 0, 0, 0, time.UTC), cpb.Goal_MONTHLY, time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)},
+		// daylight saving starts in Sydney on 2020-10-04, so this day only has 23 hours
+		{"daily across dst", time.Date(2020, time.October, 4, 0, 0, 0, 0, sydney), cpb.Goal_DAILY, time.Date(2020, time.October, 5, 0, 0, 0, 0, sydney)},
+	}
+	for _, tt := range tests {
+		if got := periodEnd(tt.start.UnixNano(), tt.recurrence, tt.start.Location()); got != tt.want.UnixNano() {
+			t.Errorf("%s: periodEnd() = %v, want %v", tt.name, time.Unix(0, got), tt.want)
+		}
+	}
+}
+
+func TestGoalSucceeded(t *testing.T) {
+	tests := []struct {
+		goaltype string
+		progress int64
+		want     bool
+	}{
+		{"aspiring", 1000, true},
+		{"aspiring", 999, false},
+		{"limiting", 999, true},
+		{"limiting", 1000, false},
+	}
+	for _, tt := range tests {
+		if got := goalSucceeded(tt.goaltype, tt.progress); got != tt.want {
+			t.Errorf("goalSucceeded(%q, %d) = %v, want %v", tt.goaltype, tt.progress, got, tt.want)
+		}
+	}
+}
+
+func TestGoalStreaks(t *testing.T) {
+	history := func(results ...bool) []*cpb.GoalPeriod {
+		var h []*cpb.GoalPeriod
+		for _, r := range results {
+			h = append(h, &cpb.GoalPeriod{Succeeded: r})
+		}
+		return h
+	}
+	tests := []struct {
+		name          string
+		history       []*cpb.GoalPeriod
+		current, best int32
+	}{
+		{"empty", nil, 0, 0},
+		{"all succeeded", history(true, true, true), 3, 3},
+		{"most recent failed", history(false, true, true), 0, 2},
+		{"longer streak before", history(true, false, true, true, true, false), 1, 3},
+	}
+	for _, tt := range tests {
+		if current, best := goalStreaks(tt.history); current != tt.current || best != tt.best {
+			t.Errorf("%s: goalStreaks() = %d, %d, want %d, %d", tt.name, current, best, tt.current, tt.best)
+		}
+	}
+}
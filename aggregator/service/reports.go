@@ -0,0 +1,231 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/messages"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+)
+
+// how often we check for usage reports due
+const reportInterval = time.Minute
+
+// number of applications and labels listed in reports
+const reportTopN = 5
+
+// latest report period that's due at now. reports cover the whole day (or week)
+// before the day they're sent on, in now's timezone
+func reportPeriod(now time.Time, frequency spb.DataAggregatorUserSettings_ReportFrequency, sendAt, weekday int32) (start, end time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for {
+		sendTime := time.Date(day.Year(), day.Month(), day.Day(), 0, int(sendAt), 0, 0, day.Location())
+		if !sendTime.After(now) && (frequency != spb.DataAggregatorUserSettings_WEEKLY || day.Weekday() == time.Weekday(weekday)) {
+			break
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+	if frequency == spb.DataAggregatorUserSettings_WEEKLY {
+		return day.AddDate(0, 0, -7), day
+	}
+	return day.AddDate(0, 0, -1), day
+}
+
+// part of an interval between start and end, activetime is pro-rated
+func clipUsage(st, et, at, start, end int64) (total, active int64) {
+	if st >= end || et <= start || et <= st {
+		return 0, 0
+	}
+	total = et - st
+	if st < start {
+		st = start
+	}
+	if et > end {
+		et = end
+	}
+	active = int64(float64(at) * float64(et-st) / float64(total))
+	return et - st, active
+}
+
+// top n of usage by time, ties broken by name
+func topUsage(usage map[string]*messages.Usage, n int) []messages.Usage {
+	var ret []messages.Usage
+	for _, u := range usage {
+		ret = append(ret, *u)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Time != ret[j].Time {
+			return ret[i].Time > ret[j].Time
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+// usage of user between start and end, grouped by application and label
+func (s *Service) getUsage(uid string, start, end int64) (total, active int64, apps, labels map[string]*messages.Usage, err error) {
+	apps = make(map[string]*messages.Usage)
+	labels = make(map[string]*messages.Usage)
+	rows, err := s.db.Query("SELECT i.starttime, i.endtime, i.activetime, i.app, COALESCE(u.label, d.label, ?) FROM intervals i LEFT JOIN user_apps u ON (i.app = u.name AND u.uid = i.uid) LEFT JOIN default_apps d ON i.app = d.name WHERE i.uid = ? AND i.endtime > ? AND i.starttime < ?", LABEL_UNCATEGORIZED, uid, start, end)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	add := func(m map[string]*messages.Usage, name string, tot, act int64) {
+		u, ok := m[name]
+		if !ok {
+			u = &messages.Usage{Name: name}
+			m[name] = u
+		}
+		u.Time += time.Duration(tot)
+		u.ActiveTime += time.Duration(act)
+	}
+	for rows.Next() {
+		var st, et, at int64
+		var app, label string
+		if err = rows.Scan(&st, &et, &at, &app, &label); err != nil {
+			return
+		}
+		tot, act := clipUsage(st, et, at, start, end)
+		total += tot
+		active += act
+		add(apps, app, tot, act)
+		add(labels, label, tot, act)
+	}
+	err = rows.Err()
+	return
+}
+
+// status of goals (and closed periods of recurring goals) overlapping start to end
+func (s *Service) getReportGoals(uid string, start, end time.Time) ([]*messages.Goal, error) {
+	rows, err := s.db.Query("SELECT title, is_label, item, goaltype, starttime, endtime, progress FROM goals WHERE uid = ? AND starttime < ? AND endtime > ? "+
+		"UNION ALL SELECT g.title, g.is_label, g.item, g.goaltype, p.starttime, p.endtime, p.progress FROM goal_periods p JOIN goals g ON (g.uid = p.uid AND g.id = p.gid) WHERE p.uid = ? AND p.endtime > ? AND p.endtime <= ? ORDER BY 5",
+		uid, end.UnixNano(), start.UnixNano(), uid, start.UnixNano(), end.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var goals []*messages.Goal
+	for rows.Next() {
+		g := &messages.Goal{}
+		var st, et, progress int64
+		if err = rows.Scan(&g.Title, &g.IsLabel, &g.Item, &g.Type, &st, &et, &progress); err != nil {
+			return nil, err
+		}
+		g.Start = time.Unix(0, st).In(start.Location())
+		g.End = time.Unix(0, et).In(start.Location())
+		g.Progress = float64(progress) / 10
+		g.Ended = et <= end.UnixNano()
+		g.Succeeded = g.Ended && goalSucceeded(g.Type, progress)
+		goals = append(goals, g)
+	}
+	return goals, rows.Err()
+}
+
+func (s *Service) buildReport(uid string, frequency spb.DataAggregatorUserSettings_ReportFrequency, start, end time.Time) (*messages.UsageReport, error) {
+	r := &messages.UsageReport{
+		Frequency: "daily",
+		Start:     start,
+		End:       end,
+	}
+	prevStart := start.AddDate(0, 0, -1)
+	if frequency == spb.DataAggregatorUserSettings_WEEKLY {
+		r.Frequency = "weekly"
+		prevStart = start.AddDate(0, 0, -7)
+	}
+	total, active, apps, labels, err := s.getUsage(uid, start.UnixNano(), end.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	r.TotalTime, r.ActiveTime = time.Duration(total), time.Duration(active)
+	r.Apps = topUsage(apps, reportTopN)
+	r.Labels = topUsage(labels, reportTopN)
+	prevTotal, _, _, _, err := s.getUsage(uid, prevStart.UnixNano(), start.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	r.PreviousTotalTime = time.Duration(prevTotal)
+	if prevTotal > 0 {
+		r.Change = float64(total-prevTotal) / float64(prevTotal) * 100
+	}
+	if r.Goals, err = s.getReportGoals(uid, start, end); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// send usage reports to users whose report is due periodically
+// to be run in its own goroutine
+func (s *Service) RunReportRoutine() {
+	timer := time.NewTicker(reportInterval)
+	for range timer.C {
+		s.sendReports(time.Now())
+	}
+}
+
+func (s *Service) sendReports(now time.Time) {
+	if s.notifiers["email"] == nil {
+		return
+	}
+	type reportUser struct {
+		uid              string
+		frequency        spb.DataAggregatorUserSettings_ReportFrequency
+		sendAt, weekday  int32
+		lastReportPeriod int64
+	}
+	rows, err := s.db.Query("SELECT id, report_frequency, report_time, report_weekday, last_report_at FROM users WHERE report_frequency != 0 AND verified = ?", true)
+	if err != nil {
+		s.log.Error("error getting users with usage reports", zap.Error(err))
+		return
+	}
+	var users []reportUser
+	for rows.Next() {
+		var u reportUser
+		var frequency int32
+		if err = rows.Scan(&u.uid, &frequency, &u.sendAt, &u.weekday, &u.lastReportPeriod); err != nil {
+			s.log.Error("failed to scan report user", zap.Error(err))
+			continue
+		}
+		u.frequency = spb.DataAggregatorUserSettings_ReportFrequency(frequency)
+		users = append(users, u)
+	}
+	rows.Close()
+	for _, u := range users {
+		start, end := reportPeriod(now.In(s.getUserLocation(u.uid)), u.frequency, u.sendAt, u.weekday)
+		if end.UnixNano() <= u.lastReportPeriod {
+			continue
+		}
+		if err = s.sendReport(u.uid, u.frequency, start, end); err != nil {
+			s.log.Error("error sending usage report", zap.Error(err), zap.String("uid", u.uid))
+		}
+	}
+}
+
+func (s *Service) sendReport(uid string, frequency spb.DataAggregatorUserSettings_ReportFrequency, start, end time.Time) error {
+	report, err := s.buildReport(uid, frequency, start, end)
+	if err != nil {
+		return err
+	}
+	// nothing to report, don't bother the user
+	if report.TotalTime > 0 || len(report.Goals) > 0 {
+		data, locale, err := s.userMessageData(uid)
+		if err != nil {
+			return err
+		}
+		data.Report = report
+		msg, err := s.messages.Render(messages.Report, locale, data)
+		if err != nil {
+			return err
+		}
+		if err = s.sendNotification(uid, "email", data.User.Email, msg); err != nil {
+			return err
+		}
+		s.log.Debug("sent usage report", zap.String("uid", uid), zap.Time("start", start), zap.Time("end", end))
+	}
+	_, err = s.db.Exec("UPDATE users SET last_report_at = ? WHERE id = ?", end.UnixNano(), uid)
+	return err
+}
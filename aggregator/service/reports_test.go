@@ -0,0 +1,68 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/messages"
+	spb "git.yiad.am/productimon/proto/svc"
+)
+
+func TestReportPeriod(t *testing.T) {
+	date := func(day, hour, min int) time.Time {
+		return time.Date(2020, time.August, day, hour, min, 0, 0, time.UTC)
+	}
+	// 2020-08-03 is a Monday
+	tests := []struct {
+		name       string
+		now        time.Time
+		frequency  spb.DataAggregatorUserSettings_ReportFrequency
+		sendAt     int32
+		weekday    int32
+		start, end time.Time
+	}{
+		{"daily after send time", date(5, 9, 0), spb.DataAggregatorUserSettings_DAILY, 8 * 60, 0, date(4, 0, 0), date(5, 0, 0)},
+		{"daily at send time", date(5, 8, 0), spb.DataAggregatorUserSettings_DAILY, 8 * 60, 0, date(4, 0, 0), date(5, 0, 0)},
+		{"daily before send time", date(5, 7, 59), spb.DataAggregatorUserSettings_DAILY, 8 * 60, 0, date(3, 0, 0), date(4, 0, 0)},
+		{"weekly on send day", date(3, 10, 0), spb.DataAggregatorUserSettings_WEEKLY, 9 * 60, 1, date(-4, 0, 0), date(3, 0, 0)},
+		{"weekly later in week", date(7, 10, 0), spb.DataAggregatorUserSettings_WEEKLY, 9 * 60, 1, date(-4, 0, 0), date(3, 0, 0)},
+		{"weekly before send time", date(10, 8, 0), spb.DataAggregatorUserSettings_WEEKLY, 9 * 60, 1, date(-4, 0, 0), date(3, 0, 0)},
+	}
+	for _, tt := range tests {
+		start, end := reportPeriod(tt.now, tt.frequency, tt.sendAt, tt.weekday)
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s: reportPeriod() = %v, %v, want %v, %v", tt.name, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestClipUsage(t *testing.T) {
+	tests := []struct {
+		st, et, at, start, end int64
+		total, active          int64
+	}{
+		{10, 20, 5, 0, 100, 10, 5},
+		{10, 20, 10, 15, 100, 5, 5},
+		{10, 20, 10, 0, 12, 2, 2},
+		{10, 20, 5, 20, 30, 0, 0},
+	}
+	for _, tt := range tests {
+		if total, active := clipUsage(tt.st, tt.et, tt.at, tt.start, tt.end); total != tt.total || active != tt.active {
+			t.Errorf("clipUsage(%d, %d, %d, %d, %d) = %d, %d, want %d, %d", tt.st, tt.et, tt.at, tt.start, tt.end, total, active, tt.total, tt.active)
+		}
+	}
+}
+
+func TestTopUsage(t *testing.T) {
+	usage := map[string]*messages.Usage{
+		"a": {Name: "a", Time: 1},
+		"b": {Name: "b", Time: 3},
+		"c": {Name: "c", Time: 3},
+		"d": {Name: "d", Time: 2},
+	}
+	want := []messages.Usage{{Name: "b", Time: 3}, {Name: "c", Time: 3}, {Name: "d", Time: 2}}
+	if got := topUsage(usage, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("topUsage() = %v, want %v", got, want)
+	}
+}
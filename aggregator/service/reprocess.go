@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"sort"
+
+	"git.yiad.am/productimon/analyzer/deviceState"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func reprocessInterval(i deviceState.Interval) *spb.DataAggregatorReprocessIntervalsResponse_Interval {
+	return &spb.DataAggregatorReprocessIntervalsResponse_Interval{Starttime: i.Start, Endtime: i.End, Activetime: i.Active, App: i.App}
+}
+
+func (s *Service) storedIntervals(uid string, did int64) ([]deviceState.Interval, error) {
+	rows, err := s.db.Query("SELECT starttime, endtime, activetime, app FROM intervals WHERE uid = ? AND did = ? ORDER BY starttime", uid, did)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []deviceState.Interval
+	for rows.Next() {
+		var i deviceState.Interval
+		if err = rows.Scan(&i.Start, &i.End, &i.Active, &i.App); err != nil {
+			return nil, err
+		}
+		ret = append(ret, i)
+	}
+	return ret, rows.Err()
+}
+
+// compare stored intervals of a device to recomputed ones
+func diffIntervals(device *cpb.Device, stored, recomputed []deviceState.Interval) *spb.DataAggregatorReprocessIntervalsResponse_DeviceDiff {
+	diff := &spb.DataAggregatorReprocessIntervalsResponse_DeviceDiff{Device: device}
+	left := make(map[deviceState.Interval]int)
+	for _, i := range stored {
+		left[i]++
+	}
+	for _, i := range recomputed {
+		if left[i] > 0 {
+			left[i]--
+			diff.Unchanged++
+		} else {
+			diff.Added = append(diff.Added, reprocessInterval(i))
+		}
+	}
+	for _, i := range stored {
+		if left[i] > 0 {
+			left[i]--
+			diff.Removed = append(diff.Removed, reprocessInterval(i))
+		}
+	}
+	sort.SliceStable(diff.Added, func(i, j int) bool { return diff.Added[i].Starttime < diff.Added[j].Starttime })
+	return diff
+}
+
+// replace the intervals and activity buckets of a device, needs s.db lock held
+func (s *Service) replaceIntervals(uid string, did int64, intervals []deviceState.Interval, buckets []deviceState.Bucket) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM intervals WHERE uid = ? AND did = ?", uid, did); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM activity_buckets WHERE uid = ? AND did = ?", uid, did); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, i := range intervals {
+		if _, err = tx.Exec("INSERT INTO intervals (uid, did, starttime, endtime, activetime, app) VALUES(?, ?, ?, ?, ?, ?)", uid, did, i.Start, i.End, i.Active, i.App); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, b := range buckets {
+		if _, err = tx.Exec("INSERT INTO activity_buckets (uid, did, starttime, minute, activetime) VALUES(?, ?, ?, ?, ?)", uid, did, b.Start, b.Minute, b.Active); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Service) reprocessDevice(uid string, did int64, dryRun bool) (*spb.DataAggregatorReprocessIntervalsResponse_DeviceDiff, error) {
+	var diff *spb.DataAggregatorReprocessIntervalsResponse_DeviceDiff
+	err := s.ds.Reprocess(s, uid, did, dryRun, func(intervals []deviceState.Interval, buckets []deviceState.Bucket) error {
+		stored, err := s.storedIntervals(uid, did)
+		if err != nil {
+			return err
+		}
+		diff = diffIntervals(&cpb.Device{User: &cpb.User{Id: uid}, Id: did}, stored, intervals)
+		if dryRun {
+			return nil
+		}
+		// buckets are replaced even if intervals are the same, e.g. for
+		// intervals from before they were stored
+		s.db.Lock()
+		defer s.db.Unlock()
+		return s.replaceIntervals(uid, did, intervals, buckets)
+	})
+	return diff, err
+}
+
+// Recompute intervals of the devices in req from their events and then the
+// progress of their users' goals, including closed periods of recurring goals
+func (s *Service) Reprocess(req *spb.DataAggregatorReprocessIntervalsRequest) (*spb.DataAggregatorReprocessIntervalsResponse, error) {
+	st := "SELECT uid, id FROM devices"
+	var args []interface{}
+	if req.User != nil {
+		st += " WHERE uid = ?"
+		args = append(args, req.User.Id)
+		if req.Device != nil {
+			st += " AND id = ?"
+			args = append(args, req.Device.Id)
+		}
+	}
+	rows, err := s.db.Query(st+" ORDER BY uid, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	var devices []*cpb.Device
+	for rows.Next() {
+		d := &cpb.Device{User: &cpb.User{}}
+		if err = rows.Scan(&d.User.Id, &d.Id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	rows.Close()
+
+	rsp := &spb.DataAggregatorReprocessIntervalsResponse{}
+	changed := make(map[string]bool)
+	for _, d := range devices {
+		diff, err := s.reprocessDevice(d.User.Id, d.Id, req.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		rsp.Devices = append(rsp.Devices, diff)
+		if len(diff.Added) > 0 || len(diff.Removed) > 0 {
+			changed[d.User.Id] = true
+		}
+	}
+	if req.DryRun {
+		return rsp, nil
+	}
+	for uid := range changed {
+		gids, err := s.db.Query("SELECT id FROM goals WHERE uid = ?", uid)
+		if err != nil {
+			return nil, err
+		}
+		var goals []int64
+		for gids.Next() {
+			var gid int64
+			if err = gids.Scan(&gid); err != nil {
+				gids.Close()
+				return nil, err
+			}
+			goals = append(goals, gid)
+		}
+		gids.Close()
+		for _, gid := range goals {
+			if err = s.recomputeGoalPeriods(uid, gid); err != nil {
+				return nil, err
+			}
+			s.UpdateGoal(uid, gid)
+		}
+	}
+	return rsp, nil
+}
+
+func (s *Service) ReprocessIntervals(ctx context.Context, req *spb.DataAggregatorReprocessIntervalsRequest) (*spb.DataAggregatorReprocessIntervalsResponse, error) {
+	if !s.isAdmin(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	if req.Device != nil && req.User == nil {
+		return nil, status.Error(codes.InvalidArgument, "device user not specified")
+	}
+	rsp, err := s.Reprocess(req)
+	if err != nil {
+		s.log.Error("failed to reprocess intervals", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	return rsp, nil
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"testing"
+
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+)
+
+func TestReprocessIntervals(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	defer db.Close()
+	s.ds.SetGapLimits(0, 2)
+	addEvents(t, s, appSwitch(1, 100, "vim"), appSwitch(3, 300, "firefox"), stopTracking(4, 400))
+	// arrives after it was skipped, so it's only stored
+	addEvents(t, s, appSwitch(2, 200, "bash"), appSwitch(5, 500, "vim"))
+	stored := []testInterval{{100, 300, 0, "vim"}, {300, 400, 0, "firefox"}}
+	checkIntervals(t, s, stored)
+
+	req := &spb.DataAggregatorReprocessIntervalsRequest{User: &cpb.User{Id: testUid}, DryRun: true}
+	rsp, err := s.Reprocess(req)
+	if err != nil {
+		t.Fatalf("Reprocess failed: %v", err)
+	}
+	if len(rsp.Devices) != 1 {
+		t.Fatalf("reprocessed %d devices, want 1", len(rsp.Devices))
+	}
+	diff := rsp.Devices[0]
+	if diff.Unchanged != 1 || len(diff.Removed) != 1 || len(diff.Added) != 2 {
+		t.Errorf("diff has %d unchanged, %d removed and %d added intervals, want 1, 1 and 2", diff.Unchanged, len(diff.Removed), len(diff.Added))
+	}
+	if len(diff.Removed) == 1 && (diff.Removed[0].Starttime != 100 || diff.Removed[0].Endtime != 300) {
+		t.Errorf("removed %v, want vim from 100 to 300", diff.Removed[0])
+	}
+	checkIntervals(t, s, stored)
+
+	req.DryRun = false
+	if _, err = s.Reprocess(req); err != nil {
+		t.Fatalf("Reprocess failed: %v", err)
+	}
+	checkIntervals(t, s, []testInterval{{100, 200, 0, "vim"}, {200, 300, 0, "bash"}, {300, 400, 0, "firefox"}})
+	// the device state carries on from the recomputed one
+	addEvents(t, s, stopTracking(6, 600))
+	checkIntervals(t, s, []testInterval{{100, 200, 0, "vim"}, {200, 300, 0, "bash"}, {300, 400, 0, "firefox"}, {500, 600, 0, "vim"}})
+}
+
+func TestReprocessGoalPeriods(t *testing.T) {
+	path := openRecoveryDB(t)
+	s, db := startAggregator(t, path)
+	defer db.Close()
+	s.ds.SetGapLimits(0, 2)
+	addEvents(t, s, appSwitch(1, 100, "vim"), appSwitch(3, 300, "firefox"), stopTracking(4, 400))
+	addEvents(t, s, appSwitch(2, 200, "bash"), appSwitch(5, 500, "vim"))
+	// at most 100ns of bash a period, the closed one was recorded without it
+	if _, err := s.db.Exec("INSERT INTO goals (uid, id, title, is_label, item, is_percent, goal_duration, target_duration, base_duration, starttime, endtime, compare_starttime, compare_endtime, equalized, progress, goaltype, recurrence) VALUES (?, 0, 'less bash', ?, 'bash', ?, 100, 100, 0, 1000, 2000, 0, 0, ?, 0, 'limiting', ?)",
+		testUid, false, false, false, cpb.Goal_DAILY); err != nil {
+		t.Fatalf("can't insert goal: %v", err)
+	}
+	if _, err := s.db.Exec("INSERT INTO goal_periods (uid, gid, starttime, endtime, progress, succeeded) VALUES (?, 0, 0, 1000, 0, ?)", testUid, true); err != nil {
+		t.Fatalf("can't insert goal period: %v", err)
+	}
+
+	if _, err := s.Reprocess(&spb.DataAggregatorReprocessIntervalsRequest{User: &cpb.User{Id: testUid}}); err != nil {
+		t.Fatalf("Reprocess failed: %v", err)
+	}
+	history, err := s.getGoalHistory(testUid)
+	if err != nil {
+		t.Fatalf("getGoalHistory failed: %v", err)
+	}
+	if len(history[0]) != 1 || history[0][0].Progress != 1 || history[0][0].Succeeded {
+		t.Errorf("goal history after Reprocess is %v, want a failed period with progress 1", history[0])
+	}
+}
@@ -5,11 +5,12 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
-	"sync"
 
 	"git.yiad.am/productimon/aggregator/authenticator"
 	schema "git.yiad.am/productimon/aggregator/db"
+	"git.yiad.am/productimon/aggregator/messages"
 	"git.yiad.am/productimon/aggregator/notifications"
+	"git.yiad.am/productimon/aggregator/storage"
 	"git.yiad.am/productimon/analyzer/deviceState"
 	"git.yiad.am/productimon/internal"
 	spb "git.yiad.am/productimon/proto/svc"
@@ -22,30 +23,47 @@ import (
 type Service struct {
 	domain    string
 	auther    *authenticator.Authenticator
-	dbWLock   sync.Mutex
-	db        *sql.DB
+	db        *storage.DB
 	log       *zap.Logger
 	notifiers map[string]notifications.Notifier
+	messages  *messages.Catalogue
+
+	// pushes notifications to devices subscribed via SubscribeNotifications
+	deviceNotifier *notifications.DeviceNotifier
 
 	ds *deviceState.DsMap
+
+	// wrong pairing codes entered per user
+	pairingFailures *attemptLimiter
+	// wrong two-factor codes entered per user when logging in
+	secondFactorFailures *attemptLimiter
 }
 
 var (
-	flagFirstUser string
+	flagFirstUser           string
+	flagMessageTemplatesDir string
+	flagDefaultLocale       string
 )
 
 func init() {
 	flag.StringVar(&flagFirstUser, "first_user_email", "admin@productimon.com", "The email address of the auto-created first admin user (only used when running for first time)")
+	flag.StringVar(&flagMessageTemplatesDir, "message_templates_dir", "", "Directory of notification message templates (<locale>/<message>.tmpl) overriding built-in ones")
+	flag.StringVar(&flagDefaultLocale, "default_locale", messages.DefaultLocale, "Locale of notification messages for users who haven't set one")
 }
 
-func NewService(domain string, auther *authenticator.Authenticator, db *sql.DB, logger *zap.Logger) (*Service, error) {
-	// TODO: version control schema and use migrations to update
-	if _, err := db.Exec("SELECT 1 FROM users LIMIT 1"); err != nil {
-		logger.Info("Initiating database")
-		if _, err = db.Exec(string(schema.Data["schema.sql"])); err != nil {
-			logger.Error("error init db", zap.Error(err))
-			return nil, err
-		}
+func NewService(domain string, auther *authenticator.Authenticator, db *storage.DB, logger *zap.Logger) (*Service, error) {
+	catalogue, err := messages.Load(flagMessageTemplatesDir, flagDefaultLocale)
+	if err != nil {
+		logger.Error("error loading message templates", zap.Error(err))
+		return nil, err
+	}
+	if _, err := schema.Migrate(db, false, logger); err != nil {
+		logger.Error("error migrating db", zap.Error(err))
+		return nil, err
+	}
+	var tmp int64
+	if err := db.QueryRow("SELECT 1 FROM users LIMIT 1").Scan(&tmp); err == sql.ErrNoRows {
+		logger.Info("Creating first user")
 		uid := uuid.New().String()
 		rawPwd, err := password.Generate(16, 4, 4, false, false)
 		if err != nil {
@@ -57,7 +75,7 @@ func NewService(domain string, auther *authenticator.Authenticator, db *sql.DB,
 			logger.Error("error encrypting password", zap.Error(err))
 			return nil, err
 		}
-		if _, err = db.Exec("INSERT INTO users VALUES(?,?,?, TRUE, TRUE)", uid, flagFirstUser, pwd); err != nil {
+		if _, err = db.Exec("INSERT INTO users (id, email, password, verified, admin) VALUES(?,?,?, TRUE, TRUE)", uid, flagFirstUser, string(pwd)); err != nil {
 			logger.Error("error create first user", zap.Error(err))
 			return nil, err
 		}
@@ -66,15 +84,30 @@ func NewService(domain string, auther *authenticator.Authenticator, db *sql.DB,
 		fmt.Printf("Initial Admin User: %s\n", flagFirstUser)
 		fmt.Printf("Password: %s\n", rawPwd)
 		fmt.Println("====================")
+	} else if err != nil {
+		logger.Error("error checking for existing users", zap.Error(err))
+		return nil, err
 	}
 	s := &Service{
-		domain:    domain,
-		auther:    auther,
-		db:        db,
-		log:       logger,
-		notifiers: make(map[string]notifications.Notifier),
+		domain:         domain,
+		auther:         auther,
+		db:             db,
+		log:            logger,
+		notifiers:      make(map[string]notifications.Notifier),
+		messages:       catalogue,
+		deviceNotifier: notifications.NewDeviceNotifier(),
+
+		pairingFailures:      newAttemptLimiter(pairingCodeDuration, maxPairingFailures),
+		secondFactorFailures: newAttemptLimiter(secondFactorWindow, maxSecondFactorFailures),
+	}
+	s.RegisterNotifier(s.deviceNotifier)
+	s.ds = deviceState.NewDsMap(s.lazyInitEidHandler, s.replayEvents, logger)
+	s.ds.SetGapLimits(flagEventGapTimeout, flagEventQueueMaxBuffered)
+	if auther != nil {
+		auther.SetGenerationFunc(s.tokenGeneration)
+		auther.SetSessionFunc(s.checkSession)
+		auther.SetCertFunc(s.checkDeviceCert)
 	}
-	s.ds = deviceState.NewDsMap(s.lazyInitEidHandler, logger)
 	return s, nil
 }
 
@@ -82,12 +115,18 @@ func (s *Service) RegisterNotifier(n notifications.Notifier) {
 	s.notifiers[n.Name()] = n
 }
 
-func (s *Service) Notify(kind, recipient, message string) error {
+func (s *Service) Notify(kind, recipient string, msg *messages.Message) error {
 	n := s.notifiers[kind]
 	if n == nil {
 		return notifications.ErrNotRegistered
 	}
-	return n.Notify(recipient, message)
+	if hn, ok := n.(notifications.HTMLNotifier); ok && msg.HTML != "" {
+		return hn.NotifyWithHTML(recipient, msg.Subject, msg.Body, msg.HTML)
+	}
+	if sn, ok := n.(notifications.SubjectNotifier); ok && msg.Subject != "" {
+		return sn.NotifyWithSubject(recipient, msg.Subject, msg.Body)
+	}
+	return n.Notify(recipient, msg.Body)
 }
 
 func (s *Service) Ping(ctx context.Context, req *spb.DataAggregatorPingRequest) (*spb.DataAggregatorPingResponse, error) {
@@ -97,14 +136,14 @@ func (s *Service) Ping(ctx context.Context, req *spb.DataAggregatorPingRequest)
 	return rsp, nil
 }
 
-func (s Service) DB() *sql.DB {
+func (s *Service) DB() *storage.DB {
 	return s.db
 }
 
 func (s *Service) DBLock() {
-	s.dbWLock.Lock()
+	s.db.Lock()
 }
 
 func (s *Service) DBUnlock() {
-	s.dbWLock.Unlock()
+	s.db.Unlock()
 }
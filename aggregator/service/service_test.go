@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.yiad.am/productimon/aggregator/authenticator"
+	"git.yiad.am/productimon/aggregator/storage"
+	_ "git.yiad.am/productimon/aggregator/storage/sqlite"
+	spb "git.yiad.am/productimon/proto/svc"
+	"github.com/google/uuid"
+	lru "github.com/hashicorp/golang-lru"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// a service with an authenticator on a fresh database, for testing RPCs
+func startRPCService(t *testing.T) *Service {
+	dir := tempDir(t)
+	db, err := storage.Open("sqlite3", filepath.Join(dir, "db.sqlite3"))
+	if err != nil {
+		t.Fatalf("can't open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newRPCService(t, dir, db)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "service_test")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// a service on db with an authenticator whose keys are kept in dir
+func newRPCService(t *testing.T, dir string, db *storage.DB) *Service {
+	auther, err := authenticator.NewAuthenticator(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), "productimon.com")
+	if err != nil {
+		t.Fatalf("can't create authenticator: %v", err)
+	}
+	s, err := NewService("productimon.com", auther, db, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+	// normally made by RunLabelRoutine
+	if labelCache == nil {
+		if labelCache, err = lru.New2Q(labelcachesize); err != nil {
+			t.Fatalf("can't create label cache: %v", err)
+		}
+	}
+	return s
+}
+
+// add a verified user, returning their uid
+func addUser(t *testing.T, s *Service, email, password string) string {
+	// the cheapest hash, Login works with any cost
+	pwd, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("can't hash password: %v", err)
+	}
+	uid := uuid.New().String()
+	if _, err = s.db.Exec("INSERT INTO users (id, email, password, verified) VALUES (?, ?, ?, ?)", uid, email, string(pwd), true); err != nil {
+		t.Fatalf("can't insert user: %v", err)
+	}
+	return uid
+}
+
+// context of a request with token in its authorization header
+func tokenContext(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+}
+
+func login(t *testing.T, s *Service, email, password string) *spb.DataAggregatorLoginResponse {
+	t.Helper()
+	rsp, err := s.Login(context.Background(), &spb.DataAggregatorLoginRequest{Email: email, Password: password})
+	if err != nil {
+		t.Fatalf("Login(%s) failed: %v", email, err)
+	}
+	return rsp
+}
+
+func checkCode(t *testing.T, what string, err error, want codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Errorf("%s: got %v (%v), want %v", what, got, err, want)
+	}
+}
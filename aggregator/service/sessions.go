@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/authenticator"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var errSessionEnded = errors.New("session has ended")
+
+// user agent of the client making the request, for users to tell sessions apart
+func userAgent(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	ua := md.Get("user-agent")
+	if len(ua) == 0 {
+		return ""
+	}
+	return ua[0]
+}
+
+// start a new session for uid, returns its id and when it ends
+func (s *Service) createSession(uid, userAgent string) (string, time.Time, error) {
+	now := time.Now()
+	sid := uuid.New().String()
+	end := now.Add(authenticator.SessionMaxLifetime)
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE uid = ? AND expires_at < ?", uid, now.UnixNano()); err != nil {
+		s.log.Error("failed to delete ended sessions", zap.Error(err), zap.String("uid", uid))
+	}
+	_, err := s.db.Exec("INSERT INTO sessions (id, uid, user_agent, created_at, refreshed_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		sid, uid, userAgent, now.UnixNano(), now.UnixNano(), end.UnixNano())
+	return sid, end, err
+}
+
+// mark session as refreshed, returns when it ends or errSessionEnded
+func (s *Service) refreshSession(uid, sid string) (time.Time, error) {
+	now := time.Now()
+	var end int64
+	err := s.db.QueryRow("SELECT expires_at FROM sessions WHERE id = ? AND uid = ?", sid, uid).Scan(&end)
+	if err == sql.ErrNoRows || err == nil && end <= now.UnixNano() {
+		return time.Time{}, errSessionEnded
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	if _, err = s.db.Exec("UPDATE sessions SET refreshed_at = ? WHERE id = ?", now.UnixNano(), sid); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, end), nil
+}
+
+// see authenticator.SessionFunc
+func (s *Service) checkSession(uid, sid string) error {
+	var end int64
+	err := s.db.QueryRow("SELECT expires_at FROM sessions WHERE id = ? AND uid = ?", sid, uid).Scan(&end)
+	if err == sql.ErrNoRows || err == nil && end <= time.Now().UnixNano() {
+		return errSessionEnded
+	}
+	return err
+}
+
+func (s *Service) ListSessions(ctx context.Context, req *cpb.Empty) (*spb.DataAggregatorListSessionsResponse, error) {
+	claims, err := s.auther.AuthenticateToken(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	rows, err := s.db.Query("SELECT id, user_agent, created_at, refreshed_at, expires_at FROM sessions WHERE uid = ? AND expires_at > ? ORDER BY refreshed_at DESC", claims.Uid, time.Now().UnixNano())
+	if err != nil {
+		s.log.Error("failed to get sessions", zap.Error(err), zap.String("uid", claims.Uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	defer rows.Close()
+	rsp := &spb.DataAggregatorListSessionsResponse{}
+	for rows.Next() {
+		session := &spb.DataAggregatorSession{}
+		if err = rows.Scan(&session.Id, &session.UserAgent, &session.CreatedAt, &session.RefreshedAt, &session.ExpiresAt); err != nil {
+			s.log.Error("failed to scan session", zap.Error(err))
+			continue
+		}
+		session.Current = session.Id == claims.Id
+		rsp.Sessions = append(rsp.Sessions, session)
+	}
+	return rsp, nil
+}
+
+func (s *Service) RevokeSession(ctx context.Context, req *spb.DataAggregatorRevokeSessionRequest) (*cpb.Empty, error) {
+	claims, err := s.auther.AuthenticateToken(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	sid := req.Id
+	if sid == "" {
+		sid = claims.Id
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	res, err := s.db.Exec("DELETE FROM sessions WHERE id = ? AND uid = ?", sid, claims.Uid)
+	if err != nil {
+		s.log.Error("failed to revoke session", zap.Error(err), zap.String("uid", claims.Uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+	s.log.Info("revoked session", zap.String("uid", claims.Uid), zap.String("sid", sid))
+	return &cpb.Empty{}, nil
+}
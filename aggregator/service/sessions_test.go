@@ -0,0 +1,115 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"google.golang.org/grpc/codes"
+)
+
+// session id of token
+func sessionId(t *testing.T, s *Service, token string) string {
+	t.Helper()
+	claims, err := s.auther.AuthenticateToken(tokenContext(token))
+	if err != nil {
+		t.Fatalf("AuthenticateToken failed: %v", err)
+	}
+	return claims.Id
+}
+
+func TestRevokeSession(t *testing.T) {
+	s := startRPCService(t)
+	addUser(t, s, "user@productimon.com", "password")
+	addUser(t, s, "other@productimon.com", "password")
+	laptop := login(t, s, "user@productimon.com", "password").Token
+	phone := login(t, s, "user@productimon.com", "password").Token
+	other := login(t, s, "other@productimon.com", "password").Token
+
+	sessions, err := s.ListSessions(tokenContext(laptop), &cpb.Empty{})
+	if err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+	if len(sessions.Sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions.Sessions))
+	}
+	for _, session := range sessions.Sessions {
+		if want := session.Id == sessionId(t, s, laptop); session.Current != want {
+			t.Errorf("session %s current = %v, want %v", session.Id, session.Current, want)
+		}
+	}
+
+	// sessions of other users can't be revoked
+	_, err = s.RevokeSession(tokenContext(laptop), &spb.DataAggregatorRevokeSessionRequest{Id: sessionId(t, s, other)})
+	checkCode(t, "RevokeSession of another user", err, codes.NotFound)
+	if _, _, err = s.auther.VerifyToken(other); err != nil {
+		t.Errorf("token of another user rejected after failed revoke: %v", err)
+	}
+
+	phoneSid := sessionId(t, s, phone)
+	if _, err = s.RevokeSession(tokenContext(laptop), &spb.DataAggregatorRevokeSessionRequest{Id: phoneSid}); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+	if _, _, err = s.auther.VerifyToken(phone); err == nil {
+		t.Error("VerifyToken accepted token of revoked session")
+	}
+	_, err = s.UserDetails(tokenContext(phone), &cpb.Empty{})
+	checkCode(t, "UserDetails with revoked session", err, codes.Unauthenticated)
+	_, err = s.ExtendToken(tokenContext(phone), &cpb.Empty{})
+	checkCode(t, "ExtendToken with revoked session", err, codes.Unauthenticated)
+	_, err = s.RevokeSession(tokenContext(laptop), &spb.DataAggregatorRevokeSessionRequest{Id: phoneSid})
+	checkCode(t, "RevokeSession of revoked session", err, codes.NotFound)
+	if _, _, err = s.auther.VerifyToken(laptop); err != nil {
+		t.Errorf("token of other session rejected: %v", err)
+	}
+
+	// logging out revokes the current session
+	if _, err = s.RevokeSession(tokenContext(laptop), &spb.DataAggregatorRevokeSessionRequest{}); err != nil {
+		t.Fatalf("RevokeSession of current session failed: %v", err)
+	}
+	if _, _, err = s.auther.VerifyToken(laptop); err == nil {
+		t.Error("VerifyToken accepted token after logging out")
+	}
+}
+
+func TestExtendTokenMaxLifetime(t *testing.T) {
+	s := startRPCService(t)
+	addUser(t, s, "user@productimon.com", "password")
+	token := login(t, s, "user@productimon.com", "password").Token
+	sid := sessionId(t, s, token)
+
+	// logged in almost SessionMaxLifetime ago
+	end := time.Now().Add(time.Minute)
+	if _, err := s.db.Exec("UPDATE sessions SET expires_at = ? WHERE id = ?", end.UnixNano(), sid); err != nil {
+		t.Fatalf("can't update session: %v", err)
+	}
+	rsp, err := s.ExtendToken(tokenContext(token), &cpb.Empty{})
+	if err != nil {
+		t.Fatalf("ExtendToken failed: %v", err)
+	}
+	claims, err := s.auther.AuthenticateToken(tokenContext(rsp.Token))
+	if err != nil {
+		t.Fatalf("extended token rejected: %v", err)
+	}
+	if claims.Id != sid {
+		t.Errorf("extended token has session %s, want %s", claims.Id, sid)
+	}
+	if claims.ExpiresAt > end.Unix() {
+		t.Errorf("extended token expires at %v, after the session ends at %v", time.Unix(claims.ExpiresAt, 0), end)
+	}
+	var expires int64
+	if err = s.db.QueryRow("SELECT expires_at FROM sessions WHERE id = ?", sid).Scan(&expires); err != nil {
+		t.Fatalf("can't get session: %v", err)
+	}
+	if expires != end.UnixNano() {
+		t.Errorf("ExtendToken moved session end to %v, want %v", time.Unix(0, expires), end)
+	}
+
+	// past the maximum lifetime the session is over, however recent the token
+	if _, err = s.db.Exec("UPDATE sessions SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Second).UnixNano(), sid); err != nil {
+		t.Fatalf("can't update session: %v", err)
+	}
+	_, err = s.ExtendToken(tokenContext(rsp.Token), &cpb.Empty{})
+	checkCode(t, "ExtendToken after session ended", err, codes.Unauthenticated)
+}
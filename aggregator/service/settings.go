@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/messages"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var flagDefaultTimezone string
+
+func init() {
+	flag.StringVar(&flagDefaultTimezone, "default_timezone", "UTC", "Default IANA time zone for users who haven't set one (used for day boundaries in goals)")
+}
+
+// get user's timezone, falling back to server default
+func (s *Service) getUserLocation(uid string) *time.Location {
+	var tz string
+	if err := s.db.QueryRow("SELECT timezone FROM users WHERE id = ?", uid).Scan(&tz); err != nil {
+		s.log.Error("failed to get user timezone", zap.Error(err), zap.String("uid", uid))
+	}
+	if tz == "" {
+		tz = flagDefaultTimezone
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		s.log.Error("failed to load timezone", zap.Error(err), zap.String("uid", uid), zap.String("timezone", tz))
+		return time.UTC
+	}
+	return loc
+}
+
+// get template data and locale for messages sent to user
+func (s *Service) userMessageData(uid string) (*messages.Data, string, error) {
+	data := &messages.Data{Domain: s.domain}
+	var locale string
+	if err := s.db.QueryRow("SELECT email, locale FROM users WHERE id = ?", uid).Scan(&data.User.Email, &locale); err != nil {
+		return nil, "", err
+	}
+	return data, locale, nil
+}
+
+func (s *Service) GetUserSettings(ctx context.Context, req *cpb.Empty) (*spb.DataAggregatorUserSettings, error) {
+	uid, did, err := s.auther.AuthenticateRequest(ctx)
+	if err != nil || did != -1 {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	rsp := &spb.DataAggregatorUserSettings{}
+	var thresholds string
+	var reportFrequency int32
+	if err = s.db.QueryRow("SELECT timezone, locale, notify_thresholds, quiet_hours_start, quiet_hours_end, max_daily_notifications, report_frequency, report_time, report_weekday, min_keystrokes_per_minute, min_clicks_per_minute, idle_gap FROM users WHERE id = ?", uid).Scan(
+		&rsp.Timezone, &rsp.Locale, &thresholds, &rsp.QuietHoursStart, &rsp.QuietHoursEnd, &rsp.MaxDailyNotifications, &reportFrequency, &rsp.ReportTime, &rsp.ReportWeekday,
+		&rsp.MinKeystrokesPerMinute, &rsp.MinClicksPerMinute, &rsp.IdleGap); err != nil {
+		s.log.Error("failed to get user settings", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	rsp.NotificationThresholds = parseThresholds(thresholds)
+	rsp.ReportFrequency = spb.DataAggregatorUserSettings_ReportFrequency(reportFrequency)
+	return rsp, nil
+}
+
+func (s *Service) UpdateUserSettings(ctx context.Context, req *spb.DataAggregatorUserSettings) (*cpb.Empty, error) {
+	uid, did, err := s.auther.AuthenticateRequest(ctx)
+	if err != nil || did != -1 {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	if req.Timezone != "" {
+		if _, err = time.LoadLocation(req.Timezone); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "unknown timezone")
+		}
+	}
+	if req.Locale != "" && !messages.ValidLocale(req.Locale) {
+		return nil, status.Error(codes.InvalidArgument, "invalid locale")
+	}
+	if err = validateThresholds(req.NotificationThresholds); err != nil {
+		return nil, err
+	}
+	if req.QuietHoursStart < 0 || req.QuietHoursStart >= 24*60 || req.QuietHoursEnd < 0 || req.QuietHoursEnd >= 24*60 {
+		return nil, status.Error(codes.InvalidArgument, "quiet hours must be minutes of day")
+	}
+	if req.MaxDailyNotifications < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid daily notification limit")
+	}
+	if _, ok := spb.DataAggregatorUserSettings_ReportFrequency_name[int32(req.ReportFrequency)]; !ok {
+		return nil, status.Error(codes.InvalidArgument, "invalid report frequency")
+	}
+	if req.ReportTime < 0 || req.ReportTime >= 24*60 {
+		return nil, status.Error(codes.InvalidArgument, "report time must be minute of day")
+	}
+	if req.ReportWeekday < 0 || req.ReportWeekday > 6 {
+		return nil, status.Error(codes.InvalidArgument, "invalid report weekday")
+	}
+	if req.MinKeystrokesPerMinute < 0 || req.MinClicksPerMinute < 0 || req.IdleGap < 0 {
+		return nil, status.Error(codes.InvalidArgument, "activity settings can't be negative")
+	}
+	if req.ReportFrequency != spb.DataAggregatorUserSettings_NEVER && s.notifiers["email"] == nil {
+		return nil, status.Error(codes.FailedPrecondition, "email is not enabled on this server")
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	var reportFrequency int32
+	if err = s.db.QueryRow("SELECT report_frequency FROM users WHERE id = ?", uid).Scan(&reportFrequency); err != nil {
+		s.log.Error("failed to get user settings", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if _, err = s.db.Exec("UPDATE users SET timezone = ?, locale = ?, notify_thresholds = ?, quiet_hours_start = ?, quiet_hours_end = ?, max_daily_notifications = ?, report_frequency = ?, report_time = ?, report_weekday = ?, "+
+		"min_keystrokes_per_minute = ?, min_clicks_per_minute = ?, idle_gap = ? WHERE id = ?",
+		req.Timezone, req.Locale, formatThresholds(req.NotificationThresholds), req.QuietHoursStart, req.QuietHoursEnd, req.MaxDailyNotifications, req.ReportFrequency, req.ReportTime, req.ReportWeekday,
+		req.MinKeystrokesPerMinute, req.MinClicksPerMinute, req.IdleGap, uid); err != nil {
+		s.log.Error("failed to update user settings", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if reportFrequency == int32(spb.DataAggregatorUserSettings_NEVER) && req.ReportFrequency != spb.DataAggregatorUserSettings_NEVER {
+		// first report is sent at the next scheduled time rather than right away
+		_, end := reportPeriod(time.Now().In(s.getUserLocation(uid)), req.ReportFrequency, req.ReportTime, req.ReportWeekday)
+		if _, err = s.db.Exec("UPDATE users SET last_report_at = ? WHERE id = ?", end.UnixNano(), uid); err != nil {
+			s.log.Error("failed to update last report time", zap.Error(err), zap.String("uid", uid))
+			return nil, status.Error(codes.Internal, "something went wrong")
+		}
+	}
+	return &cpb.Empty{}, nil
+}
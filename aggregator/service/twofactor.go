@@ -0,0 +1,347 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/totp"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const numRecoveryCodes = 10
+
+const (
+	// wrong TOTP or recovery codes a user may enter per secondFactorWindow
+	// when logging in, after which even the right code is rejected
+	maxSecondFactorFailures = 5
+	secondFactorWindow      = 15 * time.Minute
+)
+
+// names of server_settings
+const serverSettingRequire2FA = "require_2fa"
+
+// get a setting admins can change at runtime, empty if not set
+func (s *Service) getServerSetting(name string) (string, error) {
+	var value string
+	err := s.db.QueryRow("SELECT value FROM server_settings WHERE name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// db must be locked
+func (s *Service) setServerSetting(name, value string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("DELETE FROM server_settings WHERE name = ?", name); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO server_settings (name, value) VALUES (?, ?)", name, value); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// whether admins enforce two-factor authentication for all users
+func (s *Service) require2FA() bool {
+	value, err := s.getServerSetting(serverSettingRequire2FA)
+	if err != nil {
+		s.log.Error("failed to get server setting", zap.Error(err), zap.String("name", serverSettingRequire2FA))
+	}
+	return value == "true"
+}
+
+// whether user must pass two-factor authentication for a full token
+func (s *Service) mfaRequired(uid string) (bool, error) {
+	var enabled bool
+	if err := s.db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", uid).Scan(&enabled); err != nil {
+		return false, err
+	}
+	return enabled || s.require2FA(), nil
+}
+
+// normalize recovery code the way users might type it and hash it
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// random codes like 7kq2m-x4fzt
+func generateRecoveryCodes() ([]string, error) {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	codes := make([]string, numRecoveryCodes)
+	b := make([]byte, 10)
+	for i := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+	}
+	return codes, nil
+}
+
+// check code against user's TOTP secret or unused recovery codes, consuming it.
+// db must be locked
+func (s *Service) checkSecondFactor(uid, code string) (bool, error) {
+	var secret string
+	var lastStep int64
+	if err := s.db.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE id = ? AND totp_enabled = ?", uid, true).Scan(&secret, &lastStep); err != nil {
+		return false, err
+	}
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		if step <= lastStep {
+			s.log.Info("rejected replayed totp code", zap.String("uid", uid))
+			return false, nil
+		}
+		_, err := s.db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ?", step, uid)
+		return err == nil, err
+	}
+	res, err := s.db.Exec("DELETE FROM recovery_codes WHERE uid = ? AND code_hash = ?", uid, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if n == 1 {
+		s.log.Info("used recovery code", zap.String("uid", uid))
+	}
+	return n == 1, err
+}
+
+// login response for uid whose password has been checked, either a token or a
+// two-factor authentication challenge
+func (s *Service) loginResponse(ctx context.Context, uid string) (*spb.DataAggregatorLoginResponse, error) {
+	var enabled bool
+	if err := s.db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", uid).Scan(&enabled); err != nil {
+		s.log.Error("failed to get 2fa status", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	state := spb.DataAggregatorLoginResponse_NONE
+	switch {
+	case enabled:
+		state = spb.DataAggregatorLoginResponse_TOTP_REQUIRED
+	case s.require2FA():
+		state = spb.DataAggregatorLoginResponse_ENROLLMENT_REQUIRED
+	default:
+		return s.returnToken(ctx, uid, false)
+	}
+	challenge, err := s.auther.SignChallengeToken(uid)
+	if err != nil {
+		s.log.Error("can't sign challenge token", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong with signing token")
+	}
+	return &spb.DataAggregatorLoginResponse{
+		MfaState:     state,
+		MfaChallenge: challenge,
+	}, nil
+}
+
+func (s *Service) CompleteLogin(ctx context.Context, req *spb.DataAggregatorCompleteLoginRequest) (*spb.DataAggregatorLoginResponse, error) {
+	uid, err := s.auther.VerifyChallengeToken(req.MfaChallenge)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "login expired, please try again")
+	}
+	if !s.secondFactorFailures.allowed(uid) {
+		return nil, status.Error(codes.ResourceExhausted, "too many wrong codes, try again later")
+	}
+	s.db.Lock()
+	ok, err := s.checkSecondFactor(uid, req.Code)
+	s.db.Unlock()
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+	}
+	if err != nil {
+		s.log.Error("failed to check second factor", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if !ok {
+		s.secondFactorFailures.add(uid)
+		return nil, status.Error(codes.Unauthenticated, "invalid code")
+	}
+	s.log.Info("logged in with 2fa", zap.String("uid", uid))
+	return s.returnToken(ctx, uid, true)
+}
+
+// user enrolling in two-factor authentication, authenticated with a full
+// token, or a login challenge if they must enroll before logging in
+func (s *Service) authenticateEnrollment(ctx context.Context) (string, error) {
+	uid, did, err := s.auther.AuthenticateRequest(ctx)
+	if err == nil && did == -1 {
+		return uid, nil
+	}
+	return s.auther.AuthenticateChallenge(ctx)
+}
+
+func (s *Service) BeginTOTPEnrollment(ctx context.Context, req *cpb.Empty) (*spb.DataAggregatorTOTPEnrollment, error) {
+	uid, err := s.authenticateEnrollment(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		s.log.Error("failed to generate totp secret", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	var email string
+	var enabled bool
+	if err = s.db.QueryRow("SELECT email, totp_enabled FROM users WHERE id = ?", uid).Scan(&email, &enabled); err != nil {
+		s.log.Error("failed to get 2fa status", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if enabled {
+		return nil, status.Error(codes.AlreadyExists, "two-factor authentication is already enabled")
+	}
+	if _, err = s.db.Exec("UPDATE users SET totp_secret = ? WHERE id = ?", secret, uid); err != nil {
+		s.log.Error("failed to save totp secret", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	return &spb.DataAggregatorTOTPEnrollment{
+		Secret: secret,
+		Uri:    totp.URI("Productimon", email, secret),
+	}, nil
+}
+
+func (s *Service) ConfirmTOTPEnrollment(ctx context.Context, req *spb.DataAggregatorTOTPCode) (*spb.DataAggregatorConfirmTOTPEnrollmentResponse, error) {
+	uid, err := s.authenticateEnrollment(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	recoveryCodes, err := generateRecoveryCodes()
+	if err != nil {
+		s.log.Error("failed to generate recovery codes", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	err = func() error {
+		s.db.Lock()
+		defer s.db.Unlock()
+		var secret string
+		var enabled bool
+		if err := s.db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", uid).Scan(&secret, &enabled); err != nil {
+			s.log.Error("failed to get 2fa status", zap.Error(err), zap.String("uid", uid))
+			return status.Error(codes.Internal, "something went wrong")
+		}
+		if enabled {
+			return status.Error(codes.AlreadyExists, "two-factor authentication is already enabled")
+		}
+		if secret == "" {
+			return status.Error(codes.FailedPrecondition, "call BeginTOTPEnrollment first")
+		}
+		step, ok := totp.Validate(secret, req.Code, time.Now())
+		if !ok {
+			return status.Error(codes.InvalidArgument, "invalid code")
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			s.log.Error("can't begin transaction", zap.Error(err))
+			return status.Error(codes.Internal, "something went wrong")
+		}
+		defer tx.Rollback()
+		if _, err = tx.Exec("UPDATE users SET totp_enabled = ?, totp_last_step = ? WHERE id = ?", true, step, uid); err != nil {
+			s.log.Error("failed to enable totp", zap.Error(err), zap.String("uid", uid))
+			return status.Error(codes.Internal, "something went wrong")
+		}
+		if _, err = tx.Exec("DELETE FROM recovery_codes WHERE uid = ?", uid); err != nil {
+			s.log.Error("failed to delete recovery codes", zap.Error(err), zap.String("uid", uid))
+			return status.Error(codes.Internal, "something went wrong")
+		}
+		for _, c := range recoveryCodes {
+			if _, err = tx.Exec("INSERT INTO recovery_codes (uid, code_hash) VALUES (?, ?)", uid, hashRecoveryCode(c)); err != nil {
+				s.log.Error("failed to insert recovery code", zap.Error(err), zap.String("uid", uid))
+				return status.Error(codes.Internal, "something went wrong")
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			s.log.Error("failed to commit 2fa enrollment", zap.Error(err), zap.String("uid", uid))
+			return status.Error(codes.Internal, "something went wrong")
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("enabled 2fa", zap.String("uid", uid))
+	login, err := s.returnToken(ctx, uid, true)
+	if err != nil {
+		return nil, err
+	}
+	return &spb.DataAggregatorConfirmTOTPEnrollmentResponse{
+		RecoveryCodes: recoveryCodes,
+		Login:         login,
+	}, nil
+}
+
+func (s *Service) DisableTOTP(ctx context.Context, req *spb.DataAggregatorTOTPCode) (*cpb.Empty, error) {
+	uid, did, mfa, err := s.auther.AuthenticateRequestMFA(ctx)
+	if err != nil || did != -1 || !mfa {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	if s.require2FA() {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is required on this server")
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	ok, err := s.checkSecondFactor(uid, req.Code)
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+	}
+	if err != nil {
+		s.log.Error("failed to check second factor", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "invalid code")
+	}
+	if _, err = s.db.Exec("UPDATE users SET totp_secret = '', totp_enabled = ?, totp_last_step = 0 WHERE id = ?", false, uid); err != nil {
+		s.log.Error("failed to disable totp", zap.Error(err), zap.String("uid", uid))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	if _, err = s.db.Exec("DELETE FROM recovery_codes WHERE uid = ?", uid); err != nil {
+		s.log.Error("failed to delete recovery codes", zap.Error(err), zap.String("uid", uid))
+	}
+	s.log.Info("disabled 2fa", zap.String("uid", uid))
+	return &cpb.Empty{}, nil
+}
+
+func (s *Service) GetServerSettings(ctx context.Context, req *cpb.Empty) (*spb.DataAggregatorServerSettings, error) {
+	if !s.isAdmin(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	return &spb.DataAggregatorServerSettings{
+		Require_2Fa: s.require2FA(),
+	}, nil
+}
+
+func (s *Service) UpdateServerSettings(ctx context.Context, req *spb.DataAggregatorServerSettings) (*cpb.Empty, error) {
+	if !s.isAdmin(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	require2FA := "false"
+	if req.Require_2Fa {
+		require2FA = "true"
+	}
+	s.db.Lock()
+	defer s.db.Unlock()
+	if err := s.setServerSetting(serverSettingRequire2FA, require2FA); err != nil {
+		s.log.Error("failed to update server settings", zap.Error(err))
+		return nil, status.Error(codes.Internal, "something went wrong")
+	}
+	return &cpb.Empty{}, nil
+}
@@ -0,0 +1,207 @@
+package service
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"git.yiad.am/productimon/aggregator/totp"
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != numRecoveryCodes {
+		t.Fatalf("got %d codes, want %d", len(codes), numRecoveryCodes)
+	}
+	format := regexp.MustCompile(`^[a-z2-9]{5}-[a-z2-9]{5}$`)
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		if !format.MatchString(c) {
+			t.Errorf("code %q has wrong format", c)
+		}
+		if seen[c] {
+			t.Errorf("duplicate code %q", c)
+		}
+		seen[c] = true
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := hashRecoveryCode("7kq2m-x4fzt")
+	for _, typed := range []string{"7kq2mx4fzt", "7KQ2M-X4FZT", "7kq2m x4fzt"} {
+		if got := hashRecoveryCode(typed); got != want {
+			t.Errorf("hashRecoveryCode(%q) = %q, want %q", typed, got, want)
+		}
+	}
+	if hashRecoveryCode("7kq2m-x4fzu") == want {
+		t.Error("different codes have the same hash")
+	}
+}
+
+// enable TOTP for uid with a recovery code, returning its secret
+func enableTOTP(t *testing.T, s *Service, uid, recoveryCode string) string {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatalf("can't generate secret: %v", err)
+	}
+	if _, err = s.db.Exec("UPDATE users SET totp_secret = ?, totp_enabled = ? WHERE id = ?", secret, true, uid); err != nil {
+		t.Fatalf("can't enable totp: %v", err)
+	}
+	if _, err = s.db.Exec("INSERT INTO recovery_codes (uid, code_hash) VALUES (?, ?)", uid, hashRecoveryCode(recoveryCode)); err != nil {
+		t.Fatalf("can't insert recovery code: %v", err)
+	}
+	return secret
+}
+
+func currentCode(t *testing.T, secret string) string {
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatalf("can't generate code: %v", err)
+	}
+	return code
+}
+
+func completeLogin(s *Service, challenge, code string) (*spb.DataAggregatorLoginResponse, error) {
+	return s.CompleteLogin(context.Background(), &spb.DataAggregatorCompleteLoginRequest{MfaChallenge: challenge, Code: code})
+}
+
+func TestCompleteLogin(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "mfa@productimon.com", "password")
+	secret := enableTOTP(t, s, uid, "7kq2m-x4fzt")
+
+	rsp := login(t, s, "mfa@productimon.com", "password")
+	if rsp.Token != "" || rsp.MfaState != spb.DataAggregatorLoginResponse_TOTP_REQUIRED || rsp.MfaChallenge == "" {
+		t.Fatalf("Login returned token %q, state %v and challenge %q, want only a TOTP challenge", rsp.Token, rsp.MfaState, rsp.MfaChallenge)
+	}
+	_, err := s.UserDetails(tokenContext(rsp.MfaChallenge), &cpb.Empty{})
+	checkCode(t, "UserDetails with challenge", err, codes.Unauthenticated)
+	_, err = completeLogin(s, rsp.MfaChallenge, "000000")
+	checkCode(t, "CompleteLogin with wrong code", err, codes.Unauthenticated)
+	_, err = completeLogin(s, "not a challenge", currentCode(t, secret))
+	checkCode(t, "CompleteLogin without challenge", err, codes.Unauthenticated)
+
+	code := currentCode(t, secret)
+	full, err := completeLogin(s, rsp.MfaChallenge, code)
+	if err != nil {
+		t.Fatalf("CompleteLogin failed: %v", err)
+	}
+	if _, _, mfa, err := s.auther.AuthenticateRequestMFA(tokenContext(full.Token)); err != nil || !mfa {
+		t.Errorf("token from CompleteLogin: mfa %v, error %v, want passed", mfa, err)
+	}
+	_, err = completeLogin(s, rsp.MfaChallenge, code)
+	checkCode(t, "CompleteLogin with used code", err, codes.Unauthenticated)
+
+	if _, err = completeLogin(s, rsp.MfaChallenge, "7KQ2M X4FZT"); err != nil {
+		t.Errorf("CompleteLogin with recovery code failed: %v", err)
+	}
+	_, err = completeLogin(s, rsp.MfaChallenge, "7kq2m-x4fzt")
+	checkCode(t, "CompleteLogin with used recovery code", err, codes.Unauthenticated)
+}
+
+func TestCompleteLoginAttemptLimit(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "mfa@productimon.com", "password")
+	secret := enableTOTP(t, s, uid, "7kq2m-x4fzt")
+	other := addUser(t, s, "other@productimon.com", "password")
+	otherSecret := enableTOTP(t, s, other, "7kq2m-x4fzu")
+
+	challenge := login(t, s, "mfa@productimon.com", "password").MfaChallenge
+	for i := 0; i < maxSecondFactorFailures; i++ {
+		_, err := completeLogin(s, challenge, "wrong")
+		checkCode(t, "CompleteLogin with wrong code", err, codes.Unauthenticated)
+	}
+	// a new challenge doesn't help either
+	challenge = login(t, s, "mfa@productimon.com", "password").MfaChallenge
+	_, err := completeLogin(s, challenge, currentCode(t, secret))
+	checkCode(t, "CompleteLogin with right code after too many wrong ones", err, codes.ResourceExhausted)
+	_, err = completeLogin(s, challenge, "7kq2m-x4fzt")
+	checkCode(t, "CompleteLogin with recovery code after too many wrong ones", err, codes.ResourceExhausted)
+
+	otherChallenge := login(t, s, "other@productimon.com", "password").MfaChallenge
+	if _, err = completeLogin(s, otherChallenge, currentCode(t, otherSecret)); err != nil {
+		t.Errorf("CompleteLogin of another user failed: %v", err)
+	}
+}
+
+func TestEnforcedEnrollment(t *testing.T) {
+	s := startRPCService(t)
+	addUser(t, s, "new@productimon.com", "password")
+	if err := s.setServerSetting(serverSettingRequire2FA, "true"); err != nil {
+		t.Fatalf("can't require 2fa: %v", err)
+	}
+
+	rsp := login(t, s, "new@productimon.com", "password")
+	if rsp.Token != "" || rsp.MfaState != spb.DataAggregatorLoginResponse_ENROLLMENT_REQUIRED || rsp.MfaChallenge == "" {
+		t.Fatalf("Login returned token %q, state %v and challenge %q, want only an enrollment challenge", rsp.Token, rsp.MfaState, rsp.MfaChallenge)
+	}
+	_, err := completeLogin(s, rsp.MfaChallenge, "000000")
+	checkCode(t, "CompleteLogin before enrolling", err, codes.FailedPrecondition)
+	_, err = s.GetDevices(tokenContext(rsp.MfaChallenge), &cpb.Empty{})
+	checkCode(t, "GetDevices with challenge", err, codes.Unauthenticated)
+
+	ctx := tokenContext(rsp.MfaChallenge)
+	enrollment, err := s.BeginTOTPEnrollment(ctx, &cpb.Empty{})
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment with challenge failed: %v", err)
+	}
+	_, err = s.ConfirmTOTPEnrollment(ctx, &spb.DataAggregatorTOTPCode{Code: "000000"})
+	checkCode(t, "ConfirmTOTPEnrollment with wrong code", err, codes.InvalidArgument)
+	confirmed, err := s.ConfirmTOTPEnrollment(ctx, &spb.DataAggregatorTOTPCode{Code: currentCode(t, enrollment.Secret)})
+	if err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment failed: %v", err)
+	}
+	if len(confirmed.RecoveryCodes) != numRecoveryCodes {
+		t.Errorf("got %d recovery codes, want %d", len(confirmed.RecoveryCodes), numRecoveryCodes)
+	}
+	if _, _, mfa, err := s.auther.AuthenticateRequestMFA(tokenContext(confirmed.Login.Token)); err != nil || !mfa {
+		t.Errorf("token from enrollment: mfa %v, error %v, want passed", mfa, err)
+	}
+	if rsp = login(t, s, "new@productimon.com", "password"); rsp.MfaState != spb.DataAggregatorLoginResponse_TOTP_REQUIRED {
+		t.Errorf("Login after enrolling returned state %v, want TOTP_REQUIRED", rsp.MfaState)
+	}
+}
+
+func TestDeviceSigninRequiresMFA(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	req := &spb.DataAggregatorDeviceSigninRequest{Device: &cpb.Device{Name: "laptop"}}
+
+	// logged in before 2fa was required
+	token := login(t, s, "user@productimon.com", "password").Token
+	if err := s.setServerSetting(serverSettingRequire2FA, "true"); err != nil {
+		t.Fatalf("can't require 2fa: %v", err)
+	}
+	_, err := s.DeviceSignin(tokenContext(token), req)
+	checkCode(t, "DeviceSignin with token without 2fa when it's required", err, codes.PermissionDenied)
+	if err := s.setServerSetting(serverSettingRequire2FA, "false"); err != nil {
+		t.Fatalf("can't stop requiring 2fa: %v", err)
+	}
+
+	// logged in before enabling 2fa
+	secret := enableTOTP(t, s, uid, "7kq2m-x4fzt")
+	_, err = s.DeviceSignin(tokenContext(token), req)
+	checkCode(t, "DeviceSignin with token without 2fa when it's enabled", err, codes.PermissionDenied)
+	challenge := login(t, s, "user@productimon.com", "password").MfaChallenge
+	_, err = s.DeviceSignin(tokenContext(challenge), req)
+	checkCode(t, "DeviceSignin with challenge", err, codes.Unauthenticated)
+
+	full, err := completeLogin(s, challenge, currentCode(t, secret))
+	if err != nil {
+		t.Fatalf("CompleteLogin failed: %v", err)
+	}
+	rsp, err := s.DeviceSignin(tokenContext(full.Token), req)
+	if err != nil {
+		t.Fatalf("DeviceSignin with token with 2fa failed: %v", err)
+	}
+	if len(rsp.Cert) == 0 || len(rsp.Key) == 0 {
+		t.Error("DeviceSignin returned no certificate or key")
+	}
+}
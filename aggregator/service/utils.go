@@ -2,7 +2,9 @@ package service
 
 import (
 	"fmt"
+	"time"
 
+	"git.yiad.am/productimon/aggregator/storage"
 	cpb "git.yiad.am/productimon/proto/common"
 )
 
@@ -21,3 +23,75 @@ func deviceFilters(fieldname string, devices []*cpb.Device) string {
 	}
 	return dFilter
 }
+
+const allDaysOfWeek = 1<<7 - 1
+
+// split [start, end] into ranges that only cover weekdays selected in
+// daysOfWeek (bit n for time.Weekday(n)), with day boundaries in loc.
+// Consecutive selected days are merged into a single range.
+func dayRanges(start, end int64, daysOfWeek int32, loc *time.Location) [][2]int64 {
+	if daysOfWeek&allDaysOfWeek == 0 || daysOfWeek&allDaysOfWeek == allDaysOfWeek {
+		return [][2]int64{{start, end}}
+	}
+	var ranges [][2]int64
+	t := time.Unix(0, start).In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	for day.UnixNano() < end {
+		next := day.AddDate(0, 0, 1)
+		if daysOfWeek&(1<<uint(day.Weekday())) != 0 {
+			rstart, rend := day.UnixNano(), next.UnixNano()
+			if rstart < start {
+				rstart = start
+			}
+			if rend > end {
+				rend = end
+			}
+			if n := len(ranges); n > 0 && ranges[n-1][1] == rstart {
+				ranges[n-1][1] = rend
+			} else {
+				ranges = append(ranges, [2]int64{rstart, rend})
+			}
+		}
+		day = next
+	}
+	return ranges
+}
+
+// total length of ranges returned by dayRanges
+func dayRangesDuration(ranges [][2]int64) (total int64) {
+	for _, r := range ranges {
+		total += r[1] - r[0]
+	}
+	return
+}
+
+// how many times insertNextId tries an id before giving up
+const maxNextIdAttempts = 10
+
+// insert a row of uid into table (goals or devices) in tx, with insert given
+// the next free id: one more than the largest, or first. Other aggregators
+// sharing the database may take the same id at once, then the insert fails
+// on the primary key and is retried with the next one
+func (s *Service) insertNextId(tx *storage.Tx, table, uid string, first int64, insert func(id int64) error) (int64, error) {
+	for attempt := 1; ; attempt++ {
+		var id int64
+		if err := tx.QueryRow("SELECT COALESCE(MAX(id) + 1, ?) FROM "+table+" WHERE uid = ?", first, uid).Scan(&id); err != nil {
+			return 0, err
+		}
+		// a failed statement aborts the whole transaction in some databases
+		if _, err := tx.Exec("SAVEPOINT next_id"); err != nil {
+			return 0, err
+		}
+		err := insert(id)
+		if err == nil {
+			_, err = tx.Exec("RELEASE SAVEPOINT next_id")
+			return id, err
+		}
+		if !s.db.IsUniqueViolation(err) || attempt == maxNextIdAttempts {
+			return 0, err
+		}
+		if _, err = tx.Exec("ROLLBACK TO SAVEPOINT next_id"); err != nil {
+			return 0, err
+		}
+	}
+}
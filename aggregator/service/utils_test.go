@@ -0,0 +1,99 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDayRanges(t *testing.T) {
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	ts := func(loc *time.Location, month time.Month, day, hour int) int64 {
+		return time.Date(2020, month, day, hour, 0, 0, 0, loc).UnixNano()
+	}
+	// 2020-08-02 is a Sunday
+	sun := ts(time.UTC, time.August, 2, 0)
+	tests := []struct {
+		name       string
+		start, end int64
+		daysOfWeek int32
+		loc        *time.Location
+		want       [][2]int64
+	}{
+		{"all days", sun, sun + int64(7*24*time.Hour), 0, time.UTC,
+			[][2]int64{{sun, sun + int64(7*24*time.Hour)}}},
+		{"every bit set", sun, sun + int64(7*24*time.Hour), allDaysOfWeek, time.UTC,
+			[][2]int64{{sun, sun + int64(7*24*time.Hour)}}},
+		{"tuesdays and thursdays", sun, sun + int64(7*24*time.Hour), 1<<2 | 1<<4, time.UTC,
+			[][2]int64{
+				{ts(time.UTC, time.August, 4, 0), ts(time.UTC, time.August, 5, 0)},
+				{ts(time.UTC, time.August, 6, 0), ts(time.UTC, time.August, 7, 0)},
+			}},
+		{"consecutive days merged and clipped", ts(time.UTC, time.August, 3, 12), ts(time.UTC, time.August, 5, 6), 1<<1 | 1<<2 | 1<<3, time.UTC,
+			[][2]int64{{ts(time.UTC, time.August, 3, 12), ts(time.UTC, time.August, 5, 6)}}},
+		{"user timezone", sun, sun + int64(2*24*time.Hour), 1 << 1, sydney,
+			[][2]int64{{ts(sydney, time.August, 3, 0), ts(sydney, time.August, 4, 0)}}},
+		{"no selected days in interval", sun, sun + int64(24*time.Hour), 1 << 3, time.UTC, nil},
+	}
+	for _, tt := range tests {
+		if got := dayRanges(tt.start, tt.end, tt.daysOfWeek, tt.loc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: dayRanges() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDayRangesDuration(t *testing.T) {
+	if got := dayRangesDuration([][2]int64{{0, 10}, {20, 25}}); got != 15 {
+		t.Errorf("dayRangesDuration() = %d, want 15", got)
+	}
+	if got := dayRangesDuration(nil); got != 0 {
+		t.Errorf("dayRangesDuration(nil) = %d, want 0", got)
+	}
+}
+
+func TestInsertNextId(t *testing.T) {
+	s := startRPCService(t)
+	uid := addUser(t, s, "user@productimon.com", "password")
+	addDevice(t, s, uid, 3)
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatalf("can't begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	insert := func(did int64) error {
+		_, err := tx.Exec("INSERT INTO devices (uid, id, name, kind) VALUES (?, ?, ?, ?)", uid, did, "laptop", 0)
+		return err
+	}
+
+	// as if another aggregator took the id first
+	var tried []int64
+	did, err := s.insertNextId(tx, "devices", uid, 0, func(did int64) error {
+		tried = append(tried, did)
+		if len(tried) == 1 {
+			if err := insert(did); err != nil {
+				return err
+			}
+		}
+		return insert(did)
+	})
+	if err != nil || did != 4 || !reflect.DeepEqual(tried, []int64{4, 4}) {
+		t.Errorf("insertNextId returned %d (error %v) after trying %v, want 4 after trying 4 twice", did, err, tried)
+	}
+	var n int
+	if err = tx.QueryRow("SELECT COUNT(*) FROM devices WHERE uid = ?", uid).Scan(&n); err != nil || n != 2 {
+		t.Errorf("user has %d devices (error %v), want 2", n, err)
+	}
+
+	failed := errors.New("failed")
+	tried = nil
+	if _, err = s.insertNextId(tx, "devices", uid, 0, func(did int64) error {
+		tried = append(tried, did)
+		return failed
+	}); err != failed || len(tried) != 1 {
+		t.Errorf("insertNextId returned %v after %d tries, want the insert's error after 1", err, len(tried))
+	}
+}
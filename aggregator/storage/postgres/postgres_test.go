@@ -0,0 +1,17 @@
+package postgres
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT * FROM users WHERE id = ?", "SELECT * FROM users WHERE id = $1"},
+		{"INSERT INTO t VALUES(?, ?, ?)", "INSERT INTO t VALUES($1, $2, $3)"},
+		{"SELECT '?' FROM t WHERE a = ? AND b = 'it''s?' AND c = ?", "SELECT '?' FROM t WHERE a = $1 AND b = 'it''s?' AND c = $2"},
+	}
+	for _, tt := range tests {
+		if got := (backend{}).Rebind(tt.in); got != tt.out {
+			t.Errorf("Rebind(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Package sqlite registers the SQLite3 storage backend.
+//
+// The data source name is a path to the database file, which is created on
+// first use. Options are appended to enable WAL and foreign keys unless the
+// path already contains a query string.
+package sqlite
+
+import (
+	"database/sql"
+	"strings"
+
+	"git.yiad.am/productimon/aggregator/storage"
+	"github.com/mattn/go-sqlite3"
+)
+
+const defaultOptions = "?_journal_mode=wal&_txlock=immediate&_busy_timeout=5000&_foreign_keys=1"
+
+type backend struct{}
+
+func init() {
+	storage.Register(backend{})
+}
+
+func (backend) Name() string {
+	return "sqlite3"
+}
+
+func (backend) Open(dsn string) (*sql.DB, error) {
+	if !strings.Contains(dsn, "?") {
+		dsn += defaultOptions
+	}
+	return sql.Open("sqlite3", dsn)
+}
+
+func (backend) Rebind(query string) string {
+	return query
+}
+
+// SQLite's multi-argument MAX/MIN are scalar functions
+func (backend) Greatest(a, b string) string {
+	return "MAX(" + a + ", " + b + ")"
+}
+
+func (backend) Least(a, b string) string {
+	return "MIN(" + a + ", " + b + ")"
+}
+
+func (backend) NoCase(expr string) string {
+	return expr + " COLLATE NOCASE"
+}
+
+// SQLite locks the whole database for writes
+func (backend) SingleWriter() bool {
+	return true
+}
+
+func (backend) IsUniqueViolation(err error) bool {
+	e, ok := err.(sqlite3.Error)
+	return ok && (e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || e.ExtendedCode == sqlite3.ErrConstraintUnique)
+}
+
+// a database file is only used by one process
+func (backend) MigrationLock() (lock, unlock string) {
+	return "", ""
+}
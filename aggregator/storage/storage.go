@@ -0,0 +1,184 @@
+// Package storage abstracts the database engine the aggregator runs on.
+//
+// All queries in the aggregator are written with ? placeholders and portable
+// SQL. The few constructs that differ between engines are generated by the
+// Backend (see Greatest, Least and NoCase). Backends register themselves in
+// init(), similar to database/sql drivers.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Backend knows how to open and speak to a specific database engine.
+type Backend interface {
+	// Name of the backend, as passed to -db_backend
+	Name() string
+	// Open a connection pool given a backend-specific data source name
+	Open(dsn string) (*sql.DB, error)
+	// Convert a query using ? placeholders to the backend's own syntax
+	Rebind(query string) string
+	// SQL expression for the larger of a and b
+	Greatest(a, b string) string
+	// SQL expression for the smaller of a and b
+	Least(a, b string) string
+	// SQL expression to sort expr case-insensitively
+	NoCase(expr string) string
+	// Whether the backend only supports a single writer, in which case
+	// the aggregator serializes all writes via DB.Lock
+	SingleWriter() bool
+	// Whether err is a primary key or unique constraint violation
+	IsUniqueViolation(err error) bool
+	// Statements taking and releasing a lock that excludes other processes
+	// using the database, held by the connection they run on. Both are empty
+	// if the engine has no such lock
+	MigrationLock() (lock, unlock string)
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]Backend)
+)
+
+// Make a backend available by name. This panics if it's registered twice.
+func Register(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, dup := backends[b.Name()]; dup {
+		panic("storage: Register called twice for backend " + b.Name())
+	}
+	backends[b.Name()] = b
+}
+
+// Return sorted names of all registered backends.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Database handle that rebinds queries for its backend.
+type DB struct {
+	Backend
+	db    *sql.DB
+	wlock sync.Mutex
+}
+
+// Open a database with the named backend.
+func Open(backend, dsn string) (*DB, error) {
+	backendsMu.RLock()
+	b, ok := backends[backend]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown backend %q (available: %s)", backend, strings.Join(Backends(), ", "))
+	}
+	db, err := b.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{Backend: b, db: db}, nil
+}
+
+// Wrap an already-opened connection pool.
+func New(b Backend, db *sql.DB) *DB {
+	return &DB{Backend: b, db: db}
+}
+
+func (d *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.db.Exec(d.Rebind(query), args...)
+}
+
+func (d *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.db.Query(d.Rebind(query), args...)
+}
+
+func (d *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return d.db.QueryRow(d.Rebind(query), args...)
+}
+
+func (d *DB) Begin() (*Tx, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx, b: d.Backend}, nil
+}
+
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Take the backend's MigrationLock on a connection of its own, waiting for
+// other processes that hold it. unlock releases it.
+func (d *DB) LockMigrations() (unlock func() error, err error) {
+	lock, unlockStmt := d.MigrationLock()
+	if lock == "" {
+		return func() error { return nil }, nil
+	}
+	ctx := context.Background()
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.ExecContext(ctx, lock); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() error {
+		_, err := conn.ExecContext(ctx, unlockStmt)
+		conn.Close()
+		return err
+	}, nil
+}
+
+// Acquire the write lock. This is a no-op for backends that support
+// concurrent writers, so writes must not rely on it to be consistent, e.g.
+// allocating ids has to cope with other aggregators using the database.
+func (d *DB) Lock() {
+	if d.SingleWriter() {
+		d.wlock.Lock()
+	}
+}
+
+// Release the write lock acquired by Lock.
+func (d *DB) Unlock() {
+	if d.SingleWriter() {
+		d.wlock.Unlock()
+	}
+}
+
+// Transaction that rebinds queries for its backend.
+type Tx struct {
+	tx *sql.Tx
+	b  Backend
+}
+
+func (t *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.Exec(t.b.Rebind(query), args...)
+}
+
+func (t *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.tx.Query(t.b.Rebind(query), args...)
+}
+
+func (t *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.tx.QueryRow(t.b.Rebind(query), args...)
+}
+
+func (t *Tx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *Tx) Rollback() error {
+	return t.tx.Rollback()
+}
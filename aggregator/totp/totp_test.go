@@ -0,0 +1,49 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil || got != tt.want {
+			t.Errorf("Code(%d) = %q, %v, want %q", tt.unix, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	code, _ := Code(secret, Step(now))
+	if step, ok := Validate(secret, code[:3]+" "+code[3:], now); !ok || step != Step(now) {
+		t.Errorf("Validate() of current code = %d, %v", step, ok)
+	}
+	if _, ok := Validate(secret, code, now.Add(Period)); !ok {
+		t.Error("Validate() of code from previous step = false")
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period)); ok {
+		t.Error("Validate() of code from 3 steps ago = true")
+	}
+	if _, ok := Validate(secret, "12345", now); ok {
+		t.Error("Validate() of short code = true")
+	}
+}
@@ -3,11 +3,18 @@ package deviceState
 import (
 	"database/sql"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
+	"git.yiad.am/productimon/aggregator/storage"
 	cpb "git.yiad.am/productimon/proto/common"
 	"go.uber.org/zap"
 )
 
+// state of a device, saved in the device_states table after every event it
+// runs. Events stored after its evq.lastid are still pending, either waiting
+// for an earlier event or not run before the aggregator stopped
 type DeviceState struct {
 	uid        string
 	did        int64
@@ -16,18 +23,90 @@ type DeviceState struct {
 	activeTime int64
 	running    bool
 	evq        OrderedEventQueue
+	// evq.lastid in device_states
+	savedEid int64
+	// closed intervals and active time of the events run since the state was
+	// saved, written to the intervals and activity_buckets tables with it
+	intervals []Interval
+	buckets   []Bucket
+	// receive closed intervals and active time instead of the tables when set
+	onInterval func(Interval)
+	onBucket   func(Bucket)
 }
 
-type LazyInitEidHandler func(uid string, did int64) (int64, error)
+// time spent in an app, as stored in the intervals table
+type Interval struct {
+	Start, End, Active int64
+	App                string
+}
+
+// active time in a minute of an interval, as stored in the activity_buckets
+// table so parts of intervals get their share of active time
+type Bucket struct {
+	// starttime of the interval
+	Start int64
+	// start of the minute
+	Minute int64
+	Active int64
+}
+
+// nanoseconds in a Bucket
+const BucketSize = int64(time.Minute)
+
+// split active nanoseconds between timestart and timeend into the minutes
+// they're in, in proportion to how much of the time is in each
+func splitActive(timestart, timeend, active int64) map[int64]int64 {
+	first := timestart - timestart%BucketSize
+	if timeend <= timestart {
+		return map[int64]int64{first: active}
+	}
+	ret := make(map[int64]int64)
+	var done int64
+	for m := first; m < timeend; m += BucketSize {
+		st, et := m, m+BucketSize
+		if st < timestart {
+			st = timestart
+		}
+		if et >= timeend {
+			// the rest, so rounding doesn't lose any
+			ret[m] = active - done
+			break
+		}
+		part := int64(float64(active) * float64(et-st) / float64(timeend-timestart))
+		ret[m] = part
+		done += part
+	}
+	return ret
+}
+
+type EventHandler func(ds *DeviceState, o Operator, log *zap.Logger)
+
+// a stored event to run again when rebuilding a device state
+type PendingEvent struct {
+	Eid     int64
+	Handler EventHandler
+}
+
+// returns the eid after which events of a device without saved state should be
+// replayed. eid is the event about to be run, -1 when restoring on startup
+type LazyInitEidHandler func(uid string, did int64, eid int64) (int64, error)
+
+// returns stored events of a device with eid > after in order
+type ReplayHandler func(uid string, did int64, after int64) ([]PendingEvent, error)
 
 type DsMap struct {
 	states         map[string]*DeviceState
 	initEidHandler LazyInitEidHandler
+	replayHandler  ReplayHandler
 	log            *zap.Logger
+	mutex          sync.Mutex
+	// see OrderedEventQueue
+	gapTimeout  time.Duration
+	maxBuffered int
 }
 
 type Operator interface {
-	DB() *sql.DB
+	DB() *storage.DB
 	DBLock()
 	DBUnlock()
 	UpdateGoal(uid string, gid int64)
@@ -48,102 +127,426 @@ func (ds *DeviceState) switchApp(o Operator, log *zap.Logger, app string, timest
 func (ds *DeviceState) clearState(o Operator, log *zap.Logger, timestamp int64) {
 	if ds.running {
 		ds.running = false
-		o.DBLock()
-		if _, err := o.DB().Exec("INSERT INTO intervals (uid, did, starttime, endtime, activetime, app) VALUES(?, ?, ?, ?, ?, ?)", ds.uid, ds.did, ds.startTime, timestamp, ds.activeTime, ds.app); err != nil {
-			log.Error("error in clearState", zap.Error(err))
+		i := Interval{Start: ds.startTime, End: timestamp, Active: ds.activeTime, App: ds.app}
+		if ds.onInterval != nil {
+			ds.onInterval(i)
+			return
+		}
+		ds.intervals = append(ds.intervals, i)
+	}
+}
+
+// update the goals of uid that interval i of device did counts towards
+func updateGoals(o Operator, log *zap.Logger, uid string, did int64, i Interval) {
+	goals, err := o.DB().Query("SELECT id FROM goals WHERE uid = ? AND starttime <= ? AND endtime >= ? "+
+		"AND ((is_label = FALSE AND item = ?) OR "+
+		"(is_label = TRUE AND item = "+
+		"COALESCE((SELECT label FROM user_apps WHERE uid = ? AND name = ?), (SELECT label FROM default_apps WHERE name = ?), 'Uncategorized'))) "+
+		"AND (NOT EXISTS (SELECT 1 FROM goal_devices gd WHERE gd.uid = goals.uid AND gd.gid = goals.id) OR "+
+		"EXISTS (SELECT 1 FROM goal_devices gd WHERE gd.uid = goals.uid AND gd.gid = goals.id AND gd.did = ?))",
+		uid, i.End, i.Start, i.App, uid, i.App, i.App, did)
+	switch {
+	case err == sql.ErrNoRows:
+		return
+	case err != nil:
+		log.Error("error getting affected goals", zap.Error(err))
+	default:
+		defer goals.Close()
+		for goals.Next() {
+			var gid int64
+			goals.Scan(&gid)
+			o.UpdateGoal(uid, gid)
 		}
-		o.DBUnlock()
-		// we don't want/need event heap be blocked by goal updates, so we just spawn a goroutine to do this
-		go func() {
-			// TODO: honor device filter (we need to figure out how to store device list in schema as well)
-			goals, err := o.DB().Query("SELECT id FROM goals WHERE uid = ? AND starttime <= ? AND endtime >= ? "+
-				"AND ((is_label = FALSE AND item = ?) OR "+
-				"(is_label = TRUE AND item = "+
-				"COALESCE((SELECT label FROM user_apps WHERE uid = ? AND name = ?), (SELECT label FROM default_apps WHERE name = ?), 'Uncategorized')))",
-				ds.uid, timestamp, ds.startTime, ds.app, ds.uid, ds.app, ds.app)
-			switch {
-			case err == sql.ErrNoRows:
-				return
-			case err != nil:
-				log.Error("error getting affected goals", zap.Error(err))
-			default:
-				defer goals.Close()
-				for goals.Next() {
-					var gid int64
-					goals.Scan(&gid)
-					o.UpdateGoal(ds.uid, gid)
-				}
-			}
-		}()
 	}
 }
 
-func (ds *DeviceState) setActive(o Operator, log *zap.Logger, timestart, timeend int64) {
-	ds.activeTime += timeend - timestart
+func (ds *DeviceState) setActive(o Operator, log *zap.Logger, timestart, timeend, active int64) {
+	ds.activeTime += active
+	if !ds.running {
+		return
+	}
+	for minute, part := range splitActive(timestart, timeend, active) {
+		b := Bucket{Start: ds.startTime, Minute: minute, Active: part}
+		if ds.onBucket != nil {
+			ds.onBucket(b)
+			continue
+		}
+		ds.buckets = append(ds.buckets, b)
+	}
+}
+
+func (ds *DeviceState) addBucket(tx *storage.Tx, b Bucket) error {
+	res, err := tx.Exec("UPDATE activity_buckets SET activetime = activetime + ? WHERE uid = ? AND did = ? AND starttime = ? AND minute = ?",
+		b.Active, ds.uid, ds.did, b.Start, b.Minute)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		_, err = tx.Exec("INSERT INTO activity_buckets (uid, did, starttime, minute, activetime) VALUES (?, ?, ?, ?, ?)",
+			ds.uid, ds.did, b.Start, b.Minute, b.Active)
+		return err
+	}
+	return nil
 }
 
-func switchApp(app string, timestamp int64) func(ds *DeviceState, o Operator, log *zap.Logger) {
+func switchApp(app string, timestamp int64) EventHandler {
 	return func(ds *DeviceState, o Operator, log *zap.Logger) {
 		ds.switchApp(o, log, app, timestamp)
 	}
 }
 
-func clearState(timestamp int64) func(ds *DeviceState, o Operator, log *zap.Logger) {
+func clearState(timestamp int64) EventHandler {
 	return func(ds *DeviceState, o Operator, log *zap.Logger) {
 		ds.clearState(o, log, timestamp)
 	}
 }
 
-func setActive(timestart, timeend int64) func(ds *DeviceState, o Operator, log *zap.Logger) {
+func setActive(timestart, timeend, active int64) EventHandler {
 	return func(ds *DeviceState, o Operator, log *zap.Logger) {
-		ds.setActive(o, log, timestart, timeend)
+		ds.setActive(o, log, timestart, timeend, active)
 	}
 }
 
-func SwitchApp(e *cpb.Event) func(ds *DeviceState, o Operator, log *zap.Logger) {
+func SwitchApp(e *cpb.Event) EventHandler {
 	return switchApp(e.GetAppSwitchEvent().AppName, e.Timeinterval.Start.Nanos)
 }
 
-func ClearState(e *cpb.Event) func(ds *DeviceState, o Operator, log *zap.Logger) {
+func ClearState(e *cpb.Event) EventHandler {
 	return clearState(e.Timeinterval.Start.Nanos)
 }
 
-func SetActive(e *cpb.Event) func(ds *DeviceState, o Operator, log *zap.Logger) {
-	return setActive(e.Timeinterval.Start.Nanos, e.Timeinterval.End.Nanos)
+// active is the nanoseconds of the event the user was active for
+func SetActive(e *cpb.Event, active int64) EventHandler {
+	return setActive(e.Timeinterval.Start.Nanos, e.Timeinterval.End.Nanos, active)
 }
 
-func Nop(e *cpb.Event) func(ds *DeviceState, o Operator, log *zap.Logger) {
+func Nop(e *cpb.Event) EventHandler {
 	return func(ds *DeviceState, o Operator, log *zap.Logger) {}
 }
 
-func NewDsMap(initEidHandler LazyInitEidHandler, logger *zap.Logger) *DsMap {
+func NewDsMap(initEidHandler LazyInitEidHandler, replayHandler ReplayHandler, logger *zap.Logger) *DsMap {
 	return &DsMap{
 		initEidHandler: initEidHandler,
+		replayHandler:  replayHandler,
 		states:         make(map[string]*DeviceState),
 		log:            logger,
 	}
 }
 
-func (dsm *DsMap) RunEvent(o Operator, uid string, did, eid int64, evf func(ds *DeviceState, o Operator, log *zap.Logger)) error {
+// stop waiting for missing events of a device once one has been waited on for
+// gapTimeout or maxBuffered events are waiting, 0 to wait forever. Only applies
+// to devices loaded after this is called
+func (dsm *DsMap) SetGapLimits(gapTimeout time.Duration, maxBuffered int) {
+	dsm.mutex.Lock()
+	dsm.gapTimeout = gapTimeout
+	dsm.maxBuffered = maxBuffered
+	dsm.mutex.Unlock()
+}
+
+// record events skipped by the queue of ds in event_gaps
+func (dsm *DsMap) recordGap(o Operator, ds *DeviceState, first, last int64, reason string) {
+	o.DBLock()
+	defer o.DBUnlock()
+	if _, err := o.DB().Exec("INSERT INTO event_gaps (uid, did, first_eid, last_eid, skipped_at, reason) VALUES (?, ?, ?, ?, ?, ?)",
+		ds.uid, ds.did, first, last, time.Now().UnixNano(), reason); err != nil {
+		dsm.log.Error("can't record event gap", zap.Error(err), zap.String("uid", ds.uid), zap.Int64("did", ds.did))
+	}
+}
+
+// write ds to device_states if it has run events since it was last saved
+func (ds *DeviceState) save(o Operator, log *zap.Logger) error {
+	if ds.evq.lastid == ds.savedEid {
+		return nil
+	}
+	return ds.write(o, log)
+}
+
+// write ds to device_states together with the intervals and active time of
+// the events it has run since it was last saved, so that events replayed
+// after a crash never count twice. They're kept for the next write on error
+func (ds *DeviceState) write(o Operator, log *zap.Logger) error {
+	if err := ds.writeTx(o); err != nil {
+		return err
+	}
+	ds.savedEid = ds.evq.lastid
+	// we don't want/need event heap be blocked by goal updates, so we just spawn a goroutine to do this
+	if len(ds.intervals) > 0 {
+		uid, did, intervals := ds.uid, ds.did, ds.intervals
+		go func() {
+			for _, i := range intervals {
+				updateGoals(o, log, uid, did, i)
+			}
+		}()
+	}
+	ds.intervals, ds.buckets = nil, nil
+	return nil
+}
+
+func (ds *DeviceState) writeTx(o Operator) error {
+	o.DBLock()
+	defer o.DBUnlock()
+	tx, err := o.DB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, i := range ds.intervals {
+		if _, err = tx.Exec("INSERT INTO intervals (uid, did, starttime, endtime, activetime, app) VALUES(?, ?, ?, ?, ?, ?)", ds.uid, ds.did, i.Start, i.End, i.Active, i.App); err != nil {
+			return err
+		}
+	}
+	for _, b := range ds.buckets {
+		if err = ds.addBucket(tx, b); err != nil {
+			return err
+		}
+	}
+	res, err := tx.Exec("UPDATE device_states SET last_eid = ?, app = ?, starttime = ?, activetime = ?, running = ? WHERE uid = ? AND did = ?",
+		ds.evq.lastid, ds.app, ds.startTime, ds.activeTime, ds.running, ds.uid, ds.did)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err = tx.Exec("INSERT INTO device_states (uid, did, last_eid, app, starttime, activetime, running) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			ds.uid, ds.did, ds.evq.lastid, ds.app, ds.startTime, ds.activeTime, ds.running); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// rebuild the state of a device from device_states, or initEidHandler if it
+// hasn't been saved, and queue its pending events except eid
+func (dsm *DsMap) load(o Operator, uid string, did, eid int64) (*DeviceState, error) {
+	ds := &DeviceState{
+		uid: uid,
+		did: did,
+		evq: OrderedEventQueue{
+			log:         dsm.log,
+			gapTimeout:  dsm.gapTimeout,
+			maxBuffered: dsm.maxBuffered,
+		},
+	}
+	ds.evq.onSkip = func(first, last int64, reason string) {
+		dsm.recordGap(o, ds, first, last, reason)
+	}
+	err := o.DB().QueryRow("SELECT last_eid, app, starttime, activetime, running FROM device_states WHERE uid = ? AND did = ?", uid, did).
+		Scan(&ds.evq.lastid, &ds.app, &ds.startTime, &ds.activeTime, &ds.running)
+	switch {
+	case err == sql.ErrNoRows:
+		if ds.evq.lastid, err = dsm.initEidHandler(uid, did, eid); err != nil {
+			return nil, err
+		}
+		ds.savedEid = -1
+		dsm.log.Debug("lazy init eid", zap.String("uid", uid), zap.Int64("did", did), zap.Int64("initEid", ds.evq.lastid), zap.Int64("eid", eid))
+	case err != nil:
+		return nil, err
+	default:
+		ds.savedEid = ds.evq.lastid
+	}
+	pending, err := dsm.replayHandler(uid, did, ds.evq.lastid)
+	if err != nil {
+		return nil, err
+	}
+	replayed := 0
+	for _, pe := range pending {
+		if pe.Eid == eid {
+			// run by the caller
+			continue
+		}
+		handler := pe.Handler
+		if err = ds.evq.Push(pe.Eid, func() { handler(ds, o, dsm.log) }); err != nil {
+			return nil, err
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		dsm.log.Info("replayed pending events", zap.String("uid", uid), zap.Int64("did", did), zap.Int("count", replayed), zap.Int64("lastEid", ds.evq.lastid))
+	}
+	return ds, nil
+}
+
+func (dsm *DsMap) RunEvent(o Operator, uid string, did, eid int64, evf EventHandler) error {
+	dsm.mutex.Lock()
+	defer dsm.mutex.Unlock()
 	key := idsToKey(uid, did)
 	ds, ok := dsm.states[key]
 	if !ok {
-		initEid, err := dsm.initEidHandler(uid, did)
+		var err error
+		// event is added to db before calling this, so it's not replayed
+		if ds, err = dsm.load(o, uid, did, eid); err != nil {
+			return err
+		}
+		dsm.states[key] = ds
+	}
+	err := ds.evq.Push(eid, func() { evf(ds, o, dsm.log) })
+	if serr := ds.save(o, dsm.log); serr != nil {
+		dsm.log.Error("can't save device state", zap.Error(serr), zap.String("uid", uid), zap.Int64("did", did))
+	}
+	return err
+}
+
+// Rebuild the states of all devices and run events left pending when the
+// aggregator stopped. Called on startup before accepting events
+func (dsm *DsMap) Restore(o Operator) error {
+	rows, err := o.DB().Query("SELECT uid, id FROM devices d WHERE EXISTS (SELECT 1 FROM events e WHERE e.uid = d.uid AND e.did = d.id)")
+	if err != nil {
+		return err
+	}
+	type device struct {
+		uid string
+		did int64
+	}
+	var devices []device
+	for rows.Next() {
+		var d device
+		if err = rows.Scan(&d.uid, &d.did); err != nil {
+			rows.Close()
+			return err
+		}
+		devices = append(devices, d)
+	}
+	rows.Close()
+
+	dsm.mutex.Lock()
+	defer dsm.mutex.Unlock()
+	for _, d := range devices {
+		key := idsToKey(d.uid, d.did)
+		if _, ok := dsm.states[key]; ok {
+			continue
+		}
+		ds, err := dsm.load(o, d.uid, d.did, -1)
 		if err != nil {
-			dsm.log.Error("initEidHandler failed", zap.Error(err))
+			dsm.log.Error("can't restore device state", zap.Error(err), zap.String("uid", d.uid), zap.Int64("did", d.did))
+			continue
 		}
-		// event is added to db before calling this
-		// otherwise first event is always discarded
-		if eid == initEid {
-			initEid -= 1
+		if err = ds.save(o, dsm.log); err != nil {
+			dsm.log.Error("can't save device state", zap.Error(err), zap.String("uid", d.uid), zap.Int64("did", d.did))
 		}
-		dsm.log.Debug("lazy init eid", zap.String("uid", uid), zap.Int64("did", did), zap.Int64("initEid", initEid), zap.Int64("eid", eid))
-		ds = &DeviceState{
-			uid: uid,
-			did: did,
-			evq: OrderedEventQueue{lastid: initEid, log: dsm.log},
+		dsm.states[key] = ds
+	}
+	return nil
+}
+
+// skip missing events that have been waited on for longer than the gap timeout
+// in all device states, to be called periodically
+func (dsm *DsMap) SkipStaleGaps(o Operator) {
+	dsm.mutex.Lock()
+	defer dsm.mutex.Unlock()
+	now := time.Now()
+	for _, ds := range dsm.states {
+		ds.evq.SkipStaleGaps(now)
+		if err := ds.save(o, dsm.log); err != nil {
+			dsm.log.Error("can't save device state", zap.Error(err), zap.String("uid", ds.uid), zap.Int64("did", ds.did))
+		}
+	}
+}
+
+type QueueInfo struct {
+	// last event run
+	LastEid int64
+	// events waiting for an earlier one, in order
+	BufferedEids []int64
+	// when the oldest buffered event arrived, zero if none are buffered
+	WaitingSince time.Time
+}
+
+func (ds *DeviceState) queueInfo() QueueInfo {
+	info := QueueInfo{
+		LastEid:      ds.evq.lastid,
+		WaitingSince: ds.evq.waitingSince(),
+	}
+	for _, e := range ds.evq.events {
+		info.BufferedEids = append(info.BufferedEids, e.eid)
+	}
+	sort.Slice(info.BufferedEids, func(i, j int) bool { return info.BufferedEids[i] < info.BufferedEids[j] })
+	return info
+}
+
+// the event queue of a device, false if its state isn't loaded
+func (dsm *DsMap) Queue(uid string, did int64) (QueueInfo, bool) {
+	dsm.mutex.Lock()
+	defer dsm.mutex.Unlock()
+	ds, ok := dsm.states[idsToKey(uid, did)]
+	if !ok {
+		return QueueInfo{}, false
+	}
+	return ds.queueInfo(), true
+}
+
+// stop waiting for missing events of a device and run all its buffered ones,
+// false if its state isn't loaded
+func (dsm *DsMap) FlushQueue(o Operator, uid string, did int64) (QueueInfo, bool) {
+	dsm.mutex.Lock()
+	defer dsm.mutex.Unlock()
+	ds, ok := dsm.states[idsToKey(uid, did)]
+	if !ok {
+		return QueueInfo{}, false
+	}
+	ds.evq.Flush()
+	if err := ds.save(o, dsm.log); err != nil {
+		dsm.log.Error("can't save device state", zap.Error(err), zap.String("uid", uid), zap.Int64("did", did))
+	}
+	return ds.queueInfo(), true
+}
+
+// Recompute the intervals of a device by running its stored events in id
+// order from no state, up to the last event its state has run. replace is
+// called with the closed intervals and activity buckets (including those of
+// the open interval) while no events of the device run and should write them
+// unless dryRun; the device's state is then replaced with the recomputed one
+func (dsm *DsMap) Reprocess(o Operator, uid string, did int64, dryRun bool, replace func(intervals []Interval, buckets []Bucket) error) error {
+	dsm.mutex.Lock()
+	defer dsm.mutex.Unlock()
+	key := idsToKey(uid, did)
+	ds, ok := dsm.states[key]
+	if !ok {
+		var err error
+		if ds, err = dsm.load(o, uid, did, -1); err != nil {
+			return err
 		}
 		dsm.states[key] = ds
 	}
-	return ds.evq.Push(eid, func() { evf(ds, o, dsm.log) })
+	events, err := dsm.replayHandler(uid, did, -1)
+	if err != nil {
+		return err
+	}
+	var intervals []Interval
+	active := make(map[[2]int64]int64)
+	fresh := &DeviceState{
+		uid:        uid,
+		did:        did,
+		onInterval: func(i Interval) { intervals = append(intervals, i) },
+		onBucket:   func(b Bucket) { active[[2]int64{b.Start, b.Minute}] += b.Active },
+	}
+	for _, pe := range events {
+		if pe.Eid > ds.evq.lastid {
+			break
+		}
+		pe.Handler(fresh, o, dsm.log)
+	}
+	buckets := make([]Bucket, 0, len(active))
+	for k, a := range active {
+		buckets = append(buckets, Bucket{Start: k[0], Minute: k[1], Active: a})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Start != buckets[j].Start {
+			return buckets[i].Start < buckets[j].Start
+		}
+		return buckets[i].Minute < buckets[j].Minute
+	})
+	if err = replace(intervals, buckets); err != nil || dryRun {
+		return err
+	}
+	ds.app, ds.startTime, ds.activeTime, ds.running = fresh.app, fresh.startTime, fresh.activeTime, fresh.running
+	// replace has written everything the state hasn't saved yet
+	ds.intervals, ds.buckets = nil, nil
+	if err = ds.write(o, dsm.log); err != nil {
+		return err
+	}
+	dsm.log.Info("reprocessed intervals", zap.String("uid", uid), zap.Int64("did", did), zap.Int("events", len(events)), zap.Int("intervals", len(intervals)))
+	return nil
 }
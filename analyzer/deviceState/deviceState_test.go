@@ -0,0 +1,28 @@
+package deviceState
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitActive(t *testing.T) {
+	sec := int64(time.Second)
+	minute := BucketSize
+	for _, tc := range []struct {
+		name                    string
+		timestart, timeend, act int64
+		want                    map[int64]int64
+	}{
+		{"in one minute", 10 * sec, 40 * sec, 30 * sec, map[int64]int64{0: 30 * sec}},
+		{"across minutes", 30 * sec, minute + 30*sec, 40 * sec, map[int64]int64{0: 20 * sec, minute: 20 * sec}},
+		{"over several minutes", minute + 45*sec, 4*minute + 15*sec, 150 * sec, map[int64]int64{minute: 15 * sec, 2 * minute: 60 * sec, 3 * minute: 60 * sec, 4 * minute: 15 * sec}},
+		{"ends on a minute", 0, minute, 10 * sec, map[int64]int64{0: 10 * sec}},
+		{"instant", 2*minute + sec, 2*minute + sec, sec, map[int64]int64{2 * minute: sec}},
+		{"rounding", 0, 3 * minute, 10, map[int64]int64{0: 3, minute: 3, 2 * minute: 4}},
+	} {
+		if got := splitActive(tc.timestart, tc.timeend, tc.act); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: splitActive(%d, %d, %d) = %v, want %v", tc.name, tc.timestart, tc.timeend, tc.act, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package deviceState
+
+import "expvar"
+
+// exported on /debug/vars
+var (
+	// times OrderedEventQueue gave up waiting for missing events
+	gapsSkipped = expvar.NewInt("event_queue_gaps_skipped")
+	// missing events given up on
+	eventsSkipped = expvar.NewInt("event_queue_events_skipped")
+	// events waiting for an earlier one, in all queues
+	bufferedEvents = expvar.NewInt("event_queue_buffered_events")
+)
+
+type Metrics struct {
+	GapsSkipped    int64
+	EventsSkipped  int64
+	BufferedEvents int64
+}
+
+func GetMetrics() Metrics {
+	return Metrics{
+		GapsSkipped:    gapsSkipped.Value(),
+		EventsSkipped:  eventsSkipped.Value(),
+		BufferedEvents: bufferedEvents.Value(),
+	}
+}
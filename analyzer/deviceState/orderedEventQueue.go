@@ -4,6 +4,7 @@ package deviceState
 import (
 	"container/heap"
 	"errors"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -19,8 +20,23 @@ type OrderedEventQueue struct {
 	lastid int64
 	events eventHeap
 	log    *zap.Logger
+
+	// skip the missing events once lastid+1 has been waited on for gapTimeout
+	// or maxBuffered events are buffered, 0 to never skip
+	gapTimeout  time.Duration
+	maxBuffered int
+	// when we started waiting for lastid+1, zero if nothing is buffered
+	gapStart time.Time
+	// called with the range of eids skipped and why
+	onSkip func(first, last int64, reason string)
 }
 
+const (
+	SkipReasonTimeout     = "timeout"
+	SkipReasonMaxBuffered = "max_buffered"
+	SkipReasonFlush       = "flush"
+)
+
 func (eh eventHeap) Len() int { return len(eh) }
 
 func (eh eventHeap) Less(i, j int) bool {
@@ -34,6 +50,7 @@ func (eh eventHeap) Swap(i, j int) {
 func (eh *eventHeap) Push(x interface{}) {
 	item := x.(*orderedEvent)
 	*eh = append(*eh, item)
+	bufferedEvents.Add(1)
 }
 
 func (eh *eventHeap) Pop() interface{} {
@@ -42,6 +59,7 @@ func (eh *eventHeap) Pop() interface{} {
 	item := old[n-1]
 	old[n-1] = nil // avoid memory leak
 	*eh = old[0 : n-1]
+	bufferedEvents.Add(-1)
 	return item
 }
 
@@ -55,15 +73,76 @@ func (eq *OrderedEventQueue) Push(eid int64, handler func()) error {
 		if eq.log != nil {
 			eq.log.Debug("OrderedEventQueue: running event", zap.Int64("eid", eid))
 		}
-		for len(eq.events) > 0 && eq.lastid+1 == eq.events[0].eid {
-			heap.Pop(&eq.events).(*orderedEvent).handler()
-			if eq.log != nil {
-				eq.log.Debug("OrderedEventQueue: running event", zap.Int64("eid", eq.lastid))
-			}
-			eq.lastid += 1
-		}
+		eq.runReady()
+		eq.waitFrom(time.Now())
 	default:
 		heap.Push(&eq.events, &orderedEvent{eid: eid, handler: handler})
+		if len(eq.events) == 1 {
+			eq.waitFrom(time.Now())
+		}
+		if eq.maxBuffered > 0 && len(eq.events) >= eq.maxBuffered {
+			eq.skipGap(SkipReasonMaxBuffered, time.Now())
+		}
 	}
 	return nil
 }
+
+// run buffered events that are next in order
+func (eq *OrderedEventQueue) runReady() {
+	for len(eq.events) > 0 && eq.lastid+1 == eq.events[0].eid {
+		heap.Pop(&eq.events).(*orderedEvent).handler()
+		if eq.log != nil {
+			eq.log.Debug("OrderedEventQueue: running event", zap.Int64("eid", eq.lastid))
+		}
+		eq.lastid += 1
+	}
+}
+
+// start waiting for lastid+1 at now if any events are buffered
+func (eq *OrderedEventQueue) waitFrom(now time.Time) {
+	if len(eq.events) == 0 {
+		eq.gapStart = time.Time{}
+	} else {
+		eq.gapStart = now
+	}
+}
+
+// give up waiting for the events before the first buffered one and run it,
+// the next gap is waited on from now
+func (eq *OrderedEventQueue) skipGap(reason string, now time.Time) {
+	if len(eq.events) == 0 {
+		return
+	}
+	first, last := eq.lastid+1, eq.events[0].eid-1
+	if eq.log != nil {
+		eq.log.Warn("OrderedEventQueue: skipping missing events", zap.Int64("first", first), zap.Int64("last", last), zap.String("reason", reason))
+	}
+	gapsSkipped.Add(1)
+	eventsSkipped.Add(last - first + 1)
+	eq.lastid = last
+	if eq.onSkip != nil {
+		eq.onSkip(first, last, reason)
+	}
+	eq.runReady()
+	eq.waitFrom(now)
+}
+
+// when we started waiting for the next event, zero if nothing is buffered
+func (eq *OrderedEventQueue) waitingSince() time.Time {
+	return eq.gapStart
+}
+
+// skip the gap if it has been waited on for gapTimeout at now,
+// the gap after it then gets its own gapTimeout
+func (eq *OrderedEventQueue) SkipStaleGaps(now time.Time) {
+	if eq.gapTimeout > 0 && len(eq.events) > 0 && now.Sub(eq.gapStart) >= eq.gapTimeout {
+		eq.skipGap(SkipReasonTimeout, now)
+	}
+}
+
+// skip all gaps and run every buffered event
+func (eq *OrderedEventQueue) Flush() {
+	for len(eq.events) > 0 {
+		eq.skipGap(SkipReasonFlush, time.Now())
+	}
+}
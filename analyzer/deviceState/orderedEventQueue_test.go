@@ -2,7 +2,9 @@ package deviceState
 
 import (
 	"math/rand"
+	"reflect"
 	"testing"
+	"time"
 )
 
 const randseed = 31415926
@@ -83,3 +85,85 @@ func TestOrderedEventQueue(t *testing.T) {
 		}
 	}
 }
+
+type skip struct {
+	first, last int64
+	reason      string
+}
+
+// push ids to eq, appending each one to ran when it's run
+func pushIds(t *testing.T, eq *OrderedEventQueue, ran *[]int64, ids ...int64) {
+	for _, id := range ids {
+		id := id
+		if err := eq.Push(id, func() { *ran = append(*ran, id) }); err != nil {
+			t.Errorf("eq.Push(%d) failed: %v", id, err)
+		}
+	}
+}
+
+func TestOrderedEventQueueMaxBuffered(t *testing.T) {
+	var skips []skip
+	eq := &OrderedEventQueue{lastid: 0, maxBuffered: 3, onSkip: func(first, last int64, reason string) {
+		skips = append(skips, skip{first, last, reason})
+	}}
+	var ran []int64
+	pushIds(t, eq, &ran, 1, 4, 6)
+	if !reflect.DeepEqual(ran, []int64{1}) {
+		t.Errorf("ran %v before reaching max buffered, want [1]", ran)
+	}
+	pushIds(t, eq, &ran, 7)
+	if !reflect.DeepEqual(ran, []int64{1, 4}) {
+		t.Errorf("ran %v after reaching max buffered, want [1 4]", ran)
+	}
+	if want := []skip{{2, 3, SkipReasonMaxBuffered}}; !reflect.DeepEqual(skips, want) {
+		t.Errorf("skips = %v, want %v", skips, want)
+	}
+	pushIds(t, eq, &ran, 5)
+	if !reflect.DeepEqual(ran, []int64{1, 4, 5, 6, 7}) {
+		t.Errorf("ran %v, want [1 4 5 6 7]", ran)
+	}
+	if eq.Push(3, func() {}) == nil {
+		t.Errorf("should have rejected skipped eid")
+	}
+}
+
+func TestOrderedEventQueueGapTimeout(t *testing.T) {
+	var skips []skip
+	eq := &OrderedEventQueue{lastid: 0, gapTimeout: time.Minute, onSkip: func(first, last int64, reason string) {
+		skips = append(skips, skip{first, last, reason})
+	}}
+	var ran []int64
+	pushIds(t, eq, &ran, 3, 5)
+	now := time.Now()
+	eq.SkipStaleGaps(now)
+	if len(ran) != 0 {
+		t.Errorf("ran %v before gap timeout", ran)
+	}
+	now = now.Add(time.Minute)
+	eq.SkipStaleGaps(now)
+	if !reflect.DeepEqual(ran, []int64{3}) {
+		t.Errorf("ran %v after first gap timeout, want [3]", ran)
+	}
+	// the second gap is only waited on from when the first one was skipped
+	eq.SkipStaleGaps(now.Add(time.Minute - time.Second))
+	if !reflect.DeepEqual(ran, []int64{3}) {
+		t.Errorf("ran %v before second gap timeout, want [3]", ran)
+	}
+	eq.SkipStaleGaps(now.Add(time.Minute))
+	if !reflect.DeepEqual(ran, []int64{3, 5}) {
+		t.Errorf("ran %v after second gap timeout, want [3 5]", ran)
+	}
+	if want := []skip{{1, 2, SkipReasonTimeout}, {4, 4, SkipReasonTimeout}}; !reflect.DeepEqual(skips, want) {
+		t.Errorf("skips = %v, want %v", skips, want)
+	}
+}
+
+func TestOrderedEventQueueFlush(t *testing.T) {
+	eq := &OrderedEventQueue{lastid: 0}
+	var ran []int64
+	pushIds(t, eq, &ran, 4, 2, 7)
+	eq.Flush()
+	if !reflect.DeepEqual(ran, []int64{2, 4, 7}) || eq.lastid != 7 || len(eq.events) != 0 {
+		t.Errorf("ran %v with lastid %d and %d buffered after flush, want [2 4 7], 7 and 0", ran, eq.lastid, len(eq.events))
+	}
+}
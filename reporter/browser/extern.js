@@ -9,3 +9,4 @@ function stopTracking(callback = null) {}
 function login(serverName, username, password, deviceName, callback = null) {}
 function switchUrl(url) {}
 function isTracking(callback = null) {}
+function setNotificationCallback(callback) {}
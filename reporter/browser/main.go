@@ -15,6 +15,9 @@ var (
 
 	stateMutex sync.Mutex
 	isRunning  bool
+
+	notificationMutex    sync.Mutex
+	notificationCallback js.Value
 )
 
 func isTracking() bool {
@@ -89,6 +92,17 @@ func login(server, username, password, deviceName string) bool {
 	return isRunning
 }
 
+func handleNotification(message string) {
+	notificationMutex.Lock()
+	cb := notificationCallback
+	notificationMutex.Unlock()
+	if cb.Type() == js.TypeFunction {
+		cb.Invoke(message)
+	} else {
+		log.Printf("Got notification: %s", message)
+	}
+}
+
 func switchUrl(newurl string) {
 	u, err := url.Parse(newurl)
 	if err != nil {
@@ -161,6 +175,17 @@ func registerCallbacks() {
 		}()
 		return nil
 	}))
+	// pass in a callback to be called with message of every notification server pushes to this device
+	js.Global().Set("setNotificationCallback", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) == 0 {
+			log.Println("not enough arguments")
+			return nil
+		}
+		notificationMutex.Lock()
+		notificationCallback = args[0]
+		notificationMutex.Unlock()
+		return nil
+	}))
 	js.Global().Call("onCoreLoaded", isRunning)
 }
 
@@ -168,6 +193,7 @@ func main() {
 	log.Println("Productimon wasm init")
 	c := make(chan struct{}, 0)
 	r = reporter.NewReporter(config.NewConfig())
+	r.SetNotificationHandler(handleNotification)
 	run()
 	registerCallbacks()
 	<-c // block this goroutine from quiting
@@ -10,6 +10,10 @@
 
 static char command[MAX_CMD_LEN];
 
+static void on_notification(char *message) {
+  printf("\nNotification: %s\n> ", message);
+}
+
 void *command_loop(UNUSED void *arg) {
   printf("Productimon data reporter CLI\n");
   printf("Valid commands are: start, stop and exit\n");
@@ -39,6 +43,7 @@ int main(int argc, const char *argv[]) {
   setbuf(stdout, NULL);
   setbuf(stderr, NULL);
   ProdCoreReadConfig();
+  ProdCoreSetNotificationCallback((void *)on_notification);
 
   if (!ProdCoreInitReporterInteractive()) {
     prod_error("Failed to init core module\n");
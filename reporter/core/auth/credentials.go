@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"log"
 
 	cpb "git.yiad.am/productimon/proto/common"
@@ -19,11 +20,29 @@ func (c *Credentials) GetRequestMetadata(ctx context.Context, uri ...string) (ma
 	return ret, nil
 }
 
-func (c *Credentials) Login(client spb.DataAggregatorClient, username, password string) error {
+// otp is called for a two-factor authentication code if the user needs one,
+// nil if we can't ask the user for it
+func (c *Credentials) Login(client spb.DataAggregatorClient, username, password string, otp func() (string, error)) error {
 	token, err := client.Login(context.Background(), &spb.DataAggregatorLoginRequest{Email: username, Password: password})
 	if err != nil {
 		return err
 	}
+	switch token.MfaState {
+	case spb.DataAggregatorLoginResponse_TOTP_REQUIRED:
+		if otp == nil {
+			return errors.New("two-factor authentication code required")
+		}
+		code, err := otp()
+		if err != nil {
+			return err
+		}
+		token, err = client.CompleteLogin(context.Background(), &spb.DataAggregatorCompleteLoginRequest{MfaChallenge: token.MfaChallenge, Code: code})
+		if err != nil {
+			return err
+		}
+	case spb.DataAggregatorLoginResponse_ENROLLMENT_REQUIRED:
+		return errors.New("two-factor authentication is required, please set it up in the web dashboard first")
+	}
 	c.token = token.Token
 	log.Printf("auth token: %s", token.Token)
 	user, err := client.UserDetails(context.Background(), &cpb.Empty{})
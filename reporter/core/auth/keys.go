@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+
+	spb "git.yiad.am/productimon/proto/svc"
+)
+
+// Generate an ECDSA key for this device and a certificate request for it.
+// Both are PEM encoded
+func newDeviceKey(commonName string) (key, csr []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	key = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	der, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	return key, csr, nil
+}
+
+// Get a new certificate for the device authenticated with cert, the old one
+// is revoked
+func RenewCert(server string, cert tls.Certificate) (newKey, newCert []byte, err error) {
+	req := &spb.DataAggregatorRenewDeviceCertRequest{}
+	if localKeys {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		if newKey, req.Csr, err = newDeviceKey(leaf.Subject.CommonName); err != nil {
+			return nil, nil, err
+		}
+	}
+	conn, err := ConnectToServer(server, cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	rsp, err := spb.NewDataAggregatorClient(conn).RenewDeviceCert(context.Background(), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !localKeys {
+		newKey = rsp.Key
+	}
+	return newKey, rsp.Cert, nil
+}
@@ -0,0 +1,7 @@
+//go:build js
+// +build js
+
+package auth
+
+// the browser reporter has the server generate its key
+const localKeys = false
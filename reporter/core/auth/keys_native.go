@@ -0,0 +1,7 @@
+//go:build !js
+// +build !js
+
+package auth
+
+// device keys are generated locally and never sent to the server
+const localKeys = true
@@ -8,10 +8,13 @@ import (
 	cpb "git.yiad.am/productimon/proto/common"
 	spb "git.yiad.am/productimon/proto/svc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// Login and register a new device, returning the signed certificate for mTLS
-func Login(server string, username string, password string, deviceName string) (key, cert []byte, err error) {
+// Login and register a new device, returning the signed certificate for mTLS.
+// otp is called for a two-factor authentication code if needed, can be nil
+func Login(server string, username string, password string, deviceName string, otp func() (string, error)) (key, cert []byte, err error) {
 	creds := &Credentials{}
 
 	conn, err := ConnectToServer(server, tls.Certificate{}, grpc.WithPerRPCCredentials(creds))
@@ -23,15 +26,29 @@ func Login(server string, username string, password string, deviceName string) (
 
 	client := spb.NewDataAggregatorClient(conn)
 
-	if err = creds.Login(client, username, password); err != nil {
+	if err = creds.Login(client, username, password, otp); err != nil {
 		log.Printf("cannot login: %v", err)
 		return nil, nil, err
 	}
 
+	return signinDevice(client, deviceName)
+}
+
+// register a new device with the logged in client
+func signinDevice(client spb.DataAggregatorClient, deviceName string) (key, cert []byte, err error) {
+	device := &cpb.Device{
+		Name: deviceName,
+	}
+	if localKeys {
+		key, cert, err = signinWithCSR(client, device)
+		if status.Code(err) != codes.Unimplemented {
+			return key, cert, err
+		}
+		log.Printf("Server doesn't support certificate requests, falling back to server generated key")
+	}
+
 	rsp, err := client.DeviceSignin(context.Background(), &spb.DataAggregatorDeviceSigninRequest{
-		Device: &cpb.Device{
-			Name: deviceName,
-		},
+		Device: device,
 	})
 
 	if err != nil {
@@ -43,6 +60,36 @@ func Login(server string, username string, password string, deviceName string) (
 
 }
 
+// how many times to retry signing in when another device signs in at the same time
+const csrSigninAttempts = 3
+
+// sign in device with a locally generated key
+func signinWithCSR(client spb.DataAggregatorClient, device *cpb.Device) (key, cert []byte, err error) {
+	for i := 0; i < csrSigninAttempts; i++ {
+		subject, err := client.GetDeviceSigninSubject(context.Background(), &cpb.Empty{})
+		if err != nil {
+			return nil, nil, err
+		}
+		key, csr, err := newDeviceKey(subject.CommonName)
+		if err != nil {
+			return nil, nil, err
+		}
+		rsp, err := client.DeviceSignin(context.Background(), &spb.DataAggregatorDeviceSigninRequest{
+			Device: device,
+			Csr:    csr,
+		})
+		if status.Code(err) == codes.Aborted {
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			return nil, nil, err
+		}
+		return key, rsp.Cert, nil
+	}
+	return nil, nil, status.Error(codes.Aborted, "too many devices signing in at the same time")
+}
+
 // check if cert is valid against server
 func IsLoggedIn(server string, cert tls.Certificate) bool {
 	if len(cert.Certificate) == 0 {
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"time"
+
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Register a new device by having the user approve a pairing code in the web
+// dashboard instead of entering their password, returning the signed
+// certificate like Login. showCode is called with the code to show the user
+func Pair(server string, deviceName string, showCode func(code string, expires time.Time)) (key, cert []byte, err error) {
+	creds := &Credentials{}
+
+	conn, err := ConnectToServer(server, tls.Certificate{}, grpc.WithPerRPCCredentials(creds))
+	if err != nil {
+		log.Printf("cannot dial: %v", err)
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	client := spb.NewDataAggregatorClient(conn)
+
+	pairing, err := client.RequestPairingCode(context.Background(), &spb.DataAggregatorDeviceSigninRequest{
+		Device: &cpb.Device{
+			Name: deviceName,
+		},
+	})
+	if err != nil {
+		log.Printf("cannot get pairing code: %v", err)
+		return nil, nil, err
+	}
+	showCode(pairing.Code, time.Unix(0, pairing.ExpiresAt))
+
+	interval := time.Duration(pairing.PollInterval)
+	for {
+		time.Sleep(interval)
+		rsp, err := client.PollPairing(context.Background(), &spb.DataAggregatorPollPairingRequest{Secret: pairing.Secret})
+		switch status.Code(err) {
+		case codes.OK:
+			creds.token = rsp.Token
+			return signinDevice(client, deviceName)
+		case codes.FailedPrecondition:
+			// not approved yet
+		case codes.ResourceExhausted:
+			interval += time.Second
+		default:
+			log.Printf("pairing failed: %v", err)
+			return nil, nil, err
+		}
+	}
+}
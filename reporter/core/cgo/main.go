@@ -1,3 +1,4 @@
+//go:build !js
 // +build !js
 
 package main
@@ -16,6 +17,7 @@ var r *reporter.Reporter
 func ProdCoreReadConfig() {
 	internal.ParseFlags()
 	r = reporter.NewReporter(config.NewConfig())
+	r.SetNotificationHandler(handleNotification)
 }
 
 func loginAndRun(server, username, password, deviceName string) bool {
@@ -27,7 +29,12 @@ func ProdCoreInitReporterInteractive() bool {
 	if r.Run() {
 		return true
 	}
-	return loginAndRun(interactiveScanCreds(r.Config.Server))
+	r.SetOTPPrompt(interactiveScanOTP)
+	server, username, password, deviceName := interactiveScanCreds(r.Config.Server)
+	if username == "" {
+		return r.Pair(server, deviceName, printPairingCode(server)) && r.Run()
+	}
+	return loginAndRun(server, username, password, deviceName)
 }
 
 //export ProdCoreInitReporterByCert
@@ -71,6 +78,7 @@ func ProdCoreIsTracking() bool {
 }
 
 // expect copts to be a nullptr-terminated c-string array
+//
 //export ProdCoreSetOptions
 func ProdCoreSetOptions(copts **C.char) {
 	var opts []string
@@ -98,6 +106,15 @@ func ProdCoreSaveConfig() bool {
 	return r.SaveConfig() == nil
 }
 
+// cb should be a void (*)(char *message). It's called from a background
+// thread for every notification pushed by the server to this device, and
+// message is freed after cb returns. Pass NULL to unregister.
+//
+//export ProdCoreSetNotificationCallback
+func ProdCoreSetNotificationCallback(cb unsafe.Pointer) {
+	setNotificationCallback(cb)
+}
+
 //export ProdCoreQuitReporter
 func ProdCoreQuitReporter() {
 	r.Quit()
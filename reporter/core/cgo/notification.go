@@ -0,0 +1,41 @@
+//go:build !js
+// +build !js
+
+package main
+
+/*
+#include <stdlib.h>
+
+// cb is a void (*)(char *) registered by ProdCoreSetNotificationCallback
+static void call_notification_callback(void *cb, char *message) {
+  ((void (*)(char *))cb)(message);
+}
+*/
+import "C"
+import (
+	"sync"
+	"unsafe"
+)
+
+var (
+	notificationCallback      unsafe.Pointer
+	notificationCallbackMutex sync.Mutex
+)
+
+func setNotificationCallback(cb unsafe.Pointer) {
+	notificationCallbackMutex.Lock()
+	notificationCallback = cb
+	notificationCallbackMutex.Unlock()
+}
+
+func handleNotification(message string) {
+	notificationCallbackMutex.Lock()
+	cb := notificationCallback
+	notificationCallbackMutex.Unlock()
+	if cb == nil {
+		return
+	}
+	cmsg := C.CString(message)
+	defer C.free(unsafe.Pointer(cmsg))
+	C.call_notification_callback(cb, cmsg)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -13,8 +14,13 @@ func interactiveScanCreds(defaultserver string) (server, username, password, dev
 	if server == "" {
 		server = defaultserver
 	}
-	fmt.Printf("Username? ")
+	fmt.Printf("Username? [leave empty to pair with a code instead] ")
 	fmt.Scanln(&username)
+	if username == "" {
+		fmt.Printf("Device name? ")
+		fmt.Scanln(&deviceName)
+		return
+	}
 	fmt.Printf("Password? ")
 	bytePassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
 	if err == nil {
@@ -30,3 +36,15 @@ func interactiveScanCreds(defaultserver string) (server, username, password, dev
 	fmt.Scanln(&deviceName)
 	return
 }
+
+func interactiveScanOTP() (code string, err error) {
+	fmt.Printf("Two-factor authentication code (or a recovery code)? ")
+	_, err = fmt.Scanln(&code)
+	return
+}
+
+func printPairingCode(server string) func(code string, expires time.Time) {
+	return func(code string, expires time.Time) {
+		fmt.Printf("To sign in this device, go to https://%s/pair and enter %s (expires at %s)\n", server, code, expires.Format("15:04"))
+	}
+}
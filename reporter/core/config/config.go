@@ -5,6 +5,7 @@ import (
 	"flag"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"git.yiad.am/productimon/internal"
@@ -16,6 +17,7 @@ type Config struct {
 	Key                       []byte
 	Certificate               []byte
 	cert                      tls.Certificate
+	certMutex                 sync.Mutex
 	LastEid                   int64
 	MaxInputReportingInterval time.Duration
 	TrackingOptions           map[string]bool
@@ -73,19 +75,36 @@ func newConfig() *Config {
 }
 
 func (c *Config) Cert() tls.Certificate {
+	c.certMutex.Lock()
+	defer c.certMutex.Unlock()
 	if len(c.cert.Certificate) == 0 {
-		c.ReloadCert()
+		c.reloadCert()
 	}
 	return c.cert
 }
 
 func (c *Config) ReloadCert() {
+	c.certMutex.Lock()
+	c.reloadCert()
+	c.certMutex.Unlock()
+}
+
+func (c *Config) reloadCert() {
 	var err error
 	if c.cert, err = tls.X509KeyPair(c.Certificate, c.Key); err != nil {
 		log.Println(err)
 	}
 }
 
+// Replace the device certificate, e.g. after it's renewed
+func (c *Config) SetCert(cert, key []byte) {
+	c.certMutex.Lock()
+	c.Certificate = cert
+	c.Key = key
+	c.reloadCert()
+	c.certMutex.Unlock()
+}
+
 func (c *Config) SetOptions(options ...string) {
 	// clear the map first
 	c.TrackingOptions = make(map[string]bool)
@@ -0,0 +1,60 @@
+package reporter
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log"
+	"time"
+
+	"git.yiad.am/productimon/reporter/core/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// how often to check if the device certificate needs renewing
+	certCheckInterval = time.Hour
+	// renew the device certificate when it expires in less than this
+	certRenewBefore = 7 * 24 * time.Hour
+)
+
+// blocking goroutine that keeps the device certificate from expiring until
+// ctx is done
+func (r *Reporter) runCertRenewal(ctx context.Context) {
+	for {
+		if err := r.renewCertIfNeeded(ctx); err != nil {
+			if status.Code(err) == codes.Unimplemented {
+				log.Printf("Server doesn't support renewing certificates")
+				return
+			}
+			log.Printf("Failed to renew certificate: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(certCheckInterval):
+		}
+	}
+}
+
+func (r *Reporter) renewCertIfNeeded(ctx context.Context) error {
+	cert := r.Config.Cert()
+	if len(cert.Certificate) == 0 {
+		return errors.New("no certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if time.Until(leaf.NotAfter) > certRenewBefore {
+		return nil
+	}
+	log.Printf("Certificate expires at %v, renewing", leaf.NotAfter)
+	key, newCert, err := auth.RenewCert(r.Config.Server, cert)
+	if err != nil {
+		return err
+	}
+	r.Config.SetCert(newCert, key)
+	return r.Config.Save()
+}
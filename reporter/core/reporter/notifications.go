@@ -0,0 +1,76 @@
+package reporter
+
+import (
+	"context"
+	"log"
+	"time"
+
+	cpb "git.yiad.am/productimon/proto/common"
+	spb "git.yiad.am/productimon/proto/svc"
+	"git.yiad.am/productimon/reporter/core/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// how long to wait before subscribing again after notification stream breaks
+const notificationRetryInterval = 30 * time.Second
+
+// Set a function to be called with every notification the server pushes to
+// this device. It's called from a background goroutine.
+func (r *Reporter) SetNotificationHandler(handler func(message string)) {
+	r.notificationMutex.Lock()
+	r.notificationHandler = handler
+	r.notificationMutex.Unlock()
+}
+
+func (r *Reporter) handleNotification(message string) {
+	r.notificationMutex.Lock()
+	handler := r.notificationHandler
+	r.notificationMutex.Unlock()
+	if handler != nil {
+		handler(message)
+	} else {
+		log.Printf("Got notification: %s", message)
+	}
+}
+
+// blocking goroutine for receiving notifications from server until ctx is done
+func (r *Reporter) runNotifications(ctx context.Context) {
+	for {
+		err := r.receiveNotifications(ctx)
+		if status.Code(err) == codes.Unimplemented {
+			log.Printf("Server doesn't support pushing notifications")
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		log.Printf("Notification stream closed: %v, retrying in %v", err, notificationRetryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(notificationRetryInterval):
+		}
+	}
+}
+
+func (r *Reporter) receiveNotifications(ctx context.Context) error {
+	conn, err := auth.ConnectToServer(r.Config.Server, r.Config.Cert())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stream, err := spb.NewDataAggregatorClient(conn).SubscribeNotifications(ctx, &cpb.Empty{})
+	if err != nil {
+		return err
+	}
+	for {
+		n, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		r.handleNotification(n.Message)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"sync"
+	"time"
 
 	cpb "git.yiad.am/productimon/proto/common"
 	spb "git.yiad.am/productimon/proto/svc"
@@ -35,6 +36,12 @@ type Reporter struct {
 
 	currentApp        string
 	windowSwitchMutex sync.Mutex
+
+	notificationHandler func(message string)
+	notificationMutex   sync.Mutex
+	stopBackground      context.CancelFunc
+
+	otpPrompt func() (string, error)
 }
 
 // Create a new Reporter with config
@@ -101,6 +108,11 @@ func (r *Reporter) run(init chan bool) {
 	r.eq = make(chan *cpb.Event, ChannelBufferSize)
 	r.done = make(chan chan bool)
 
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	r.stopBackground = stopBackground
+	go r.runNotifications(backgroundCtx)
+	go r.runCertRenewal(backgroundCtx)
+
 	init <- true
 
 	r.eventLoop(conn, client, eventStream)
@@ -120,16 +132,33 @@ func (r *Reporter) IsTracking() bool {
 	return r.isTracking
 }
 
+// Set how to ask the user for a two-factor authentication code when logging in
+func (r *Reporter) SetOTPPrompt(prompt func() (string, error)) {
+	r.otpPrompt = prompt
+}
+
 // Login and register as a new device. Certificate is stored in r.Config
 func (r *Reporter) Login(server, username, password, deviceName string) bool {
-	key, cert, err := auth.Login(server, username, password, deviceName)
+	key, cert, err := auth.Login(server, username, password, deviceName, r.otpPrompt)
+	if err != nil {
+		return false
+	}
+	r.Config.Server = server
+	r.Config.SetCert(cert, key)
+	r.Config.Save()
+	return true
+}
+
+// Register as a new device with a pairing code the user approves in the web
+// dashboard. showCode is called with the code to show the user. Certificate
+// is stored in r.Config
+func (r *Reporter) Pair(server, deviceName string, showCode func(code string, expires time.Time)) bool {
+	key, cert, err := auth.Pair(server, deviceName, showCode)
 	if err != nil {
 		return false
 	}
 	r.Config.Server = server
-	r.Config.Key = key
-	r.Config.Certificate = cert
-	r.Config.ReloadCert()
+	r.Config.SetCert(cert, key)
 	r.Config.Save()
 	return true
 }
@@ -162,4 +191,5 @@ func (r *Reporter) Quit() {
 	cleanup := make(chan bool)
 	r.done <- cleanup
 	<-cleanup
+	r.stopBackground()
 }
@@ -17,6 +17,20 @@
 #include "reporter/gui/OptionCheckBox.h"
 #include "reporter/plat/tracking.h"
 
+// window showing notifications pushed by server, see onNotification
+static MainWindow *notificationWindow = nullptr;
+
+// called by core from a background thread
+static void onNotification(char *message) {
+  QString msg = QString::fromUtf8(message);
+  QMetaObject::invokeMethod(
+      notificationWindow,
+      [msg]() {
+        if (notificationWindow) notificationWindow->showNotification(msg);
+      },
+      Qt::QueuedConnection);
+}
+
 // TODO rename file names to corespond to class name
 MainWindow::MainWindow() {
   setupMainLayout();
@@ -35,10 +49,22 @@ MainWindow::MainWindow() {
   trayIcon->show();
   trayIcon->showMessage("Productimon Data Reporter", "Authenticated");
 
+  notificationWindow = this;
+  ProdCoreSetNotificationCallback((void *)onNotification);
+
   layout()->setSizeConstraint(QLayout::SetFixedSize);
   setWindowIcon(QIcon(":" LOGO_IMG_PATH));
 }
 
+MainWindow::~MainWindow() {
+  ProdCoreSetNotificationCallback(NULL);
+  notificationWindow = nullptr;
+}
+
+void MainWindow::showNotification(const QString &message) {
+  trayIcon->showMessage("Productimon", message);
+}
+
 void MainWindow::setupMainLayout() {
   mainLayout = new QVBoxLayout();
   createCB();
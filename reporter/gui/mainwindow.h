@@ -23,6 +23,9 @@ class MainWindow : public QMainWindow {
 
  public:
   MainWindow();
+  ~MainWindow();
+
+  void showNotification(const QString &message);
 
  private:
   void createActions();
@@ -254,6 +254,15 @@ function init() {
   window["onCoreLoaded"] = function (/** boolean */ loggedIn) {
     log.info(logger, "js: got callback from core loaded " + loggedIn);
     reporter.loggedIn = loggedIn;
+    setNotificationCallback((/** string */ message) => {
+      log.info(logger, "js: got notification " + message);
+      chrome.notifications.create({
+        type: "basic",
+        iconUrl: "productimon.png",
+        title: "Productimon",
+        message: message,
+      });
+    });
   };
   reporter.init();
 }
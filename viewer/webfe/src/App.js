@@ -11,6 +11,8 @@ import { SnackbarProvider } from "notistack";
 import SignIn from "./account/SignIn";
 import SignUp from "./account/SignUp";
 import Settings from "./account/Settings";
+import ResetPassword from "./account/ResetPassword";
+import Pair from "./account/Pair";
 import Dashboard from "./dashboard/Dashboard";
 import Fixture from "./core/Fixture";
 
@@ -30,6 +32,9 @@ const useStyles = makeStyles((theme) => ({
   appBarSpacer: theme.mixins.toolbar,
 }));
 
+// pages opened from emailed links, which work without logging in
+const publicPaths = ["/reset-password"];
+
 export default function App() {
   const [loaded, setLoaded] = React.useState(false);
   const [userDetails, setUserDetails] = React.useState(null);
@@ -54,7 +59,7 @@ export default function App() {
         });
     } else {
       setLoaded(true);
-      redirectToLogin();
+      if (!publicPaths.includes(location.pathname)) redirectToLogin();
     }
   }, []);
 
@@ -80,6 +85,12 @@ export default function App() {
                 <Route path="/signup">
                   <SignUp setUserDetails={setUserDetails} />
                 </Route>
+                <Route path="/reset-password">
+                  <ResetPassword />
+                </Route>
+                <Route path="/pair">
+                  <Pair />
+                </Route>
                 <Route path="/dashboard">
                   <Dashboard graphs={graphs} setGraphs={setGraphs} />
                 </Route>
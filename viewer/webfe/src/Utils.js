@@ -103,8 +103,9 @@ export function redirectToLogin() {
   if (location.pathname != "/") location.href = "/";
 }
 
-export function rpc(methodDescriptor, request) {
-  const token = window.localStorage.getItem("token");
+// token defaults to the logged in user's
+export function rpc(methodDescriptor, request, token) {
+  if (!token) token = window.localStorage.getItem("token");
   if (!request) request = new Empty();
   return new Promise((resolve, reject) => {
     grpc.unary(methodDescriptor, {
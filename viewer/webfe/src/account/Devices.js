@@ -0,0 +1,75 @@
+import React, { useEffect } from "react";
+import { useHistory } from "react-router-dom";
+import { useSnackbar } from "notistack";
+
+import Button from "@material-ui/core/Button";
+import List from "@material-ui/core/List";
+import ListItem from "@material-ui/core/ListItem";
+import ListItemSecondaryAction from "@material-ui/core/ListItemSecondaryAction";
+import ListItemText from "@material-ui/core/ListItemText";
+
+import { Device, Empty } from "productimon/proto/common/common_pb";
+import { DataAggregator } from "productimon/proto/svc/aggregator_pb_service";
+
+import { rpc } from "../Utils";
+
+// devices signed in to the user's account, which can be renamed or removed.
+// Removing a device signs it out, its data is kept
+export default function Devices() {
+  const { enqueueSnackbar } = useSnackbar();
+  const history = useHistory();
+  const [devices, setDevices] = React.useState([]);
+
+  const loadDevices = () => {
+    rpc(DataAggregator.GetDevices, new Empty())
+      .then((res) => setDevices(res.getDevicesList()))
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+  useEffect(loadDevices, []);
+
+  const rename = (device) => {
+    const name = window.prompt("New device name", device.getName());
+    if (!name) return;
+    const request = new Device();
+    request.setId(device.getId());
+    request.setName(name);
+    rpc(DataAggregator.RenameDevice, request)
+      .then(loadDevices)
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+
+  const remove = (device) => {
+    if (!window.confirm(`Sign out and remove ${device.getName()}?`)) return;
+    const request = new Device();
+    request.setId(device.getId());
+    rpc(DataAggregator.RemoveDevice, request)
+      .then(() => {
+        enqueueSnackbar("Removed device", { variant: "success" });
+        loadDevices();
+      })
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+
+  return (
+    <React.Fragment>
+      <List dense>
+        {devices.map((device) => (
+          <ListItem key={device.getId()}>
+            <ListItemText primary={device.getName()} />
+            <ListItemSecondaryAction>
+              <Button size="small" onClick={() => rename(device)}>
+                Rename
+              </Button>
+              <Button size="small" onClick={() => remove(device)}>
+                Remove
+              </Button>
+            </ListItemSecondaryAction>
+          </ListItem>
+        ))}
+      </List>
+      <Button variant="contained" onClick={() => history.push("/pair")}>
+        Pair a device
+      </Button>
+    </React.Fragment>
+  );
+}
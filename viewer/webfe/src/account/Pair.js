@@ -0,0 +1,74 @@
+import React from "react";
+import { useHistory } from "react-router-dom";
+import { useSnackbar } from "notistack";
+
+import Avatar from "@material-ui/core/Avatar";
+import Button from "@material-ui/core/Button";
+import TextField from "@material-ui/core/TextField";
+import DevicesIcon from "@material-ui/icons/Devices";
+import Typography from "@material-ui/core/Typography";
+import Container from "@material-ui/core/Container";
+
+import { DataAggregatorApprovePairingRequest } from "productimon/proto/svc/aggregator_pb";
+import { DataAggregator } from "productimon/proto/svc/aggregator_pb_service";
+
+import { rpc } from "../Utils";
+import { formUseStyles } from "./SignIn";
+
+// approve the pairing code a reporter shows to sign it in as the logged in user
+export default function Pair() {
+  const classes = formUseStyles();
+  const { enqueueSnackbar } = useSnackbar();
+  const history = useHistory();
+  const [code, setCode] = React.useState("");
+
+  const approve = function (e) {
+    e.preventDefault();
+    const request = new DataAggregatorApprovePairingRequest();
+    request.setCode(code);
+    rpc(DataAggregator.ApprovePairing, request)
+      .then((device) => {
+        enqueueSnackbar(`Signed in ${device.getName()}`, {
+          variant: "success",
+        });
+        history.push("/settings");
+      })
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+
+  return (
+    <Container className={classes.paper} maxWidth="xs">
+      <Avatar className={classes.avatar}>
+        <DevicesIcon />
+      </Avatar>
+      <Typography component="h1" variant="h5">
+        Pair a device
+      </Typography>
+      <form className={classes.form} onSubmit={approve}>
+        <Typography>
+          Enter the code shown by the reporter. Only enter codes from devices
+          you are setting up yourself.
+        </Typography>
+        <TextField
+          variant="outlined"
+          margin="normal"
+          required
+          fullWidth
+          autoFocus
+          label="Pairing Code"
+          autoComplete="off"
+          onChange={(e) => setCode(e.target.value)}
+        />
+        <Button
+          type="submit"
+          fullWidth
+          variant="contained"
+          color="primary"
+          className={classes.submit}
+        >
+          Sign In Device
+        </Button>
+      </form>
+    </Container>
+  );
+}
@@ -0,0 +1,132 @@
+import React from "react";
+import { useHistory, useLocation } from "react-router-dom";
+import { useSnackbar } from "notistack";
+
+import Avatar from "@material-ui/core/Avatar";
+import Button from "@material-ui/core/Button";
+import TextField from "@material-ui/core/TextField";
+import LockOutlinedIcon from "@material-ui/icons/LockOutlined";
+import Typography from "@material-ui/core/Typography";
+import Container from "@material-ui/core/Container";
+
+import {
+  DataAggregatorRequestPasswordResetRequest,
+  DataAggregatorResetPasswordRequest,
+} from "productimon/proto/svc/aggregator_pb";
+import { DataAggregator } from "productimon/proto/svc/aggregator_pb_service";
+
+import { rpc } from "../Utils";
+import { formUseStyles } from "./SignIn";
+
+// asks for an email to send the reset link to, or a new password when
+// opened from the link
+export default function ResetPassword() {
+  const classes = formUseStyles();
+  const { enqueueSnackbar } = useSnackbar();
+  const history = useHistory();
+  const token = new URLSearchParams(useLocation().search).get("token");
+
+  const [email, setEmail] = React.useState("");
+  const [password, setPassword] = React.useState("");
+  const [confirmPassword, setConfirmPassword] = React.useState("");
+  const [sent, setSent] = React.useState(false);
+
+  const requestReset = function (e) {
+    e.preventDefault();
+    const request = new DataAggregatorRequestPasswordResetRequest();
+    request.setEmail(email);
+    rpc(DataAggregator.RequestPasswordReset, request)
+      .then(() => setSent(true))
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+
+  const resetPassword = function (e) {
+    e.preventDefault();
+    if (password != confirmPassword) {
+      enqueueSnackbar("Passwords don't match", { variant: "error" });
+      return;
+    }
+    const request = new DataAggregatorResetPasswordRequest();
+    request.setToken(token);
+    request.setNewPassword(password);
+    rpc(DataAggregator.ResetPassword, request)
+      .then(() => {
+        enqueueSnackbar("Password reset, you can sign in now", {
+          variant: "success",
+        });
+        history.push("/");
+      })
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+
+  return (
+    <Container className={classes.paper} maxWidth="xs">
+      <Avatar className={classes.avatar}>
+        <LockOutlinedIcon />
+      </Avatar>
+      <Typography component="h1" variant="h5">
+        Reset password
+      </Typography>
+      {token ? (
+        <form className={classes.form} onSubmit={resetPassword}>
+          <TextField
+            variant="outlined"
+            margin="normal"
+            required
+            fullWidth
+            autoFocus
+            label="New Password"
+            type="password"
+            autoComplete="new-password"
+            onChange={(e) => setPassword(e.target.value)}
+          />
+          <TextField
+            variant="outlined"
+            margin="normal"
+            required
+            fullWidth
+            label="Confirm New Password"
+            type="password"
+            autoComplete="new-password"
+            onChange={(e) => setConfirmPassword(e.target.value)}
+          />
+          <Button
+            type="submit"
+            fullWidth
+            variant="contained"
+            color="primary"
+            className={classes.submit}
+          >
+            Reset Password
+          </Button>
+        </form>
+      ) : sent ? (
+        <Typography className={classes.form}>
+          If an account exists for {email}, we've sent it a link to reset the
+          password. The link is valid for an hour.
+        </Typography>
+      ) : (
+        <form className={classes.form} onSubmit={requestReset}>
+          <TextField
+            variant="outlined"
+            margin="normal"
+            required
+            fullWidth
+            autoFocus
+            label="Email Address"
+            onChange={(e) => setEmail(e.target.value)}
+          />
+          <Button
+            type="submit"
+            fullWidth
+            variant="contained"
+            color="primary"
+            className={classes.submit}
+          >
+            Send Reset Link
+          </Button>
+        </form>
+      )}
+    </Container>
+  );
+}
@@ -0,0 +1,62 @@
+import React, { useEffect } from "react";
+import { useSnackbar } from "notistack";
+
+import Button from "@material-ui/core/Button";
+import List from "@material-ui/core/List";
+import ListItem from "@material-ui/core/ListItem";
+import ListItemSecondaryAction from "@material-ui/core/ListItemSecondaryAction";
+import ListItemText from "@material-ui/core/ListItemText";
+
+import { DataAggregatorRevokeSessionRequest } from "productimon/proto/svc/aggregator_pb";
+import { DataAggregator } from "productimon/proto/svc/aggregator_pb_service";
+
+import { rpc, formatNano } from "../Utils";
+
+// logged in sessions of the user, which can be signed out remotely
+export default function Sessions() {
+  const { enqueueSnackbar } = useSnackbar();
+  const [sessions, setSessions] = React.useState([]);
+
+  const loadSessions = () => {
+    rpc(DataAggregator.ListSessions)
+      .then((res) => setSessions(res.getSessionsList()))
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+  useEffect(loadSessions, []);
+
+  const revoke = (session) => {
+    const request = new DataAggregatorRevokeSessionRequest();
+    request.setId(session.getId());
+    rpc(DataAggregator.RevokeSession, request)
+      .then(() => {
+        enqueueSnackbar("Signed out session", { variant: "success" });
+        loadSessions();
+      })
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+
+  return (
+    <List dense>
+      {sessions.map((session) => (
+        <ListItem key={session.getId()}>
+          <ListItemText
+            primary={
+              (session.getUserAgent() || "Unknown client") +
+              (session.getCurrent() ? " (this session)" : "")
+            }
+            secondary={`Signed in ${formatNano(
+              session.getCreatedAt()
+            )}, last active ${formatNano(session.getRefreshedAt())}`}
+          />
+          {!session.getCurrent() && (
+            <ListItemSecondaryAction>
+              <Button size="small" onClick={() => revoke(session)}>
+                Sign out
+              </Button>
+            </ListItemSecondaryAction>
+          )}
+        </ListItem>
+      ))}
+    </List>
+  );
+}
@@ -8,9 +8,14 @@ import Grid from "@material-ui/core/Grid";
 import Button from "@material-ui/core/Button";
 import TextField from "@material-ui/core/TextField";
 import Checkbox from "@material-ui/core/Checkbox";
+import Typography from "@material-ui/core/Typography";
 import { rpc, redirectToLogin } from "../Utils";
 import { DataAggregator } from "productimon/proto/svc/aggregator_pb_service";
 import { Empty } from "productimon/proto/common/common_pb";
+import { DataAggregatorChangePasswordRequest } from "productimon/proto/svc/aggregator_pb";
+import { TwoFactorSettings } from "./TwoFactor";
+import Sessions from "./Sessions";
+import Devices from "./Devices";
 
 const useStyles = makeStyles((theme) => ({
   container: {
@@ -47,6 +52,33 @@ export default function Settings({ setUserDetails }) {
       });
   };
 
+  const [oldPassword, setOldPassword] = React.useState("");
+  const [newPassword, setNewPassword] = React.useState("");
+  const changePassword = (e) => {
+    e.preventDefault();
+    const request = new DataAggregatorChangePasswordRequest();
+    request.setOldPassword(oldPassword);
+    request.setNewPassword(newPassword);
+    rpc(DataAggregator.ChangePassword, request)
+      .then((res) => {
+        // all other sessions are signed out, including the old token
+        window.localStorage.setItem("token", res.getToken());
+        setOldPassword("");
+        setNewPassword("");
+        enqueueSnackbar("Password changed", { variant: "success" });
+      })
+      .catch((err) => {
+        enqueueSnackbar(err, { variant: "error" });
+      });
+  };
+
+  const [totpEnabled, setTotpEnabled] = React.useState(null);
+  useEffect(() => {
+    rpc(DataAggregator.UserDetails)
+      .then((res) => setTotpEnabled(res.getTotpEnabled()))
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  }, []);
+
   const classes = useStyles();
 
   return (
@@ -58,6 +90,55 @@ export default function Settings({ setUserDetails }) {
         justify="center"
         alignItems="center"
       >
+        <Grid item xs={12} md={6} lg={6}>
+          <Typography variant="h6" gutterBottom>
+            Change password
+          </Typography>
+          <form onSubmit={changePassword}>
+            <TextField
+              label="Current password"
+              type="password"
+              autoComplete="current-password"
+              fullWidth
+              value={oldPassword}
+              onChange={(e) => setOldPassword(e.target.value)}
+            />
+            <TextField
+              label="New password"
+              type="password"
+              autoComplete="new-password"
+              fullWidth
+              value={newPassword}
+              onChange={(e) => setNewPassword(e.target.value)}
+            />
+            <Button type="submit" variant="contained">
+              Change Password
+            </Button>
+          </form>
+        </Grid>
+        <Grid item xs={12} md={6} lg={6}>
+          <Typography variant="h6" gutterBottom>
+            Sessions
+          </Typography>
+          <Sessions />
+        </Grid>
+        <Grid item xs={12} md={6} lg={6}>
+          <Typography variant="h6" gutterBottom>
+            Devices
+          </Typography>
+          <Devices />
+        </Grid>
+        {totpEnabled != null && (
+          <Grid item xs={12} md={6} lg={6}>
+            <Typography variant="h6" gutterBottom>
+              Two-factor authentication
+            </Typography>
+            <TwoFactorSettings
+              enabled={totpEnabled}
+              setEnabled={setTotpEnabled}
+            />
+          </Grid>
+        )}
         <Grid item xs={12} md={6} lg={6}>
           <Button
             variant="contained"
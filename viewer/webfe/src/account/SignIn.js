@@ -14,10 +14,17 @@ import Typography from "@material-ui/core/Typography";
 import Container from "@material-ui/core/Container";
 import { makeStyles } from "@material-ui/core/styles";
 
-import { DataAggregatorLoginRequest } from "productimon/proto/svc/aggregator_pb";
+import {
+  DataAggregatorLoginRequest,
+  DataAggregatorLoginResponse,
+  DataAggregatorCompleteLoginRequest,
+} from "productimon/proto/svc/aggregator_pb";
 import { DataAggregator } from "productimon/proto/svc/aggregator_pb_service";
 
 import { rpc } from "../Utils";
+import { TOTPEnrollment } from "./TwoFactor";
+
+const MFAState = DataAggregatorLoginResponse.MFAState;
 
 export const formUseStyles = makeStyles((theme) => ({
   paper: {
@@ -45,6 +52,27 @@ export default function SignIn(props) {
 
   const [username, setEmail] = React.useState("");
   const [password, setPassword] = React.useState("");
+  const [ssoProviders, setSsoProviders] = React.useState([]);
+  // set when password is correct but two-factor authentication is needed
+  const [mfa, setMfa] = React.useState(null);
+  const [code, setCode] = React.useState("");
+
+  useEffect(() => {
+    // 404 if single sign-on isn't enabled on this server
+    fetch("/oidc/providers")
+      .then((res) => (res.ok ? res.json() : []))
+      .then(setSsoProviders)
+      .catch(() => setSsoProviders([]));
+  }, []);
+
+  useEffect(() => {
+    // left by the single sign-on callback when the user has to enter a code
+    const challenge = window.sessionStorage.getItem("mfa_challenge");
+    if (challenge) {
+      window.sessionStorage.removeItem("mfa_challenge");
+      setMfa({ state: MFAState.TOTP_REQUIRED, challenge: challenge });
+    }
+  }, []);
 
   const handleChange = function (e, setter) {
     setter(e.target.value);
@@ -62,6 +90,13 @@ export default function SignIn(props) {
     }, []);
   }
 
+  const loggedIn = function (res) {
+    window.localStorage.setItem("token", res.getToken());
+    props.setUserDetails(res.getUser());
+    enqueueSnackbar("Logged in successfully", { variant: "success" });
+    history.push("/dashboard");
+  };
+
   const doLogin = function (e) {
     e.preventDefault();
 
@@ -70,16 +105,79 @@ export default function SignIn(props) {
     request.setPassword(password);
     rpc(DataAggregator.Login, request)
       .then((res) => {
-        window.localStorage.setItem("token", res.getToken());
-        props.setUserDetails(res.getUser());
-        enqueueSnackbar("Logged in successfully", { variant: "success" });
-        history.push("/dashboard");
+        if (res.getMfaState() == MFAState.NONE) {
+          loggedIn(res);
+        } else {
+          setMfa({ state: res.getMfaState(), challenge: res.getMfaChallenge() });
+        }
       })
       .catch((err) => {
         enqueueSnackbar(err, { variant: "error" });
         props.setUserDetails(null);
       });
   };
+
+  const completeLogin = function (e) {
+    e.preventDefault();
+
+    const request = new DataAggregatorCompleteLoginRequest();
+    request.setMfaChallenge(mfa.challenge);
+    request.setCode(code);
+    rpc(DataAggregator.CompleteLogin, request)
+      .then(loggedIn)
+      .catch((err) => {
+        enqueueSnackbar(err, { variant: "error" });
+        if (err.includes("expired")) setMfa(null);
+      });
+  };
+
+  if (mfa && mfa.state == MFAState.ENROLLMENT_REQUIRED) {
+    return (
+      <Container className={classes.paper} maxWidth="xs">
+        <Typography component="h1" variant="h5" gutterBottom>
+          Set up two-factor authentication
+        </Typography>
+        <Typography gutterBottom>
+          This server requires two-factor authentication for all users.
+        </Typography>
+        <TOTPEnrollment token={mfa.challenge} onEnrolled={loggedIn} />
+      </Container>
+    );
+  }
+  if (mfa) {
+    return (
+      <Container className={classes.paper} maxWidth="xs">
+        <Avatar className={classes.avatar}>
+          <LockOutlinedIcon />
+        </Avatar>
+        <Typography component="h1" variant="h5">
+          Two-factor authentication
+        </Typography>
+        <form className={classes.form} onSubmit={completeLogin}>
+          <TextField
+            variant="outlined"
+            margin="normal"
+            required
+            fullWidth
+            autoFocus
+            label="Code from your authenticator app, or a recovery code"
+            autoComplete="one-time-code"
+            value={code}
+            onChange={(e) => handleChange(e, setCode)}
+          />
+          <Button
+            type="submit"
+            fullWidth
+            variant="contained"
+            color="primary"
+            className={classes.submit}
+          >
+            Verify
+          </Button>
+        </form>
+      </Container>
+    );
+  }
   return (
     <Container className={classes.paper} maxWidth="xs">
       <Avatar className={classes.avatar}>
@@ -121,9 +219,25 @@ export default function SignIn(props) {
         >
           Sign In
         </Button>
+        {ssoProviders.map((p) => (
+          <Button
+            key={p.name}
+            fullWidth
+            variant="outlined"
+            color="primary"
+            href={`/oidc/login?provider=${encodeURIComponent(p.name)}`}
+            style={{ marginBottom: 16 }}
+          >
+            Sign in with {p.display_name}
+          </Button>
+        ))}
 
         <Grid container>
-          <Grid item xs />
+          <Grid item xs>
+            <RouterLink to="/reset-password" style={{ textDecoration: "none" }}>
+              Forgot password?
+            </RouterLink>
+          </Grid>
           <Grid item>
             <RouterLink to="/signup" style={{ textDecoration: "none" }}>
               Don't have an account? Sign Up
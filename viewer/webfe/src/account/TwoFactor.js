@@ -0,0 +1,144 @@
+import React, { useEffect } from "react";
+import { useSnackbar } from "notistack";
+
+import Button from "@material-ui/core/Button";
+import Grid from "@material-ui/core/Grid";
+import Link from "@material-ui/core/Link";
+import TextField from "@material-ui/core/TextField";
+import Typography from "@material-ui/core/Typography";
+
+import { DataAggregatorTOTPCode } from "productimon/proto/svc/aggregator_pb";
+import { DataAggregator } from "productimon/proto/svc/aggregator_pb_service";
+
+import { rpc } from "../Utils";
+
+// Set up an authenticator app. token is the login challenge when the user
+// must enroll before logging in, otherwise the stored token is used.
+// onEnrolled is called with the login response once the user has saved
+// their recovery codes
+export function TOTPEnrollment({ token, onEnrolled }) {
+  const { enqueueSnackbar } = useSnackbar();
+  const [enrollment, setEnrollment] = React.useState(null);
+  const [code, setCode] = React.useState("");
+  const [confirmed, setConfirmed] = React.useState(null);
+
+  useEffect(() => {
+    rpc(DataAggregator.BeginTOTPEnrollment, null, token)
+      .then(setEnrollment)
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  }, []);
+
+  const confirm = (e) => {
+    e.preventDefault();
+    const request = new DataAggregatorTOTPCode();
+    request.setCode(code);
+    rpc(DataAggregator.ConfirmTOTPEnrollment, request, token)
+      .then(setConfirmed)
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+
+  if (confirmed) {
+    return (
+      <Grid container direction="column" spacing={2}>
+        <Grid item>
+          <Typography>
+            Two-factor authentication is enabled. Save these recovery codes
+            somewhere safe, each can be used once to log in if you lose your
+            authenticator. They won't be shown again.
+          </Typography>
+        </Grid>
+        <Grid item>
+          <pre>{confirmed.getRecoveryCodesList().join("\n")}</pre>
+        </Grid>
+        <Grid item>
+          <Button
+            variant="contained"
+            color="primary"
+            onClick={() => onEnrolled(confirmed.getLogin())}
+          >
+            I have saved my recovery codes
+          </Button>
+        </Grid>
+      </Grid>
+    );
+  }
+  if (!enrollment) return null;
+  return (
+    <form onSubmit={confirm}>
+      <Typography>
+        Add this account to your authenticator app with{" "}
+        <Link href={enrollment.getUri()}>this link</Link> or the secret{" "}
+        <code>{enrollment.getSecret()}</code>, then enter the code it shows.
+      </Typography>
+      <TextField
+        variant="outlined"
+        margin="normal"
+        required
+        fullWidth
+        autoFocus
+        label="Code"
+        autoComplete="one-time-code"
+        value={code}
+        onChange={(e) => setCode(e.target.value)}
+      />
+      <Button type="submit" fullWidth variant="contained" color="primary">
+        Enable two-factor authentication
+      </Button>
+    </form>
+  );
+}
+
+// enable or disable two-factor authentication for the logged in user
+export function TwoFactorSettings({ enabled, setEnabled }) {
+  const { enqueueSnackbar } = useSnackbar();
+  const [enrolling, setEnrolling] = React.useState(false);
+  const [code, setCode] = React.useState("");
+
+  const disable = (e) => {
+    e.preventDefault();
+    const request = new DataAggregatorTOTPCode();
+    request.setCode(code);
+    rpc(DataAggregator.DisableTOTP, request)
+      .then(() => {
+        enqueueSnackbar("Two-factor authentication disabled", {
+          variant: "success",
+        });
+        setCode("");
+        setEnabled(false);
+      })
+      .catch((err) => enqueueSnackbar(err, { variant: "error" }));
+  };
+
+  if (enrolling) {
+    return (
+      <TOTPEnrollment
+        onEnrolled={(login) => {
+          // old token hasn't passed two-factor authentication
+          window.localStorage.setItem("token", login.getToken());
+          setEnrolling(false);
+          setEnabled(true);
+        }}
+      />
+    );
+  }
+  if (!enabled) {
+    return (
+      <Button variant="contained" onClick={() => setEnrolling(true)}>
+        Enable two-factor authentication
+      </Button>
+    );
+  }
+  return (
+    <form onSubmit={disable}>
+      <TextField
+        label="Code or recovery code"
+        autoComplete="one-time-code"
+        value={code}
+        onChange={(e) => setCode(e.target.value)}
+      />
+      <Button type="submit" variant="contained">
+        Disable two-factor authentication
+      </Button>
+    </form>
+  );
+}
@@ -31,7 +31,9 @@ import TextFieldsIcon from "@material-ui/icons/TextFields";
 import AlarmIcon from "@material-ui/icons/Alarm";
 import ListItemText from "@material-ui/core/ListItemText";
 
-import { redirectToLogin } from "../Utils";
+import { rpc, redirectToLogin } from "../Utils";
+import { DataAggregatorRevokeSessionRequest } from "productimon/proto/svc/aggregator_pb";
+import { DataAggregator } from "productimon/proto/svc/aggregator_pb_service";
 import { graphTitle } from "../dashboard/Graph";
 
 const drawerWidth = 240;
@@ -117,6 +119,11 @@ export default function Fixture(props) {
 
   const handleLogout = () => {
     handleClose();
+    // revoke the token server side too, signed out locally either way
+    rpc(
+      DataAggregator.RevokeSession,
+      new DataAggregatorRevokeSessionRequest()
+    ).catch(() => {});
     props.setUserDetails(null);
     window.localStorage.removeItem("token");
     history.push("/");
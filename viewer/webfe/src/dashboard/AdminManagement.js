@@ -4,7 +4,9 @@ import { useSnackbar } from "notistack";
 
 import { makeStyles } from "@material-ui/core/styles";
 import Button from "@material-ui/core/Button";
+import Checkbox from "@material-ui/core/Checkbox";
 import Container from "@material-ui/core/Container";
+import FormControlLabel from "@material-ui/core/FormControlLabel";
 import Grid from "@material-ui/core/Grid";
 import MaterialTable from "material-table";
 import Paper from "@material-ui/core/Paper";
@@ -26,6 +28,7 @@ import Remove from "@material-ui/icons/Remove";
 import Search from "@material-ui/icons/Search";
 
 import { rpc } from "../Utils";
+import { DataAggregatorServerSettings } from "productimon/proto/svc/aggregator_pb";
 import { DataAggregator } from "productimon/proto/svc/aggregator_pb_service";
 import { User, Empty } from "productimon/proto/common/common_pb";
 
@@ -63,6 +66,14 @@ export default function AdminManagement() {
 
   const [email, setEmail] = useState("");
   const [data, setData] = useState([]);
+  const [require2fa, setRequire2fa] = useState(false);
+  useEffect(() => {
+    rpc(DataAggregator.GetServerSettings)
+      .then((res) => setRequire2fa(res.getRequire2fa()))
+      .catch((err) => {
+        enqueueSnackbar(err, { variant: "error" });
+      });
+  }, []);
   useEffect(() => {
     const request = new Empty();
     rpc(DataAggregator.ListAdmins, request)
@@ -90,6 +101,18 @@ export default function AdminManagement() {
       });
   };
 
+  const updateRequire2fa = (e) => {
+    const request = new DataAggregatorServerSettings();
+    request.setRequire2fa(e.target.checked);
+    rpc(DataAggregator.UpdateServerSettings, request)
+      .then((res) => {
+        setRequire2fa(request.getRequire2fa());
+      })
+      .catch((err) => {
+        enqueueSnackbar(err, { variant: "error" });
+      });
+  };
+
   return (
     <Container maxWidth="lg" className={classes.container}>
       <div className={classes.root}>
@@ -131,6 +154,20 @@ export default function AdminManagement() {
               </Grid>
             </Paper>
           </Grid>
+          <Grid item className={classes.fullWidth}>
+            <Paper className={classes.paper}>
+              <FormControlLabel
+                control={
+                  <Checkbox
+                    checked={require2fa}
+                    onChange={updateRequire2fa}
+                    color="primary"
+                  />
+                }
+                label="Require two-factor authentication for all users"
+              />
+            </Paper>
+          </Grid>
           <Grid item className={classes.fullWidth}>
             <TableContainer component={Paper}>
               <MaterialTable